@@ -13,6 +13,8 @@ var (
 	scan                   bool
 	s3scan                 bool
 	s3restore              bool
+	s3audit                bool
+	s3auditRequeue         bool
 	docstoreIndexesReindex bool
 	check                  bool
 	loglevel               string
@@ -24,6 +26,8 @@ func main() {
 	flag.BoolVar(&scan, "scan", false, "Trigger a BlobStore rescan.")
 	flag.BoolVar(&s3scan, "s3-scan", false, "Trigger a BlobStore rescan of the S3 backend.")
 	flag.BoolVar(&s3restore, "s3-restore", false, "Trigger a BlobStore restore of the S3 backend.")
+	flag.BoolVar(&s3audit, "s3-audit", false, "Compare the S3 backend with the local state.")
+	flag.BoolVar(&s3auditRequeue, "s3-audit-requeue", false, "Upload the missing packs and blobs found by the S3 audit.")
 	flag.BoolVar(&docstoreIndexesReindex, "docstore-indexes-reindex", false, "Trigger a re-indexing of all document store sort indexes.")
 	flag.StringVar(&loglevel, "loglevel", "", "logging level (debug|info|warn|crit)")
 	flag.Parse()
@@ -40,6 +44,8 @@ func main() {
 	conf.ScanMode = scan
 	conf.S3ScanMode = s3scan
 	conf.S3RestoreMode = s3restore
+	conf.S3AuditMode = s3audit || s3auditRequeue
+	conf.S3AuditRequeueMode = s3auditRequeue
 	conf.DocstoreIndexesReindexMode = docstoreIndexesReindex
 	if loglevel != "" {
 		conf.LogLevel = loglevel
@@ -3,19 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
-	"a4.io/blobstash/pkg/backend/s3/s3util"
-	"a4.io/blobstash/pkg/config"
-	"a4.io/blobstash/pkg/crypto"
+	humanize "github.com/dustin/go-humanize"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"a4.io/blobstash/pkg/backend/s3"
+	"a4.io/blobstash/pkg/config"
 )
 
 func usage() {
@@ -24,6 +20,11 @@ func usage() {
 }
 
 func main() {
+	targetName := flag.String("target", "", "name of the replication target to restore from (defaults to the first one)")
+	workers := flag.Int("workers", 4, "number of packs downloaded in parallel")
+	dryRun := flag.Bool("dry-run", false, "only list the packs that would be restored")
+	until := flag.String("until", "", "restore the state as of the given time (RFC 3339), the packs uploaded after are skipped")
+	force := flag.Bool("force", false, "overwrite the packs already present in the packs directory")
 	flag.Usage = usage
 	flag.Parse()
 
@@ -40,75 +41,92 @@ func main() {
 			log.Fatalf("failed to load config at \"%v\": %v", flag.Arg(0), err)
 		}
 	}
-	packsDir := filepath.Join(conf.VarDir(), "blobs")
-	os.MkdirAll(packsDir, 0700)
-	region := conf.S3Repl.Region
-
-	var sess *session.Session
-	if conf.S3Repl.Endpoint != "" {
-		sess, err = s3util.NewWithCustomEndoint(conf.S3Repl.AccessKey, conf.S3Repl.SecretKey, region, conf.S3Repl.Endpoint)
-		if err != nil {
-			panic(err)
+	var target *config.S3Repl
+	for _, t := range conf.S3Repls.Enabled() {
+		if *targetName == "" || t.Name == *targetName {
+			target = t
+			break
 		}
-	} else {
-		// Create a S3 Session
-		sess, err = s3util.New(region)
+	}
+	if target == nil {
+		log.Fatalf("replication target not found")
+	}
+	if target.Region == "" {
+		target.Region = "us-east-1"
+	}
+	if *workers < 1 {
+		log.Fatalf("-workers must be at least 1")
+	}
+	var untilTime time.Time
+	if *until != "" {
+		untilTime, err = time.Parse(time.RFC3339, *until)
 		if err != nil {
-			panic(err)
+			log.Fatalf("invalid -until time: %v", err)
 		}
 	}
 
-	key, err := conf.S3Repl.Key()
+	packsDir := filepath.Join(conf.VarDir(), "blobs")
+	if err := os.MkdirAll(packsDir, 0700); err != nil {
+		log.Fatalf("failed to create the packs directory: %v", err)
+	}
+
+	keyring, err := target.Keyring()
 	if err != nil {
-		panic(err)
+		log.Fatalf("failed to load the keys: %v", err)
 	}
 
-	downloader := s3manager.NewDownloader(sess)
-	bucket := conf.S3Repl.Bucket
-	s3svc := s3.New(sess)
-	obucket := s3util.NewBucket(s3svc, bucket)
-	packs, err := obucket.ListPrefix("packs/", "", 100)
+	// Either the S3 bucket or the local directory (e.g. an USB disk)
+	back, err := s3.NewRemote(target)
 	if err != nil {
-		panic(err)
+		log.Fatalf("failed to init the remote: %v", err)
 	}
 
-	var cnt int
-	fmt.Printf("Restoring ")
-	for _, pack := range packs {
-		fmt.Printf("%s ", filepath.Base(pack.Key))
-		if err := BlobsFilesDownloadPack(key, downloader, packsDir, bucket, pack.Key); err != nil {
-			panic(err)
-		}
-		cnt++
+	// Finished packs are recorded in the journal, so an interrupted restore can be resumed
+	journal, err := openJournal(filepath.Join(conf.VarDir(), "s3-restore.journal"+target.Suffix()))
+	if err != nil {
+		log.Fatalf("failed to open the restore journal: %v", err)
 	}
+	defer journal.Close()
 
-	fmt.Printf("\n\n%d BlobsFiles packs restored.\n\nPlease run the following command to finishing restoring:\n\n\tblobstash -scan -s3-restore /path/to/config\n\n", cnt)
-	os.Exit(0)
-}
+	// Remove the temporary files left by an interrupted restore
+	if err := cleanTempFiles(packsDir); err != nil {
+		log.Fatalf("failed to remove the temporary files: %v", err)
+	}
 
-func BlobsFilesDownloadPack(ckey *[32]byte, downloader *s3manager.Downloader, packDir, bucket, key string) error {
-	f, err := ioutil.TempFile("", "blobstash_blobsfile_download")
+	// List all the packs first
+	list, err := listPacks(back, journal, packsDir, untilTime)
 	if err != nil {
-		return err
-	}
-	defer os.Remove(f.Name())
-	if _, err := downloader.Download(f, &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	}); err != nil {
-		return err
+		log.Fatalf("failed to list the packs: %v", err)
 	}
-	if err := f.Close(); err != nil {
-		return err
+	packs := list.packs
+
+	fmt.Printf("Restoring from %s: %d packs to restore (%s), %d already restored", back, len(packs),
+		humanize.Bytes(uint64(list.size)), list.skippedDone)
+	if !untilTime.IsZero() {
+		fmt.Printf(", %d uploaded after %s", list.skippedUntil, untilTime.Format(time.RFC3339))
 	}
-	decrypted, err := crypto.Open(ckey, f.Name())
-	if err != nil {
-		return err
+	fmt.Printf("\n\n")
+
+	if *dryRun {
+		for _, pack := range packs {
+			fmt.Printf("%s\t%s\t%s\n", filepath.Base(pack.Key), humanize.Bytes(uint64(pack.Size)),
+				list.uploadedAt(pack).Format(time.RFC3339))
+		}
+		os.Exit(0)
 	}
 
-	if err := os.Rename(decrypted, filepath.Join(packDir, filepath.Base(key))); err != nil {
-		return err
+	r := &restorer{keyring: keyring, back: back, packsDir: packsDir, journal: journal, force: *force}
+	stats := r.restore(packs, *workers)
+
+	fmt.Printf("\n%d BlobsFiles packs restored (%d blobs verified).\n", stats.packs, stats.blobs)
+	if len(stats.errors) > 0 {
+		fmt.Printf("\n%d packs failed, run the command again to retry them:\n", len(stats.errors))
+		for pack, err := range stats.errors {
+			fmt.Printf("\t%s: %v\n", pack, err)
+		}
+		os.Exit(1)
 	}
 
-	return nil
+	fmt.Printf("\nPlease run the following command to finishing restoring:\n\n\tblobstash -scan -s3-restore /path/to/config\n\n")
+	os.Exit(0)
 }
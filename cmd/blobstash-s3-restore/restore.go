@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/backend/remote"
+	"a4.io/blobstash/pkg/backend/s3"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/crypto"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+// BlobsFile pack format (see a4.io/blobsfile): a 64 bytes header followed by the records, a record being the
+// BLAKE2b-256 hash of the blob (32 bytes), 2 flag bytes, the size of the data (4 bytes, little-endian) and the data
+const (
+	packHeaderSize = 64
+	packHashSize   = 32
+
+	packFlagCompressed = 2
+	packFlagEOF        = 8
+
+	packSnappy = 1
+)
+
+// journal keeps track of the packs already restored (one key per line)
+type journal struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]bool
+}
+
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{f: f, done: map[string]bool{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			j.done[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// Done returns true if the pack has already been restored (and is still there)
+func (j *journal) Done(key, packsDir string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.done[key] {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(packsDir, filepath.Base(key)))
+	return err == nil
+}
+
+func (j *journal) Add(key string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.WriteString(key + "\n"); err != nil {
+		return err
+	}
+	j.done[key] = true
+	return j.f.Sync()
+}
+
+func (j *journal) Close() error {
+	return j.f.Close()
+}
+
+// packList holds the packs to restore
+type packList struct {
+	packs        []*remote.Object
+	times        map[string]time.Time // Upload time of the packs (only fetched when filtering on it)
+	size         int64
+	skippedDone  int
+	skippedUntil int
+}
+
+func (l *packList) uploadedAt(pack *remote.Object) time.Time {
+	if t, ok := l.times[pack.Key]; ok {
+		return t
+	}
+	return pack.ModTime
+}
+
+// listPacks returns the packs to restore, skipping the ones already restored and the ones uploaded after `until` (if
+// not zero)
+func listPacks(back remote.Backend, journal *journal, packsDir string, until time.Time) (*packList, error) {
+	list := &packList{packs: []*remote.Object{}, times: map[string]time.Time{}}
+	if err := remote.Iter(back, "packs/", 1000, func(pack *remote.Object) error {
+		if journal.Done(pack.Key, packsDir) {
+			list.skippedDone++
+			return nil
+		}
+		if !until.IsZero() {
+			// The modification time of the object can't be used as it changes when the pack is re-encrypted
+			t, err := s3.PackTime(back, pack)
+			if err != nil {
+				return err
+			}
+			list.times[pack.Key] = t
+			if t.After(until) {
+				list.skippedUntil++
+				return nil
+			}
+		}
+		list.packs = append(list.packs, pack)
+		list.size += pack.Size
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// cleanTempFiles removes the temporary files left in the packs directory by an interrupted restore
+func cleanTempFiles(packsDir string) error {
+	for _, pattern := range []string{".download-*", ".restore-*"} {
+		matches, err := filepath.Glob(filepath.Join(packsDir, pattern))
+		if err != nil {
+			return err
+		}
+		for _, path := range matches {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type restoreStats struct {
+	packs, blobs int
+	errors       map[string]error
+}
+
+type restorer struct {
+	keyring  *crypto.Keyring
+	back     remote.Backend
+	packsDir string
+	journal  *journal
+	force    bool
+}
+
+// restore downloads the packs using a pool of workers, a failed pack does not stop the restore
+func (r *restorer) restore(packs []*remote.Object, workers int) *restoreStats {
+	stats := &restoreStats{errors: map[string]error{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan *remote.Object)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pack := range queue {
+				blobs, err := r.restorePack(pack.Key)
+				mu.Lock()
+				if err != nil {
+					stats.errors[pack.Key] = err
+					fmt.Printf("[%d/%d] %s failed: %v\n", stats.packs+len(stats.errors), len(packs), filepath.Base(pack.Key), err)
+				} else {
+					stats.packs++
+					stats.blobs += blobs
+					fmt.Printf("[%d/%d] %s restored (%d blobs)\n", stats.packs+len(stats.errors), len(packs), filepath.Base(pack.Key), blobs)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, pack := range packs {
+		queue <- pack
+	}
+	close(queue)
+	wg.Wait()
+	return stats
+}
+
+// restorePack downloads, decrypts and verifies a pack before moving it in the packs directory, the number of blobs
+// is returned
+func (r *restorer) restorePack(key string) (int, error) {
+	dst := filepath.Join(r.packsDir, filepath.Base(key))
+	// Checked before downloading the pack too
+	if err := checkDst(dst, r.force); err != nil {
+		return 0, err
+	}
+
+	f, err := ioutil.TempFile(r.packsDir, ".download-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	if err := r.back.Download(key, f); err != nil {
+		f.Close()
+		return 0, fmt.Errorf("failed to download: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	decrypted, err := crypto.Open(r.keyring, f.Name())
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	defer os.Remove(decrypted)
+
+	blobs, err := verifyPack(decrypted)
+	if err != nil {
+		return 0, fmt.Errorf("failed to verify: %w", err)
+	}
+
+	if err := moveFile(decrypted, dst, r.force); err != nil {
+		return 0, err
+	}
+	if err := r.journal.Add(key); err != nil {
+		return 0, err
+	}
+	return blobs, nil
+}
+
+// verifyPack checks the hash of every blob in the pack (and the ref of the blobs with a non-native ref), and returns
+// the number of blobs
+func verifyPack(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if _, err := io.CopyN(ioutil.Discard, r, packHeaderSize); err != nil {
+		return 0, fmt.Errorf("failed to read the header: %w", err)
+	}
+
+	var n int
+	offset := int64(packHeaderSize)
+	hdr := make([]byte, packHashSize+6)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, fmt.Errorf("failed to read the record at offset %d: %w", offset, err)
+		}
+		hash, flags := hdr[:packHashSize], hdr[packHashSize:packHashSize+2]
+		if flags[0] == packFlagEOF {
+			return n, nil
+		}
+		size := binary.LittleEndian.Uint32(hdr[packHashSize+2:])
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return n, fmt.Errorf("failed to read the record at offset %d: %w", offset, err)
+		}
+		if err := verifyRecord(hash, flags, data); err != nil {
+			return n, fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		n++
+		offset += int64(len(hdr)) + int64(size)
+	}
+}
+
+// verifyRecord checks the data of a record against its hash
+func verifyRecord(hash, flags, data []byte) error {
+	if flags[0] == packFlagCompressed && flags[1] != 0 {
+		if flags[1] != packSnappy {
+			return fmt.Errorf("unknown compression %d", flags[1])
+		}
+		var err error
+		data, err = snappy.Decode(nil, data)
+		if err != nil {
+			return fmt.Errorf("failed to decompress: %w", err)
+		}
+	}
+	if sum := blake2b.Sum256(data); !bytes.Equal(sum[:], hash) {
+		return errors.New("blob hash mismatch")
+	}
+	if ref, data, ok := blobstore.UnwrapRef(data); ok {
+		h, err := hashutil.ComputeLike(ref, data)
+		if err != nil {
+			return err
+		}
+		if h != ref {
+			return fmt.Errorf("blob %s hash mismatch", ref)
+		}
+	}
+	return nil
+}
+
+// checkDst returns an error if the destination already exists and must not be overwritten
+func checkDst(dst string, force bool) error {
+	if force {
+		return nil
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists (use -force to overwrite it)", dst)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// moveFile renames the file, or copies it if the destination is on another device, an existing destination is only
+// overwritten if force is set
+func moveFile(src, dst string, force bool) error {
+	if err := checkDst(dst, force); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"a4.io/blobsfile"
+
+	"a4.io/blobstash/pkg/backend/remote"
+	"a4.io/blobstash/pkg/crypto"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// uploadPack creates a pack, and uploads it (encrypted with `key`) as `name` in the remote directory
+func uploadPack(key *[32]byte, back *remote.Dir, name string) {
+	dir, err := ioutil.TempDir("", "blobstash_s3_restore_pack")
+	check(err)
+	defer os.RemoveAll(dir)
+	packs, err := blobsfile.New(&blobsfile.Opts{Directory: dir})
+	check(err)
+	for i := 0; i < 3; i++ {
+		data := []byte(fmt.Sprintf("%s-blob%d", name, i))
+		check(packs.Put(hashutil.ComputeWith(hashutil.BLAKE2b256, data), data))
+	}
+	check(packs.Close())
+
+	encrypted, err := crypto.Seal(key, filepath.Join(dir, "blobs-00000"))
+	check(err)
+	defer os.Remove(encrypted)
+	f, err := os.Open(encrypted)
+	check(err)
+	defer f.Close()
+	check(back.Upload("packs/"+name, f))
+}
+
+func TestRestore(t *testing.T) {
+	root, err := ioutil.TempDir("", "blobstash_s3_restore")
+	check(err)
+	defer os.RemoveAll(root)
+	remoteDir := filepath.Join(root, "remote")
+	packsDir := filepath.Join(root, "blobs")
+	check(os.MkdirAll(remoteDir, 0700))
+	check(os.MkdirAll(packsDir, 0700))
+
+	var key [32]byte
+	copy(key[:], []byte("6368616e676520746869732070617373"))
+	back := remote.NewDir(remoteDir)
+
+	until := time.Now().Add(-1 * time.Hour)
+	// A pack uploaded before `until` and re-encrypted since (the modification time of the object changed)
+	uploadPack(&key, back, "blobs-00000")
+	check(back.Upload("packs-time/blobs-00000", strings.NewReader(until.Add(-1*time.Hour).Format(time.RFC3339Nano))))
+	// A pack uploaded after `until`
+	uploadPack(&key, back, "blobs-00001")
+	check(back.Upload("packs-time/blobs-00001", strings.NewReader(time.Now().Format(time.RFC3339Nano))))
+	// A pack uploaded before the upload time was recorded
+	uploadPack(&key, back, "blobs-00002")
+	old := until.Add(-2 * time.Hour)
+	check(os.Chtimes(filepath.Join(remoteDir, "packs", "blobs-00002"), old, old))
+
+	// Left by an interrupted restore
+	check(ioutil.WriteFile(filepath.Join(packsDir, ".download-123"), []byte("partial"), 0600))
+	check(cleanTempFiles(packsDir))
+	if _, err := os.Stat(filepath.Join(packsDir, ".download-123")); !os.IsNotExist(err) {
+		t.Errorf("the temporary file should have been removed")
+	}
+
+	journal, err := openJournal(filepath.Join(root, "journal"))
+	check(err)
+	defer journal.Close()
+
+	list, err := listPacks(back, journal, packsDir, until)
+	check(err)
+	if len(list.packs) != 2 || list.packs[0].Key != "packs/blobs-00000" || list.packs[1].Key != "packs/blobs-00002" {
+		t.Fatalf("unexpected packs %+v", list.packs)
+	}
+	if list.skippedUntil != 1 || list.skippedDone != 0 {
+		t.Errorf("unexpected list %+v", list)
+	}
+	if !list.uploadedAt(list.packs[1]).Equal(old) {
+		t.Errorf("the modification time should be used for the legacy packs, got %v", list.uploadedAt(list.packs[1]))
+	}
+
+	r := &restorer{keyring: crypto.NewKeyring(&key), back: back, packsDir: packsDir, journal: journal}
+	stats := r.restore(list.packs, 2)
+	if stats.packs != 2 || stats.blobs != 6 || len(stats.errors) != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	for _, name := range []string{"blobs-00000", "blobs-00002"} {
+		if _, err := os.Stat(filepath.Join(packsDir, name)); err != nil {
+			t.Errorf("pack %s not restored: %v", name, err)
+		}
+	}
+	files, err := ioutil.ReadDir(packsDir)
+	check(err)
+	if len(files) != 2 {
+		t.Errorf("only the restored packs should be in the packs directory, got %d files", len(files))
+	}
+
+	// The restored packs are skipped when resuming
+	list, err = listPacks(back, journal, packsDir, time.Time{})
+	check(err)
+	if len(list.packs) != 1 || list.packs[0].Key != "packs/blobs-00001" || list.skippedDone != 2 {
+		t.Errorf("unexpected list %+v", list)
+	}
+
+	// A corrupted pack fails without stopping the restore
+	check(back.Upload("packs/blobs-00003", strings.NewReader("corrupted")))
+	list, err = listPacks(back, journal, packsDir, time.Time{})
+	check(err)
+	stats = r.restore(list.packs, 2)
+	if stats.packs != 1 || len(stats.errors) != 1 || stats.errors["packs/blobs-00003"] == nil {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	files, err = ioutil.ReadDir(packsDir)
+	check(err)
+	if len(files) != 3 {
+		t.Errorf("the temporary files of the failed pack should have been removed, got %d files", len(files))
+	}
+
+	// An existing pack is only overwritten with -force
+	check(ioutil.WriteFile(filepath.Join(packsDir, "blobs-00004"), []byte("local"), 0600))
+	uploadPack(&key, back, "blobs-00004")
+	list, err = listPacks(back, journal, packsDir, time.Time{})
+	check(err)
+	stats = r.restore(list.packs, 2)
+	if stats.packs != 0 || len(stats.errors) != 2 || stats.errors["packs/blobs-00004"] == nil {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(packsDir, "blobs-00004")); err != nil || string(data) != "local" {
+		t.Errorf("the existing pack should not have been overwritten (%q, %v)", data, err)
+	}
+	r.force = true
+	stats = r.restore(list.packs, 2)
+	if stats.packs != 1 || stats.blobs != 3 || len(stats.errors) != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// writePack creates a pack containing the given records (keyed by their BLAKE2b-256 hash) and returns its path
+func writePack(dir string, recs ...[]byte) string {
+	packs, err := blobsfile.New(&blobsfile.Opts{Directory: dir})
+	check(err)
+	for _, rec := range recs {
+		check(packs.Put(hashutil.ComputeWith(hashutil.BLAKE2b256, rec), rec))
+	}
+	check(packs.Close())
+	return filepath.Join(dir, "blobs-00000")
+}
+
+func TestVerifyPack(t *testing.T) {
+	data := []byte("hello")
+	ref := hashutil.ComputeWith(hashutil.SHA256, data)
+	for _, tdata := range []struct {
+		name    string
+		recs    [][]byte
+		tamper  bool
+		blobs   int
+		wantErr bool
+	}{
+		{"valid", [][]byte{[]byte("blob"), []byte("#blobstash/ref " + ref + "\nhello")}, false, 2, false},
+		{"tampered", [][]byte{[]byte("blob")}, true, 0, true},
+		{"bad ref", [][]byte{[]byte("#blobstash/ref " + ref + "\nhellO")}, false, 0, true},
+	} {
+		t.Run(tdata.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "blobstash_s3_restore_verify")
+			check(err)
+			defer os.RemoveAll(dir)
+			path := writePack(dir, tdata.recs...)
+			if tdata.tamper {
+				f, err := os.OpenFile(path, os.O_RDWR, 0600)
+				check(err)
+				// Overwrite the first byte of the data of the first record
+				_, err = f.WriteAt([]byte("X"), packHeaderSize+packHashSize+6)
+				check(err)
+				check(f.Close())
+			}
+			blobs, err := verifyPack(path)
+			if (err != nil) != tdata.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if blobs != tdata.blobs {
+				t.Errorf("expected %d blobs, got %d", tdata.blobs, blobs)
+			}
+		})
+	}
+}
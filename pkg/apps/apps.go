@@ -25,6 +25,7 @@ import (
 	"a4.io/blobstash/pkg/blobstore"
 	blobstoreLua "a4.io/blobstash/pkg/blobstore/lua"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/docstore"
 	docstoreLua "a4.io/blobstash/pkg/docstore/lua"
 	"a4.io/blobstash/pkg/extra"
@@ -303,9 +304,11 @@ func (apps *Apps) newApp(appConf *config.AppConfig, conf *config.Config) (*App,
 				L.SetGlobal("blobstash", confTable)
 
 				docstore.SetLuaGlobals(L)
+				// The writes are accounted to the namespace/auth of the request
+				ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
 				blobstoreLua.Setup(context.TODO(), L, apps.bs)
 				filetreeLua.Setup(L, apps.ft, apps.bs, apps.kvs)
-				docstoreLua.Setup(L, apps.docstore)
+				docstoreLua.Setup(ctx, L, apps.docstore)
 				kvLua.Setup(L, apps.kvs, context.TODO())
 				gitserverLua.Setup(L, apps.gs)
 				// setup "apps"
@@ -1,6 +1,7 @@
 package auth // import "a4.io/blobstash/pkg/auth"
 
 import (
+	"context"
 	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
@@ -66,6 +67,25 @@ func Check(req *http.Request) bool {
 	return false
 }
 
+// FromRequest returns the auth of an authenticated request
+func FromRequest(r *http.Request) (*Auth, bool) {
+	a, ok := gcontext.GetOk(r, authKey)
+	if !ok {
+		return nil, false
+	}
+	return a.(*Auth), true
+}
+
+// ServeWithContext calls the handler with the given context, the auth of the request is kept
+func ServeWithContext(ctx context.Context, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	r2 := r.WithContext(ctx)
+	if a, ok := gcontext.GetOk(r, authKey); ok {
+		gcontext.Set(r2, authKey, a)
+		defer gcontext.Clear(r2)
+	}
+	next.ServeHTTP(w, r2)
+}
+
 func Can(w http.ResponseWriter, r *http.Request, action, resource string) bool {
 	auth, ok := gcontext.GetOk(r, authKey)
 	if !ok {
@@ -85,6 +105,20 @@ func Can(w http.ResponseWriter, r *http.Request, action, resource string) bool {
 	return can
 }
 
+// Allowed is like `Can`, but without setting the RBAC headers (for checks done on each item of a stream)
+func Allowed(r *http.Request, action, resource string) bool {
+	auth, ok := gcontext.GetOk(r, authKey)
+	if !ok {
+		// If there's no auth, it's not enabled
+		return true
+	}
+	can, err := auth.(*Auth).roles.Can(action, resource)
+	if err != nil {
+		panic(err)
+	}
+	return can
+}
+
 func Forbidden(w http.ResponseWriter) {
 	httputil.WriteJSONError(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
 }
@@ -0,0 +1,174 @@
+package remote // import "a4.io/blobstash/pkg/backend/remote"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnavailable is returned when the directory of a `Dir` backend is missing (e.g. the disk is unplugged)
+var ErrUnavailable = errors.New("remote directory not available")
+
+// Dir is a remote backend storing the objects in a local directory, meant to be a mounted NAS share or an external
+// disk (that can be unplugged, the upload queue is kept until it's available again).
+//
+// The directory is never created, so nothing gets written to the mount point while the disk is not mounted.
+type Dir struct {
+	root string
+}
+
+// NewDir returns a backend storing the objects in `root`
+func NewDir(root string) *Dir {
+	return &Dir{root: root}
+}
+
+func (d *Dir) String() string {
+	return fmt.Sprintf("dir-%s", d.root)
+}
+
+// path returns the path of the object if the directory is available
+func (d *Dir) path(key string) (string, error) {
+	fi, err := os.Stat(d.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%w: %s", ErrUnavailable, d.root)
+		}
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%w: %s is not a directory", ErrUnavailable, d.root)
+	}
+	key = filepath.Clean("/" + key)
+	return filepath.Join(d.root, filepath.FromSlash(key)), nil
+}
+
+// Upload atomically writes the object (it's written in a temporary file first)
+func (d *Dir) Upload(key string, src io.ReadSeeker) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Download copies the object into `dst`
+func (d *Dir) Download(key string, dst io.WriterAt) error {
+	r, err := d.Reader(key, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(&offsetWriter{w: dst}, r)
+	return err
+}
+
+// offsetWriter writes sequentially to an `io.WriterAt`
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (d *Dir) Reader(key string, size int64) (io.ReadCloser, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return f, nil
+	}
+	return &limitedReadCloser{io.LimitReader(f, size), f}, nil
+}
+
+func (d *Dir) List(prefix, marker string, max int) ([]*Object, error) {
+	path, err := d.path(prefix)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// `ReadDir` already sorts the entries by name
+	out := []*Object{}
+	for _, fi := range infos {
+		// Skip the sub-directories and the pending uploads
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		key := prefix + fi.Name()
+		if key <= marker {
+			continue
+		}
+		out = append(out, &Object{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		if max > 0 && len(out) == max {
+			break
+		}
+	}
+	return out, nil
+}
+
+func (d *Dir) Exists(key string) (bool, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *Dir) Delete(key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
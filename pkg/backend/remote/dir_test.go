@@ -0,0 +1,97 @@
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_remote_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := NewDir(dir)
+	for _, key := range []string{"b", "a", "c", "packs/blobs-00000", "packs/blobs-00001"} {
+		if err := d.Upload(key, strings.NewReader("data-"+key)); err != nil {
+			panic(err)
+		}
+	}
+
+	// Only the objects directly under the prefix are listed
+	keys := []string{}
+	if err := Iter(d, "", 2, func(o *Object) error {
+		keys = append(keys, o.Key)
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	if strings.Join(keys, ",") != "a,b,c" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+	packs, err := d.List("packs/", "", 10)
+	if err != nil {
+		panic(err)
+	}
+	if len(packs) != 2 || packs[0].Key != "packs/blobs-00000" || packs[0].Size != int64(len("data-packs/blobs-00000")) {
+		t.Errorf("unexpected packs %+v", packs)
+	}
+
+	f, err := ioutil.TempFile("", "blobstash_remote_download")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(f.Name())
+	if err := d.Download("packs/blobs-00001", f); err != nil {
+		panic(err)
+	}
+	f.Close()
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(data, []byte("data-packs/blobs-00001")) {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	r, err := d.Reader("a", 4)
+	if err != nil {
+		panic(err)
+	}
+	data, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		panic(err)
+	}
+	if string(data) != "data" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	if err := d.Delete("a"); err != nil {
+		panic(err)
+	}
+	for key, expected := range map[string]bool{"a": false, "b": true} {
+		exists, err := d.Exists(key)
+		if err != nil {
+			panic(err)
+		}
+		if exists != expected {
+			t.Errorf("%s exists=%v, expected %v", key, exists, expected)
+		}
+	}
+
+	// An unplugged disk must not be recreated
+	unplugged := NewDir(filepath.Join(dir, "unplugged"))
+	if err := unplugged.Upload("a", strings.NewReader("data")); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unplugged")); !os.IsNotExist(err) {
+		t.Errorf("the directory should not have been created")
+	}
+}
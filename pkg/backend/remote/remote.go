@@ -0,0 +1,67 @@
+/*
+
+Package remote defines the off-site storage used by the replication (the encrypted blobs and BlobsFile packs are
+uploaded to a remote backend).
+
+*/
+package remote // import "a4.io/blobstash/pkg/backend/remote"
+
+import (
+	"io"
+	"time"
+)
+
+// Object is an object stored in a remote backend
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time // When the object was uploaded
+}
+
+// Backend is a remote object storage, the keys are "/"-separated paths (the individual blobs are stored at the root
+// and the packs in "packs/")
+type Backend interface {
+	// Upload saves the content of `src` at `key` (overwriting any existing object)
+	Upload(key string, src io.ReadSeeker) error
+
+	// Download writes the content of the object into `dst`
+	Download(key string, dst io.WriterAt) error
+
+	// Reader returns a reader for the first `size` bytes of the object (the whole object if `size` <= 0)
+	Reader(key string, size int64) (io.ReadCloser, error)
+
+	// List returns at most `max` objects directly under `prefix` (not recursively), sorted by key and starting after
+	// `marker`
+	List(prefix, marker string, max int) ([]*Object, error)
+
+	// Exists returns true if the object exists
+	Exists(key string) (bool, error)
+
+	// Delete removes the object
+	Delete(key string) error
+
+	// String returns a human-readable name of the backend
+	String() string
+}
+
+// Iter calls `f` for each object directly under `prefix`, the objects are listed by batches of `max`
+func Iter(b Backend, prefix string, max int, f func(*Object) error) error {
+	var marker string
+	for {
+		objects, err := b.List(prefix, marker, max)
+		if err != nil {
+			return err
+		}
+
+		if len(objects) == 0 {
+			return nil
+		}
+
+		for _, object := range objects {
+			if err := f(object); err != nil {
+				return err
+			}
+			marker = object.Key
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package s3 // import "a4.io/blobstash/pkg/backend/s3"
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+
+	"a4.io/blobstash/pkg/backend/remote"
+	"a4.io/blobstash/pkg/crypto"
+)
+
+// AuditIssue is an object that failed the decryption spot-check
+type AuditIssue struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// AuditResult is the result of the comparison between the remote objects and the local state
+type AuditResult struct {
+	PacksChecked int `json:"packs_checked"`
+	BlobsChecked int `json:"blobs_checked"`
+	SampleSize   int `json:"sample_size"`
+
+	// Local sealed packs (paths) not uploaded, and uploaded packs (keys) not found locally
+	MissingPacks []string `json:"missing_packs"`
+	ExtraPacks   []string `json:"extra_packs"`
+
+	// Indexed blobs (plain-text hashes) whose object is missing, and objects not referenced by the index
+	MissingBlobs []string `json:"missing_blobs"`
+	ExtraObjects []string `json:"extra_objects"`
+
+	Undecryptable []*AuditIssue `json:"undecryptable"`
+
+	// Number of missing packs/blobs uploaded again
+	Requeued int `json:"requeued"`
+}
+
+// Consistent returns true if no issue were found
+func (r *AuditResult) Consistent() bool {
+	return len(r.MissingPacks) == 0 && len(r.ExtraPacks) == 0 && len(r.MissingBlobs) == 0 &&
+		len(r.ExtraObjects) == 0 && len(r.Undecryptable) == 0
+}
+
+// Audit compares the remote packs and blobs with the local sealed packs and the index, and tries to decrypt a random
+// sample of `sample` packs and blobs (the packs are only partially downloaded)
+func (b *S3Backend) Audit(sealedPacks []string, sample int) (*AuditResult, error) {
+	res := &AuditResult{
+		SampleSize:    sample,
+		MissingPacks:  []string{},
+		ExtraPacks:    []string{},
+		MissingBlobs:  []string{},
+		ExtraObjects:  []string{},
+		Undecryptable: []*AuditIssue{},
+	}
+
+	// Compare the packs
+	remotePacks := map[string]bool{}
+	if err := remote.Iter(b.remote, "packs/", 1000, func(object *remote.Object) error {
+		remotePacks[object.Key] = true
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list the packs: %w", err)
+	}
+	localPacks := map[string]bool{}
+	for _, pack := range sealedPacks {
+		key := "packs/" + filepath.Base(pack)
+		localPacks[key] = true
+		if !remotePacks[key] {
+			res.MissingPacks = append(res.MissingPacks, pack)
+		}
+	}
+	packs := []string{}
+	for key := range remotePacks {
+		packs = append(packs, key)
+		// With tiered storage, the local packs are compacted when blobs are evicted (the evicted blobs are still
+		// stored individually in the tiering target)
+		if !localPacks[key] && !b.keepBlobs {
+			res.ExtraPacks = append(res.ExtraPacks, key)
+		}
+	}
+	sort.Strings(packs)
+	sort.Strings(res.ExtraPacks)
+	res.PacksChecked = len(packs)
+
+	// Compare the blobs
+	objects := map[string]bool{}
+	if err := remote.Iter(b.remote, "", 1000, func(object *remote.Object) error {
+		objects[object.Key] = true
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list the blobs: %w", err)
+	}
+	indexed := map[string]bool{}
+	missing := map[string]string{}
+	blobs := []string{}
+	if err := b.index.IterKeys(func(hash, ehash string, _ []byte) error {
+		res.BlobsChecked++
+		indexed[ehash] = true
+		if !objects[ehash] {
+			missing[hash] = ehash
+			return nil
+		}
+		blobs = append(blobs, hash)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to iter the index: %w", err)
+	}
+	extra := []string{}
+	for key := range objects {
+		if !indexed[key] {
+			extra = append(extra, key)
+		}
+	}
+	// The blobs may have been uploaded, or deleted once included in an uploaded pack, since the listing
+	if err := b.recheck(res, missing, extra); err != nil {
+		return nil, err
+	}
+
+	// Spot-check the decryption
+	if b.encrypted {
+		for n, i := range rand.Perm(len(packs)) {
+			if n >= sample {
+				break
+			}
+			if err := b.checkPack(packs[i]); err != nil {
+				res.Undecryptable = append(res.Undecryptable, &AuditIssue{Key: packs[i], Error: err.Error()})
+			}
+		}
+		for n, i := range rand.Perm(len(blobs)) {
+			if n >= sample {
+				break
+			}
+			// `Get` also verifies the hash of the decrypted blob
+			if _, err := b.Get(blobs[i]); err != nil {
+				ehash, _ := b.index.Get(blobs[i])
+				// Deleted since (once included in an uploaded pack)
+				if ehash == "" {
+					continue
+				}
+				res.Undecryptable = append(res.Undecryptable, &AuditIssue{Key: ehash, Error: err.Error()})
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// recheck only reports the missing blobs and the extra objects that are still inconsistent, with the upload queue
+// lock held (the upload worker holds it while indexing an uploaded blob, and the deletion of the blobs included in an
+// uploaded pack holds it)
+func (b *S3Backend) recheck(res *AuditResult, missing map[string]string, extra []string) error {
+	if len(missing) == 0 && len(extra) == 0 {
+		return nil
+	}
+	b.uploadQueue.Lock()
+	defer b.uploadQueue.Unlock()
+
+	for hash, ehash := range missing {
+		current, err := b.index.Get(hash)
+		if err != nil {
+			return fmt.Errorf("failed to check the index: %w", err)
+		}
+		if current != ehash {
+			continue
+		}
+		exists, err := b.remote.Exists(ehash)
+		if err != nil {
+			return fmt.Errorf("failed to check the object: %w", err)
+		}
+		if !exists {
+			res.MissingBlobs = append(res.MissingBlobs, hash)
+		}
+	}
+	sort.Strings(res.MissingBlobs)
+
+	if len(extra) == 0 {
+		return nil
+	}
+	indexed := map[string]bool{}
+	if err := b.index.IterKeys(func(_, ehash string, _ []byte) error {
+		indexed[ehash] = true
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to iter the index: %w", err)
+	}
+	for _, key := range extra {
+		if indexed[key] {
+			continue
+		}
+		// Being uploaded by the upload worker
+		if _, ok := b.uploading.Load(key); ok {
+			continue
+		}
+		exists, err := b.remote.Exists(key)
+		if err != nil {
+			return fmt.Errorf("failed to check the object: %w", err)
+		}
+		if exists {
+			res.ExtraObjects = append(res.ExtraObjects, key)
+		}
+	}
+	sort.Strings(res.ExtraObjects)
+	return nil
+}
+
+// checkPack decrypts the beginning of the pack
+func (b *S3Backend) checkPack(key string) error {
+	r, err := b.remote.Reader(key, crypto.CheckSize)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return crypto.Check(b.keyring, r)
+}
+
+// Requeue uploads the missing packs again (in the background), and adds the missing blobs (if still available locally) to the upload
+// queue, the number of re-uploaded packs and re-queued blobs is returned
+func (b *S3Backend) Requeue(res *AuditResult) (int, error) {
+	var cnt int
+	// The packs uploads wait for the upload window
+	for _, pack := range res.MissingPacks {
+		go func(pack string) {
+			if err := b.BlobsFilesUploadPack(pack); err != nil {
+				b.log.Error("failed to upload pack", "pack", pack, "err", err)
+			}
+		}(pack)
+		cnt++
+	}
+	for _, hash := range res.MissingBlobs {
+		exists, err := b.backend.Exists(hash)
+		if err != nil {
+			return cnt, err
+		}
+		if !exists {
+			b.log.Warn("missing blob not available locally", "hash", hash)
+			continue
+		}
+		// The upload worker skips the indexed blobs
+		if err := b.index.Delete(hash); err != nil {
+			return cnt, err
+		}
+		if err := b.Put(hash); err != nil {
+			return cnt, err
+		}
+		cnt++
+	}
+	res.Requeued = cnt
+	return cnt, nil
+}
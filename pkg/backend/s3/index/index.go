@@ -2,8 +2,11 @@ package index // import "a4.io/blobstash/pkg/backend/s3/index"
 
 import (
 	"encoding/hex"
+	"io"
 	"sync"
 
+	"a4.io/blobstash/pkg/crypto"
+	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/rangedb"
 )
 
@@ -38,6 +41,11 @@ func (i *Index) Close() error {
 }
 
 func (i *Index) Index(plainHash, encryptedHash string) error {
+	return i.IndexWithKey(plainHash, encryptedHash, nil)
+}
+
+// IndexWithKey indexes the blob along with the ID of the key it was encrypted with (stored after the encrypted hash)
+func (i *Index) IndexWithKey(plainHash, encryptedHash string, keyID []byte) error {
 	i.Lock()
 	defer i.Unlock()
 	phash, err := hex.DecodeString(plainHash)
@@ -48,7 +56,17 @@ func (i *Index) Index(plainHash, encryptedHash string) error {
 	if err != nil {
 		return err
 	}
-	return i.db.Set(phash, ehash)
+	return i.db.Set(phash, append(ehash, keyID...))
+}
+
+// splitValue returns the encrypted hash and the key ID (nil for the blobs indexed before the key IDs were introduced,
+// the values without a key ID are 32 bytes long, or 34 bytes long for the SHA-256 refs)
+func splitValue(v []byte) ([]byte, []byte) {
+	switch len(v) {
+	case hashutil.DigestSize + crypto.KeyIDLength, hashutil.DigestSize + 2 + crypto.KeyIDLength:
+		return v[:len(v)-crypto.KeyIDLength], v[len(v)-crypto.KeyIDLength:]
+	}
+	return v, nil
 }
 
 func (i *Index) Delete(hash string) error {
@@ -93,7 +111,41 @@ func (i *Index) Get(hash string) (string, error) {
 		return "", err
 	}
 	if v != nil {
-		return hex.EncodeToString(v), nil
+		ehash, _ := splitValue(v)
+		return hex.EncodeToString(ehash), nil
 	}
 	return "", nil
 }
+
+// IterKeys calls `f` with the plain hash, the encrypted hash and the key ID of every indexed blob
+func (i *Index) IterKeys(f func(string, string, []byte) error) error {
+	r := i.db.PrefixRange(nil, false)
+	defer r.Close()
+	k, v, err := r.Next()
+	for ; err == nil; k, v, err = r.Next() {
+		ehash, keyID := splitValue(v)
+		if err := f(hex.EncodeToString(k), hex.EncodeToString(ehash), keyID); err != nil {
+			return err
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Iter calls `f` with the plain hash of every indexed blob
+func (i *Index) Iter(f func(string) error) error {
+	r := i.db.PrefixRange(nil, false)
+	defer r.Close()
+	k, _, err := r.Next()
+	for ; err == nil; k, _, err = r.Next() {
+		if err := f(hex.EncodeToString(k)); err != nil {
+			return err
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
@@ -37,4 +37,19 @@ func TestIndex(t *testing.T) {
 	if ok2 {
 		t.Errorf("h \"%s\" should not exists", h2)
 	}
+
+	// The key ID is stored after the encrypted hash
+	keyID := []byte("01234567")
+	check(i.IndexWithKey(h, h2, keyID))
+	ehash, err = i.Get(h)
+	check(err)
+	if ehash != h2 {
+		t.Errorf("failed to retrieve encrypted hash, expected %q, got %q", ehash, h2)
+	}
+	check(i.IterKeys(func(hash, ehash string, id []byte) error {
+		if hash != h || ehash != h2 || string(id) != string(keyID) {
+			t.Errorf("unexpected entry %s %s %q", hash, ehash, id)
+		}
+		return nil
+	}))
 }
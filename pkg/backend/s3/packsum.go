@@ -0,0 +1,59 @@
+package s3 // import "a4.io/blobstash/pkg/backend/s3"
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"a4.io/blobstash/pkg/backend/remote"
+)
+
+// packSumsPrefix is where the checksum of the content of each uploaded pack is stored, the packs keep their name when
+// they're rewritten (e.g. compacted), and the uploaded object can't be compared as it's encrypted
+const packSumsPrefix = "packs-sum/"
+
+func packSumKey(key string) string {
+	return packSumsPrefix + path.Base(key)
+}
+
+// packSum returns the checksum of the local pack
+func packSum(pack string) (string, error) {
+	f, err := os.Open(pack)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadedPackSum returns the checksum of the uploaded pack (empty if it was uploaded before the checksums were
+// recorded)
+func uploadedPackSum(back remote.Backend, key string) (string, error) {
+	exists, err := back.Exists(packSumKey(key))
+	if err != nil || !exists {
+		return "", err
+	}
+	rc, err := back.Reader(packSumKey(key), 0)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// savePackSum records the checksum of the uploaded pack
+func savePackSum(back remote.Backend, key, sum string) error {
+	return back.Upload(packSumKey(key), strings.NewReader(sum))
+}
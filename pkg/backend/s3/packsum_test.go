@@ -0,0 +1,90 @@
+package s3
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/backend/remote"
+	"a4.io/blobstash/pkg/crypto"
+)
+
+func TestUploadPackChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_s3_packsum")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "remote"), 0700); err != nil {
+		panic(err)
+	}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	var key [32]byte
+	copy(key[:], []byte("6368616e676520746869732070617373"))
+	back := &S3Backend{
+		name:      "test",
+		log:       logger,
+		remote:    remote.NewDir(filepath.Join(dir, "remote")),
+		encrypted: true,
+		keyring:   crypto.NewKeyring(&key),
+		keepBlobs: true,
+	}
+
+	pack := filepath.Join(dir, "blobs-00000")
+	if err := ioutil.WriteFile(pack, []byte("v1"), 0600); err != nil {
+		panic(err)
+	}
+	if err := back.BlobsFilesUploadPack(pack); err != nil {
+		panic(err)
+	}
+	sum, err := packSum(pack)
+	if err != nil {
+		panic(err)
+	}
+	if uploaded, err := uploadedPackSum(back.remote, "packs/blobs-00000"); err != nil || uploaded != sum {
+		t.Errorf("the checksum should have been recorded, got %q (%v)", uploaded, err)
+	}
+
+	// An unchanged pack is not uploaded again
+	if err := back.remote.Upload("packs/blobs-00000", strings.NewReader("marker")); err != nil {
+		panic(err)
+	}
+	if err := back.BlobsFilesUploadPack(pack); err != nil {
+		panic(err)
+	}
+	if got := readRemote(back.remote, "packs/blobs-00000"); got != "marker" {
+		t.Errorf("the unchanged pack should not have been uploaded again")
+	}
+
+	// A pack rewritten under the same name is uploaded again
+	if err := ioutil.WriteFile(pack, []byte("v2"), 0600); err != nil {
+		panic(err)
+	}
+	if err := back.BlobsFilesUploadPack(pack); err != nil {
+		panic(err)
+	}
+	if got := readRemote(back.remote, "packs/blobs-00000"); got == "marker" {
+		t.Errorf("the rewritten pack should have been uploaded again")
+	}
+	if uploaded, _ := uploadedPackSum(back.remote, "packs/blobs-00000"); uploaded == sum {
+		t.Errorf("the checksum should have been updated")
+	}
+}
+
+func readRemote(back remote.Backend, key string) string {
+	rc, err := back.Reader(key, 0)
+	if err != nil {
+		panic(err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,54 @@
+package s3 // import "a4.io/blobstash/pkg/backend/s3"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/backend/remote"
+)
+
+// packTimesPrefix is where the upload time of each pack is stored, the modification time of the pack object can't be
+// relied on as it changes when the pack is re-encrypted
+const packTimesPrefix = "packs-time/"
+
+func packTimeKey(key string) string {
+	return packTimesPrefix + path.Base(key)
+}
+
+// savePackTime records the upload time of the pack (an already recorded time is kept)
+func savePackTime(back remote.Backend, key string, t time.Time) error {
+	exists, err := back.Exists(packTimeKey(key))
+	if err != nil || exists {
+		return err
+	}
+	return back.Upload(packTimeKey(key), strings.NewReader(t.UTC().Format(time.RFC3339Nano)))
+}
+
+// PackTime returns the time the pack was first uploaded, the modification time of the object is returned for the
+// packs uploaded before the time was recorded
+func PackTime(back remote.Backend, pack *remote.Object) (time.Time, error) {
+	exists, err := back.Exists(packTimeKey(pack.Key))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !exists {
+		return pack.ModTime, nil
+	}
+	rc, err := back.Reader(packTimeKey(pack.Key), 0)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid upload time for pack %s: %w", pack.Key, err)
+	}
+	return t, nil
+}
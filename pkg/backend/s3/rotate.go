@@ -0,0 +1,233 @@
+package s3 // import "a4.io/blobstash/pkg/backend/s3"
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/backend/remote"
+	"a4.io/blobstash/pkg/crypto"
+)
+
+// keyRotation holds the progress of the re-encryption (with the active key) of the packs and blobs encrypted with an
+// old key
+type keyRotation struct {
+	sync.Mutex
+	running    bool
+	startedAt  time.Time
+	finishedAt time.Time
+
+	packsTotal, packsDone int
+	blobsTotal, blobsDone int
+	errors                int
+	lastError             string
+}
+
+func (r *keyRotation) stats() map[string]interface{} {
+	r.Lock()
+	defer r.Unlock()
+	out := map[string]interface{}{
+		"running":     r.running,
+		"packs_total": r.packsTotal,
+		"packs_done":  r.packsDone,
+		"blobs_total": r.blobsTotal,
+		"blobs_done":  r.blobsDone,
+		"errors":      r.errors,
+	}
+	if !r.startedAt.IsZero() {
+		out["started_at"] = r.startedAt.Format(time.RFC3339)
+	}
+	if !r.finishedAt.IsZero() {
+		out["finished_at"] = r.finishedAt.Format(time.RFC3339)
+	}
+	if r.lastError != "" {
+		out["last_error"] = r.lastError
+	}
+	return out
+}
+
+func (r *keyRotation) failed(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.errors++
+	r.lastError = err.Error()
+}
+
+// rotateKeys re-encrypts the packs and blobs encrypted with an old key, the failed ones are retried on the next
+// startup
+func (b *S3Backend) rotateKeys() {
+	defer close(b.rotateDone)
+	log := b.log.New("worker", "key_rotation")
+	log.Info("starting key rotation", "active_key", crypto.FormatKeyID(b.keyring.ActiveID()))
+	r := b.rotation
+	r.Lock()
+	r.running = true
+	r.startedAt = time.Now()
+	r.Unlock()
+	defer func() {
+		r.Lock()
+		defer r.Unlock()
+		r.running = false
+		r.finishedAt = time.Now()
+		if r.errors == 0 {
+			log.Info("key rotation done, the old keys can be removed from the config", "packs", r.packsDone,
+				"blobs", r.blobsDone, "duration", r.finishedAt.Sub(r.startedAt))
+		} else {
+			log.Error("key rotation done with errors", "errors", r.errors, "duration", r.finishedAt.Sub(r.startedAt))
+		}
+	}()
+
+	// List everything first so the progress can be reported
+	packs, err := b.packsToRotate()
+	if err != nil {
+		log.Error("failed to list the packs", "err", err)
+		r.failed(err)
+		return
+	}
+	blobs := map[string]string{}
+	if err := b.index.IterKeys(func(hash, ehash string, keyID []byte) error {
+		if !b.keyring.IsActive(keyID) {
+			blobs[hash] = ehash
+		}
+		return nil
+	}); err != nil {
+		log.Error("failed to iter the index", "err", err)
+		r.failed(err)
+		return
+	}
+	r.Lock()
+	r.packsTotal = len(packs)
+	r.blobsTotal = len(blobs)
+	r.Unlock()
+
+	for _, pack := range packs {
+		select {
+		case <-b.rotateStop:
+			return
+		default:
+		}
+		if err := b.rotatePack(pack); err != nil {
+			log.Error("failed to re-encrypt pack", "pack", pack.Key, "err", err)
+			r.failed(err)
+			continue
+		}
+		r.Lock()
+		r.packsDone++
+		r.Unlock()
+	}
+	for hash, ehash := range blobs {
+		select {
+		case <-b.rotateStop:
+			return
+		default:
+		}
+		if err := b.rotateBlob(hash, ehash); err != nil {
+			log.Error("failed to re-encrypt blob", "hash", hash, "err", err)
+			r.failed(err)
+			continue
+		}
+		r.Lock()
+		r.blobsDone++
+		r.Unlock()
+	}
+}
+
+// packsToRotate returns the packs not encrypted with the active key
+func (b *S3Backend) packsToRotate() ([]*remote.Object, error) {
+	packs := []*remote.Object{}
+	if err := remote.Iter(b.remote, "packs/", 1000, func(object *remote.Object) error {
+		rc, err := b.remote.Reader(object.Key, crypto.HeaderSize)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		keyID, err := crypto.PackKeyID(rc)
+		if err != nil {
+			return fmt.Errorf("failed to read header of %s: %w", object.Key, err)
+		}
+		if !b.keyring.IsActive(keyID) {
+			packs = append(packs, object)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return packs, nil
+}
+
+// rotatePack decrypts the pack and overwrites it with the pack encrypted with the active key
+func (b *S3Backend) rotatePack(pack *remote.Object) error {
+	key := pack.Key
+	// Keep the original upload time of the packs uploaded before it was recorded
+	if err := savePackTime(b.remote, key, pack.ModTime); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile("", "blobstash_blobsfile_rotate")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := b.remote.Download(key, f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	decrypted, err := crypto.Open(b.keyring, f.Name())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(decrypted)
+	encrypted, err := crypto.Seal(b.keyring.Active(), decrypted)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(encrypted)
+
+	ef, err := os.Open(encrypted)
+	if err != nil {
+		return err
+	}
+	defer ef.Close()
+	return b.upload(key, ef)
+}
+
+// rotateBlob uploads the blob encrypted with the active key (and updates the index) before deleting the old object
+func (b *S3Backend) rotateBlob(hash, ehash string) error {
+	// The download and the upload are done without holding the upload queue lock
+	data, err := b.Get(hash)
+	if err != nil {
+		return err
+	}
+	newEhash, edata, keyID, err := b.seal(hash, data)
+	if err != nil {
+		return err
+	}
+	if err := b.upload(newEhash, bytes.NewReader(edata)); err != nil {
+		return err
+	}
+
+	// Prevent the upload worker from updating the index in the meantime
+	b.uploadQueue.Lock()
+	// The blob may have been deleted since (once included in an uploaded pack)
+	current, err := b.index.Get(hash)
+	if err != nil {
+		b.uploadQueue.Unlock()
+		return err
+	}
+	if current != ehash {
+		b.uploadQueue.Unlock()
+		return b.remote.Delete(newEhash)
+	}
+	err = b.index.IndexWithKey(hash, newEhash, keyID)
+	b.uploadQueue.Unlock()
+	if err != nil {
+		return err
+	}
+	return b.remote.Delete(ehash)
+}
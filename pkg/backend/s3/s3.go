@@ -16,18 +16,16 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	humanize "github.com/dustin/go-humanize"
 	log "github.com/inconshreveable/log15"
 
 	"a4.io/blobsfile"
 
+	"a4.io/blobstash/pkg/backend/remote"
 	"a4.io/blobstash/pkg/backend/s3/index"
 	"a4.io/blobstash/pkg/backend/s3/s3util"
 	"a4.io/blobstash/pkg/blob"
@@ -36,6 +34,7 @@ import (
 	"a4.io/blobstash/pkg/docstore/id"
 	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/metrics"
 	"a4.io/blobstash/pkg/queue"
 )
 
@@ -51,74 +50,141 @@ import (
 
 var ErrWriteOnly = errors.New("backend is in read-only mode")
 
+// ErrClosed is returned when the backend is closed while waiting for the upload window
+var ErrClosed = errors.New("backend closed")
+
+var (
+	uploadedMetric      = metrics.NewCounterVec("blobstash_s3_uploaded", "Objects uploaded to S3.", "target", "kind")
+	uploadedBytesMetric = metrics.NewCounterVec("blobstash_s3_uploaded_bytes", "Bytes uploaded to S3.", "target", "kind")
+	uploadErrorsMetric  = metrics.NewCounterVec("blobstash_s3_upload_errors", "Failed S3 uploads.", "target", "kind")
+
+	// Updated by `Stats`
+	queueBlobsMetric = metrics.NewGaugeVec("blobstash_s3_upload_queue_blobs", "Blobs waiting in the S3 upload queue.", "target")
+	queueBytesMetric = metrics.NewGaugeVec("blobstash_s3_upload_queue_bytes", "Size of the blobs waiting in the S3 upload queue.", "target")
+)
+
 type dlIndexItem struct {
 	blob *blob.Blob
 	id   *id.ID
 }
 
+// LocalBackend is the local storage engine the replicated blobs are read from (and restored to)
+type LocalBackend interface {
+	Put(hash string, data []byte) error
+	Get(hash string) ([]byte, error)
+	Exists(hash string) (bool, error)
+	Size(hash string) (int, error)
+	Enumerate(blobs chan<- *blob.SizedBlobRef, start, end string, limit int) error
+}
+
+// S3Backend replicates the blobs (encrypted) to a remote backend: S3 or a local directory
 type S3Backend struct {
-	log log.Logger
+	name string
+	log  log.Logger
 
 	uploadQueue *queue.Queue
 	index       *index.Index
 
+	// Objects uploaded by the upload worker but not indexed yet (the upload queue lock is not held during the uploads)
+	uploading sync.Map
+
 	encrypted bool
-	key       *[32]byte
+	keyring   *crypto.Keyring
 
-	backend *blobsfile.BlobsFiles
+	// Progress of the re-encryption with the active key (nil if there is no old keys)
+	rotation   *keyRotation
+	rotateStop chan struct{}
+	rotateDone chan struct{}
+
+	backend LocalBackend
 	hub     *hub.Hub
 
 	wg sync.WaitGroup
 
-	s3 *s3.S3
+	remote remote.Backend
+
+	// Where the downloaded packs are restored
+	packsDir string
 
-	// Uses to upload/download BlobsFiles packs
-	uploader   *s3manager.Uploader
-	downloader *s3manager.Downloader
+	// The blobs uploaded individually are kept after their pack is uploaded (the tiered storage fetches them)
+	keepBlobs bool
 
 	stop chan struct{}
+	done chan struct{}
+
+	// Upload rate limit (nil if unlimited) and time-of-day windows
+	limiter *limiter
+	windows []*window
 
-	bucket string
+	// Set to 1 to upload outside the windows until the queue is empty and the pending packs are uploaded
+	flushing int32
+
+	// Number of packs waiting for the upload window (or being uploaded)
+	pendingPacks int32
 
 	uploadedSinceStartup      uint64
 	blobsUploadedSinceStartup int
 }
 
-func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config.Config, packsDir string) (*S3Backend, error) {
-	// Parse config
+// NewRemote returns the remote backend for the replication config: a local directory if `dir` is set, the S3 bucket
+// otherwise
+func NewRemote(conf *config.S3Repl) (remote.Backend, error) {
+	if conf.Dir != "" {
+		return remote.NewDir(conf.Dir), nil
+	}
+
 	var sess *session.Session
-	bucket := conf.S3Repl.Bucket
-	region := conf.S3Repl.Region
+	var err error
+	if conf.Endpoint != "" {
+		sess, err = s3util.NewWithCustomEndoint(conf.AccessKey, conf.SecretKey, conf.Region, conf.Endpoint)
+	} else {
+		// Create a S3 Session
+		sess, err = s3util.New(conf.Region)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The bucket is created if it does not exist
+	return s3util.NewRemote(sess, conf.Bucket)
+}
+
+// New initializes the replication to the given target, each target has its own upload queue and index
+func New(logger log.Logger, back LocalBackend, h *hub.Hub, conf *config.Config, target *config.S3Repl, packsDir string) (*S3Backend, error) {
+	// Parse config
 	scanMode := conf.S3ScanMode
 	restoreMode := conf.S3RestoreMode
-	key, err := conf.S3Repl.Key()
+	keyring, err := target.Keyring()
 	if err != nil {
 		return nil, err
 	}
 
-	var s3svc *s3.S3
-	if conf.S3Repl.Endpoint != "" {
-		sess, err = s3util.NewWithCustomEndoint(conf.S3Repl.AccessKey, conf.S3Repl.SecretKey, region, conf.S3Repl.Endpoint)
-		if err != nil {
-			return nil, err
-		}
-		s3svc = s3.New(sess)
-	} else {
-		// Create a S3 Session
-		sess, err = s3util.New(region)
+	rback, err := NewRemote(target)
+	if err != nil {
+		return nil, err
+	}
+
+	windows, err := parseWindows(target.UploadWindows)
+	if err != nil {
+		return nil, err
+	}
+	var lmt *limiter
+	if target.UploadRate != "" {
+		rate, err := humanize.ParseBytes(target.UploadRate)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("invalid upload rate: %w", err)
 		}
-		s3svc = s3.New(sess)
+		lmt = &limiter{rate: int64(rate)}
 	}
+
 	// Init the disk-backed queue
-	uq, err := queue.New(filepath.Join(conf.VarDir(), "s3-upload.queue"))
+	uq, err := queue.New(filepath.Join(conf.VarDir(), "s3-upload.queue"+target.Suffix()))
 	if err != nil {
 		return nil, err
 	}
 
 	// Init the disk-backed index
-	indexPath := filepath.Join(conf.VarDir(), "s3-backend.index")
+	indexPath := filepath.Join(conf.VarDir(), "s3-backend.index"+target.Suffix())
 	if scanMode || restoreMode {
 		logger.Debug("trying to remove old index file")
 		os.Remove(indexPath)
@@ -129,65 +195,71 @@ func New(logger log.Logger, back *blobsfile.BlobsFiles, h *hub.Hub, conf *config
 	}
 
 	s3backend := &S3Backend{
+		name:        target.TargetName(),
 		log:         logger,
 		backend:     back,
 		hub:         h,
-		s3:          s3svc,
+		remote:      rback,
+		packsDir:    packsDir,
+		keepBlobs:   target.Tiering != nil,
 		stop:        make(chan struct{}),
-		bucket:      bucket,
-		key:         key,
+		done:        make(chan struct{}),
+		limiter:     lmt,
+		windows:     windows,
+		keyring:     keyring,
 		uploadQueue: uq,
 		index:       i,
-		uploader:    s3manager.NewUploader(sess),
-		downloader:  s3manager.NewDownloader(sess),
 	}
 
 	// FIXME(tsileo): should encypption be optional?
-	if key != nil {
+	if keyring != nil {
 		s3backend.encrypted = true
 	}
 
-	logger.Info("Initializing S3 replication", "bucket", bucket, "encrypted", s3backend.encrypted, "scan_mode", scanMode, "restore_mode", restoreMode)
-
-	// Ensure the bucket exist
-	obucket := s3util.NewBucket(s3backend.s3, bucket)
-	ok, err := obucket.Exists()
-	if err != nil {
-		return nil, err
-	}
-
-	// Create it if it does not
-	if !ok {
-		logger.Info("creating bucket", "bucket", bucket)
-		if err := obucket.Create(); err != nil {
-			return nil, err
-		}
-	}
+	logger.Info("Initializing S3 replication", "remote", rback, "encrypted", s3backend.encrypted, "scan_mode", scanMode, "restore_mode", restoreMode)
 
 	// Initialize the worker (queue consumer)
 	go s3backend.uploadWorker()
 
+	// Re-encrypt the packs and blobs encrypted with an old key
+	if keyring != nil && keyring.HasOldKeys() && !scanMode && !restoreMode {
+		s3backend.rotation = &keyRotation{}
+		s3backend.rotateStop = make(chan struct{})
+		s3backend.rotateDone = make(chan struct{})
+		go s3backend.rotateKeys()
+	}
+
 	return s3backend, nil
 }
 
+// Name returns the name of the target
+func (b *S3Backend) Name() string {
+	return b.name
+}
+
+// Remote returns the remote backend the blobs are replicated to
+func (b *S3Backend) Remote() remote.Backend {
+	return b.remote
+}
+
 func (b *S3Backend) BlobsFilesDownloadPack(key string) error {
 	f, err := ioutil.TempFile("", "blobstash_blobsfile_download")
 	if err != nil {
 		return err
 	}
 	defer os.Remove(f.Name())
-	if err := b.DownloadFile(key, f); err != nil {
+	if err := b.remote.Download(key, f); err != nil {
 		return err
 	}
 	if err := f.Close(); err != nil {
 		return err
 	}
-	decrypted, err := crypto.Open(b.key, f.Name())
+	decrypted, err := crypto.Open(b.keyring, f.Name())
 	if err != nil {
 		return err
 	}
 
-	if err := os.Rename(decrypted, filepath.Join("TODO packsDir", filepath.Base(key))); err != nil {
+	if err := os.Rename(decrypted, filepath.Join(b.packsDir, filepath.Base(key))); err != nil {
 		return err
 	}
 
@@ -195,20 +267,43 @@ func (b *S3Backend) BlobsFilesDownloadPack(key string) error {
 }
 
 func (b *S3Backend) BlobsFilesUploadPack(pack string) error {
-	bucket := s3util.NewBucket(b.s3, b.bucket)
-	obj := bucket.GetObject("packs/" + filepath.Base(pack))
-	exists, err := obj.Exists()
+	key := "packs/" + filepath.Base(pack)
+	sum, err := packSum(pack)
+	if err != nil {
+		return err
+	}
+	exists, err := b.remote.Exists(key)
 	if err != nil {
 		return err
 	}
-	b.log.Info("checking pack", "pack", pack, "exists", exists, "obj", obj)
+	b.log.Info("checking pack", "pack", pack, "exists", exists, "key", key)
 
 	if exists {
-		b.log.Info("already uploaded", "pack", pack)
-		return nil
+		// The content is compared as a rewritten pack keeps its name (the packs uploaded before the checksums were
+		// recorded are uploaded again)
+		uploadedSum, err := uploadedPackSum(b.remote, key)
+		if err != nil {
+			return err
+		}
+		if uploadedSum == sum {
+			b.log.Info("already uploaded", "pack", pack)
+			return nil
+		}
+		b.log.Info("pack changed since its upload", "pack", pack)
+	}
+
+	atomic.AddInt32(&b.pendingPacks, 1)
+	defer atomic.AddInt32(&b.pendingPacks, -1)
+	if !b.waitUploadWindow() {
+		return ErrClosed
+	}
+
+	// Recorded before the upload, as an uploaded pack is never uploaded again
+	if err := savePackTime(b.remote, key, time.Now()); err != nil {
+		return fmt.Errorf("failed to save the pack upload time: %w", err)
 	}
 
-	encrypted, err := crypto.Seal(b.key, pack)
+	encrypted, err := crypto.Seal(b.keyring.Active(), pack)
 	if err != nil {
 		return err
 	}
@@ -221,22 +316,24 @@ func (b *S3Backend) BlobsFilesUploadPack(pack string) error {
 	}
 	defer f.Close()
 
-	// Upload to S3 (with extra retries)
-	for i := 0; i < 3; i++ {
-		tlog := b.log.New("pack", pack, "try", i+1)
-		if _, err := f.Seek(0, io.SeekStart); err != nil {
-			return err
-		}
-		if err := b.UploadFile(f, "packs/"+filepath.Base(pack)); err != nil {
-			if !request.IsErrorRetryable(err) {
-				tlog.Info("failed to upload pack", "err", err)
-				return err
-			}
-			tlog.Info("failed to upload pack, will retry", "pack", pack, "err", err)
-		}
-		break
+	if err := b.upload(key, f); err != nil {
+		uploadErrorsMetric.With(b.name, "pack").Inc()
+		b.log.Info("failed to upload pack", "pack", pack, "err", err)
+		return err
 	}
 	b.log.Info("pack uploaded", "pack", pack)
+	uploadedMetric.With(b.name, "pack").Inc()
+	if fi, err := f.Stat(); err == nil {
+		uploadedBytesMetric.With(b.name, "pack").Add(float64(fi.Size()))
+	}
+	if err := savePackSum(b.remote, key, sum); err != nil {
+		return fmt.Errorf("failed to save the pack checksum: %w", err)
+	}
+
+	// The blobs still need to be uploaded individually for the tiered storage
+	if b.keepBlobs {
+		return nil
+	}
 
 	blobs, err := blobsfile.ScanBlobsFile(pack)
 	if err != nil {
@@ -251,25 +348,36 @@ func (b *S3Backend) BlobsFilesUploadPack(pack string) error {
 	b.uploadQueue.Unlock()
 
 	for _, h := range blobs {
-		exists, err := b.index.Exists(h)
-		if err != nil {
+		if err := b.deleteBlob(h); err != nil {
 			return err
 		}
-		b.log.Debug("deleting blob", "hash", h, "exists", exists)
-		if exists {
-			ehash, err := b.index.Get(h)
-			if err == nil && ehash != "" {
-				if err := bucket.GetObject(ehash).Delete(); err != nil {
-					return fmt.Errorf("failed to remove blob:%s/%s: %v", h, ehash, err)
-				}
-				if err := b.index.Delete(h); err != nil {
-					return err
-				}
-				b.log.Debug("blob deleted", "hash", h)
+	}
+	b.log.Info(fmt.Sprintf("%d blobs deleted", len(blobs)))
+	return nil
+}
+
+// deleteBlob removes the individual blob (now included in an uploaded pack), the upload queue lock is held so the
+// audit never sees the object deleted while still indexed
+func (b *S3Backend) deleteBlob(h string) error {
+	b.uploadQueue.Lock()
+	defer b.uploadQueue.Unlock()
+	exists, err := b.index.Exists(h)
+	if err != nil {
+		return err
+	}
+	b.log.Debug("deleting blob", "hash", h, "exists", exists)
+	if exists {
+		ehash, err := b.index.Get(h)
+		if err == nil && ehash != "" {
+			if err := b.remote.Delete(ehash); err != nil {
+				return fmt.Errorf("failed to remove blob:%s/%s: %v", h, ehash, err)
 			}
+			if err := b.index.Delete(h); err != nil {
+				return err
+			}
+			b.log.Debug("blob deleted", "hash", h)
 		}
 	}
-	b.log.Info(fmt.Sprintf("%d blobs deleted", len(blobs)))
 	return nil
 }
 
@@ -283,34 +391,12 @@ func (b *S3Backend) BlobsFilesSyncWorker(sealedPacks []string) error {
 	return nil
 }
 
-func (b *S3Backend) DownloadFile(key string, dest io.WriterAt) error {
-	if _, err := b.downloader.Download(dest, &s3.GetObjectInput{
-		Bucket: aws.String(b.bucket),
-		Key:    aws.String(key),
-	}); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (b *S3Backend) UploadFile(src io.Reader, key string) error {
-	if _, err := b.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(b.bucket),
-		Key:    aws.String(key),
-		Body:   src,
-	}); err != nil {
-		return err
-	}
-	return nil
-}
-
 func (b *S3Backend) String() string {
 	suf := ""
 	if b.encrypted {
 		suf = "-encrypted"
 	}
-	return fmt.Sprintf("s3-backend-%s", b.bucket) + suf
+	return fmt.Sprintf("s3-backend-%s", b.remote) + suf
 }
 
 func (b *S3Backend) Stats() (map[string]interface{}, error) {
@@ -331,14 +417,31 @@ func (b *S3Backend) Stats() (map[string]interface{}, error) {
 		total += uint64(sz)
 	}
 
-	return map[string]interface{}{
-		"blobs_waiting":                           count,
-		"blobs_size":                              total,
-		"blobs_size_human":                        humanize.Bytes(total),
-		"blobs_uploaded_since_startup":            b.blobsUploadedSinceStartup,
-		"blobs_size_uploaded_since_startup":       b.uploadedSinceStartup,
+	queueBlobsMetric.With(b.name).Set(float64(count))
+	queueBytesMetric.With(b.name).Set(float64(total))
+
+	out := map[string]interface{}{
+		"name":                              b.name,
+		"upload_window_open":                inWindows(b.windows, time.Now()),
+		"flushing":                          atomic.LoadInt32(&b.flushing) == 1,
+		"remote":                            b.remote.String(),
+		"blobs_waiting":                     count,
+		"blobs_size":                        total,
+		"blobs_size_human":                  humanize.Bytes(total),
+		"blobs_uploaded_since_startup":      b.blobsUploadedSinceStartup,
+		"blobs_size_uploaded_since_startup": b.uploadedSinceStartup,
 		"blobs_size_uploaded_since_startup_human": humanize.Bytes(b.uploadedSinceStartup),
-	}, nil
+	}
+	if b.limiter != nil {
+		out["upload_rate"] = humanize.Bytes(uint64(b.limiter.rate)) + "/s"
+	}
+	if b.encrypted {
+		out["active_key"] = crypto.FormatKeyID(b.keyring.ActiveID())
+	}
+	if b.rotation != nil {
+		out["key_rotation"] = b.rotation.stats()
+	}
+	return out, nil
 }
 
 func (b *S3Backend) Put(hash string) error {
@@ -349,23 +452,22 @@ func (b *S3Backend) Put(hash string) error {
 }
 
 func (b *S3Backend) Reindex(restore bool) error {
-	bucket := s3util.NewBucket(b.s3, b.bucket)
 	b.log.Info("Starting S3 re-indexing")
 	start := time.Now()
 	max := 100
 	cnt := 0
 
-	if err := bucket.Iter(max, func(object *s3util.Object) error {
+	if err := remote.Iter(b.remote, "", max, func(object *remote.Object) error {
 		b.log.Debug("fetching an objects batch from S3")
 		ehash := object.Key
-		eblob := s3util.NewEncryptedBlob(object, b.key)
-		hash, err := eblob.PlainTextHash()
+		eblob := s3util.NewEncryptedBlob(b.remote, ehash, b.keyring)
+		hash, keyID, err := eblob.Header()
 		if err != nil {
 			return err
 		}
 		b.log.Debug("indexing plain-text hash", "hash", hash)
 
-		if err := b.index.Index(hash, ehash); err != nil {
+		if err := b.index.IndexWithKey(hash, ehash, keyID); err != nil {
 			return err
 		}
 
@@ -412,7 +514,7 @@ func (b *S3Backend) Reindex(restore bool) error {
 	b.log.Info("S3 scan done", "objects_downloaded_cnt", cnt, "duration", time.Since(start))
 	start = time.Now()
 	cnt = 0
-	out := make(chan *blobsfile.Blob)
+	out := make(chan *blob.SizedBlobRef)
 	errc := make(chan error, 1)
 	go func() {
 		errc <- b.backend.Enumerate(out, "", "\xff", 0)
@@ -454,95 +556,200 @@ L:
 			log.Debug("worker stopped")
 			break L
 		default:
-			b.uploadQueue.Lock()
-			// log.Debug("polling")
-			blb := &blob.Blob{}
-			ok, deqFunc, err := b.uploadQueue.Dequeue(blb)
+			// Outside of the upload windows, the blobs stay in the queue
+			if !b.canUpload() {
+				time.Sleep(1 * time.Second)
+				continue L
+			}
+			batch, err := b.nextUploadBatch()
 			if err != nil {
 				panic(err)
 			}
-			if !ok {
-				b.uploadQueue.Unlock()
+			if len(batch) == 0 {
+				// The pack uploads also wait for the flush to end
+				if atomic.LoadInt32(&b.pendingPacks) == 0 && atomic.CompareAndSwapInt32(&b.flushing, 1, 0) {
+					log.Info("upload queue flushed")
+				}
+				time.Sleep(1 * time.Second)
+				continue L
 			}
-			if ok {
-				if err := func(blob *blob.Blob) error {
-					t := time.Now()
-					defer b.uploadQueue.Unlock()
-					b.wg.Add(1)
-					defer b.wg.Done()
-
-					// Double check the blob does not exists
-					exists, err := b.index.Exists(blob.Hash)
-					if err != nil {
-						deqFunc(false)
-						return err
-					}
-					if exists {
-						log.Debug("blob already exist", "hash", blob.Hash)
-						deqFunc(true)
-						return nil
-					}
-
-					data, err := b.backend.Get(blob.Hash)
-					if err != nil {
-						deqFunc(false)
-						return err
-					}
-
-					if err := b.put(blob.Hash, data); err != nil {
-						deqFunc(false)
-						return err
-					}
-					deqFunc(true)
-					blobSize := uint64(len(data))
-					b.uploadedSinceStartup += blobSize
-					b.blobsUploadedSinceStartup++
-					log.Info("blob uploaded to s3", "hash", blob.Hash, "size", humanize.Bytes(blobSize), "duration", time.Since(t), "uploaded_since_startup", humanize.Bytes(b.uploadedSinceStartup))
-
-					return nil
-				}(blb); err != nil {
-					log.Error("failed to upload blob", "hash", blb.Hash, "err", err)
+			for _, qb := range batch {
+				select {
+				case <-b.stop:
+					log.Debug("worker stopped")
+					break L
+				default:
+				}
+				if !b.canUpload() {
+					continue L
+				}
+				if err := b.uploadQueued(log, qb); err != nil {
+					log.Error("failed to upload blob", "hash", qb.blob.Hash, "err", err)
+					uploadErrorsMetric.With(b.name, "blob").Inc()
 					time.Sleep(1 * time.Second)
+					continue L
 				}
-				continue L
 			}
-			time.Sleep(1 * time.Second)
-			continue L
 		}
 	}
 }
 
-func (b *S3Backend) put(hash string, data []byte) error {
-	// At this point, we're sure the blob does not exist remotely
+// uploadBatchSize is the maximum number of blobs copied out of the upload queue at once
+const uploadBatchSize = 100
 
-	ehash := hash
-	// Encrypt if requested
-	if b.encrypted {
-		var err error
-		data, err = s3util.Seal(b.key, &blob.Blob{Hash: hash, Data: data})
+// queuedBlob is a blob waiting in the upload queue
+type queuedBlob struct {
+	key  []byte
+	blob *blob.Blob
+}
+
+// nextUploadBatch returns the oldest blobs of the upload queue, without removing them (the lock is only held while
+// copying them, not during the uploads)
+func (b *S3Backend) nextUploadBatch() ([]*queuedBlob, error) {
+	b.uploadQueue.Lock()
+	defer b.uploadQueue.Unlock()
+	var batch []*queuedBlob
+	var cursor []byte
+	for len(batch) < uploadBatchSize {
+		blb := &blob.Blob{}
+		k, ok, err := b.uploadQueue.Next(cursor, blb)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if !ok {
+			break
 		}
-		// Re-compute the hash
-		ehash = hashutil.Compute(data)
+		batch = append(batch, &queuedBlob{key: k, blob: blb})
+		cursor = k
+	}
+	return batch, nil
+}
+
+// uploadQueued uploads a blob copied out of the upload queue, the upload queue lock is only held to index the blob
+// and remove it from the queue once uploaded
+func (b *S3Backend) uploadQueued(log log.Logger, qb *queuedBlob) error {
+	t := time.Now()
+	b.wg.Add(1)
+	defer b.wg.Done()
+	hash := qb.blob.Hash
+
+	// Double check the blob does not exists
+	exists, err := b.index.Exists(hash)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Debug("blob already exist", "hash", hash)
+		b.uploadQueue.Lock()
+		defer b.uploadQueue.Unlock()
+		return b.uploadQueue.Delete(qb.key)
 	}
 
-	// Prepare the upload request
-	params := &s3.PutObjectInput{
-		Bucket:   aws.String(b.bucket),
-		Key:      aws.String(ehash),
-		Body:     bytes.NewReader(data),
-		Metadata: map[string]*string{},
+	data, err := b.backend.Get(hash)
+	if err != nil {
+		return err
+	}
+	ehash, edata, keyID, err := b.seal(hash, data)
+	if err != nil {
+		return err
+	}
+	b.uploading.Store(ehash, true)
+	defer b.uploading.Delete(ehash)
+	if err := b.upload(ehash, bytes.NewReader(edata)); err != nil {
+		return err
+	}
+
+	b.uploadQueue.Lock()
+	// The blob may have been removed from the queue since (once included in an uploaded pack)
+	queued, err := b.uploadQueue.Contains(qb.key)
+	if err != nil {
+		b.uploadQueue.Unlock()
+		return err
+	}
+	if !queued {
+		b.uploadQueue.Unlock()
+		log.Debug("blob removed from the queue during the upload", "hash", hash)
+		return b.remote.Delete(ehash)
+	}
+	if err := b.index.IndexWithKey(hash, ehash, keyID); err != nil {
+		b.uploadQueue.Unlock()
+		return err
+	}
+	err = b.uploadQueue.Delete(qb.key)
+	b.uploadQueue.Unlock()
+	if err != nil {
+		return err
+	}
+
+	blobSize := uint64(len(data))
+	b.uploadedSinceStartup += blobSize
+	b.blobsUploadedSinceStartup++
+	uploadedMetric.With(b.name, "blob").Inc()
+	uploadedBytesMetric.With(b.name, "blob").Add(float64(blobSize))
+	log.Info("blob uploaded to s3", "hash", hash, "size", humanize.Bytes(blobSize), "duration", time.Since(t), "uploaded_since_startup", humanize.Bytes(b.uploadedSinceStartup))
+	return nil
+}
+
+// Flush uploads the queued blobs (and the pending packs) now, even outside of the upload windows
+func (b *S3Backend) Flush() {
+	b.log.Info("flush requested")
+	atomic.StoreInt32(&b.flushing, 1)
+}
+
+// canUpload returns true if the uploads are allowed right now
+func (b *S3Backend) canUpload() bool {
+	return atomic.LoadInt32(&b.flushing) == 1 || inWindows(b.windows, time.Now())
+}
+
+// waitUploadWindow blocks until the uploads are allowed, false is returned if the backend is closed in the meantime
+func (b *S3Backend) waitUploadWindow() bool {
+	for !b.canUpload() {
+		select {
+		case <-b.done:
+			return false
+		case <-time.After(1 * time.Second):
+		}
+	}
+	return true
+}
+
+// upload uploads the object to the remote, throttled if an upload rate is set
+func (b *S3Backend) upload(key string, src io.ReadSeeker) error {
+	if b.limiter != nil {
+		src = &throttledReader{r: src, l: b.limiter}
+	}
+	return b.remote.Upload(key, src)
+}
+
+// seal encrypts the blob (if requested), and returns the remote key, the data to upload and the ID of the key used
+func (b *S3Backend) seal(hash string, data []byte) (string, []byte, []byte, error) {
+	if !b.encrypted {
+		return hash, data, nil, nil
+	}
+	edata, err := s3util.Seal(b.keyring.Active(), &blob.Blob{Hash: hash, Data: data})
+	if err != nil {
+		return "", nil, nil, err
+	}
+	// Re-compute the hash
+	return hashutil.Compute(edata), edata, b.keyring.ActiveID(), nil
+}
+
+func (b *S3Backend) put(hash string, data []byte) error {
+	// At this point, we're sure the blob does not exist remotely
+
+	ehash, data, keyID, err := b.seal(hash, data)
+	if err != nil {
+		return err
 	}
 
 	// Actually upload the blob
-	if _, err := b.s3.PutObject(params); err != nil {
+	if err := b.upload(ehash, bytes.NewReader(data)); err != nil {
 		return err
 	}
 
 	// Save the hash in the local index
-	if err := b.index.Index(hash, ehash); err != nil {
-		return nil
+	if err := b.index.IndexWithKey(hash, ehash, keyID); err != nil {
+		return err
 	}
 
 	return nil
@@ -552,6 +759,12 @@ func (b *S3Backend) Indexed(hash string) (bool, error) {
 	return b.index.Exists(hash)
 }
 
+// IterIndexed calls `f` for each blob uploaded individually (the blobs only available in the uploaded packs are not
+// indexed)
+func (b *S3Backend) IterIndexed(f func(string) error) error {
+	return b.index.Iter(f)
+}
+
 func (b *S3Backend) Exists(hash string) (bool, error) {
 	return b.Indexed(hash)
 }
@@ -562,19 +775,30 @@ func (b *S3Backend) Get(hash string) ([]byte, error) {
 		return nil, err
 	}
 
-	obj := s3util.NewBucket(b.s3, b.bucket).GetObject(ehash)
-	eblob := s3util.NewEncryptedBlob(obj, b.key)
+	eblob := s3util.NewEncryptedBlob(b.remote, ehash, b.keyring)
 	fhash, data, err := eblob.HashAndPlainText()
+	if err != nil {
+		return nil, err
+	}
 	if fhash != hash {
 		return nil, fmt.Errorf("hash does not match")
 	}
+	// Also verify the decrypted content
+	if err := (&blob.Blob{Hash: hash, Data: data}).Check(); err != nil {
+		return nil, err
+	}
 
-	return data, err
+	return data, nil
 }
 
 func (b *S3Backend) Close() {
 	b.log.Debug("stopping workers")
+	close(b.done)
 	b.stop <- struct{}{}
+	if b.rotation != nil {
+		close(b.rotateStop)
+		<-b.rotateDone
+	}
 	b.log.Debug("waiting for waitgroup")
 	b.wg.Wait()
 	b.log.Debug("done")
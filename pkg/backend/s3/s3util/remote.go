@@ -0,0 +1,96 @@
+package s3util // import "a4.io/blobstash/pkg/backend/s3/s3util"
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"a4.io/blobstash/pkg/backend/remote"
+)
+
+// Remote is the S3 implementation of `remote.Backend`
+type Remote struct {
+	bucket *Bucket
+
+	// Used to upload/download the BlobsFile packs
+	uploader   *s3manager.Uploader
+	downloader *s3manager.Downloader
+}
+
+// NewRemote returns a remote backend for the given bucket (that is created if it does not exist)
+func NewRemote(sess *session.Session, bucket string) (*Remote, error) {
+	b := NewBucket(s3.New(sess), bucket)
+	ok, err := b.Exists()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err := b.Create(); err != nil {
+			return nil, err
+		}
+	}
+	return &Remote{
+		bucket:     b,
+		uploader:   s3manager.NewUploader(sess),
+		downloader: s3manager.NewDownloader(sess),
+	}, nil
+}
+
+func (r *Remote) String() string {
+	return fmt.Sprintf("s3-%s", r.bucket.Name)
+}
+
+// Upload uploads the object (with extra retries)
+func (r *Remote) Upload(key string, src io.ReadSeeker) error {
+	var err error
+	for i := 0; i < 3; i++ {
+		if _, err = src.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = r.uploader.Upload(&s3manager.UploadInput{
+			Bucket: aws.String(r.bucket.Name),
+			Key:    aws.String(key),
+			Body:   src,
+		}); err == nil || !request.IsErrorRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (r *Remote) Download(key string, dst io.WriterAt) error {
+	_, err := r.downloader.Download(dst, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket.Name),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (r *Remote) Reader(key string, size int64) (io.ReadCloser, error) {
+	return r.bucket.GetObject(key).reader(size)
+}
+
+func (r *Remote) List(prefix, marker string, max int) ([]*remote.Object, error) {
+	objects, err := r.bucket.ListPrefix(prefix, marker, max)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*remote.Object, 0, len(objects))
+	for _, o := range objects {
+		out = append(out, &remote.Object{Key: o.Key, Size: o.Size, ModTime: o.LastModified})
+	}
+	return out, nil
+}
+
+func (r *Remote) Exists(key string) (bool, error) {
+	return r.bucket.GetObject(key).Exists()
+}
+
+func (r *Remote) Delete(key string) error {
+	return r.bucket.GetObject(key).Delete()
+}
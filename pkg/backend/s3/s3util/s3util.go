@@ -15,8 +15,12 @@ import (
 	"io"
 	"io/ioutil"
 	"strings"
+	"time"
 
+	"a4.io/blobstash/pkg/backend/remote"
 	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/crypto"
+	"a4.io/blobstash/pkg/hashutil"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -40,26 +44,19 @@ const (
 
 const (
 	versionFlag byte = 1 << iota
+	// Set along with the version flag when the plain-text ref is a SHA-256 hash (BLAKE2b-256 otherwise)
+	sha256Flag
+	// Set along with the version flag when the key ID follows the "data blob" flag
+	keyIDFlag
 )
 
+// HeaderSize is the size of the sealed blob header, enough to read the plain-text hash and the key ID
+const HeaderSize = 21 + 32 + 2 + crypto.KeyIDLength
+
 var (
 	blobHeader = []byte("#blobstash/secretbox\n")
 )
 
-// nextKey returns the next key for lexigraphical (key = NextKey(lastkey))
-func nextKey(key string) string {
-	bkey := []byte(key)
-	i := len(bkey)
-	for i > 0 {
-		i--
-		bkey[i]++
-		if bkey[i] != 0 {
-			break
-		}
-	}
-	return string(bkey)
-}
-
 func New(region string) (*session.Session, error) {
 	return session.NewSessionWithOptions(session.Options{
 		Config: aws.Config{
@@ -152,10 +149,11 @@ func (b *Bucket) ListPrefix(prefix, marker string, max int) ([]*Object, error) {
 			continue
 		}
 		out = append(out, &Object{
-			s3:     b.s3,
-			Key:    *item.Key,
-			Bucket: b.Name,
-			Size:   *item.Size,
+			s3:           b.s3,
+			Key:          *item.Key,
+			Bucket:       b.Name,
+			Size:         *item.Size,
+			LastModified: aws.TimeValue(item.LastModified),
 		})
 	}
 	return out, nil
@@ -180,43 +178,22 @@ func (b *Bucket) List(marker string, max int) ([]*Object, error) {
 			continue
 		}
 		out = append(out, &Object{
-			s3:     b.s3,
-			Key:    *item.Key,
-			Bucket: b.Name,
-			Size:   *item.Size,
+			s3:           b.s3,
+			Key:          *item.Key,
+			Bucket:       b.Name,
+			Size:         *item.Size,
+			LastModified: aws.TimeValue(item.LastModified),
 		})
 	}
 	return out, nil
 }
 
-func (b *Bucket) Iter(max int, f func(*Object) error) error {
-	var marker string
-	for {
-		objects, err := b.List(marker, max)
-		if err != nil {
-			return err
-		}
-
-		if len(objects) == 0 {
-			break
-		}
-
-		for _, object := range objects {
-			if err := f(object); err != nil {
-				return err
-			}
-			marker = nextKey(object.Key)
-		}
-	}
-
-	return nil
-}
-
 type Object struct {
-	Key    string
-	Bucket string
-	Size   int64
-	s3     *s3.S3
+	Key          string
+	Bucket       string
+	Size         int64
+	LastModified time.Time
+	s3           *s3.S3
 }
 
 func (o *Object) Delete() error {
@@ -283,17 +260,19 @@ func (o *Object) reader(size int64) (io.ReadCloser, error) {
 	return resp.Body, nil
 }
 
+// EncryptedBlob is a sealed blob stored in a remote backend
 type EncryptedBlob struct {
-	o   *Object
-	key *[32]byte
+	back    remote.Backend
+	objKey  string
+	keyring *crypto.Keyring
 }
 
-func NewEncryptedBlob(o *Object, key *[32]byte) *EncryptedBlob {
-	return &EncryptedBlob{o: o, key: key}
+func NewEncryptedBlob(back remote.Backend, objKey string, keyring *crypto.Keyring) *EncryptedBlob {
+	return &EncryptedBlob{back: back, objKey: objKey, keyring: keyring}
 }
 
 func (b *EncryptedBlob) PlainText() ([]byte, error) {
-	r, err := b.o.Reader()
+	r, err := b.back.Reader(b.objKey, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -303,11 +282,11 @@ func (b *EncryptedBlob) PlainText() ([]byte, error) {
 		return nil, err
 	}
 
-	if !bytes.Equal(blobHeader, data[0:21]) {
-		return nil, fmt.Errorf("missing header (\"%s\")", data[0:21])
+	if err := checkHeader(data); err != nil {
+		return nil, err
 	}
 
-	decoded, err := Open(b.key, data)
+	decoded, err := Open(b.keyring, data)
 	if err != nil {
 		return nil, err
 	}
@@ -316,7 +295,7 @@ func (b *EncryptedBlob) PlainText() ([]byte, error) {
 }
 
 func (b *EncryptedBlob) HashAndPlainText() (string, []byte, error) {
-	r, err := b.o.Reader()
+	r, err := b.back.Reader(b.objKey, 0)
 	if err != nil {
 		return "", nil, err
 	}
@@ -326,53 +305,91 @@ func (b *EncryptedBlob) HashAndPlainText() (string, []byte, error) {
 		return "", nil, err
 	}
 
-	if !bytes.Equal(blobHeader, data[0:21]) {
-		return "", nil, fmt.Errorf("missing header (\"%s\")", data[0:21])
+	if err := checkHeader(data); err != nil {
+		return "", nil, err
 	}
 
-	decoded, err := Open(b.key, data)
+	decoded, err := Open(b.keyring, data)
 	if err != nil {
 		return "", nil, err
 	}
 
-	return hex.EncodeToString(data[21:53]), decoded, nil
+	return plainTextRef(data), decoded, nil
+}
+
+func checkHeader(data []byte) error {
+	if len(data) < len(blobHeader)+32+2 {
+		return fmt.Errorf("truncated header (%d bytes)", len(data))
+	}
+	if !bytes.Equal(blobHeader, data[0:21]) {
+		return fmt.Errorf("missing header (\"%s\")", data[0:21])
+	}
+	return nil
+}
+
+// plainTextRef returns the ref of the plain-text blob from the sealed blob header
+func plainTextRef(data []byte) string {
+	if data[53]&sha256Flag != 0 {
+		return hashutil.Ref(hashutil.SHA256, data[21:53])
+	}
+	return hex.EncodeToString(data[21:53])
+}
+
+// keyID returns the ID of the key used to seal the blob (nil if the blob was sealed before the key IDs were
+// introduced)
+func keyID(data []byte) []byte {
+	if data[53]&keyIDFlag == 0 {
+		return nil
+	}
+	return data[55 : 55+crypto.KeyIDLength]
 }
 
 func (b *EncryptedBlob) PlainTextHash() (string, error) {
-	r, err := b.o.Peeker(53)
-	defer r.Close()
+	hash, _, err := b.Header()
+	return hash, err
+}
+
+// Header returns the plain-text hash and the ID of the key used to seal the blob
+func (b *EncryptedBlob) Header() (string, []byte, error) {
+	r, err := b.back.Reader(b.objKey, HeaderSize)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
+	defer r.Close()
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	if !bytes.Equal(blobHeader, data[0:21]) {
-		return "", fmt.Errorf("missing header (\"%s\")", data[0:21])
+	if err := checkHeader(data); err != nil {
+		return "", nil, err
 	}
 
-	return hex.EncodeToString(data[21:53]), nil
+	return plainTextRef(data), keyID(data), nil
 }
 
-// Seal the data with the key derived from `password` (using scrypt) and seal the data with nacl/secretbox
+// Seal the data with nacl/secretbox, the ID of the key is stored in the header
 func Seal(nkey *[32]byte, blb *blob.Blob) ([]byte, error) {
 	// FIXME(tsileo): store a flag for "data blobs"
 	nonce := new([nonceLength]byte)
 	if _, err := rand.Reader.Read(nonce[:]); err != nil {
 		return nil, err
 	}
-	bhash, err := hex.DecodeString(blb.Hash)
+	// Only the raw digest is stored, the algorithm is stored along with the version flag
+	algo, bhash, err := hashutil.Digest(blb.Hash)
 	if err != nil {
 		return nil, err
 	}
-	// Box will contains our meta data (alg byte + salt + nonce + flag)
-	box := make([]byte, nonceLength+len(blobHeader)+len(bhash)+2)
+	version := versionFlag | keyIDFlag
+	if algo == hashutil.SHA256 {
+		version |= sha256Flag
+	}
+	// Box will contains our meta data (header + hash + version + flag + key ID + nonce)
+	box := make([]byte, nonceLength+len(blobHeader)+len(bhash)+2+crypto.KeyIDLength)
 	copy(box[:], blobHeader)
 	copy(box[len(blobHeader):], bhash)
 	// Add the version flag
-	copy(box[len(blobHeader)+len(bhash):], []byte{versionFlag})
+	copy(box[len(blobHeader)+len(bhash):], []byte{version})
 
 	// Add the "data blob" flag
 	flag := []byte{0}
@@ -381,24 +398,40 @@ func Seal(nkey *[32]byte, blb *blob.Blob) ([]byte, error) {
 	}
 
 	copy(box[len(blobHeader)+len(bhash)+1:], flag)
+	// The key ID
+	copy(box[len(blobHeader)+len(bhash)+2:], crypto.KeyID(nkey))
 	// And the nonce
-	copy(box[len(blobHeader)+len(bhash)+2:], nonce[:])
+	copy(box[len(blobHeader)+len(bhash)+2+crypto.KeyIDLength:], nonce[:])
 	return secretbox.Seal(box, blb.Data, nonce, nkey), nil
 }
 
-// Open a previously sealed secretbox with the key derived from `password` (using scrypt)
-func Open(nkey *[32]byte, data []byte) ([]byte, error) {
+// Open a previously sealed secretbox with the key from the keyring it was sealed with (all the keys are tried for the
+// blobs sealed before the key IDs were introduced)
+func Open(keyring *crypto.Keyring, data []byte) ([]byte, error) {
+	start := len(blobHeader) + 32 + 2
+	keys := keyring.Keys()
+	if id := keyID(data); id != nil {
+		key, ok := keyring.Key(id)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", crypto.ErrUnknownKey, crypto.FormatKeyID(id))
+		}
+		keys = []*[32]byte{key}
+		start += crypto.KeyIDLength
+	}
+	if len(data) < start+nonceLength {
+		return nil, fmt.Errorf("truncated blob (%d bytes)", len(data))
+	}
 	// Extract the nonce
 	nonce := new([nonceLength]byte)
-	copy(nonce[:], data[len(blobHeader)+32+2:len(blobHeader)+32+2+nonceLength])
-	box := data[nonceLength+32+2+len(blobHeader):]
+	copy(nonce[:], data[start:start+nonceLength])
+	box := data[start+nonceLength:]
 	// Actually decrypt the cipher text
-	decrypted, success := secretbox.Open(nil, box, nonce, nkey)
-
-	// Ensure the decryption succeed
-	if !success {
-		return nil, errors.New("failed to decrypt file (bad password?)")
+	for _, nkey := range keys {
+		if decrypted, success := secretbox.Open(nil, box, nonce, nkey); success {
+			return decrypted, nil
+		}
 	}
 
-	return decrypted, nil
+	// Ensure the decryption succeed
+	return nil, errors.New("failed to decrypt file (bad password?)")
 }
@@ -0,0 +1,93 @@
+package s3 // import "a4.io/blobstash/pkg/backend/s3"
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// limiter caps the upload rate of a target (shared by the blobs and the packs uploads)
+type limiter struct {
+	mu   sync.Mutex
+	rate int64 // bytes per second
+
+	// Time at which the bytes read so far would have been sent at the max rate
+	next time.Time
+}
+
+// wait blocks until the `n` bytes can be sent without exceeding the rate
+func (l *limiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// throttledReader limits the read rate (and thus the upload rate) of the underlying reader
+type throttledReader struct {
+	r io.ReadSeeker
+	l *limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Keep the reads small to smooth the rate
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.l.wait(n)
+	}
+	return n, err
+}
+
+func (t *throttledReader) Seek(offset int64, whence int) (int64, error) {
+	return t.r.Seek(offset, whence)
+}
+
+// window is a time-of-day window (in minutes since midnight, the end is excluded)
+type window struct {
+	start, end int
+}
+
+func parseWindows(windows []string) ([]*window, error) {
+	out := []*window{}
+	for _, w := range windows {
+		var sh, sm, eh, em int
+		if _, err := fmt.Sscanf(w, "%d:%d-%d:%d", &sh, &sm, &eh, &em); err != nil {
+			return nil, fmt.Errorf("invalid upload window %q (expected \"HH:MM-HH:MM\")", w)
+		}
+		if sh < 0 || sh > 23 || eh < 0 || eh > 23 || sm < 0 || sm > 59 || em < 0 || em > 59 {
+			return nil, fmt.Errorf("invalid upload window %q", w)
+		}
+		out = append(out, &window{start: sh*60 + sm, end: eh*60 + em})
+	}
+	return out, nil
+}
+
+// inWindows returns true if `t` is in one of the windows (always true if there is no windows)
+func inWindows(windows []*window, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range windows {
+		if w.start <= w.end {
+			if m >= w.start && m < w.end {
+				return true
+			}
+			continue
+		}
+		// The window spans midnight (e.g. "22:00-06:00")
+		if m >= w.start || m < w.end {
+			return true
+		}
+	}
+	return false
+}
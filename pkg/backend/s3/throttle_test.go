@@ -0,0 +1,57 @@
+package s3
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestUploadWindows(t *testing.T) {
+	windows, err := parseWindows([]string{"01:00-07:30", "22:00-00:30"})
+	if err != nil {
+		panic(err)
+	}
+	for hm, expected := range map[string]bool{
+		"00:59": false,
+		"01:00": true,
+		"07:29": true,
+		"07:30": false,
+		"12:00": false,
+		"22:00": true,
+		"23:59": true,
+		"00:15": true,
+	} {
+		tm, err := time.Parse("15:04", hm)
+		if err != nil {
+			panic(err)
+		}
+		if inWindows(windows, tm) != expected {
+			t.Errorf("%s in windows should be %v", hm, expected)
+		}
+	}
+	if !inWindows(nil, time.Now()) {
+		t.Errorf("no windows means always")
+	}
+	for _, invalid := range []string{"1am-2am", "25:00-01:00", "22:00-24:00", "01:00"} {
+		if _, err := parseWindows([]string{invalid}); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	data := make([]byte, 64*1024)
+	start := time.Now()
+	out, err := ioutil.ReadAll(&throttledReader{r: bytes.NewReader(data), l: &limiter{rate: 256 * 1024}})
+	if err != nil {
+		panic(err)
+	}
+	if len(out) != len(data) {
+		t.Errorf("short read %d", len(out))
+	}
+	// 64KB at 256KB/s
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("read too fast (%v)", d)
+	}
+}
@@ -2,7 +2,9 @@ package blob // import "a4.io/blobstash/pkg/blob"
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 
 	"a4.io/blobstash/pkg/hashutil"
 )
@@ -13,6 +15,12 @@ var (
 	// FIXME(tsileo): #blobstash/doc\n header
 )
 
+// MaxSize is the maximum size of a blob read by `ReadVerified`
+var MaxSize = 64 << 20 // 64MB
+
+// ErrHashMismatch is returned when the blob content does not match its hash
+var ErrHashMismatch = errors.New("hash mismatch")
+
 // SizedBlobRef holds a blob hash and its size
 type SizedBlobRef struct {
 	Hash string `json:"hash"`
@@ -40,15 +48,27 @@ func New(data []byte) *Blob {
 	}
 }
 
-// Check ensures the hash match the data
+// Check ensures the hash match the data, the hash is computed with the algorithm of the ref (so blobs hashed with
+// any of the supported algorithms can be checked)
 func (b *Blob) Check() error {
-	chash := hashutil.Compute(b.Data)
+	chash, err := hashutil.ComputeLike(b.Hash, b.Data)
+	if err != nil {
+		return err
+	}
 	if b.Hash != chash {
 		return fmt.Errorf("Hash mismatch: given=%s, computed=%v", b.Hash, chash)
 	}
 	return nil
 }
 
+// Rehash returns a copy of the blob hashed with the given algorithm (used to migrate blobs to another algorithm)
+func (b *Blob) Rehash(algo string) (*Blob, error) {
+	if _, err := hashutil.NewHash(algo); err != nil {
+		return nil, err
+	}
+	return &Blob{Hash: hashutil.ComputeWith(algo, b.Data), Data: b.Data}, nil
+}
+
 // IsMeta returns true if the blob contains "meta blob (an encoded internal data)
 func (b *Blob) IsMeta() bool {
 	if len(b.Data) < len(metaHeader) {
@@ -70,3 +90,28 @@ func (b *Blob) IsFiletreeNode() bool {
 	}
 	return false
 }
+
+// ReadVerified reads a blob from the given reader, the hash is computed while reading and an error is returned if it
+// does not match the expected hash
+func ReadVerified(hash string, r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	algo, err := hashutil.AlgorithmOf(hash)
+	if err != nil {
+		return nil, err
+	}
+	h, err := hashutil.NewHash(algo)
+	if err != nil {
+		return nil, err
+	}
+	n, err := buf.ReadFrom(io.TeeReader(io.LimitReader(r, int64(MaxSize)+1), h))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(MaxSize) {
+		return nil, fmt.Errorf("blob too big (max size is %d bytes)", MaxSize)
+	}
+	if chash := hashutil.Ref(algo, h.Sum(nil)); chash != hash {
+		return nil, fmt.Errorf("%w: given=%s, computed=%v", ErrHashMismatch, hash, chash)
+	}
+	return buf.Bytes(), nil
+}
@@ -1,7 +1,8 @@
 package api // import "a4.io/blobstash/pkg/blobstore/api"
 
 import (
-	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 
@@ -9,12 +10,14 @@ import (
 
 	"a4.io/blobsfile"
 	"a4.io/blobstash/pkg/auth"
-	mblob "a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
 	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/usage"
 )
 
 type BlobStoreAPI struct {
@@ -29,6 +32,7 @@ func (bs *BlobStoreAPI) Register(r *mux.Router, basicAuth func(http.Handler) htt
 	r.Handle("/blobs", basicAuth(http.HandlerFunc(bs.enumerateHandler())))
 	r.Handle("/upload", basicAuth(http.HandlerFunc(bs.uploadHandler())))
 	r.Handle("/blob/{hash}", basicAuth(http.HandlerFunc(bs.blobHandler())))
+	r.Handle("/_rehash", basicAuth(http.HandlerFunc(bs.rehashHandler())))
 }
 
 func (bs *BlobStoreAPI) uploadHandler() func(http.ResponseWriter, *http.Request) {
@@ -77,19 +81,11 @@ func (bs *BlobStoreAPI) uploadHandler() func(http.ResponseWriter, *http.Request)
 					return
 				}
 				hash := part.FormName()
-				var buf bytes.Buffer
-				buf.ReadFrom(part)
-				blob := buf.Bytes()
-				// FIXME(tsileo): should we do the check here? or let the storage engine do it
-				chash := hashutil.Compute(blob)
-				if hash != chash {
-					httputil.WriteJSONError(w, http.StatusInternalServerError, "blob corrupted, hash does not match, expected "+chash)
+				// The blob is hashed while being read, and rejected if the hash does not match
+				if _, err := bs.bs.PutReader(ctx, hash, part); err != nil {
+					httputil.WriteJSONError(w, putErrorStatus(err), err.Error())
 					return
 				}
-				b := &mblob.Blob{Hash: hash, Data: blob}
-				if _, err := bs.bs.Put(ctx, b); err != nil {
-					httputil.WriteJSONError(w, http.StatusInternalServerError, err.Error())
-				}
 			}
 			// XXX(tsileo): returns a `http.StatusNoContent` here?
 		default:
@@ -113,9 +109,7 @@ func (bs *BlobStoreAPI) blobHandler() func(http.ResponseWriter, *http.Request) {
 				auth.Forbidden(w)
 				return
 			}
-			// FIXME(tsileo): clean this case, skip a decoding/encoding round and return the bytes as is from the
-			// backend storage
-			blob, err := bs.bs.Get(ctx, vars["hash"])
+			blob, size, err := bs.bs.GetReader(ctx, vars["hash"])
 			if err != nil {
 				if err == blobsfile.ErrBlobNotFound {
 					httputil.WriteJSONError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
@@ -124,7 +118,11 @@ func (bs *BlobStoreAPI) blobHandler() func(http.ResponseWriter, *http.Request) {
 				}
 				return
 			}
-			httputil.Write(r, w, blob)
+			defer blob.Close()
+			if algo, err := hashutil.AlgorithmOf(vars["hash"]); err == nil {
+				w.Header().Set("BlobStash-Hash-Algorithm", algo)
+			}
+			httputil.WriteReader(r, w, blob, size)
 			return
 		case "HEAD":
 			if !auth.Can(
@@ -158,25 +156,19 @@ func (bs *BlobStoreAPI) blobHandler() func(http.ResponseWriter, *http.Request) {
 				return
 			}
 
-			blob, err := httputil.Read(r)
+			body, err := httputil.Reader(r)
 			if err != nil {
 				httputil.Error(w, err)
 				return
 			}
 
-			// FIXME(tsileo): should we do the check here? or let the storage engine do it
+			// The blob is hashed while being read, and rejected if the hash does not match
 			// XXX(tsileo): if the blob is already snappy encoded, find a way to skip the extra decoding/encoding like for GET
-			chash := hashutil.Compute(blob)
-			if vars["hash"] != chash {
-				httputil.WriteJSONError(w, http.StatusInternalServerError, "blob corrupted, hash does not match, expected "+chash)
+			if _, err := bs.bs.PutReader(ctx, vars["hash"], body); err != nil {
+				httputil.WriteJSONError(w, putErrorStatus(err), err.Error())
 				return
 			}
 
-			b := &mblob.Blob{Hash: vars["hash"], Data: blob}
-			if _, err := bs.bs.Put(ctx, b); err != nil {
-				httputil.WriteJSONError(w, http.StatusInternalServerError, err.Error())
-			}
-
 			w.WriteHeader(http.StatusCreated)
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -208,7 +200,15 @@ func (bs *BlobStoreAPI) enumerateHandler() func(http.ResponseWriter, *http.Reque
 			// if sscan := r.URL.Query().Get("scan"); sscan != "" {
 			// 	scan = true
 			// }
-			refs, nextCursor, err := bs.bs.Enumerate(ctx, q.Get("cursor"), "\xff", limit)
+			// Optional kind filter
+			kind := q.Get("type")
+			if kind != "" {
+				if err := blobstore.ValidKind(kind); err != nil {
+					httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+			}
+			refs, nextCursor, err := bs.bs.EnumerateKind(ctx, kind, q.Get("cursor"), "\xff", limit)
 			if err != nil {
 				httputil.Error(w, err)
 				return
@@ -229,3 +229,89 @@ func (bs *BlobStoreAPI) enumerateHandler() func(http.ResponseWriter, *http.Reque
 		}
 	}
 }
+
+// putErrorStatus returns the status code for a failed blob upload
+func putErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, hashutil.ErrUnknownAlgorithm), errors.Is(err, blob.ErrHashMismatch):
+		return http.StatusBadRequest
+	case errors.Is(err, blobstore.ErrUnsupportedRef):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, usage.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type rehashRequest struct {
+	Refs      []string `json:"refs"`
+	Algorithm string   `json:"algorithm"`
+}
+
+// rehashHandler is the migration path to another hash algorithm: the given blobs are re-saved under the ref computed
+// with the requested algorithm, and the mapping old ref => new ref is returned.
+//
+// The references to the old refs (kv entries, filetree nodes, documents...) are not updated, the old blobs are kept
+// so they stay valid, and it's up to the client to write new versions pointing to the new refs.
+func (bs *BlobStoreAPI) rehashHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+
+		req := &rehashRequest{}
+		if err := httputil.Unmarshal(r, req); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Algorithm == "" {
+			req.Algorithm = hashutil.Algorithm()
+		}
+		if _, err := hashutil.NewHash(req.Algorithm); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		refs := map[string]string{}
+		for _, ref := range req.Refs {
+			data, err := bs.bs.Get(ctx, ref)
+			if err != nil {
+				if err == blobsfile.ErrBlobNotFound {
+					httputil.WriteJSONError(w, http.StatusNotFound, fmt.Sprintf("blob %s not found", ref))
+					return
+				}
+				panic(err)
+			}
+			nblob, err := (&blob.Blob{Hash: ref, Data: data}).Rehash(req.Algorithm)
+			if err != nil {
+				panic(err)
+			}
+			if nblob.Hash != ref {
+				if _, err := bs.bs.Put(ctx, nblob); err != nil {
+					httputil.WriteJSONError(w, putErrorStatus(err), err.Error())
+					return
+				}
+			}
+			refs[ref] = nblob.Hash
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": map[string]interface{}{
+				"algorithm": req.Algorithm,
+				"refs":      refs,
+			},
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestRehash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_blobstore_api_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	// The default BlobsFile storage engine can mix the hash algorithms
+	bs, err := blobstore.New(logger, false, dir, &config.Config{}, hub.New(logger, true))
+	if err != nil {
+		panic(err)
+	}
+	defer bs.Close()
+	ctx := context.Background()
+
+	data := []byte("hello")
+	old := &blob.Blob{Hash: hashutil.ComputeWith(hashutil.BLAKE2b256, data), Data: data}
+	if _, err := bs.Put(ctx, old); err != nil {
+		panic(err)
+	}
+
+	r := mux.NewRouter()
+	New(bs).Register(r, func(h http.Handler) http.Handler { return h })
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	js, err := json.Marshal(&rehashRequest{Refs: []string{old.Hash}, Algorithm: hashutil.SHA256})
+	if err != nil {
+		panic(err)
+	}
+	resp, err := http.Post(server.URL+"/_rehash", "application/json", bytes.NewReader(js))
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	out := &struct {
+		Data struct {
+			Algorithm string            `json:"algorithm"`
+			Refs      map[string]string `json:"refs"`
+		} `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		panic(err)
+	}
+	newRef := out.Data.Refs[old.Hash]
+	if newRef != hashutil.ComputeWith(hashutil.SHA256, data) {
+		t.Errorf("unexpected new ref %q", newRef)
+	}
+
+	// The new blob is saved, and the old one is kept as the references to it are not updated
+	for _, ref := range []string{old.Hash, newRef} {
+		got, err := bs.Get(ctx, ref)
+		if err != nil {
+			t.Errorf("failed to get %s: %v", ref, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("bad data for %s", ref)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package audit // import "a4.io/blobstash/pkg/blobstore/audit"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/backend/s3"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// ErrInProgress is returned when an audit is already running
+var ErrInProgress = fmt.Errorf("an audit is already in progress")
+
+// DefaultSampleSize is the number of packs and blobs (per target) decrypted by default
+const DefaultSampleSize = 20
+
+// Report holds the result of the last (or current) audit
+type Report struct {
+	Running    bool   `json:"running"`
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	Requeue    bool                       `json:"requeue"`
+	Consistent bool                       `json:"consistent"`
+	Targets    map[string]*s3.AuditResult `json:"targets"`
+
+	// Time of the last audit that completed without finding any issue (carried over from the previous reports)
+	LastSuccessAt string `json:"last_success_at,omitempty"`
+}
+
+// Auditor checks that the replication targets match the local state
+type Auditor struct {
+	bs *blobstore.BlobStore
+
+	// Path of the persisted report
+	path string
+
+	report  *Report
+	running bool
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+
+	log log.Logger
+}
+
+// New initializes the auditor and loads the last report
+func New(logger log.Logger, conf *config.Config, bs *blobstore.BlobStore) (*Auditor, error) {
+	logger.Debug("init")
+	a := &Auditor{
+		bs:   bs,
+		path: filepath.Join(conf.VarDir(), "s3-audit.json"),
+		log:  logger,
+	}
+
+	// Load the last report
+	data, err := ioutil.ReadFile(a.path)
+	switch {
+	case err == nil:
+		a.report = &Report{}
+		if err := json.Unmarshal(data, a.report); err != nil {
+			return nil, fmt.Errorf("failed to load audit report: %v", err)
+		}
+		// The server was stopped during the audit
+		a.report.Running = false
+	case os.IsNotExist(err):
+	default:
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Register the admin endpoint
+func (a *Auditor) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/_s3_audit", basicAuth(http.HandlerFunc(a.auditHandler())))
+}
+
+// Close waits for the current audit to finish
+func (a *Auditor) Close() error {
+	a.wg.Wait()
+	return nil
+}
+
+// Report returns a copy of the last (or current) report
+func (a *Auditor) Report() *Report {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.report == nil {
+		return nil
+	}
+	report := *a.report
+	report.Targets = map[string]*s3.AuditResult{}
+	for name, res := range a.report.Targets {
+		report.Targets[name] = res
+	}
+	return &report
+}
+
+// Trigger starts an audit in the background
+func (a *Auditor) Trigger(requeue bool, sample int) error {
+	if !a.start() {
+		return ErrInProgress
+	}
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		if _, err := a.run(requeue, sample); err != nil {
+			a.log.Error("audit failed", "err", err)
+		}
+	}()
+	return nil
+}
+
+// start marks the audit as running, returns false if an audit is already running
+func (a *Auditor) start() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running {
+		return false
+	}
+	a.running = true
+	return true
+}
+
+// save persists the current report, must be called with the lock held
+func (a *Auditor) save() error {
+	data, err := json.Marshal(a.report)
+	if err != nil {
+		return err
+	}
+	tmpPath := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, a.path)
+}
+
+// Audit compares every replication target with the local state, and optionally uploads the missing packs and blobs
+// again
+func (a *Auditor) Audit(requeue bool, sample int) (*Report, error) {
+	if !a.start() {
+		return nil, ErrInProgress
+	}
+	return a.run(requeue, sample)
+}
+
+// run performs the audit, must be called after `start`
+func (a *Auditor) run(requeue bool, sample int) (*Report, error) {
+	a.mu.Lock()
+	start := time.Now()
+	report := &Report{
+		Running:   true,
+		StartedAt: start.Format(time.RFC3339),
+		Requeue:   requeue,
+		Targets:   map[string]*s3.AuditResult{},
+	}
+	if a.report != nil {
+		report.LastSuccessAt = a.report.LastSuccessAt
+	}
+	a.report = report
+	a.mu.Unlock()
+	a.log.Info("audit started", "requeue", requeue, "sample", sample)
+
+	consistent, err := a.audit(report, requeue, sample)
+
+	a.mu.Lock()
+	a.running = false
+	report.Running = false
+	report.FinishedAt = time.Now().Format(time.RFC3339)
+	if err != nil {
+		report.Error = err.Error()
+	} else {
+		report.Consistent = consistent
+		if consistent {
+			report.LastSuccessAt = report.FinishedAt
+		}
+	}
+	a.log.Info("audit done", "consistent", report.Consistent, "err", err, "duration", time.Since(start))
+	serr := a.save()
+	a.mu.Unlock()
+	if serr != nil {
+		return nil, serr
+	}
+	return a.Report(), err
+}
+
+func (a *Auditor) audit(report *Report, requeue bool, sample int) (bool, error) {
+	s3backs := a.bs.S3Backends()
+	if len(s3backs) == 0 {
+		return false, blobstore.ErrRemoteNotAvailable
+	}
+	consistent := true
+	sealedPacks := a.bs.SealedPacks()
+	for _, s3back := range s3backs {
+		res, err := s3back.Audit(sealedPacks, sample)
+		if err != nil {
+			return false, fmt.Errorf("target %q: %w", s3back.Name(), err)
+		}
+		a.log.Info("target audited", "target", s3back.Name(), "consistent", res.Consistent(),
+			"missing_packs", len(res.MissingPacks), "extra_packs", len(res.ExtraPacks),
+			"missing_blobs", len(res.MissingBlobs), "extra_objects", len(res.ExtraObjects),
+			"undecryptable", len(res.Undecryptable))
+		for _, issue := range res.Undecryptable {
+			a.log.Warn("undecryptable object", "target", s3back.Name(), "key", issue.Key, "err", issue.Error)
+		}
+		if !res.Consistent() {
+			consistent = false
+		}
+		if requeue {
+			cnt, err := s3back.Requeue(res)
+			if err != nil {
+				return false, fmt.Errorf("target %q: failed to requeue: %w", s3back.Name(), err)
+			}
+			a.log.Info("missing items requeued", "target", s3back.Name(), "requeued", cnt)
+		}
+		a.mu.Lock()
+		report.Targets[s3back.Name()] = res
+		a.mu.Unlock()
+	}
+	return consistent, nil
+}
+
+func (a *Auditor) auditHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": a.Report(),
+			})
+		case "POST":
+			if !a.bs.ReplicationEnabled() {
+				httputil.WriteJSONError(w, http.StatusNotFound, blobstore.ErrRemoteNotAvailable.Error())
+				return
+			}
+			q := httputil.NewQuery(r.URL.Query())
+			requeue, err := q.GetBoolDefault("requeue", false)
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			sample, err := q.GetIntDefault("sample", DefaultSampleSize)
+			if err != nil || sample < 0 {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "invalid sample size")
+				return
+			}
+			if err := a.Trigger(requeue, sample); err != nil {
+				if err == ErrInProgress {
+					httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+					return
+				}
+				panic(err)
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
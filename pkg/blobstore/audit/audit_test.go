@@ -0,0 +1,154 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/backend/remote"
+	"a4.io/blobstash/pkg/backend/s3/s3util"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func waitIndexed(bs *blobstore.BlobStore, hashes []string) {
+	for i := 0; i < 100; i++ {
+		ok := true
+		for _, hash := range hashes {
+			indexed, err := bs.S3Backends()[0].Indexed(hash)
+			if err != nil {
+				panic(err)
+			}
+			ok = ok && indexed
+		}
+		if ok {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	panic("blobs not uploaded")
+}
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_audit_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	remoteDir := filepath.Join(dir, "remote")
+	if err := os.MkdirAll(remoteDir, 0700); err != nil {
+		panic(err)
+	}
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("6368616e676520746869732070617373"), 0600); err != nil {
+		panic(err)
+	}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{
+		DataDir:       dir,
+		StorageEngine: blobstore.DirEngine,
+		S3Repls:       config.S3Repls{&config.S3Repl{Dir: remoteDir, KeyFile: keyFile}},
+	}
+	bs, err := blobstore.New(logger, true, dir, conf, hub.New(logger, true))
+	if err != nil {
+		panic(err)
+	}
+	defer bs.Close()
+
+	hashes := []string{}
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("hello%d", i))
+		b := &blob.Blob{Hash: hashutil.Compute(data), Data: data}
+		if _, err := bs.Put(context.Background(), b); err != nil {
+			panic(err)
+		}
+		hashes = append(hashes, b.Hash)
+	}
+	waitIndexed(bs, hashes)
+
+	a, err := New(logger, conf, bs)
+	if err != nil {
+		panic(err)
+	}
+	defer a.Close()
+	report, err := a.Audit(false, 10)
+	if err != nil {
+		panic(err)
+	}
+	if !report.Consistent || report.LastSuccessAt == "" {
+		t.Errorf("unexpected report %+v", report.Targets["default"])
+	}
+
+	// Remove an object, corrupt another one, and add an unknown one
+	back := bs.S3Backends()[0].Remote()
+	keys := objectKeys(back)
+	if err := back.Delete(keys[hashes[0]]); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(remoteDir, keys[hashes[1]]), []byte("#blobstash/secretbox\noops"), 0600); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(remoteDir, "extra"), []byte("extra"), 0600); err != nil {
+		panic(err)
+	}
+
+	report, err = a.Audit(true, 10)
+	if err != nil {
+		panic(err)
+	}
+	res := report.Targets["default"]
+	if report.Consistent || len(res.MissingBlobs) != 1 || res.MissingBlobs[0] != hashes[0] ||
+		len(res.ExtraObjects) != 1 || res.ExtraObjects[0] != "extra" || len(res.Undecryptable) != 1 {
+		t.Errorf("unexpected report %+v", res)
+	}
+	if res.Requeued != 1 {
+		t.Errorf("the missing blob should have been requeued")
+	}
+	waitIndexed(bs, hashes[:1])
+
+	// The last successful audit is kept
+	a, err = New(logger, conf, bs)
+	if err != nil {
+		panic(err)
+	}
+	if last := a.Report(); last.Consistent || last.LastSuccessAt == "" {
+		t.Errorf("unexpected last report %+v", last)
+	}
+
+	// Only one audit can run at a time
+	if !a.start() {
+		t.Fatalf("no audit should be running")
+	}
+	if err := a.Trigger(false, 10); err != ErrInProgress {
+		t.Errorf("expected ErrInProgress, got %v", err)
+	}
+	if _, err := a.Audit(false, 10); err != ErrInProgress {
+		t.Errorf("expected ErrInProgress, got %v", err)
+	}
+}
+
+// objectKeys returns the remote object key of each blob
+func objectKeys(back remote.Backend) map[string]string {
+	out := map[string]string{}
+	if err := remote.Iter(back, "", 100, func(o *remote.Object) error {
+		hash, err := s3util.NewEncryptedBlob(back, o.Key, nil).PlainTextHash()
+		if err != nil {
+			return err
+		}
+		out[hash] = o.Key
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/blob"
+)
+
+// Available storage engines (selected via the `storage_engine` config item)
+const (
+	BlobsFileEngine = "blobsfile"
+	DirEngine       = "dir"
+)
+
+// ErrBlobNotFound is returned by all the storage engines when a blob is missing
+var ErrBlobNotFound = blobsfile.ErrBlobNotFound
+
+// ErrUnsupportedRef is returned when a storage engine cannot store a blob because of its hash algorithm
+var ErrUnsupportedRef = fmt.Errorf("unsupported ref")
+
+// Stats holds the storage engine stats
+type Stats struct {
+	// The total number of blobs stored
+	BlobsCount int
+
+	// The size of all the blobs stored
+	BlobsSize int64
+
+	// The number of BlobsFile (will always be 0 for engines that don't pack blobs)
+	BlobsFilesCount int
+
+	// The size of all the BlobsFile
+	BlobsFilesSize int64
+}
+
+// Backend is the interface implemented by the local storage engines
+type Backend interface {
+	Put(hash string, data []byte) error
+	Get(hash string) ([]byte, error)
+
+	// GetReader returns a reader for the blob content along with its size, engines that can't stream blobs from disk
+	// may buffer the blob.
+	GetReader(hash string) (io.ReadCloser, int, error)
+
+	Exists(hash string) (bool, error)
+	Size(hash string) (int, error)
+
+	// Enumerate outputs the blobs in the [start, end] range into the given chan (ordered lexicographically),
+	// the chan must be closed by the engine.
+	Enumerate(blobs chan<- *blob.SizedBlobRef, start, end string, limit int) error
+	EnumeratePrefix(blobs chan<- *blob.SizedBlobRef, prefix string, limit int) error
+
+	Stats() (*Stats, error)
+
+	// Check ensures the integrity of all the stored blobs
+	Check() error
+
+	// Compact permanently removes the given blobs (used by the garbage collector and the tiered storage eviction)
+	Compact(remove map[string]struct{}) error
+
+	// SetSealedFunc registers a callback called each time a pack is sealed (it will never be called for engines
+	// that store blobs individually)
+	SetSealedFunc(func(path string))
+
+	// SealedPacks returns the path of all the sealed packs
+	SealedPacks() []string
+
+	Close() error
+}
+
+func newBackend(logger log.Logger, engine, dir string) (Backend, error) {
+	switch engine {
+	case "", BlobsFileEngine:
+		return newBlobsFileBackend(logger, filepath.Join(dir, "blobs"))
+	case DirEngine:
+		return newDirBackend(filepath.Join(dir, "blobs-dir"))
+	default:
+		return nil, fmt.Errorf("unknown storage engine \"%s\"", engine)
+	}
+}
@@ -0,0 +1,561 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+// blobsFileBackend implements the `Backend` interface on top of BlobsFile (the default storage engine)
+type blobsFileBackend struct {
+	back *blobsfile.BlobsFiles
+
+	dir        string
+	logger     log.Logger
+	sealedFunc func(string)
+
+	// The lock is only held exclusively while the packs are being compacted
+	mu sync.RWMutex
+
+	// Offsets of the records in the packs, indexed lazily when streaming blobs (reset when the packs are rewritten)
+	offsetsMu sync.Mutex
+	offsets   map[int]*packOffsets
+}
+
+// BlobsFile pack layout (see a4.io/blobsfile): a header followed by the records, a record being the BLAKE2b-256
+// hash of the blob, 2 flag bytes (the record kind and the compression algorithm) and the size of the (compressed)
+// data as a little-endian uint32, followed by the data
+const (
+	packHeaderSize   = 64
+	recordHeaderSize = 38
+
+	recordFlagBlob       = 1
+	recordFlagCompressed = 2
+)
+
+// packOffsets holds the offsets of the records of a pack, keyed by their hash
+type packOffsets struct {
+	// Offset of the first record not indexed yet
+	scanned int64
+	records map[[32]byte]int64
+}
+
+// packSize is the maximum size of a pack (BlobsFile default if 0), only changed by the tests
+var packSize int64
+
+func openBlobsFile(logger log.Logger, dir string) (*blobsfile.BlobsFiles, error) {
+	back, err := blobsfile.New(&blobsfile.Opts{
+		Compression:   blobsfile.Snappy,
+		BlobsFileSize: packSize,
+		Directory:     dir,
+		LogFunc: func(msg string) {
+			logger.Info(msg, "submodule", "blobsfile")
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to init BlobsFile: %v", err)
+	}
+	return back, nil
+}
+
+func newBlobsFileBackend(logger log.Logger, dir string) (*blobsFileBackend, error) {
+	// BlobsFile rebuilds its index from the packs if it's missing (e.g. after a restore)
+	_, err := os.Stat(filepath.Join(dir, "blobs-index"))
+	reindexed := os.IsNotExist(err)
+
+	back, err := openBlobsFile(logger, dir)
+	if err != nil {
+		return nil, err
+	}
+	b := &blobsFileBackend{back: back, dir: dir, logger: logger}
+	if reindexed {
+		if err := b.restoreRefs(); err != nil {
+			back.Close()
+			return nil, fmt.Errorf("failed to restore the refs: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// refHeader prefixes the records of the blobs whose ref is not a BLAKE2b-256 digest, the packs only record the
+// BLAKE2b-256 digest of each record, so the original ref is needed to index them again from the packs
+const refHeader = "#blobstash/ref "
+
+// isNativeRef returns true if the ref is the digest recorded in the packs
+func isNativeRef(hash string) bool {
+	algo, err := hashutil.AlgorithmOf(hash)
+	return err == nil && algo == hashutil.BLAKE2b256
+}
+
+// recordOverhead returns the size of the header of the record of the blob
+func recordOverhead(hash string) int {
+	if isNativeRef(hash) {
+		return 0
+	}
+	return len(refHeader) + len(hash) + 1
+}
+
+// wrapRef returns the record of a blob with a non-native ref
+func wrapRef(hash string, data []byte) []byte {
+	rec := make([]byte, 0, recordOverhead(hash)+len(data))
+	rec = append(rec, refHeader+hash+"\n"...)
+	return append(rec, data...)
+}
+
+// UnwrapRef returns the ref and the data of a record of a blob with a non-native ref
+func UnwrapRef(rec []byte) (string, []byte, bool) {
+	if !bytes.HasPrefix(rec, []byte(refHeader)) {
+		return "", nil, false
+	}
+	i := bytes.IndexByte(rec, '\n')
+	if i < 0 {
+		return "", nil, false
+	}
+	return string(rec[len(refHeader):i]), rec[i+1:], true
+}
+
+// Put saves the blob, refs of any supported algorithm can be mixed as the BlobsFile index is keyed by the raw ref.
+//
+// The packs only record the BLAKE2b-256 digest of the blobs, so the record of a blob with another ref starts with the
+// ref (see `restoreRefs`).
+func (b *blobsFileBackend) Put(hash string, data []byte) error {
+	if _, err := hashutil.AlgorithmOf(hash); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupportedRef, err)
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if !isNativeRef(hash) {
+		data = wrapRef(hash, data)
+	}
+	return b.back.Put(hash, data)
+}
+
+func (b *blobsFileBackend) Get(hash string) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	data, err := b.back.Get(hash)
+	if err != nil || isNativeRef(hash) {
+		return data, err
+	}
+	ref, data, ok := UnwrapRef(data)
+	if !ok || ref != hash {
+		return nil, fmt.Errorf("invalid record for blob %s", hash)
+	}
+	return data, nil
+}
+
+// GetReader streams the blob from its pack, the data is decompressed on the fly and the hash is checked once the
+// blob is fully read.
+//
+// The blobs with a non-native ref are read whole (their record can't be located in the pack from the ref).
+func (b *blobsFileBackend) GetReader(hash string) (io.ReadCloser, int, error) {
+	if !isNativeRef(hash) {
+		return b.getWhole(hash)
+	}
+	var sum [32]byte
+	if _, err := hex.Decode(sum[:], []byte(hash)); err != nil {
+		return nil, 0, err
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	// Find the pack containing the blob (the end is compared to the raw index keys, "\xff" would overflow)
+	out := make(chan *blobsfile.Blob, 1)
+	if err := b.back.Enumerate(out, hash, "\xfe", 1); err != nil {
+		return nil, 0, err
+	}
+	cblob, ok := <-out
+	if !ok || cblob.Hash != hash {
+		return nil, 0, ErrBlobNotFound
+	}
+
+	f, err := os.Open(filepath.Join(b.dir, fmt.Sprintf("blobs-%05d", cblob.N)))
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, ok, err := b.recordOffset(f, cblob.N, sum)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if !ok {
+		// The pack will be indexed again on the next call
+		f.Close()
+		return b.getWhole(hash)
+	}
+
+	hdr := make([]byte, recordHeaderSize)
+	if _, err := f.ReadAt(hdr, offset); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	data := io.NewSectionReader(f, offset+recordHeaderSize, int64(binary.LittleEndian.Uint32(hdr[34:])))
+	var r io.Reader = data
+	switch hdr[33] {
+	case 0:
+	case byte(blobsfile.Snappy):
+		if r, err = newSnappyReader(data); err != nil {
+			f.Close()
+			return nil, 0, fmt.Errorf("blob %s: %w", hash, err)
+		}
+	default:
+		f.Close()
+		return nil, 0, fmt.Errorf("blob %s: unknown compression %d", hash, hdr[33])
+	}
+	h, err := hashutil.NewHash(hashutil.BLAKE2b256)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return &recordReader{Reader: r, f: f, h: h, sum: sum[:], hash: hash}, cblob.Size, nil
+}
+
+// getWhole returns the blob wrapped in a reader
+func (b *blobsFileBackend) getWhole(hash string) (io.ReadCloser, int, error) {
+	data, err := b.Get(hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), len(data), nil
+}
+
+// recordOffset returns the offset of the record with the given hash in the pack `n`, the records written since the
+// last call are indexed first (must be called with the lock held)
+func (b *blobsFileBackend) recordOffset(f *os.File, n int, sum [32]byte) (int64, bool, error) {
+	b.offsetsMu.Lock()
+	defer b.offsetsMu.Unlock()
+	if b.offsets == nil {
+		b.offsets = map[int]*packOffsets{}
+	}
+	po, ok := b.offsets[n]
+	if !ok {
+		po = &packOffsets{scanned: packHeaderSize, records: map[[32]byte]int64{}}
+		b.offsets[n] = po
+	}
+	if offset, ok := po.records[sum]; ok {
+		return offset, true, nil
+	}
+
+	hdr := make([]byte, recordHeaderSize)
+	for {
+		if _, err := f.ReadAt(hdr, po.scanned); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, false, err
+		}
+		// Stop at the end of the blobs (followed by the parity blobs once the pack is sealed)
+		if flag := hdr[32]; flag != recordFlagBlob && flag != recordFlagCompressed {
+			break
+		}
+		var h [32]byte
+		copy(h[:], hdr)
+		po.records[h] = po.scanned
+		po.scanned += recordHeaderSize + int64(binary.LittleEndian.Uint32(hdr[34:]))
+	}
+	offset, ok := po.records[sum]
+	if !ok {
+		// May have been read while being written
+		delete(b.offsets, n)
+	}
+	return offset, ok, nil
+}
+
+// recordReader closes the pack once done, and checks the hash of the blob once fully read
+type recordReader struct {
+	io.Reader
+	f    *os.File
+	h    hash.Hash
+	sum  []byte
+	hash string
+}
+
+// Read implements io.Reader
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.h.Sum(nil), r.sum) {
+		return n, fmt.Errorf("blob %s: hash mismatch", r.hash)
+	}
+	return n, err
+}
+
+// Close implements io.Closer
+func (r *recordReader) Close() error {
+	return r.f.Close()
+}
+
+func (b *blobsFileBackend) Exists(hash string) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.back.Exists(hash)
+}
+
+func (b *blobsFileBackend) Size(hash string) (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	size, err := b.back.Size(hash)
+	if err != nil {
+		return 0, err
+	}
+	return size - recordOverhead(hash), nil
+}
+
+func (b *blobsFileBackend) Enumerate(blobs chan<- *blob.SizedBlobRef, start, end string, limit int) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	out := make(chan *blobsfile.Blob)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.back.Enumerate(out, start, end, limit)
+	}()
+	return b.forward(blobs, out, errc)
+}
+
+func (b *blobsFileBackend) EnumeratePrefix(blobs chan<- *blob.SizedBlobRef, prefix string, limit int) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	out := make(chan *blobsfile.Blob)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.back.EnumeratePrefix(out, prefix, limit)
+	}()
+	return b.forward(blobs, out, errc)
+}
+
+func (b *blobsFileBackend) forward(blobs chan<- *blob.SizedBlobRef, out <-chan *blobsfile.Blob, errc <-chan error) error {
+	defer close(blobs)
+	for cblob := range out {
+		blobs <- &blob.SizedBlobRef{Hash: cblob.Hash, Size: cblob.Size - recordOverhead(cblob.Hash)}
+	}
+	return <-errc
+}
+
+func (b *blobsFileBackend) Stats() (*Stats, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	stats, err := b.back.Stats()
+	if err != nil {
+		return nil, err
+	}
+	return &Stats{
+		BlobsCount:      stats.BlobsCount,
+		BlobsSize:       stats.BlobsSize,
+		BlobsFilesCount: stats.BlobsFilesCount,
+		BlobsFilesSize:  stats.BlobsFilesSize,
+	}, nil
+}
+
+func (b *blobsFileBackend) Check() error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.back.CheckBlobsFiles()
+}
+
+func (b *blobsFileBackend) SetSealedFunc(f func(string)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sealedFunc = f
+	b.back.SetBlobsFilesSealedFunc(f)
+}
+
+func (b *blobsFileBackend) SealedPacks() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.back.SealedPacks()
+}
+
+func (b *blobsFileBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.back.Close()
+}
+
+// Compact rewrites all the packs without the removed blobs.
+//
+// BlobsFile packs are append-only, so the kept blobs are copied to a fresh set of packs in a temporary directory that
+// replaces the current one once complete.
+func (b *blobsFileBackend) Compact(remove map[string]struct{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// List the blobs to keep first, as we can't write while enumerating
+	hashes, err := b.hashes()
+	if err != nil {
+		return err
+	}
+	keep := []string{}
+	for _, hash := range hashes {
+		if _, ok := remove[hash]; !ok {
+			keep = append(keep, hash)
+		}
+	}
+
+	if err := b.rewrite(keep, nil); err != nil {
+		return err
+	}
+
+	b.logger.Info("packs compacted", "kept", len(keep), "removed", len(hashes)-len(keep))
+	return nil
+}
+
+// restoreRefs re-keys the blobs with a non-native ref after the index has been rebuilt from the packs (BlobsFile
+// indexes them by the BLAKE2b-256 digest of their record)
+func (b *blobsFileBackend) restoreRefs() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hashes, err := b.hashes()
+	if err != nil {
+		return err
+	}
+	refs := map[string]string{}
+	for _, hash := range hashes {
+		data, err := b.back.Get(hash)
+		if err != nil {
+			return err
+		}
+		ref, data, ok := UnwrapRef(data)
+		if !ok || isNativeRef(ref) {
+			continue
+		}
+		// Only trust the header if the ref matches the data
+		if h, err := hashutil.ComputeLike(ref, data); err != nil || h != ref {
+			continue
+		}
+		refs[hash] = ref
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	if err := b.rewrite(hashes, refs); err != nil {
+		return err
+	}
+
+	b.logger.Info("refs restored", "blobs", len(refs))
+	return nil
+}
+
+// hashes returns the keys of all the records (must be called with the lock held)
+func (b *blobsFileBackend) hashes() ([]string, error) {
+	hashes := []string{}
+	out := make(chan *blobsfile.Blob)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.back.EnumeratePrefix(out, "", 0)
+	}()
+	for cblob := range out {
+		hashes = append(hashes, cblob.Hash)
+	}
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// rewrite copies the `keep` records to a fresh set of packs (under the key from `rename` if any) in a temporary
+// directory that replaces the current one once complete (must be called with the lock held)
+func (b *blobsFileBackend) rewrite(keep []string, rename map[string]string) error {
+	tmpDir := b.dir + ".compact"
+	oldDir := b.dir + ".old"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	nback, err := openBlobsFile(b.logger, tmpDir)
+	if err != nil {
+		return err
+	}
+	for _, hash := range keep {
+		data, err := b.back.Get(hash)
+		if err != nil {
+			nback.Close()
+			return err
+		}
+		key := hash
+		if ref, ok := rename[hash]; ok {
+			key = ref
+		}
+		if err := nback.Put(key, data); err != nil {
+			nback.Close()
+			return err
+		}
+	}
+	if err := nback.Close(); err != nil {
+		return err
+	}
+
+	// Swap the directories, the old packs are kept until the new ones are successfully opened
+	if err := b.back.Close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(oldDir); err != nil {
+		return b.reopen(err)
+	}
+	if err := os.Rename(b.dir, oldDir); err != nil {
+		return b.reopen(err)
+	}
+	if err := os.Rename(tmpDir, b.dir); err != nil {
+		return b.rollback(oldDir, err)
+	}
+	back, err := openBlobsFile(b.logger, b.dir)
+	if err != nil {
+		return b.rollback(oldDir, err)
+	}
+	b.setBack(back)
+
+	// The rewritten packs keep their names, they're announced again so the replicas can upload the new content
+	if b.sealedFunc != nil {
+		for _, pack := range back.SealedPacks() {
+			b.sealedFunc(pack)
+		}
+	}
+
+	return os.RemoveAll(oldDir)
+}
+
+// setBack replaces the underlying BlobsFile (must be called with the lock held)
+func (b *blobsFileBackend) setBack(back *blobsfile.BlobsFiles) {
+	if b.sealedFunc != nil {
+		back.SetBlobsFilesSealedFunc(b.sealedFunc)
+	}
+	b.back = back
+
+	b.offsetsMu.Lock()
+	b.offsets = nil
+	b.offsetsMu.Unlock()
+}
+
+// reopen reopens the current packs after a failed compaction, and returns the compaction error
+func (b *blobsFileBackend) reopen(cerr error) error {
+	back, err := openBlobsFile(b.logger, b.dir)
+	if err != nil {
+		return fmt.Errorf("compaction failed: %v, and failed to reopen the packs: %v", cerr, err)
+	}
+	b.setBack(back)
+	return fmt.Errorf("compaction failed: %w", cerr)
+}
+
+// rollback puts back the pre-compaction packs (moved to `oldDir`) and reopens them
+func (b *blobsFileBackend) rollback(oldDir string, cerr error) error {
+	if err := os.RemoveAll(b.dir); err != nil {
+		return fmt.Errorf("compaction failed: %v, and failed to roll back: %v", cerr, err)
+	}
+	if err := os.Rename(oldDir, b.dir); err != nil {
+		return fmt.Errorf("compaction failed: %v, and failed to roll back: %v", cerr, err)
+	}
+	return b.reopen(cerr)
+}
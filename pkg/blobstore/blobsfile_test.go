@@ -0,0 +1,301 @@
+package blobstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+func TestBlobsFileBackendCompact(t *testing.T) {
+	dir := "blobsfile_backend_test"
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	back, err := newBlobsFileBackend(logger, dir)
+	if err != nil {
+		panic(err)
+	}
+	defer back.Close()
+
+	hashes := []string{}
+	remove := map[string]struct{}{}
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf("hello%d", i))
+		h := hashutil.Compute(data)
+		if err := back.Put(h, data); err != nil {
+			panic(err)
+		}
+		hashes = append(hashes, h)
+		if i%2 == 0 {
+			remove[h] = struct{}{}
+		}
+	}
+
+	if err := back.Compact(remove); err != nil {
+		panic(err)
+	}
+
+	for _, h := range hashes {
+		exists, err := back.Exists(h)
+		if err != nil {
+			panic(err)
+		}
+		_, removed := remove[h]
+		if exists == removed {
+			t.Errorf("blob %s exists=%v, removed=%v", h, exists, removed)
+		}
+	}
+
+	stats, err := back.Stats()
+	if err != nil {
+		panic(err)
+	}
+	if stats.BlobsCount != 10 {
+		t.Errorf("expected 10 blobs, got %d", stats.BlobsCount)
+	}
+
+	// The compacted packs must still be writable
+	data := []byte("hello after compact")
+	h := hashutil.Compute(data)
+	if err := back.Put(h, data); err != nil {
+		panic(err)
+	}
+	if _, err := back.Get(h); err != nil {
+		t.Errorf("failed to get blob after compaction: %v", err)
+	}
+
+	if err := back.Check(); err != nil {
+		t.Errorf("check failed: %v", err)
+	}
+}
+
+func TestBlobsFileBackendCompactRollback(t *testing.T) {
+	dir := "blobsfile_backend_rollback_test"
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir + ".old")
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	back, err := newBlobsFileBackend(logger, dir)
+	if err != nil {
+		panic(err)
+	}
+	defer back.Close()
+
+	data := []byte("hello")
+	h := hashutil.Compute(data)
+	if err := back.Put(h, data); err != nil {
+		panic(err)
+	}
+
+	// Simulate a compaction failing once the directories are swapped
+	if err := back.back.Close(); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(dir, dir+".old"); err != nil {
+		panic(err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		panic(err)
+	}
+	cerr := errors.New("failed to open")
+	if err := back.rollback(dir+".old", cerr); !errors.Is(err, cerr) {
+		t.Errorf("expected the compaction error, got %v", err)
+	}
+
+	if _, err := back.Get(h); err != nil {
+		t.Errorf("the pre-compaction packs should be back: %v", err)
+	}
+	if _, err := os.Stat(dir + ".old"); !os.IsNotExist(err) {
+		t.Errorf("the old packs should have been moved back, got %v", err)
+	}
+}
+
+func TestBlobsFileBackendMixedRefs(t *testing.T) {
+	dir := "blobsfile_backend_mixed_test"
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	back, err := newBlobsFileBackend(logger, dir)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		back.Close()
+	}()
+
+	refs := map[string][]byte{}
+	for i := 0; i < 10; i++ {
+		data := []byte(fmt.Sprintf("hello%d", i))
+		algo := hashutil.BLAKE2b256
+		if i%2 == 0 {
+			algo = hashutil.SHA256
+		}
+		h := hashutil.ComputeWith(algo, data)
+		if err := back.Put(h, data); err != nil {
+			panic(err)
+		}
+		refs[h] = data
+	}
+	if err := back.Put("nope", []byte("nope")); !errors.Is(err, ErrUnsupportedRef) {
+		t.Errorf("expected ErrUnsupportedRef, got %v", err)
+	}
+
+	for h, data := range refs {
+		got, err := back.Get(h)
+		if err != nil {
+			panic(err)
+		}
+		if string(got) != string(data) {
+			t.Errorf("bad data for %s", h)
+		}
+	}
+
+	out := make(chan *blob.SizedBlobRef)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- back.EnumeratePrefix(out, "", 0)
+	}()
+	var cnt int
+	for ref := range out {
+		if _, ok := refs[ref.Hash]; !ok {
+			t.Errorf("unexpected ref %s", ref.Hash)
+		}
+		cnt++
+	}
+	if err := <-errc; err != nil {
+		panic(err)
+	}
+	if cnt != len(refs) {
+		t.Errorf("expected %d refs, got %d", len(refs), cnt)
+	}
+
+	// The refs are restored when the index is rebuilt from the packs
+	if err := back.Close(); err != nil {
+		panic(err)
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "blobs-index")); err != nil {
+		panic(err)
+	}
+	back, err = newBlobsFileBackend(logger, dir)
+	if err != nil {
+		panic(err)
+	}
+	for h, data := range refs {
+		got, err := back.Get(h)
+		if err != nil {
+			t.Errorf("failed to get %s after the reindex: %v", h, err)
+			continue
+		}
+		if string(got) != string(data) {
+			t.Errorf("bad data for %s after the reindex", h)
+		}
+		if size, err := back.Size(h); err != nil || size != len(data) {
+			t.Errorf("bad size for %s after the reindex: %d %v", h, size, err)
+		}
+	}
+	stats, err := back.Stats()
+	if err != nil {
+		panic(err)
+	}
+	if stats.BlobsCount != len(refs) {
+		t.Errorf("expected %d blobs after the reindex, got %d", len(refs), stats.BlobsCount)
+	}
+}
+
+func TestBlobsFileBackendGetReader(t *testing.T) {
+	dir := "blobsfile_backend_reader_test"
+	defer os.RemoveAll(dir)
+	defer func(size int64) {
+		packSize = size
+	}(packSize)
+	packSize = 1024 * 1024
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	back, err := newBlobsFileBackend(logger, dir)
+	if err != nil {
+		panic(err)
+	}
+	defer back.Close()
+
+	rnd := rand.New(rand.NewSource(42))
+	blobs := [][]byte{[]byte("hello")}
+	for i := 0; i < 6; i++ {
+		// Incompressible blobs, and blobs spanning several Snappy blocks with copies
+		data := make([]byte, 300*1024)
+		rnd.Read(data)
+		if i%2 == 0 {
+			for j := range data {
+				data[j] = "abcdefgh"[data[j]%8] + byte(j/4096%4)
+			}
+		}
+		blobs = append(blobs, data)
+	}
+	sha := []byte("hello sha")
+	blobs = append(blobs, sha)
+
+	refs := []string{}
+	for i, data := range blobs {
+		h := hashutil.ComputeWith(hashutil.BLAKE2b256, data)
+		if i == len(blobs)-1 {
+			h = hashutil.ComputeWith(hashutil.SHA256, data)
+		}
+		if err := back.Put(h, data); err != nil {
+			panic(err)
+		}
+		refs = append(refs, h)
+	}
+
+	for i, h := range refs {
+		r, size, err := back.GetReader(h)
+		if err != nil {
+			panic(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Errorf("failed to read blob %d: %v", i, err)
+			continue
+		}
+		if size != len(blobs[i]) || !bytes.Equal(got, blobs[i]) {
+			t.Errorf("bad data for blob %d (size=%d)", i, size)
+		}
+	}
+	if _, _, err := back.GetReader(hashutil.Compute([]byte("missing"))); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+
+	// A corrupted record is reported once the blob is read
+	h := refs[1]
+	f, err := os.OpenFile(filepath.Join(dir, "blobs-00000"), os.O_RDWR, 0600)
+	if err != nil {
+		panic(err)
+	}
+	offset, ok, err := back.recordOffset(f, 0, hashutil.ComputeRaw(blobs[1]))
+	if err != nil || !ok {
+		panic(fmt.Errorf("record not found: %v", err))
+	}
+	if _, err := f.WriteAt([]byte{'X'}, offset+recordHeaderSize+1000); err != nil {
+		panic(err)
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+	r, _, err := back.GetReader(h)
+	if err != nil {
+		panic(err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Errorf("the corrupted blob should fail to read")
+	}
+}
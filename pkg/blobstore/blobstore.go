@@ -1,21 +1,26 @@
 package blobstore // import "a4.io/blobstash/pkg/blobstore"
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	log "github.com/inconshreveable/log15"
 
-	"a4.io/blobsfile"
-
-	// "a4.io/blobstash/pkg/backend/blobsfile"
 	"a4.io/blobstash/pkg/backend/s3"
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/metrics"
+	"a4.io/blobstash/pkg/usage"
 )
 
 var (
@@ -26,6 +31,25 @@ var (
 	writeCountVar = expvar.NewInt("blobstore-write-count")
 )
 
+var (
+	opsMetric        = metrics.NewCounterVec("blobstash_blobstore_ops", "Blobstore operations.", "op", "status")
+	opDurationMetric = metrics.NewHistogramVec("blobstash_blobstore_op_duration_seconds", "Blobstore operations latency.", nil, "op")
+	bytesMetric      = metrics.NewCounterVec("blobstash_blobstore_bytes", "Bytes read from/written to the blobstore.", "op")
+)
+
+// observe records the metrics of an operation (meant to be deferred)
+func observe(op string, start time.Time, err *error) {
+	status := "ok"
+	switch {
+	case *err == ErrBlobNotFound:
+		status = "not_found"
+	case *err != nil:
+		status = "error"
+	}
+	opsMetric.With(op, status).Inc()
+	opDurationMetric.With(op).Observe(time.Since(start).Seconds())
+}
+
 var ErrBlobExists = fmt.Errorf("blob exist")
 
 var ErrRemoteNotAvailable = fmt.Errorf("remote backend not available")
@@ -48,11 +72,32 @@ func NextHexKey(key string) string {
 }
 
 type BlobStore struct {
-	back   *blobsfile.BlobsFiles
-	s3back *s3.S3Backend
+	back   Backend
+	engine string
+
+	// The replication targets (the failures are independent, each target has its own queue)
+	s3backs []*s3.S3Backend
+	// The replication targets that failed to init (reported as unhealthy, the blobstore starts without them)
+	brokenS3 map[string]error
 
 	hub  *hub.Hub
 	root bool
+
+	// Blobs recently uploaded, used to prevent the GC from removing them
+	recent *recentBlobs
+
+	// Only set if tiered storage is enabled
+	tiering *tiering
+
+	// The kind of each blob
+	kinds *kindIndex
+
+	// Serializes the saves of the same blob (so a blob is only saved, and its event emitted, once)
+	locker *locker
+
+	// Optional usage accounting (and quotas enforcement)
+	usage *usage.Usage
+
 	stop chan struct{}
 
 	log log.Logger
@@ -60,100 +105,266 @@ type BlobStore struct {
 
 func New(logger log.Logger, root bool, dir string, conf2 *config.Config, hub *hub.Hub) (*BlobStore, error) {
 	logger.Debug("init")
-	back, err := blobsfile.New(&blobsfile.Opts{
-		Compression: blobsfile.Snappy,
-		Directory:   filepath.Join(dir, "blobs"),
-		LogFunc: func(msg string) {
-			logger.Info(msg, "submodule", "blobsfile")
-		},
-	})
+	var engine string
+	if conf2 != nil {
+		engine = conf2.StorageEngine
+	}
+	back, err := newBackend(logger, engine, dir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to init BlobsFile: %v", err)
+		return nil, err
 	}
-	var s3back *s3.S3Backend
+	var s3backs []*s3.S3Backend
+	brokenS3 := map[string]error{}
+	// The remote used by the tiered storage
+	var tieringBack *s3.S3Backend
+	var tieringConf *config.Tiering
 	if root && conf2 != nil {
-		if s3repl := conf2.S3Repl; s3repl != nil && s3repl.Bucket != "" {
-			logger.Debug("init s3 replication")
-			var err error
-			s3back, err = s3.New(logger.New("app", "s3_replication"), back, hub, conf2, filepath.Join(dir, "blobs"))
+		if err := conf2.S3Repls.Validate(); err != nil {
+			return nil, err
+		}
+		for _, target := range conf2.S3Repls.Enabled() {
+			logger.Debug("init s3 replication", "target", target.TargetName())
+			s3back, err := s3.New(logger.New("app", "s3_replication", "target", target.TargetName()), back, hub, conf2,
+				target, filepath.Join(dir, "blobs"))
 			if err != nil {
-				return nil, err
+				logger.Error("failed to init replication target, starting without it", "target", target.TargetName(),
+					"err", err)
+				brokenS3[target.TargetName()] = err
+				if target.Tiering != nil {
+					logger.Error("tiered storage disabled, the evicted blobs are not available",
+						"target", target.TargetName())
+				}
+				continue
+			}
+			s3backs = append(s3backs, s3back)
+			if target.Tiering != nil {
+				tieringBack = s3back
+				tieringConf = target.Tiering
 			}
 		}
 	}
+	kinds, err := newKindIndex(filepath.Join(dir, "kinds.index"))
+	if err != nil {
+		return nil, err
+	}
 	bs := &BlobStore{
-		back:   back,
-		root:   root,
-		s3back: s3back,
-		hub:    hub,
-		log:    logger,
-		stop:   make(chan struct{}),
-	}
-
-	if bs.root && bs.s3back != nil {
-		bs.back.SetBlobsFilesSealedFunc(func(path string) {
-			go func(path string) {
-				if err := bs.s3back.BlobsFilesUploadPack(path); err != nil {
-					logger.Error("failed to upload pack", "path", path, "err", err)
-				}
-			}(path)
-		})
-		go func() {
-			if err := bs.s3back.BlobsFilesSyncWorker(bs.back.SealedPacks()); err != nil {
-				logger.Error("failed to sync BlobsFile", "err", err)
+		kinds:    kinds,
+		back:     back,
+		engine:   engine,
+		root:     root,
+		s3backs:  s3backs,
+		brokenS3: brokenS3,
+		hub:      hub,
+		recent:   newRecentBlobs(),
+		locker:   newLocker(),
+		log:      logger,
+		stop:     make(chan struct{}),
+	}
+
+	if tieringBack != nil {
+		logger.Debug("init tiered storage", "target", tieringBack.Name())
+		bs.tiering, err = newTiering(logger.New("submodule", "tiering"), back, tieringBack, tieringConf,
+			filepath.Join(dir, "tiering.index"))
+		if err != nil {
+			return nil, err
+		}
+		bs.tiering.kinds = kinds
+		if engine != DirEngine {
+			logger.Warn("tiered storage enabled with BlobsFile, every eviction will rewrite (and upload again) all the packs")
+		}
+		go bs.tiering.run(bs.stop)
+	}
+
+	// The packs are uploaded even with tiered storage (so the instance can be restored), the tiering target keeps the
+	// individual blobs as the evicted blobs are fetched one by one
+	if bs.root && len(bs.s3backs) > 0 {
+		bs.back.SetSealedFunc(func(path string) {
+			for _, s3back := range bs.s3backs {
+				go func(s3back *s3.S3Backend, path string) {
+					if err := s3back.BlobsFilesUploadPack(path); err != nil {
+						logger.Error("failed to upload pack", "target", s3back.Name(), "path", path, "err", err)
+					}
+				}(s3back, path)
 			}
-		}()
+		})
+		for _, s3back := range bs.s3backs {
+			go func(s3back *s3.S3Backend) {
+				if err := s3back.BlobsFilesSyncWorker(bs.back.SealedPacks()); err != nil {
+					logger.Error("failed to sync BlobsFile", "target", s3back.Name(), "err", err)
+				}
+			}(s3back)
+		}
 	}
 
 	return bs, nil
 }
 
+// SetUsage enables the usage accounting, the new blobs are rejected if they would exceed a hard quota
+func (bs *BlobStore) SetUsage(u *usage.Usage) {
+	bs.usage = u
+}
+
+// Usage returns the usage accounting (nil if disabled)
+func (bs *BlobStore) Usage() *usage.Usage {
+	return bs.usage
+}
+
 func (bs *BlobStore) Check() error {
-	if err := bs.back.CheckBlobsFiles(); err != nil {
+	if err := bs.back.Check(); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (bs *BlobStore) S3Backend() *s3.S3Backend {
-	return bs.s3back
+// StorageEngine returns the name of the local storage engine
+func (bs *BlobStore) StorageEngine() string {
+	if bs.engine == "" {
+		return BlobsFileEngine
+	}
+	return bs.engine
+}
+
+// S3Backends returns the replication targets
+func (bs *BlobStore) S3Backends() []*s3.S3Backend {
+	return bs.s3backs
+}
+
+// SealedPacks returns the path of the sealed packs uploaded to the replication targets
+func (bs *BlobStore) SealedPacks() []string {
+	return bs.back.SealedPacks()
 }
 
 func (bs *BlobStore) ReplicationEnabled() bool {
-	return bs.s3back != nil
+	return len(bs.s3backs) > 0
 }
 
 func (bs *BlobStore) Close() error {
 	// TODO(tsileo): improve this
-	if bs.s3back != nil {
-		bs.s3back.Close()
+	if bs.tiering != nil {
+		close(bs.stop)
+		bs.tiering.Close()
+	}
+	for _, s3back := range bs.s3backs {
+		s3back.Close()
 	}
 
 	if err := bs.back.Close(); err != nil {
 		return err
 	}
+	if err := bs.kinds.Close(); err != nil {
+		return err
+	}
 	return nil
 }
 
+// S3Stats returns the stats of each replication target (indexed by name), a failing target is reported as unhealthy
+// along with its error
 func (bs *BlobStore) S3Stats() (map[string]interface{}, error) {
-	fmt.Printf("S3Stats %+v %+v\n\n", bs.root, bs.s3back)
-	if !bs.root || bs.s3back == nil {
+	if !bs.root || len(bs.s3backs)+len(bs.brokenS3) == 0 {
 		return nil, ErrRemoteNotAvailable
 	}
-	return bs.s3back.Stats()
+	out := map[string]interface{}{}
+	for name, err := range bs.brokenS3 {
+		out[name] = unhealthyStats(name, err)
+	}
+	for _, s3back := range bs.s3backs {
+		stats, err := s3back.Stats()
+		if err != nil {
+			out[s3back.Name()] = unhealthyStats(s3back.Name(), err)
+			continue
+		}
+		stats["healthy"] = true
+		if bs.tiering != nil && bs.tiering.remote == remoteStore(s3back) {
+			stats["tiering"] = bs.tiering.stats()
+		}
+		out[s3back.Name()] = stats
+	}
+	return out, nil
+}
+
+func unhealthyStats(name string, err error) map[string]interface{} {
+	return map[string]interface{}{
+		"name":    name,
+		"healthy": false,
+		"error":   err.Error(),
+	}
 }
 
-func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) (bool, error) {
+func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) (_ bool, err error) {
+	defer observe("put", time.Now(), &err)
 	bs.log.Info("OP Put", "hash", blob.Hash, "len", len(blob.Data))
-	var saved bool
 
 	// Ensure the blob hash match the blob content
 	if err := blob.Check(); err != nil {
+		return false, err
+	}
+
+	return bs.put(ctx, blob)
+}
+
+// PutReader saves the blob read from `r`, the content is hashed while being read (and rejected if it does not match
+// the given hash).
+func (bs *BlobStore) PutReader(ctx context.Context, hash string, r io.Reader) (_ bool, err error) {
+	defer observe("put", time.Now(), &err)
+	bs.log.Info("OP PutReader", "hash", hash)
+	bs.recent.add(hash)
+	exists, err := bs.exists(hash)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		bs.log.Debug("blob already saved", "hash", hash)
+		return false, nil
+	}
+
+	data, err := blob.ReadVerified(hash, r)
+	if err != nil {
+		return false, err
+	}
+
+	return bs.put(ctx, &blob.Blob{Hash: hash, Data: data})
+}
+
+// put saves an already verified blob
+func (bs *BlobStore) put(ctx context.Context, blob *blob.Blob) (bool, error) {
+	saved, err := bs.save(ctx, blob)
+	if err != nil || !saved {
 		return saved, err
 	}
 
-	exists, err := bs.back.Exists(blob.Hash)
+	var specialBlob bool
+	if blob.IsMeta() || blob.IsFiletreeNode() {
+		specialBlob = true
+	}
+
+	// Wait for subscribed event completion (outside the blob lock, as the subscribers may put the same blob again)
+	if err := bs.hub.NewBlobEvent(ctx, blob, nil); err != nil {
+		return saved, err
+	}
+
+	writeCountVar.Add(1)
+	writeVar.Add(int64(len(blob.Data)))
+	bytesMetric.With("write").Add(float64(len(blob.Data)))
+
+	bs.log.Debug("blob saved", "hash", blob.Hash, "special_blob", specialBlob)
+	return saved, nil
+}
+
+// save stores the blob if it does not exist yet, returns true if it was saved.
+//
+// The check and the save are done under the lock of the blob hash, so concurrent puts of the same blob only save it
+// (and emit its event) once.
+func (bs *BlobStore) save(ctx context.Context, blob *blob.Blob) (bool, error) {
+	var saved bool
+
+	bs.locker.Lock(blob.Hash)
+	defer bs.locker.Unlock(blob.Hash)
+
+	// Protect the blob from the GC, even if it already exists, as it's about to be referenced
+	bs.recent.add(blob.Hash)
+
+	exists, err := bs.exists(blob.Hash)
 	if err != nil {
 		return saved, err
 	}
@@ -165,71 +376,287 @@ func (bs *BlobStore) Put(ctx context.Context, blob *blob.Blob) (bool, error) {
 
 	saved = true
 
-	var specialBlob bool
-	if blob.IsMeta() || blob.IsFiletreeNode() {
-		specialBlob = true
+	if bs.usage != nil {
+		if err := bs.usage.ReserveBlob(ctx, blob.Hash, len(blob.Data)); err != nil {
+			return false, err
+		}
 	}
 
 	// Save the blob
 	if err := bs.back.Put(blob.Hash, blob.Data); err != nil {
+		if bs.usage != nil {
+			if uerr := bs.usage.ReleaseBlob(blob.Hash); uerr != nil {
+				bs.log.Error("failed to release the blob usage", "hash", blob.Hash, "err", uerr)
+			}
+		}
 		return saved, err
 	}
-
-	// Wait for adding the blob to the S3 replication queue if enabled
-	if bs.root && bs.s3back != nil {
-		if err := bs.s3back.Put(blob.Hash); err != nil {
+	if err := bs.kinds.add(blob.Hash, BlobKind(blob), len(blob.Data)); err != nil {
+		return saved, err
+	}
+	if bs.tiering != nil {
+		if err := bs.tiering.saved(blob); err != nil {
 			return saved, err
 		}
 	}
 
-	// Wait for subscribed event completion
-	if err := bs.hub.NewBlobEvent(ctx, blob, nil); err != nil {
-		return saved, err
+	// Wait for adding the blob to the replication queues if enabled (a failing target does not block the others)
+	if bs.root {
+		var errs []string
+		for _, s3back := range bs.s3backs {
+			if err := s3back.Put(blob.Hash); err != nil {
+				errs = append(errs, fmt.Sprintf("target %q: %v", s3back.Name(), err))
+			}
+		}
+		if len(errs) > 0 {
+			return saved, fmt.Errorf("failed to enqueue blob %s: %s", blob.Hash, strings.Join(errs, ", "))
+		}
 	}
 
-	writeCountVar.Add(1)
-	writeVar.Add(int64(len(blob.Data)))
-
-	bs.log.Debug("blob saved", "hash", blob.Hash, "special_blob", specialBlob)
 	return saved, nil
 }
 
-func (bs *BlobStore) Stats() (*blobsfile.Stats, error) {
+func (bs *BlobStore) Stats() (*Stats, error) {
 	return bs.back.Stats()
 }
 
-func (bs *BlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+func (bs *BlobStore) Get(ctx context.Context, hash string) (_ []byte, err error) {
+	defer observe("get", time.Now(), &err)
 	bs.log.Info("OP Get", "hash", hash)
 	blob, err := bs.back.Get(hash)
-	if err != nil {
+	switch {
+	case err == nil:
+		if bs.tiering != nil {
+			if err := bs.tiering.accessed(hash); err != nil {
+				return nil, err
+			}
+		}
+	case err == ErrBlobNotFound && bs.tiering != nil:
+		// The blob may have been evicted
+		if blob, err = bs.tiering.fetch(hash); err != nil {
+			return nil, err
+		}
+	default:
 		return nil, err
 	}
 
 	readCountVar.Add(1)
 	readVar.Add(int64(len(blob)))
+	bytesMetric.With("read").Add(float64(len(blob)))
 
 	return blob, err
 }
 
-func (bs *BlobStore) Stat(ctx context.Context, hash string) (bool, error) {
+// GetReader returns a reader for the given blob along with its size, the reader must be closed by the caller
+func (bs *BlobStore) GetReader(ctx context.Context, hash string) (_ io.ReadCloser, _ int, err error) {
+	defer observe("get", time.Now(), &err)
+	bs.log.Info("OP GetReader", "hash", hash)
+	r, size, err := bs.back.GetReader(hash)
+	switch {
+	case err == nil:
+		if bs.tiering != nil {
+			if err := bs.tiering.accessed(hash); err != nil {
+				r.Close()
+				return nil, 0, err
+			}
+		}
+	case err == ErrBlobNotFound && bs.tiering != nil:
+		// The blob may have been evicted
+		data, err := bs.tiering.fetch(hash)
+		if err != nil {
+			return nil, 0, err
+		}
+		r, size = ioutil.NopCloser(bytes.NewReader(data)), len(data)
+	default:
+		return nil, 0, err
+	}
+
+	readCountVar.Add(1)
+	readVar.Add(int64(size))
+	bytesMetric.With("read").Add(float64(size))
+
+	return r, size, nil
+}
+
+func (bs *BlobStore) Stat(ctx context.Context, hash string) (_ bool, err error) {
+	defer observe("stat", time.Now(), &err)
 	bs.log.Info("OP Stat", "hash", hash)
-	return bs.back.Exists(hash)
+	return bs.exists(hash)
+}
+
+// exists returns true if the blob is stored locally (or has been evicted to S3 if tiered storage is enabled)
+func (bs *BlobStore) exists(hash string) (bool, error) {
+	exists, err := bs.back.Exists(hash)
+	if err != nil || exists || bs.tiering == nil {
+		return exists, err
+	}
+	return bs.tiering.evicted(hash)
 }
 
 // func (backend *BlobsFileBackend) Enumerate(blobs chan<- *blob.SizedBlobRef, start, stop string, limit int) error {
-func (bs *BlobStore) Enumerate(ctx context.Context, start, end string, limit int) ([]*blob.SizedBlobRef, string, error) {
+func (bs *BlobStore) Enumerate(ctx context.Context, start, end string, limit int) (_ []*blob.SizedBlobRef, _ string, err error) {
+	defer observe("enumerate", time.Now(), &err)
 	return bs.enumerate(ctx, start, end, limit, false)
 }
 
+// EnumerateAll returns all the blobs in the [start, end] range, including the ones evicted by the tiered storage (not
+// returned by `Enumerate` as they are not stored locally, they are listed using the kind index)
+func (bs *BlobStore) EnumerateAll(ctx context.Context, start, end string) ([]*blob.SizedBlobRef, error) {
+	refs, _, err := bs.Enumerate(ctx, start, end, 0)
+	if err != nil || bs.tiering == nil {
+		return refs, err
+	}
+	indexed, err := bs.kinds.enumerateAll(start, end)
+	if err != nil {
+		return nil, err
+	}
+	local := map[string]struct{}{}
+	for _, ref := range refs {
+		local[ref.Hash] = struct{}{}
+	}
+	for _, ref := range indexed {
+		if _, ok := local[ref.Hash]; ok {
+			continue
+		}
+		// Only keep the blobs that can be fetched back from the remote storage
+		evicted, err := bs.tiering.evicted(ref.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if evicted {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Hash < refs[j].Hash
+	})
+	return refs, nil
+}
+
+// EnumerateKind works like `Enumerate` but only returns the blobs of the given kind (all the blobs if `kind` is empty).
+//
+// Until the kind index has been backfilled by `Scan`, the blobs missing from the index are read (and indexed).
+func (bs *BlobStore) EnumerateKind(ctx context.Context, kind, start, end string, limit int) ([]*blob.SizedBlobRef, string, error) {
+	if kind == "" {
+		return bs.Enumerate(ctx, start, end, limit)
+	}
+	if err := ValidKind(kind); err != nil {
+		return nil, "", err
+	}
+	bs.log.Info("OP EnumerateKind", "kind", kind, "start", start, "end", end, "limit", limit)
+	if end == "" {
+		end = "\xff"
+	}
+
+	var refs []*blob.SizedBlobRef
+	backfilled, err := bs.kinds.backfilled()
+	if err != nil {
+		return nil, "", err
+	}
+	if backfilled {
+		refs, err = bs.kinds.enumerate(kind, start, end, limit)
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		allRefs, _, err := bs.enumerate(ctx, start, end, 0, false)
+		if err != nil {
+			return nil, "", err
+		}
+		refs = []*blob.SizedBlobRef{}
+		for _, ref := range allRefs {
+			k, err := bs.kind(ref.Hash)
+			if err != nil {
+				return nil, "", err
+			}
+			if k != kind {
+				continue
+			}
+			refs = append(refs, ref)
+			if limit > 0 && len(refs) == limit {
+				break
+			}
+		}
+	}
+
+	var cursor string
+	if len(refs) > 0 {
+		cursor = NextHexKey(refs[len(refs)-1].Hash)
+	}
+	return refs, cursor, nil
+}
+
+// Kind returns the kind of the given blob, `ErrBlobNotFound` is returned if the blob is not stored locally
+func (bs *BlobStore) Kind(ctx context.Context, hash string) (string, error) {
+	return bs.kind(hash)
+}
+
+// kind returns the kind of a blob, the blob is read (and indexed) if it's missing from the kind index
+func (bs *BlobStore) kind(hash string) (string, error) {
+	kind, err := bs.kinds.kind(hash)
+	if err != nil || kind != "" {
+		return kind, err
+	}
+	data, err := bs.back.Get(hash)
+	if err != nil {
+		return "", err
+	}
+	kind = BlobKind(&blob.Blob{Hash: hash, Data: data})
+	if err := bs.kinds.add(hash, kind, len(data)); err != nil {
+		return "", err
+	}
+	return kind, nil
+}
+
+// Scan triggers a ScanBlob event for every meta blob (used to rebuild the indexes).
+//
+// The storage engine is always enumerated as some blobs may have been written without going through `put` (e.g. the
+// blobs restored from S3), the kind index only allows to skip reading the blobs already indexed as non-meta blobs.
 func (bs *BlobStore) Scan(ctx context.Context) error {
-	_, _, err := bs.enumerate(ctx, "", "\xff", 0, true)
-	return err
+	// List the blobs first, as the storage engine can't be read while enumerating
+	refs := []*blob.SizedBlobRef{}
+	out := make(chan *blob.SizedBlobRef)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- bs.back.EnumeratePrefix(out, "", 0)
+	}()
+	for ref := range out {
+		refs = append(refs, ref)
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		kind, err := bs.kinds.kind(ref.Hash)
+		if err != nil {
+			return err
+		}
+		if kind != "" && !isMetaKind(kind) {
+			continue
+		}
+		data, err := bs.back.Get(ref.Hash)
+		if err != nil {
+			return err
+		}
+		b := &blob.Blob{Hash: ref.Hash, Data: data}
+		if kind == "" {
+			// Backfill the kind index
+			if err := bs.kinds.add(ref.Hash, BlobKind(b), len(data)); err != nil {
+				return err
+			}
+		}
+		if err := bs.hub.ScanBlobEvent(ctx, b, nil); err != nil {
+			return err
+		}
+	}
+	return bs.kinds.setBackfilled()
 }
 
 func (bs *BlobStore) enumerate(ctx context.Context, start, end string, limit int, scan bool) ([]*blob.SizedBlobRef, string, error) {
 	var cursor string
 	bs.log.Info("OP Enumerate", "start", start, "end", end, "limit", limit)
-	out := make(chan *blobsfile.Blob)
+	out := make(chan *blob.SizedBlobRef)
 	refs := []*blob.SizedBlobRef{}
 	errc := make(chan error, 1)
 	go func() {
@@ -247,6 +674,10 @@ func (bs *BlobStore) enumerate(ctx context.Context, start, end string, limit int
 			if err != nil {
 				return nil, cursor, err
 			}
+			// Backfill the kind index
+			if err := bs.kinds.add(cblob.Hash, BlobKind(&blob.Blob{Hash: cblob.Hash, Data: fullblob}), len(fullblob)); err != nil {
+				return nil, cursor, err
+			}
 			if err := bs.hub.ScanBlobEvent(ctx, &blob.Blob{Hash: cblob.Hash, Data: fullblob}, nil); err != nil {
 				return nil, cursor, err
 			}
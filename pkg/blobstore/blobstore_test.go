@@ -0,0 +1,69 @@
+package blobstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestBrokenReplicationTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_blobstore_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+
+	remoteDir := filepath.Join(dir, "remote")
+	if err := os.MkdirAll(remoteDir, 0700); err != nil {
+		panic(err)
+	}
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("6368616e676520746869732070617373"), 0600); err != nil {
+		panic(err)
+	}
+	conf := &config.Config{
+		DataDir: filepath.Join(dir, "data"),
+		S3Repls: config.S3Repls{
+			&config.S3Repl{Name: "ok", Dir: remoteDir, KeyFile: keyFile},
+			// The key file does not exist
+			&config.S3Repl{Name: "broken", Dir: remoteDir, KeyFile: filepath.Join(dir, "missing")},
+		},
+	}
+	bs, err := New(logger, true, conf.DataDir, conf, hub.New(logger, true))
+	if err != nil {
+		t.Fatalf("the blobstore should start without the broken target: %v", err)
+	}
+	defer bs.Close()
+
+	if n := len(bs.S3Backends()); n != 1 {
+		t.Errorf("expected 1 replication target, got %d", n)
+	}
+	data := []byte("hello")
+	if _, err := bs.Put(context.Background(), &blob.Blob{Hash: hashutil.Compute(data), Data: data}); err != nil {
+		t.Errorf("failed to put the blob: %v", err)
+	}
+
+	stats, err := bs.S3Stats()
+	if err != nil {
+		t.Fatalf("failed to get the S3 stats: %v", err)
+	}
+	ok := stats["ok"].(map[string]interface{})
+	if ok["healthy"] != true {
+		t.Errorf("the ok target should be healthy: %+v", ok)
+	}
+	broken := stats["broken"].(map[string]interface{})
+	if broken["healthy"] != false || broken["error"] == "" {
+		t.Errorf("the broken target should be reported as unhealthy: %+v", broken)
+	}
+}
@@ -0,0 +1,289 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+// dirBackend is a simple storage engine that stores one file per blob, using the first two hex chars of the hash
+// as a sub-directory (i.e. `<dir>/ab/abcdef...`).
+// Blobs are stored uncompressed, it's meant for small instances and tests.
+type dirBackend struct {
+	dir string
+
+	blobsCount int
+	blobsSize  int64
+
+	sync.Mutex
+}
+
+func newDirBackend(dir string) (*dirBackend, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	b := &dirBackend{dir: dir}
+
+	// Compute the initial stats
+	if err := b.walk("", func(hash string, size int64) error {
+		b.blobsCount++
+		b.blobsSize += size
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *dirBackend) path(hash string) (string, error) {
+	if len(hash) < 2 || strings.ContainsAny(hash, "/.") {
+		return "", fmt.Errorf("invalid hash \"%s\"", hash)
+	}
+	return filepath.Join(b.dir, hash[0:2], hash), nil
+}
+
+func (b *dirBackend) Put(hash string, data []byte) error {
+	path, err := b.path(hash)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Write the blob in a temp file first, and rename it to ensure the write is atomic
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+hash)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	b.blobsCount++
+	b.blobsSize += int64(len(data))
+	return nil
+}
+
+func (b *dirBackend) Get(hash string) ([]byte, error) {
+	path, err := b.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (b *dirBackend) GetReader(hash string) (io.ReadCloser, int, error) {
+	path, err := b.path(hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, ErrBlobNotFound
+		}
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, int(fi.Size()), nil
+}
+
+func (b *dirBackend) Exists(hash string) (bool, error) {
+	path, err := b.path(hash)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *dirBackend) Size(hash string) (int, error) {
+	path, err := b.path(hash)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrBlobNotFound
+		}
+		return 0, err
+	}
+	return int(fi.Size()), nil
+}
+
+// walk iterates over all the blobs (ordered lexicographically) starting at `start`
+func (b *dirBackend) walk(start string, f func(string, int64) error) error {
+	dirs, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	dstart := start
+	if len(dstart) > 2 {
+		dstart = dstart[0:2]
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 || d.Name() < dstart {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(b.dir, d.Name()))
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			// Skip the temp files
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") || fi.Name() < start {
+				continue
+			}
+			if err := f(fi.Name(), fi.Size()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// errStopWalk is used to stop the iteration early
+var errStopWalk = fmt.Errorf("stop walk")
+
+func (b *dirBackend) Enumerate(blobs chan<- *blob.SizedBlobRef, start, end string, limit int) error {
+	defer close(blobs)
+	i := 0
+	if err := b.walk(start, func(hash string, size int64) error {
+		if hash > end || (limit != 0 && i == limit) {
+			return errStopWalk
+		}
+		blobs <- &blob.SizedBlobRef{Hash: hash, Size: int(size)}
+		i++
+		return nil
+	}); err != nil && err != errStopWalk {
+		return err
+	}
+	return nil
+}
+
+func (b *dirBackend) EnumeratePrefix(blobs chan<- *blob.SizedBlobRef, prefix string, limit int) error {
+	defer close(blobs)
+	i := 0
+	if err := b.walk(prefix, func(hash string, size int64) error {
+		if !strings.HasPrefix(hash, prefix) || (limit != 0 && i == limit) {
+			return errStopWalk
+		}
+		blobs <- &blob.SizedBlobRef{Hash: hash, Size: int(size)}
+		i++
+		return nil
+	}); err != nil && err != errStopWalk {
+		return err
+	}
+	return nil
+}
+
+func (b *dirBackend) Stats() (*Stats, error) {
+	b.Lock()
+	defer b.Unlock()
+	return &Stats{
+		BlobsCount: b.blobsCount,
+		BlobsSize:  b.blobsSize,
+	}, nil
+}
+
+// Check re-computes the hash of every blob
+func (b *dirBackend) Check() error {
+	var corrupted []string
+	if err := b.walk("", func(hash string, _ int64) error {
+		data, err := b.Get(hash)
+		if err != nil {
+			return err
+		}
+		if chash, err := hashutil.ComputeLike(hash, data); err != nil || chash != hash {
+			corrupted = append(corrupted, hash)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(corrupted) > 0 {
+		return fmt.Errorf("%d corrupted blobs: %q", len(corrupted), corrupted)
+	}
+	return nil
+}
+
+// Compact removes the files of the given blobs
+func (b *dirBackend) Compact(remove map[string]struct{}) error {
+	b.Lock()
+	defer b.Unlock()
+	for hash := range remove {
+		path, err := b.path(hash)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		b.blobsCount--
+		b.blobsSize -= fi.Size()
+	}
+	return nil
+}
+
+// SetSealedFunc does nothing as there's no packs
+func (b *dirBackend) SetSealedFunc(func(string)) {}
+
+// SealedPacks always returns an empty list
+func (b *dirBackend) SealedPacks() []string { return nil }
+
+func (b *dirBackend) Close() error { return nil }
@@ -0,0 +1,100 @@
+package blobstore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+func TestDirBackend(t *testing.T) {
+	dir := "dir_backend_test"
+	defer os.RemoveAll(dir)
+	back, err := newDirBackend(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	hashes := []string{}
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf("hello%d", i))
+		h := hashutil.Compute(data)
+		if err := back.Put(h, data); err != nil {
+			panic(err)
+		}
+		// Putting the same blob twice should be a no-op
+		if err := back.Put(h, data); err != nil {
+			panic(err)
+		}
+		hashes = append(hashes, h)
+	}
+
+	for _, h := range hashes {
+		exists, err := back.Exists(h)
+		if err != nil {
+			panic(err)
+		}
+		if !exists {
+			t.Errorf("blob %s should exist", h)
+		}
+		data, err := back.Get(h)
+		if err != nil {
+			panic(err)
+		}
+		if hashutil.Compute(data) != h {
+			t.Errorf("blob %s corrupted", h)
+		}
+	}
+
+	if _, err := back.Get(hashutil.Compute([]byte("nope"))); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+
+	stats, err := back.Stats()
+	if err != nil {
+		panic(err)
+	}
+	if stats.BlobsCount != 20 {
+		t.Errorf("expected 20 blobs, got %d", stats.BlobsCount)
+	}
+
+	out := make(chan *blob.SizedBlobRef)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- back.Enumerate(out, "", "\xff", 0)
+	}()
+	var prev string
+	cnt := 0
+	for ref := range out {
+		if ref.Hash <= prev {
+			t.Errorf("enumerate is not ordered: %s <= %s", ref.Hash, prev)
+		}
+		prev = ref.Hash
+		cnt++
+	}
+	if err := <-errc; err != nil {
+		panic(err)
+	}
+	if cnt != 20 {
+		t.Errorf("expected 20 blobs, got %d", cnt)
+	}
+
+	// Re-opening the backend should restore the stats
+	back2, err := newDirBackend(dir)
+	if err != nil {
+		panic(err)
+	}
+	stats2, err := back2.Stats()
+	if err != nil {
+		panic(err)
+	}
+	if stats2.BlobsCount != stats.BlobsCount || stats2.BlobsSize != stats.BlobsSize {
+		t.Errorf("stats mismatch after re-opening: %+v/%+v", stats, stats2)
+	}
+
+	if err := back.Check(); err != nil {
+		t.Errorf("check failed: %v", err)
+	}
+}
@@ -0,0 +1,392 @@
+package gc // import "a4.io/blobstash/pkg/blobstore/gc"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/docstore"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/gitserver"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/metrics"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// ErrInProgress is returned when a GC is already running
+var ErrInProgress = fmt.Errorf("a GC is already in progress")
+
+var (
+	runsMetric         = metrics.NewCounterVec("blobstash_gc_runs", "GC runs.", "dry_run", "status")
+	durationMetric     = metrics.NewHistogramVec("blobstash_gc_duration_seconds", "GC runs duration.", []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600}, "dry_run")
+	removedMetric      = metrics.NewCounterVec("blobstash_gc_removed_blobs", "Blobs removed by the GC.")
+	removedBytesMetric = metrics.NewCounterVec("blobstash_gc_removed_bytes", "Size of the blobs removed by the GC.")
+	lastRunMetric      = metrics.NewGaugeVec("blobstash_gc_last_run_timestamp_seconds", "Time of the last successful GC run.")
+)
+
+// Report holds the result of a GC run
+type Report struct {
+	DryRun bool `json:"dry_run"`
+
+	// Number of kv entries (all versions) scanned during the mark phase
+	KvEntries int `json:"kv_entries"`
+
+	BlobsCount int   `json:"blobs_count"`
+	BlobsSize  int64 `json:"blobs_size"`
+
+	LiveBlobsCount int   `json:"live_blobs_count"`
+	LiveBlobsSize  int64 `json:"live_blobs_size"`
+
+	// The unreferenced blobs
+	GarbageBlobsCount int    `json:"garbage_blobs_count"`
+	GarbageBlobsSize  int64  `json:"garbage_blobs_size"`
+	GarbageBlobsHuman string `json:"garbage_blobs_size_human"`
+
+	// The blobs actually removed (blobs uploaded during the grace period are kept)
+	RemovedBlobsCount int   `json:"removed_blobs_count"`
+	RemovedBlobsSize  int64 `json:"removed_blobs_size"`
+
+	Duration string `json:"duration"`
+}
+
+// GC implements a mark-and-sweep garbage collector for the root blobstore.
+//
+// The live blobs are marked starting from all the versions of every kv entries (from the root and all the stashes):
+// the meta blobs, the refs (and the whole tree if it's a filetree node), the docstore pointers and the git blob objects.
+type GC struct {
+	bs       *blobstore.BlobStore
+	stash    *stash.Stash
+	filetree *filetree.FileTree
+
+	running bool
+	mu      sync.Mutex
+
+	log log.Logger
+}
+
+// New initializes the GC
+func New(logger log.Logger, bs *blobstore.BlobStore, s *stash.Stash, ft *filetree.FileTree) *GC {
+	logger.Debug("init")
+	return &GC{
+		bs:       bs,
+		stash:    s,
+		filetree: ft,
+		log:      logger,
+	}
+}
+
+// Register the admin endpoint
+func (gc *GC) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/_gc", basicAuth(http.HandlerFunc(gc.gcHandler())))
+}
+
+type marker struct {
+	root     *blobstore.BlobStore
+	bs       *stash.BlobStore
+	filetree *filetree.FileTree
+
+	marked map[string]struct{}
+	trees  map[string]struct{}
+
+	kvEntries int
+
+	log log.Logger
+}
+
+func (m *marker) mark(hash string) {
+	m.marked[hash] = struct{}{}
+}
+
+// markRef marks a blob referenced by a kv entry, and the whole tree if it's a filetree node
+func (m *marker) markRef(ctx context.Context, ref string) error {
+	if _, ok := m.marked[ref]; ok {
+		return nil
+	}
+	m.mark(ref)
+
+	// Use the kind index to prevent reading the data blobs
+	kind, err := m.root.Kind(ctx, ref)
+	switch err {
+	case nil:
+		if kind == blobstore.KindNode {
+			return m.markTree(ctx, ref)
+		}
+		return nil
+	case blobstore.ErrBlobNotFound:
+	default:
+		return err
+	}
+
+	// The blob may only be stored in a stash
+	data, err := m.bs.Get(ctx, ref)
+	switch err {
+	case nil:
+	case blobstore.ErrBlobNotFound:
+		m.log.Warn("missing blob", "ref", ref)
+		return nil
+	default:
+		return err
+	}
+
+	if _, isNode := node.IsNodeBlob(data); isNode {
+		return m.markTree(ctx, ref)
+	}
+	return nil
+}
+
+func (m *marker) markTree(ctx context.Context, ref string) error {
+	if _, ok := m.trees[ref]; ok {
+		return nil
+	}
+	m.trees[ref] = struct{}{}
+
+	blobs, err := m.filetree.TreeBlobsByRef(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("failed to mark tree %s: %v", ref, err)
+	}
+	for _, h := range blobs {
+		m.mark(h)
+	}
+	return nil
+}
+
+func (m *marker) markKv(ctx context.Context, kvs store.KvStore, kv *vkv.KeyValue) error {
+	m.kvEntries++
+
+	metaBlob, err := kvs.GetMetaBlob(ctx, kv.Key, kv.Version)
+	if err != nil {
+		return err
+	}
+	if metaBlob != "" {
+		m.mark(metaBlob)
+	}
+
+	if ref := kv.HexHash(); ref != "" {
+		if err := m.markRef(ctx, ref); err != nil {
+			return err
+		}
+	}
+
+	blobs, nodes, err := docstore.Pointers(kv)
+	if err != nil {
+		return err
+	}
+	for _, h := range blobs {
+		m.mark(h)
+	}
+	for _, ref := range nodes {
+		m.mark(ref)
+		if err := m.markTree(ctx, ref); err != nil {
+			return err
+		}
+	}
+
+	gitBlobs, err := gitserver.ObjectBlobs(kv)
+	if err != nil {
+		return err
+	}
+	for _, h := range gitBlobs {
+		m.mark(h)
+	}
+
+	return nil
+}
+
+// sweeper is implemented by the kv stores hiding the expired keys until their tombstones are written
+type sweeper interface {
+	Sweep(context.Context) error
+}
+
+// markKvStore marks all the versions of all the keys
+func (m *marker) markKvStore(ctx context.Context, kvs store.KvStore) error {
+	// The expired keys are hidden from `Keys`, write their tombstones first so their versions are marked
+	if s, ok := kvs.(sweeper); ok {
+		if err := s.Sweep(ctx); err != nil {
+			return err
+		}
+	}
+	start := ""
+	// Versions may be set by the client, so they can be in the future
+	maxVersion := strconv.FormatInt(math.MaxInt64, 10)
+	for {
+		keys, cursor, err := kvs.Keys(ctx, start, "\xff", 100)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		for _, kv := range keys {
+			versions, _, err := kvs.Versions(ctx, kv.Key, maxVersion, 0)
+			if err != nil {
+				return err
+			}
+			for _, v := range versions.Versions {
+				if err := m.markKv(ctx, kvs, v); err != nil {
+					return err
+				}
+			}
+		}
+		start = cursor
+	}
+}
+
+// GC runs the garbage collector, the unreferenced blobs are only removed if `dryRun` is false
+func (gc *GC) GC(ctx context.Context, dryRun bool) (_ *Report, err error) {
+	gc.mu.Lock()
+	if gc.running {
+		gc.mu.Unlock()
+		return nil, ErrInProgress
+	}
+	gc.running = true
+	gc.mu.Unlock()
+	defer func() {
+		gc.mu.Lock()
+		gc.running = false
+		gc.mu.Unlock()
+	}()
+
+	t := time.Now()
+	defer func() {
+		status := "ok"
+		if err != nil {
+			status = "error"
+		} else {
+			lastRunMetric.With().Set(float64(time.Now().Unix()))
+		}
+		runsMetric.With(strconv.FormatBool(dryRun), status).Inc()
+		durationMetric.With(strconv.FormatBool(dryRun)).Observe(time.Since(t).Seconds())
+	}()
+
+	report := &Report{DryRun: dryRun}
+	m := &marker{
+		root:     gc.bs,
+		bs:       gc.stash.BlobStore(),
+		filetree: gc.filetree,
+		marked:   map[string]struct{}{},
+		trees:    map[string]struct{}{},
+		log:      gc.log,
+	}
+
+	// Mark phase
+	gc.log.Info("mark phase started")
+	if err := m.markKvStore(ctx, gc.stash.Root().KvStore()); err != nil {
+		return nil, err
+	}
+	for _, name := range gc.stash.ContextNames() {
+		dc, ok := gc.stash.DataContextByName(name)
+		if !ok || dc.Closed() {
+			continue
+		}
+		if err := m.markKvStore(ctxutil.WithNamespace(ctx, name), dc.KvStore()); err != nil {
+			return nil, err
+		}
+	}
+	report.KvEntries = m.kvEntries
+	gc.log.Info("mark phase done", "kv_entries", m.kvEntries, "marked", len(m.marked))
+
+	// Find the unreferenced blobs
+	refs, _, err := gc.bs.Enumerate(ctx, "", "\xff", 0)
+	if err != nil {
+		return nil, err
+	}
+	garbage := []*blob.SizedBlobRef{}
+	for _, ref := range refs {
+		report.BlobsCount++
+		report.BlobsSize += int64(ref.Size)
+		if _, ok := m.marked[ref.Hash]; ok {
+			report.LiveBlobsCount++
+			report.LiveBlobsSize += int64(ref.Size)
+			continue
+		}
+		garbage = append(garbage, ref)
+		report.GarbageBlobsCount++
+		report.GarbageBlobsSize += int64(ref.Size)
+	}
+	report.GarbageBlobsHuman = humanize.Bytes(uint64(report.GarbageBlobsSize))
+
+	// Sweep phase
+	if !dryRun && len(garbage) > 0 {
+		removed, err := gc.bs.Sweep(ctx, garbage)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range removed {
+			report.RemovedBlobsCount++
+			report.RemovedBlobsSize += int64(ref.Size)
+		}
+		removedMetric.With().Add(float64(report.RemovedBlobsCount))
+		removedBytesMetric.With().Add(float64(report.RemovedBlobsSize))
+	}
+
+	report.Duration = time.Since(t).String()
+	gc.log.Info("GC done", "dry_run", dryRun, "garbage", report.GarbageBlobsCount, "removed", report.RemovedBlobsCount,
+		"duration", report.Duration)
+	return report, nil
+}
+
+func (gc *GC) gcHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.GC, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		var dryRun bool
+		switch r.Method {
+		case "GET":
+			// GET always returns a dry run report
+			dryRun = true
+		case "POST":
+			var err error
+			q := httputil.NewQuery(r.URL.Query())
+			dryRun, err = q.GetBoolDefault("dry_run", false)
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		report, err := gc.GC(r.Context(), dryRun)
+		switch {
+		case err == nil:
+		case err == ErrInProgress:
+			httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+			return
+		case errors.Is(err, blobstore.ErrSweepNotAllowed):
+			httputil.WriteJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		default:
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": report,
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/rangedb"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Blob kinds recorded in the kind index
+const (
+	KindData     = "data"
+	KindMeta     = "meta"     // kv meta blobs (except the docstore and git ones)
+	KindNode     = "node"     // filetree nodes
+	KindDocstore = "docstore" // meta blobs of docstore documents
+	KindGit      = "git"      // meta blobs of git objects and refs
+)
+
+// Kinds lists all the blob kinds
+var Kinds = []string{KindData, KindMeta, KindNode, KindDocstore, KindGit}
+
+// metaKinds are the kinds of the blobs that must be replayed by a scan
+var metaKinds = []string{KindMeta, KindDocstore, KindGit}
+
+func isMetaKind(kind string) bool {
+	for _, k := range metaKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrUnknownKind is returned when enumerating an unknown kind
+var ErrUnknownKind = fmt.Errorf("unknown blob kind")
+
+// ValidKind returns an error if the kind is not supported
+func ValidKind(kind string) error {
+	for _, k := range Kinds {
+		if k == kind {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w \"%s\"", ErrUnknownKind, kind)
+}
+
+// BlobKind returns the kind of the given blob
+func BlobKind(b *blob.Blob) string {
+	if b.IsFiletreeNode() {
+		return KindNode
+	}
+	metaType, data, isMeta := meta.IsMetaBlob(b.Data)
+	if !isMeta {
+		return KindData
+	}
+	if metaType == vkv.KvType {
+		kv, err := vkv.UnserializeBlob(data)
+		if err == nil {
+			switch {
+			case strings.HasPrefix(kv.Key, "docstore:"):
+				return KindDocstore
+			case strings.HasPrefix(kv.Key, "_git:"):
+				return KindGit
+			}
+		}
+	}
+	return KindMeta
+}
+
+// Kind index keys prefixes
+const (
+	kindFlagKind   byte = iota // <flag><kind>:<hash> => <size>
+	kindFlagHash               // <flag><hash> => <kind>
+	kindFlagStatus             // <flag>backfilled
+)
+
+var kindBackfilledKey = append([]byte{kindFlagStatus}, []byte("backfilled")...)
+
+// kindIndex is a persistent side index recording the kind of each blob, so the blobs can be enumerated by kind without
+// reading them
+type kindIndex struct {
+	db *rangedb.RangeDB
+}
+
+func newKindIndex(path string) (*kindIndex, error) {
+	db, err := rangedb.New(path)
+	if err != nil {
+		return nil, err
+	}
+	return &kindIndex{db}, nil
+}
+
+func kindKey(kind, hash string) []byte {
+	return append([]byte{kindFlagKind}, []byte(kind+":"+hash)...)
+}
+
+func hashKey(hash string) []byte {
+	return append([]byte{kindFlagHash}, []byte(hash)...)
+}
+
+func (ki *kindIndex) add(hash, kind string, size int) error {
+	bsize := make([]byte, 4)
+	binary.BigEndian.PutUint32(bsize, uint32(size))
+	if err := ki.db.Set(kindKey(kind, hash), bsize); err != nil {
+		return err
+	}
+	return ki.db.Set(hashKey(hash), []byte(kind))
+}
+
+// kind returns the kind of the blob, or an empty string if the blob is not indexed
+func (ki *kindIndex) kind(hash string) (string, error) {
+	kind, err := ki.db.Get(hashKey(hash))
+	if err != nil {
+		return "", err
+	}
+	return string(kind), nil
+}
+
+func (ki *kindIndex) remove(hash string) error {
+	kind, err := ki.kind(hash)
+	if err != nil || kind == "" {
+		return err
+	}
+	if err := ki.db.Delete(kindKey(kind, hash)); err != nil {
+		return err
+	}
+	return ki.db.Delete(hashKey(hash))
+}
+
+// enumerate returns the blobs of the given kind in the [start, end] range
+func (ki *kindIndex) enumerate(kind, start, end string, limit int) ([]*blob.SizedBlobRef, error) {
+	refs := []*blob.SizedBlobRef{}
+	prefixLen := len(kind) + 2
+	r := ki.db.Range(kindKey(kind, start), kindKey(kind, end), false)
+	defer r.Close()
+	k, v, err := r.Next()
+	for ; err == nil && (limit == 0 || len(refs) < limit); k, v, err = r.Next() {
+		refs = append(refs, &blob.SizedBlobRef{Hash: string(k[prefixLen:]), Size: int(binary.BigEndian.Uint32(v))})
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// enumerateAll returns the blobs of any kind in the [start, end] range
+func (ki *kindIndex) enumerateAll(start, end string) ([]*blob.SizedBlobRef, error) {
+	refs := []*blob.SizedBlobRef{}
+	r := ki.db.Range(hashKey(start), hashKey(end), false)
+	defer r.Close()
+	k, v, err := r.Next()
+	for ; err == nil; k, v, err = r.Next() {
+		hash := string(k[1:])
+		bsize, err := ki.db.Get(kindKey(string(v), hash))
+		if err != nil {
+			return nil, err
+		}
+		ref := &blob.SizedBlobRef{Hash: hash}
+		if len(bsize) == 4 {
+			ref.Size = int(binary.BigEndian.Uint32(bsize))
+		}
+		refs = append(refs, ref)
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// backfilled returns true if all the blobs stored before the index was created have been indexed
+func (ki *kindIndex) backfilled() (bool, error) {
+	return ki.db.Has(kindBackfilledKey)
+}
+
+func (ki *kindIndex) setBackfilled() error {
+	return ki.db.Set(kindBackfilledKey, []byte{1})
+}
+
+func (ki *kindIndex) Close() error {
+	return ki.db.Close()
+}
@@ -0,0 +1,104 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func TestEnumerateKind(t *testing.T) {
+	dir := "kinds_test"
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	bs, err := New(logger, true, dir, nil, hub.New(logger, true))
+	if err != nil {
+		panic(err)
+	}
+	defer bs.Close()
+
+	// Only used to build meta blobs
+	m, err := meta.New(logger, hub.New(logger, true))
+	if err != nil {
+		panic(err)
+	}
+
+	expected := map[string]int{}
+	put := func(b *blob.Blob, kind string) {
+		if _, err := bs.Put(context.Background(), b); err != nil {
+			panic(err)
+		}
+		expected[kind]++
+	}
+	for i := 0; i < 10; i++ {
+		put(blob.New([]byte(fmt.Sprintf("data%d", i))), KindData)
+	}
+	for i, key := range []string{"docstore:col:1", "_git:ns:repo!o!abc", "hello"} {
+		b, err := m.Build(&vkv.KeyValue{Key: key, Version: int64(i + 1), Data: []byte("ok")})
+		if err != nil {
+			panic(err)
+		}
+		put(b, []string{KindDocstore, KindGit, KindMeta}[i])
+	}
+	h, data := (&node.RawNode{Type: "file", Name: "test.txt"}).Encode()
+	put(&blob.Blob{Hash: h, Data: data}, KindNode)
+
+	check := func() {
+		for _, kind := range Kinds {
+			refs, _, err := bs.EnumerateKind(context.Background(), kind, "", "\xff", 0)
+			if err != nil {
+				panic(err)
+			}
+			if len(refs) != expected[kind] {
+				t.Errorf("kind %s: expected %d blobs, got %d", kind, expected[kind], len(refs))
+			}
+		}
+	}
+
+	// Blobs from before the index was created are read
+	if err := bs.kinds.remove(h); err != nil {
+		panic(err)
+	}
+	check()
+
+	// And once backfilled, only the index is used
+	if err := bs.Scan(context.Background()); err != nil {
+		panic(err)
+	}
+	if backfilled, _ := bs.kinds.backfilled(); !backfilled {
+		t.Errorf("the kind index should be backfilled")
+	}
+	check()
+
+	// A blob written directly to the storage engine (e.g. restored from S3) is indexed by the next scan
+	restored := blob.New([]byte("restored"))
+	if err := bs.back.Put(restored.Hash, restored.Data); err != nil {
+		panic(err)
+	}
+	expected[KindData]++
+	if err := bs.Scan(context.Background()); err != nil {
+		panic(err)
+	}
+	check()
+
+	refs, cursor, err := bs.EnumerateKind(context.Background(), KindData, "", "\xff", 4)
+	if err != nil {
+		panic(err)
+	}
+	if len(refs) != 4 || cursor != NextHexKey(refs[3].Hash) {
+		t.Errorf("bad pagination, got %d blobs, cursor=%s", len(refs), cursor)
+	}
+
+	if _, _, err := bs.EnumerateKind(context.Background(), "nope", "", "\xff", 0); err == nil {
+		t.Errorf("unknown kind should fail")
+	}
+}
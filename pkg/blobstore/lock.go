@@ -0,0 +1,52 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"sync"
+)
+
+// locker provides a lock for each blob hash (the locks are removed once released)
+type locker struct {
+	locks map[string]chan struct{} // Map of lock for each blob hash
+
+	mu *sync.Mutex // Guard for the locks
+}
+
+func newLocker() *locker {
+	return &locker{
+		locks: map[string]chan struct{}{},
+		mu:    &sync.Mutex{},
+	}
+}
+
+func (l *locker) Lock(hash string) {
+	for {
+		l.mu.Lock()
+		// Try to retrieve the existing lock
+		lchan, ok := l.locks[hash]
+		if !ok {
+			// It does not exists, create it
+			l.locks[hash] = make(chan struct{})
+		}
+		l.mu.Unlock()
+
+		if !ok {
+			// The lock was acquired successfully
+			return
+		}
+		// Block until the channel is closed (i.e. the lock has been released)
+		<-lchan
+	}
+}
+
+func (l *locker) Unlock(hash string) {
+	l.mu.Lock()
+	lchan, ok := l.locks[hash]
+	if !ok {
+		panic("trying to unlock an unlocked lock")
+	}
+	delete(l.locks, hash)
+	l.mu.Unlock()
+
+	// Wake up the goroutines waiting for the lock
+	close(lchan)
+}
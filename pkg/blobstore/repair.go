@@ -0,0 +1,69 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"context"
+	"fmt"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+// Repair replaces the given blobs in the local storage engine, used to restore corrupt or missing blobs from a
+// replica (the corrupt local copies are removed first).
+//
+// No events are triggered as the blobs content is unchanged, the packs rewritten to remove the corrupt copies are
+// uploaded again to the replication targets.
+func (bs *BlobStore) Repair(ctx context.Context, blobs []*blob.Blob) error {
+	remove := map[string]struct{}{}
+	for _, b := range blobs {
+		if err := b.Check(); err != nil {
+			return err
+		}
+		exists, err := bs.back.Exists(b.Hash)
+		if err != nil {
+			return err
+		}
+		if exists {
+			remove[b.Hash] = struct{}{}
+		}
+	}
+
+	if len(remove) > 0 {
+		if err := bs.back.Compact(remove); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range blobs {
+		if err := bs.back.Put(b.Hash, b.Data); err != nil {
+			return err
+		}
+		if err := bs.kinds.add(b.Hash, BlobKind(b), len(b.Data)); err != nil {
+			return err
+		}
+		if bs.tiering != nil {
+			if err := bs.tiering.saved(b); err != nil {
+				return err
+			}
+		}
+		bs.log.Info("blob repaired", "hash", b.Hash)
+	}
+	return nil
+}
+
+// CheckBlob reads the blob from the local storage engine and verifies its hash, the blob size is returned (the read
+// does not count as an access for the tiered storage).
+func (bs *BlobStore) CheckBlob(hash string) (int, error) {
+	data, err := bs.back.Get(hash)
+	if err != nil {
+		return 0, err
+	}
+	chash, err := hashutil.ComputeLike(hash, data)
+	if err != nil {
+		return len(data), err
+	}
+	if chash != hash {
+		return len(data), fmt.Errorf("%w: computed=%s", blob.ErrHashMismatch, chash)
+	}
+	return len(data), nil
+}
@@ -0,0 +1,89 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+// waitForPackSum waits until the checksum recorded for the uploaded pack is set and differs from `previous`
+func waitForPackSum(t *testing.T, path, previous string) string {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if data, err := ioutil.ReadFile(path); err == nil && len(data) > 0 && string(data) != previous {
+			return string(data)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("the pack was not uploaded")
+	return ""
+}
+
+func TestRepairUploadsPacks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_repair_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(size int64) {
+		packSize = size
+	}(packSize)
+	packSize = 64 * 1024
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+
+	remoteDir := filepath.Join(dir, "remote")
+	if err := os.MkdirAll(remoteDir, 0700); err != nil {
+		panic(err)
+	}
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("6368616e676520746869732070617373"), 0600); err != nil {
+		panic(err)
+	}
+	conf := &config.Config{
+		DataDir: filepath.Join(dir, "data"),
+		S3Repls: config.S3Repls{&config.S3Repl{Dir: remoteDir, KeyFile: keyFile}},
+	}
+	bs, err := New(logger, true, conf.DataDir, conf, hub.New(logger, true))
+	if err != nil {
+		panic(err)
+	}
+	defer bs.Close()
+	ctx := context.Background()
+
+	// Fill the first pack (random data so the blobs are not compressed)
+	blobs := []*blob.Blob{}
+	for i := 0; i < 24; i++ {
+		data := make([]byte, 4096)
+		if _, err := rand.Read(data); err != nil {
+			panic(err)
+		}
+		b := &blob.Blob{Hash: hashutil.Compute(data), Data: data}
+		if _, err := bs.Put(ctx, b); err != nil {
+			panic(err)
+		}
+		blobs = append(blobs, b)
+	}
+	sumPath := filepath.Join(remoteDir, "packs-sum", "blobs-00000")
+	sum := waitForPackSum(t, sumPath, "")
+
+	// The repaired blob is moved out of the first pack, that is rewritten under the same name
+	if err := bs.Repair(ctx, []*blob.Blob{blobs[0]}); err != nil {
+		panic(err)
+	}
+	waitForPackSum(t, sumPath, sum)
+	if data, err := bs.Get(ctx, blobs[0].Hash); err != nil || string(data) != string(blobs[0].Data) {
+		t.Errorf("failed to get the repaired blob: %v", err)
+	}
+}
@@ -0,0 +1,453 @@
+package scrub // import "a4.io/blobstash/pkg/blobstore/scrub"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/client/oplog"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// ErrInProgress is returned when a scrub is already running
+var ErrInProgress = fmt.Errorf("a scrub is already in progress")
+
+// Issue kinds
+const (
+	Corrupt = "corrupt" // the local blob content does not match its hash (or cannot be read)
+	Missing = "missing" // the blob is indexed in S3 but missing locally
+)
+
+// Repair sources
+const (
+	FromS3            = "s3" // followed by ":<target name>"
+	FromReplicateFrom = "replicate_from"
+)
+
+// Issue is an integrity issue detected by the scrubber
+type Issue struct {
+	Hash       string `json:"hash"`
+	Kind       string `json:"kind"`
+	Error      string `json:"error,omitempty"`
+	DetectedAt string `json:"detected_at"`
+
+	Repaired     bool   `json:"repaired"`
+	RepairedFrom string `json:"repaired_from,omitempty"`
+	RepairError  string `json:"repair_error,omitempty"`
+}
+
+// Report holds the result of the last (or current) scrub
+type Report struct {
+	Running    bool   `json:"running"`
+	StartedAt  string `json:"started_at"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	Error      string `json:"error,omitempty"`
+
+	BlobsChecked      int    `json:"blobs_checked"`
+	BytesChecked      int64  `json:"bytes_checked"`
+	BytesCheckedHuman string `json:"bytes_checked_human"`
+
+	// Number of entries of the S3 index cross-checked against the local store
+	S3IndexChecked int `json:"s3_index_checked"`
+
+	Issues []*Issue `json:"issues"`
+}
+
+// Scrubber periodically walks all the blobs of the root blobstore to detect bit rot, the corrupt/missing blobs are
+// repaired from the S3 replica or the `replicate_from` peer when possible.
+type Scrubber struct {
+	bs   *blobstore.BlobStore
+	peer *oplog.Oplog
+
+	// Max read rate in bytes/second (0 means unlimited)
+	rate     int64
+	interval time.Duration
+
+	// Path of the persisted report
+	path string
+
+	report  *Report
+	running bool
+	mu      sync.Mutex
+
+	trigger chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	log log.Logger
+}
+
+// New initializes the scrubber, the background scrubs only starts if the `scrub` config item is set
+func New(logger log.Logger, conf *config.Config, bs *blobstore.BlobStore) (*Scrubber, error) {
+	logger.Debug("init")
+	s := &Scrubber{
+		bs:       bs,
+		interval: 168 * time.Hour,
+		path:     filepath.Join(conf.VarDir(), "scrub.json"),
+		trigger:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		log:      logger,
+	}
+	if conf.ReplicateFrom != nil {
+		s.peer = oplog.New(clientutil.NewClientUtil(conf.ReplicateFrom.URL,
+			clientutil.WithAPIKey(conf.ReplicateFrom.APIKey)))
+	}
+	if sconf := conf.Scrub; sconf != nil {
+		if sconf.Rate != "" {
+			rate, err := humanize.ParseBytes(sconf.Rate)
+			if err != nil {
+				return nil, fmt.Errorf("invalid scrub rate: %v", err)
+			}
+			s.rate = int64(rate)
+		}
+		if sconf.Interval != "" {
+			var err error
+			if s.interval, err = time.ParseDuration(sconf.Interval); err != nil {
+				return nil, fmt.Errorf("invalid scrub interval: %v", err)
+			}
+		}
+	}
+
+	// Load the last report
+	data, err := ioutil.ReadFile(s.path)
+	switch {
+	case err == nil:
+		s.report = &Report{}
+		if err := json.Unmarshal(data, s.report); err != nil {
+			return nil, fmt.Errorf("failed to load scrub report: %v", err)
+		}
+		// The server was stopped during the scrub
+		s.report.Running = false
+	case os.IsNotExist(err):
+	default:
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.run(conf.Scrub != nil)
+	return s, nil
+}
+
+// Register the admin endpoint
+func (s *Scrubber) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/_scrub", basicAuth(http.HandlerFunc(s.scrubHandler())))
+}
+
+// Close stops the scrubber (and waits for the current scrub to stop)
+func (s *Scrubber) Close() error {
+	close(s.stop)
+	s.wg.Wait()
+	return nil
+}
+
+// Report returns a copy of the last (or current) report
+func (s *Scrubber) Report() *Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.report == nil {
+		return nil
+	}
+	report := *s.report
+	report.Issues = make([]*Issue, len(s.report.Issues))
+	for i, issue := range s.report.Issues {
+		icopy := *issue
+		report.Issues[i] = &icopy
+	}
+	return &report
+}
+
+// Trigger starts a scrub in the background
+func (s *Scrubber) Trigger() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return ErrInProgress
+	}
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Scrubber) run(periodic bool) {
+	defer s.wg.Done()
+	for {
+		var next <-chan time.Time
+		if periodic {
+			wait := s.interval
+			if last := s.Report(); last != nil {
+				if started, err := time.Parse(time.RFC3339, last.StartedAt); err == nil {
+					wait = time.Until(started.Add(s.interval))
+				}
+			}
+			if wait < 0 {
+				wait = 0
+			}
+			next = time.After(wait)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-s.trigger:
+		case <-next:
+		}
+		if err := s.Scrub(context.Background()); err != nil && err != ErrInProgress {
+			s.log.Error("scrub failed", "err", err)
+		}
+	}
+}
+
+// save persists the current report, must be called with the lock held
+func (s *Scrubber) save() error {
+	data, err := json.Marshal(s.report)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// update applies `f` to the current report and persists it
+func (s *Scrubber) update(f func(*Report)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s.report)
+	return s.save()
+}
+
+// throttle blocks to keep the read rate under the limit, false is returned if the scrubber is stopping
+func (s *Scrubber) throttle(start time.Time, bytesRead int64) bool {
+	if s.rate > 0 {
+		expected := time.Duration(float64(bytesRead) / float64(s.rate) * float64(time.Second))
+		if d := expected - time.Since(start); d > 0 {
+			select {
+			case <-s.stop:
+				return false
+			case <-time.After(d):
+			}
+		}
+	}
+	select {
+	case <-s.stop:
+		return false
+	default:
+		return true
+	}
+}
+
+// fetch retrieves a verified copy of the blob from one of the replicas
+func (s *Scrubber) fetch(ctx context.Context, hash string) ([]byte, string, error) {
+	var errs []string
+	for _, s3back := range s.bs.S3Backends() {
+		indexed, err := s3back.Indexed(hash)
+		if err != nil {
+			return nil, "", err
+		}
+		if indexed {
+			data, err := s3back.Get(hash)
+			if err == nil {
+				return data, FromS3 + ":" + s3back.Name(), nil
+			}
+			errs = append(errs, fmt.Sprintf("s3:%s: %v", s3back.Name(), err))
+		}
+	}
+	if s.peer != nil {
+		data, err := s.peer.GetBlob(ctx, hash)
+		if err == nil {
+			err = (&blob.Blob{Hash: hash, Data: data}).Check()
+		}
+		if err == nil {
+			return data, FromReplicateFrom, nil
+		}
+		errs = append(errs, fmt.Sprintf("replicate_from: %v", err))
+	}
+	if len(errs) == 0 {
+		return nil, "", fmt.Errorf("no replica available")
+	}
+	return nil, "", fmt.Errorf("%v", errs)
+}
+
+// Scrub checks all the blobs, and tries to repair the corrupt/missing ones
+func (s *Scrubber) Scrub(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return ErrInProgress
+	}
+	s.running = true
+	start := time.Now()
+	s.report = &Report{Running: true, StartedAt: start.Format(time.RFC3339), Issues: []*Issue{}}
+	s.mu.Unlock()
+	s.log.Info("scrub started")
+
+	err := s.scrub(ctx, start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	s.report.Running = false
+	s.report.FinishedAt = time.Now().Format(time.RFC3339)
+	if err != nil {
+		s.report.Error = err.Error()
+	}
+	s.log.Info("scrub done", "blobs", s.report.BlobsChecked, "issues", len(s.report.Issues), "err", err,
+		"duration", time.Since(start))
+	if serr := s.save(); serr != nil {
+		return serr
+	}
+	return err
+}
+
+func (s *Scrubber) addIssue(issue *Issue) error {
+	s.log.Warn("integrity issue detected", "hash", issue.Hash, "kind", issue.Kind, "err", issue.Error)
+	issue.DetectedAt = time.Now().Format(time.RFC3339)
+	return s.update(func(r *Report) {
+		r.Issues = append(r.Issues, issue)
+	})
+}
+
+func (s *Scrubber) scrub(ctx context.Context, start time.Time) error {
+	// Re-hash all the local blobs
+	refs, _, err := s.bs.Enumerate(ctx, "", "\xff", 0)
+	if err != nil {
+		return err
+	}
+	var bytesRead int64
+	issues := []*Issue{}
+	for _, ref := range refs {
+		size, err := s.bs.CheckBlob(ref.Hash)
+		bytesRead += int64(size)
+		switch {
+		case err == nil:
+		case err == blobstore.ErrBlobNotFound:
+			// The blob may have been evicted/removed since the enumeration
+		default:
+			issue := &Issue{Hash: ref.Hash, Kind: Corrupt, Error: err.Error()}
+			if err := s.addIssue(issue); err != nil {
+				return err
+			}
+			issues = append(issues, issue)
+		}
+		s.mu.Lock()
+		s.report.BlobsChecked++
+		s.report.BytesChecked = bytesRead
+		s.report.BytesCheckedHuman = humanize.Bytes(uint64(bytesRead))
+		s.mu.Unlock()
+		if !s.throttle(start, bytesRead) {
+			return fmt.Errorf("scrub interrupted")
+		}
+	}
+
+	// Cross-check the S3 indexes against the local store (a blob can be indexed by several targets)
+	missing := map[string]bool{}
+	for _, s3back := range s.bs.S3Backends() {
+		if err := s3back.IterIndexed(func(hash string) error {
+			s.mu.Lock()
+			s.report.S3IndexChecked++
+			s.mu.Unlock()
+			exists, err := s.bs.Stat(ctx, hash)
+			if err != nil {
+				return err
+			}
+			if !exists && !missing[hash] {
+				missing[hash] = true
+				issue := &Issue{Hash: hash, Kind: Missing}
+				if err := s.addIssue(issue); err != nil {
+					return err
+				}
+				issues = append(issues, issue)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return s.repair(ctx, issues)
+}
+
+// repair fetches the blobs from the replicas and replaces them all at once (as BlobsFile packs must be rewritten)
+func (s *Scrubber) repair(ctx context.Context, issues []*Issue) error {
+	blobs := []*blob.Blob{}
+	repaired := []*Issue{}
+	sources := []string{}
+	for _, issue := range issues {
+		data, from, err := s.fetch(ctx, issue.Hash)
+		if err != nil {
+			if err := s.update(func(*Report) { issue.RepairError = err.Error() }); err != nil {
+				return err
+			}
+			continue
+		}
+		blobs = append(blobs, &blob.Blob{Hash: issue.Hash, Data: data})
+		repaired = append(repaired, issue)
+		sources = append(sources, from)
+	}
+	if len(blobs) == 0 {
+		return nil
+	}
+
+	rerr := s.bs.Repair(ctx, blobs)
+	return s.update(func(*Report) {
+		for i, issue := range repaired {
+			if rerr != nil {
+				issue.RepairError = rerr.Error()
+				continue
+			}
+			issue.Repaired = true
+			issue.RepairedFrom = sources[i]
+		}
+	})
+}
+
+func (s *Scrubber) scrubHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": s.Report(),
+			})
+		case "POST":
+			if err := s.Trigger(); err != nil {
+				if err == ErrInProgress {
+					httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+					return
+				}
+				panic(err)
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
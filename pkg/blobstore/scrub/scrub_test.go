@@ -0,0 +1,85 @@
+package scrub
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestScrubDetectsCorruptBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_scrub_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{DataDir: dir, StorageEngine: blobstore.DirEngine}
+	bs, err := blobstore.New(logger, true, dir, conf, hub.New(logger, true))
+	if err != nil {
+		panic(err)
+	}
+	defer bs.Close()
+
+	hashes := []string{}
+	for i := 0; i < 10; i++ {
+		data := []byte(fmt.Sprintf("hello%d", i))
+		b := &blob.Blob{Hash: hashutil.Compute(data), Data: data}
+		if _, err := bs.Put(context.Background(), b); err != nil {
+			panic(err)
+		}
+		hashes = append(hashes, b.Hash)
+	}
+
+	// Flip the content of one blob
+	corrupt := hashes[3]
+	if err := ioutil.WriteFile(filepath.Join(dir, "blobs-dir", corrupt[0:2], corrupt), []byte("oops"), 0600); err != nil {
+		panic(err)
+	}
+
+	s, err := New(logger, conf, bs)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	if err := s.Scrub(context.Background()); err != nil {
+		panic(err)
+	}
+
+	report := s.Report()
+	if report.BlobsChecked != 10 {
+		t.Errorf("expected 10 blobs checked, got %d", report.BlobsChecked)
+	}
+	if len(report.Issues) != 1 {
+		t.Fatalf("expected 1 issue, got %d", len(report.Issues))
+	}
+	issue := report.Issues[0]
+	if issue.Hash != corrupt || issue.Kind != Corrupt {
+		t.Errorf("unexpected issue %+v", issue)
+	}
+	// No replica is available
+	if issue.Repaired || issue.RepairError == "" {
+		t.Errorf("the blob should not be repaired: %+v", issue)
+	}
+
+	// The report must be persisted
+	s2, err := New(logger, conf, bs)
+	if err != nil {
+		panic(err)
+	}
+	defer s2.Close()
+	if r := s2.Report(); r == nil || len(r.Issues) != 1 {
+		t.Errorf("failed to reload the report: %+v", r)
+	}
+}
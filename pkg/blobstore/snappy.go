@@ -0,0 +1,124 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// snappyWindow is the size of the blocks compressed independently by the Snappy encoder, copies never reference the
+// data of a previous block
+const snappyWindow = 65536
+
+var errSnappyCorrupt = errors.New("snappy: corrupt input")
+
+// snappyReader decodes a Snappy block (as written in the BlobsFile records) as a stream, only the last
+// `snappyWindow` decoded bytes are kept in memory
+type snappyReader struct {
+	r *bufio.Reader
+
+	// The decoded bytes not produced yet
+	left uint64
+
+	// The last decoded bytes (for the copies), followed by the bytes not read yet (starting at `off`)
+	buf []byte
+	off int
+
+	err error
+}
+
+func newSnappyReader(r io.Reader) (*snappyReader, error) {
+	br := bufio.NewReader(r)
+	left, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, errSnappyCorrupt
+	}
+	return &snappyReader{r: br, left: left}, nil
+}
+
+// Read implements io.Reader
+func (s *snappyReader) Read(p []byte) (int, error) {
+	for s.off == len(s.buf) {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.err = s.decode()
+	}
+	n := copy(p, s.buf[s.off:])
+	s.off += n
+	return n, nil
+}
+
+// decode decodes the next element (a literal or a copy), must be called once all the decoded bytes are read
+func (s *snappyReader) decode() error {
+	if s.left == 0 {
+		return io.EOF
+	}
+	if len(s.buf) > 2*snappyWindow {
+		n := copy(s.buf, s.buf[len(s.buf)-snappyWindow:])
+		s.buf = s.buf[:n]
+		s.off = n
+	}
+
+	tag, err := s.r.ReadByte()
+	if err != nil {
+		return errSnappyCorrupt
+	}
+	var b [4]byte
+	var length, offset int
+	switch tag & 0x03 {
+	case 0x00:
+		// Literal
+		x := uint32(tag >> 2)
+		if x >= 60 {
+			n := int(x - 59)
+			if _, err := io.ReadFull(s.r, b[:n]); err != nil {
+				return errSnappyCorrupt
+			}
+			x = binary.LittleEndian.Uint32(b[:])
+		}
+		length = int(x) + 1
+		if length > snappyWindow || uint64(length) > s.left {
+			return errSnappyCorrupt
+		}
+		start := len(s.buf)
+		s.buf = append(s.buf, make([]byte, length)...)
+		if _, err := io.ReadFull(s.r, s.buf[start:]); err != nil {
+			return errSnappyCorrupt
+		}
+		s.left -= uint64(length)
+		return nil
+	case 0x01:
+		// Copy with a 1 byte offset
+		x, err := s.r.ReadByte()
+		if err != nil {
+			return errSnappyCorrupt
+		}
+		length = 4 + int(tag>>2)&0x07
+		offset = int(tag&0xe0)<<3 | int(x)
+	case 0x02:
+		// Copy with a 2 bytes offset
+		if _, err := io.ReadFull(s.r, b[:2]); err != nil {
+			return errSnappyCorrupt
+		}
+		length = 1 + int(tag>>2)
+		offset = int(binary.LittleEndian.Uint16(b[:2]))
+	case 0x03:
+		// Copy with a 4 bytes offset
+		if _, err := io.ReadFull(s.r, b[:]); err != nil {
+			return errSnappyCorrupt
+		}
+		length = 1 + int(tag>>2)
+		offset = int(binary.LittleEndian.Uint32(b[:]))
+	}
+	if offset <= 0 || offset > len(s.buf) || uint64(length) > s.left {
+		return errSnappyCorrupt
+	}
+	// The copy may overlap the bytes it produces
+	for i := 0; i < length; i++ {
+		s.buf = append(s.buf, s.buf[len(s.buf)-offset])
+	}
+	s.left -= uint64(length)
+	return nil
+}
@@ -0,0 +1,114 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/blob"
+)
+
+// GCGracePeriod is the duration during which a freshly uploaded blob cannot be garbage collected (clients upload the
+// data blobs before the meta blobs/kv entries that reference them).
+var GCGracePeriod = 1 * time.Hour
+
+// ErrSweepNotAllowed is returned when trying to remove blobs from a blobstore that does not support it
+var ErrSweepNotAllowed = fmt.Errorf("sweep not allowed")
+
+// recentBlobs keeps track of the blobs uploaded during the grace period (even if they were already stored), grouped
+// by minute.
+type recentBlobs struct {
+	buckets map[int64]map[string]struct{}
+	started time.Time
+	sync.Mutex
+}
+
+func newRecentBlobs() *recentBlobs {
+	return &recentBlobs{
+		buckets: map[int64]map[string]struct{}{},
+		started: time.Now(),
+	}
+}
+
+func (r *recentBlobs) add(hash string) {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now().Unix() / 60
+	bucket, ok := r.buckets[now]
+	if !ok {
+		// Drop the expired buckets
+		limit := now - int64(GCGracePeriod/time.Minute)
+		for k := range r.buckets {
+			if k < limit {
+				delete(r.buckets, k)
+			}
+		}
+		bucket = map[string]struct{}{}
+		r.buckets[now] = bucket
+	}
+	bucket[hash] = struct{}{}
+}
+
+// contains must be called with the lock held
+func (r *recentBlobs) contains(hash string) bool {
+	for _, bucket := range r.buckets {
+		if _, ok := bucket[hash]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Sweep permanently removes the given (unreferenced) blobs from the root blobstore and returns the removed blobs.
+//
+// The blobs uploaded during the last `GCGracePeriod` are always kept, and a GarbageCollection event is triggered for
+// each removed blob.
+func (bs *BlobStore) Sweep(ctx context.Context, garbage []*blob.SizedBlobRef) ([]*blob.SizedBlobRef, error) {
+	if !bs.root {
+		return nil, ErrSweepNotAllowed
+	}
+	// Removing blobs would mess with the packs already uploaded to S3
+	if len(bs.s3backs) > 0 || len(bs.brokenS3) > 0 {
+		return nil, fmt.Errorf("%w: not supported when S3 replication is enabled", ErrSweepNotAllowed)
+	}
+
+	// Prevent blobs from being uploaded while the blobs are being removed
+	bs.recent.Lock()
+	defer bs.recent.Unlock()
+
+	// Blobs uploaded before the server started are unknown
+	if time.Since(bs.recent.started) < GCGracePeriod {
+		return nil, fmt.Errorf("%w: the server must be up for at least %s", ErrSweepNotAllowed, GCGracePeriod)
+	}
+
+	removed := []*blob.SizedBlobRef{}
+	toRemove := map[string]struct{}{}
+	for _, ref := range garbage {
+		if bs.recent.contains(ref.Hash) {
+			continue
+		}
+		toRemove[ref.Hash] = struct{}{}
+		removed = append(removed, ref)
+	}
+
+	if len(removed) == 0 {
+		return removed, nil
+	}
+
+	bs.log.Info("OP Sweep", "blobs", len(removed))
+	if err := bs.back.Compact(toRemove); err != nil {
+		return nil, err
+	}
+
+	for _, ref := range removed {
+		if err := bs.kinds.remove(ref.Hash); err != nil {
+			return nil, err
+		}
+		if err := bs.hub.GarbageCollectionEvent(ctx, &blob.Blob{Hash: ref.Hash}, ref); err != nil {
+			return nil, err
+		}
+	}
+
+	return removed, nil
+}
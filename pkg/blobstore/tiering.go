@@ -0,0 +1,358 @@
+package blobstore // import "a4.io/blobstash/pkg/blobstore"
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// accessResolution is the minimum duration between two updates of the last access time of a blob (to prevent
+// writing to the index for every read)
+var accessResolution = 10 * time.Minute
+
+// Blob kinds stored along with the last access time
+const (
+	kindUnknown byte = iota
+	kindData
+	kindSpecial // meta and filetree node blobs, never evicted
+)
+
+// remoteStore is the remote storage where the evicted blobs are fetched from (implemented by the S3 backend)
+type remoteStore interface {
+	// Indexed returns true if the blob has been uploaded
+	Indexed(hash string) (bool, error)
+
+	// Get returns the decrypted blob content (verified by `fetch`)
+	Get(hash string) ([]byte, error)
+}
+
+// tiering implements the tiered storage mode.
+//
+// The data blobs that are cold (not read for `maxAge`, or the least recently read ones when the local storage is above
+// `maxSize`) and already uploaded to S3 are evicted from the local storage engine, a read miss will fetch the blob
+// from S3 (and re-cache it locally if `recache` is set).
+//
+// The evicted blobs are not listed by `Enumerate`.
+type tiering struct {
+	back   Backend
+	remote remoteStore
+
+	maxAge   time.Duration
+	maxSize  int64
+	recache  bool
+	interval time.Duration
+
+	// The last access time and kind of each local blob
+	db *rangedb.RangeDB
+
+	// The evicted blobs are removed from the kind index (optional)
+	kinds *kindIndex
+
+	mu             sync.Mutex
+	lastEviction   time.Time
+	evictedCount   int
+	evictedSize    int64
+	fetchedCount   int
+	lastEvictError string
+
+	log log.Logger
+}
+
+func newTiering(logger log.Logger, back Backend, remote remoteStore, conf *config.Tiering, path string) (*tiering, error) {
+	t := &tiering{
+		back:     back,
+		remote:   remote,
+		recache:  conf.Recache,
+		interval: 1 * time.Hour,
+		log:      logger,
+	}
+	var err error
+	if conf.MaxAge != "" {
+		if t.maxAge, err = time.ParseDuration(conf.MaxAge); err != nil {
+			return nil, fmt.Errorf("invalid tiering max_age: %v", err)
+		}
+	}
+	if conf.MaxSize != "" {
+		maxSize, err := humanize.ParseBytes(conf.MaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tiering max_size: %v", err)
+		}
+		t.maxSize = int64(maxSize)
+	}
+	if conf.Interval != "" {
+		if t.interval, err = time.ParseDuration(conf.Interval); err != nil {
+			return nil, fmt.Errorf("invalid tiering interval: %v", err)
+		}
+	}
+	if t.db, err = rangedb.New(path); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func encodeAccess(kind byte, t time.Time) []byte {
+	out := make([]byte, 9)
+	out[0] = kind
+	binary.BigEndian.PutUint64(out[1:], uint64(t.Unix()))
+	return out
+}
+
+func decodeAccess(data []byte) (byte, time.Time) {
+	if len(data) != 9 {
+		return kindUnknown, time.Time{}
+	}
+	return data[0], time.Unix(int64(binary.BigEndian.Uint64(data[1:])), 0)
+}
+
+func (t *tiering) getAccess(hash string) (byte, time.Time, error) {
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return kindUnknown, time.Time{}, err
+	}
+	data, err := t.db.Get(bhash)
+	if err != nil {
+		return kindUnknown, time.Time{}, err
+	}
+	kind, lastAccess := decodeAccess(data)
+	return kind, lastAccess, nil
+}
+
+func (t *tiering) setAccess(hash string, kind byte, lastAccess time.Time) error {
+	bhash, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	return t.db.Set(bhash, encodeAccess(kind, lastAccess))
+}
+
+func blobKind(b *blob.Blob) byte {
+	if b.IsMeta() || b.IsFiletreeNode() {
+		return kindSpecial
+	}
+	return kindData
+}
+
+// saved must be called each time a blob is saved locally
+func (t *tiering) saved(b *blob.Blob) error {
+	return t.setAccess(b.Hash, blobKind(b), time.Now())
+}
+
+// accessed must be called each time a blob is read locally
+func (t *tiering) accessed(hash string) error {
+	kind, lastAccess, err := t.getAccess(hash)
+	if err != nil {
+		return err
+	}
+	if time.Since(lastAccess) < accessResolution {
+		return nil
+	}
+	return t.setAccess(hash, kind, time.Now())
+}
+
+// fetch retrieves an evicted blob from the remote storage, `ErrBlobNotFound` is returned if the blob has never been
+// uploaded
+func (t *tiering) fetch(hash string) ([]byte, error) {
+	indexed, err := t.remote.Indexed(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !indexed {
+		return nil, ErrBlobNotFound
+	}
+	data, err := t.remote.Get(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch evicted blob %s: %w", hash, err)
+	}
+	if err := (&blob.Blob{Hash: hash, Data: data}).Check(); err != nil {
+		return nil, fmt.Errorf("evicted blob %s is corrupted: %w", hash, err)
+	}
+	t.log.Debug("evicted blob fetched", "hash", hash)
+
+	t.mu.Lock()
+	t.fetchedCount++
+	t.mu.Unlock()
+
+	if t.recache {
+		b := &blob.Blob{Hash: hash, Data: data}
+		if err := t.back.Put(hash, data); err != nil {
+			return nil, err
+		}
+		if err := t.saved(b); err != nil {
+			return nil, err
+		}
+		if t.kinds != nil {
+			if err := t.kinds.add(hash, KindData, len(data)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return data, nil
+}
+
+// evicted returns true if the blob can be fetched from the remote storage (must only be called for blobs missing
+// locally)
+func (t *tiering) evicted(hash string) (bool, error) {
+	return t.remote.Indexed(hash)
+}
+
+type evictionCandidate struct {
+	hash       string
+	size       int
+	lastAccess time.Time
+}
+
+// evict removes the cold data blobs from the local storage engine
+func (t *tiering) evict() error {
+	if t.maxAge == 0 && t.maxSize == 0 {
+		return nil
+	}
+	start := time.Now()
+
+	// List the local blobs
+	refs := []*blob.SizedBlobRef{}
+	out := make(chan *blob.SizedBlobRef)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- t.back.EnumeratePrefix(out, "", 0)
+	}()
+	var localSize int64
+	for ref := range out {
+		refs = append(refs, ref)
+		localSize += int64(ref.Size)
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+
+	candidates := []*evictionCandidate{}
+	for _, ref := range refs {
+		kind, lastAccess, err := t.getAccess(ref.Hash)
+		if err != nil {
+			return err
+		}
+		if kind == kindUnknown {
+			// Blob saved before tiering was enabled, the clock starts now
+			data, err := t.back.Get(ref.Hash)
+			if err != nil {
+				return err
+			}
+			kind = blobKind(&blob.Blob{Hash: ref.Hash, Data: data})
+			lastAccess = time.Now()
+			if err := t.setAccess(ref.Hash, kind, lastAccess); err != nil {
+				return err
+			}
+		}
+		if kind != kindData {
+			continue
+		}
+		// Only evict blobs that can be fetched back
+		indexed, err := t.remote.Indexed(ref.Hash)
+		if err != nil {
+			return err
+		}
+		if !indexed {
+			continue
+		}
+		candidates = append(candidates, &evictionCandidate{ref.Hash, ref.Size, lastAccess})
+	}
+
+	// The least recently read blobs are evicted first
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastAccess.Before(candidates[j].lastAccess)
+	})
+	remove := map[string]struct{}{}
+	var removedSize int64
+	for _, c := range candidates {
+		tooOld := t.maxAge > 0 && start.Sub(c.lastAccess) > t.maxAge
+		overBudget := t.maxSize > 0 && localSize-removedSize > t.maxSize
+		if !tooOld && !overBudget {
+			// Candidates are sorted, the next ones are not older
+			break
+		}
+		remove[c.hash] = struct{}{}
+		removedSize += int64(c.size)
+	}
+
+	if len(remove) > 0 {
+		if err := t.back.Compact(remove); err != nil {
+			return err
+		}
+		for h := range remove {
+			bhash, err := hex.DecodeString(h)
+			if err != nil {
+				return err
+			}
+			// The blob stays in the kind index (it still belongs to the blobstore, and the index is the only listing of
+			// the evicted blobs)
+			if err := t.db.Delete(bhash); err != nil {
+				return err
+			}
+		}
+	}
+
+	t.mu.Lock()
+	t.lastEviction = start
+	t.evictedCount += len(remove)
+	t.evictedSize += removedSize
+	t.mu.Unlock()
+
+	t.log.Info("eviction done", "evicted", len(remove), "evicted_size", humanize.Bytes(uint64(removedSize)),
+		"duration", time.Since(start))
+	return nil
+}
+
+// run periodically evicts the cold blobs until `stop` is closed
+func (t *tiering) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			err := t.evict()
+			t.mu.Lock()
+			if err != nil {
+				t.log.Error("eviction failed", "err", err)
+				t.lastEvictError = err.Error()
+			} else {
+				t.lastEvictError = ""
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+func (t *tiering) stats() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var lastEviction string
+	if !t.lastEviction.IsZero() {
+		lastEviction = t.lastEviction.Format(time.RFC3339)
+	}
+	return map[string]interface{}{
+		"max_age":             t.maxAge.String(),
+		"max_size":            humanize.Bytes(uint64(t.maxSize)),
+		"recache":             t.recache,
+		"last_eviction":       lastEviction,
+		"last_eviction_error": t.lastEvictError,
+		"evicted_count":       t.evictedCount,
+		"evicted_size":        t.evictedSize,
+		"evicted_size_human":  humanize.Bytes(uint64(t.evictedSize)),
+		"fetched_count":       t.fetchedCount,
+	}
+}
+
+func (t *tiering) Close() error {
+	return t.db.Close()
+}
@@ -0,0 +1,110 @@
+package blobstore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+type memRemote map[string][]byte
+
+func (r memRemote) Indexed(hash string) (bool, error) {
+	_, ok := r[hash]
+	return ok, nil
+}
+
+func (r memRemote) Get(hash string) ([]byte, error) {
+	data, ok := r[hash]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", hash)
+	}
+	return data, nil
+}
+
+func TestTieringEvict(t *testing.T) {
+	dir := "tiering_test"
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	back, err := newDirBackend(dir + "/blobs")
+	if err != nil {
+		panic(err)
+	}
+	remote := memRemote{}
+	tr, err := newTiering(logger, back, remote, &config.Tiering{MaxAge: "1h", Recache: true}, dir+"/tiering.index")
+	if err != nil {
+		panic(err)
+	}
+	defer tr.Close()
+
+	old := time.Now().Add(-2 * time.Hour)
+	blobs := []*blob.Blob{}
+	for i := 0; i < 10; i++ {
+		data := []byte(fmt.Sprintf("hello%d", i))
+		b := &blob.Blob{Hash: hashutil.Compute(data), Data: data}
+		if err := back.Put(b.Hash, b.Data); err != nil {
+			panic(err)
+		}
+		if err := tr.saved(b); err != nil {
+			panic(err)
+		}
+		// Only the first half is uploaded
+		if i < 5 {
+			remote[b.Hash] = b.Data
+		}
+		// The odd blobs are cold
+		if i%2 == 1 {
+			if err := tr.setAccess(b.Hash, kindData, old); err != nil {
+				panic(err)
+			}
+		}
+		blobs = append(blobs, b)
+	}
+
+	if err := tr.evict(); err != nil {
+		panic(err)
+	}
+
+	for i, b := range blobs {
+		exists, err := back.Exists(b.Hash)
+		if err != nil {
+			panic(err)
+		}
+		shouldBeEvicted := i < 5 && i%2 == 1
+		if exists == shouldBeEvicted {
+			t.Errorf("blob %d exists=%v, should be evicted=%v", i, exists, shouldBeEvicted)
+		}
+	}
+
+	// A read miss fetches the blob back (and re-caches it)
+	data, err := tr.fetch(blobs[1].Hash)
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(data, blobs[1].Data) {
+		t.Errorf("bad fetched data")
+	}
+	if exists, _ := back.Exists(blobs[1].Hash); !exists {
+		t.Errorf("blob should have been re-cached")
+	}
+	if _, err := tr.fetch(hashutil.Compute([]byte("nope"))); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+
+	// A corrupted remote blob is never returned (nor re-cached)
+	remote[blobs[3].Hash] = []byte("corrupted")
+	if _, err := tr.fetch(blobs[3].Hash); err == nil {
+		t.Errorf("expected an error for a corrupted blob")
+	}
+	if exists, _ := back.Exists(blobs[3].Hash); exists {
+		t.Errorf("the corrupted blob should not have been re-cached")
+	}
+}
@@ -125,3 +125,32 @@ func (kvs *KvStore) Keys(ctx context.Context, prefix, start, end string, limit i
 
 	return keys.Keys, nil
 }
+
+// KeysFrom returns at most `limit` keys (latest versions), starting at `cursor`, along with the cursor for the next
+// page (empty once all the keys have been returned)
+func (kvs *KvStore) KeysFrom(ctx context.Context, cursor string, limit int) ([]*response.KeyValue, string, error) {
+	resp, err := kvs.client.Get(fmt.Sprintf("/api/kvstore/keys?cursor=%s&limit=%d", url.QueryEscape(cursor), limit))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return nil, "", err
+	}
+
+	keys := &struct {
+		Data       []*response.KeyValue `json:"data"`
+		Pagination struct {
+			Cursor  string `json:"cursor"`
+			HasMore bool   `json:"has_more"`
+		} `json:"pagination"`
+	}{}
+	if err := clientutil.Unmarshal(resp, keys); err != nil {
+		return nil, "", err
+	}
+	if !keys.Pagination.HasMore {
+		return keys.Data, "", nil
+	}
+	return keys.Data, keys.Pagination.Cursor, nil
+}
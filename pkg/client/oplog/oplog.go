@@ -6,11 +6,13 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 
 	"a4.io/blobstash/pkg/client/clientutil"
 )
 
 var (
+	headerID    = []byte("id:")
 	headerEvent = []byte("event:")
 	headerData  = []byte("data:")
 )
@@ -19,7 +21,9 @@ type Oplog struct {
 	client *clientutil.ClientUtil
 }
 
+// Op is an oplog event, `ID` is only set for the persisted events
 type Op struct {
+	ID    string
 	Event string
 	Data  string
 }
@@ -47,9 +51,19 @@ func (o *Oplog) GetBlob(ctx context.Context, hash string) ([]byte, error) {
 	return clientutil.Decode(resp)
 }
 
+// Notify streams the events to `ops`, starting after the event `lastEventID` if set (a "resync" event is sent first if
+// the remote cannot resume from there), the optional `filters` select the events (e.g. "types=kv&prefix=app:")
 // FIXME(tsileo): use a ctx and support cancelation
-func (o *Oplog) Notify(ctx context.Context, ops chan<- *Op, connCallback func()) error {
-	resp, err := o.client.Get("/_oplog/")
+func (o *Oplog) Notify(ctx context.Context, lastEventID string, filters url.Values, ops chan<- *Op, connCallback func()) error {
+	var options []func(*http.Request) error
+	if lastEventID != "" {
+		options = append(options, clientutil.WithHeader("Last-Event-ID", lastEventID))
+	}
+	path := "/_oplog/"
+	if len(filters) > 0 {
+		path += "?" + filters.Encode()
+	}
+	resp, err := o.client.Get(path, options...)
 	if err != nil {
 		return err
 	}
@@ -74,6 +88,13 @@ func (o *Oplog) Notify(ctx context.Context, ops chan<- *Op, connCallback func())
 			return err
 		}
 		switch {
+		case bytes.HasPrefix(line, headerID):
+			if op == nil {
+				op = &Op{}
+			}
+			// Remove header
+			id := bytes.Replace(line, headerID, []byte(""), 1)
+			op.ID = string(id[1 : len(id)-1]) // Remove initial space and newline
 		case bytes.HasPrefix(line, headerEvent):
 			if op == nil {
 				op = &Op{}
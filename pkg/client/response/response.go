@@ -2,10 +2,12 @@ package response // import "a4.io/blobstash/pkg/client/response"
 
 // KeyValue holds a singke key value pair, along with the version (the creation timestamp)
 type KeyValue struct {
-	Key     string `json:"key,omitempty"`
-	Hash    string `json:"hash"`
-	Data    []byte `json:"data"`
-	Version int    `json:"version"`
+	Key       string `json:"key,omitempty"`
+	Hash      string `json:"hash"`
+	Data      []byte `json:"data"`
+	Version   int    `json:"version"`
+	TTL       int64  `json:"ttl,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
 }
 
 // KeyValueVersions holds the full history for a key value pair
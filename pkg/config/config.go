@@ -5,11 +5,14 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/inconshreveable/log15"
 	"gopkg.in/yaml.v2"
 
 	"a4.io/blobstash/pkg/config/pathutil"
+	"a4.io/blobstash/pkg/crypto"
 )
 
 var (
@@ -17,6 +20,9 @@ var (
 	LetsEncryptDir = "letsencrypt"
 )
 
+// MaxSyncTreeDepth is the maximum depth of the sync Merkle tree (16^6 leaves)
+const MaxSyncTreeDepth = 6
+
 // AppConfig holds an app configuration items
 type AppConfig struct {
 	Name              string `yaml:"name"`
@@ -33,30 +39,254 @@ type AppConfig struct {
 	Config map[string]interface{} `yaml:"config"`
 }
 
+// S3Repl is a replication target
 type S3Repl struct {
+	// Name identifies the target (required when there are multiple targets), its upload queue and index are
+	// stored in `s3-upload.queue.<name>` and `s3-backend.index.<name>`
+	Name string `yaml:"name"`
+
 	Bucket    string `yaml:"bucket"`
 	Region    string `yaml:"region"`
 	KeyFile   string `yaml:"key_file"`
 	Endpoint  string `yaml:"endpoint"`
 	AccessKey string `yaml:"access_key_id"`
 	SecretKey string `yaml:"secret_access_key"`
+
+	// OldKeyFiles holds the previous keys (`key_file` being the active key), they are only used to decrypt, and the
+	// packs and blobs encrypted with them are re-encrypted with the active key in the background
+	OldKeyFiles []string `yaml:"old_key_files"`
+
+	// Dir replicates to a mounted directory (e.g. a NAS share or an USB disk) instead of a S3 bucket
+	Dir string `yaml:"dir"`
+
+	// UploadRate is the maximum upload rate in bytes per second (e.g. "500KB"), unlimited if empty
+	UploadRate string `yaml:"upload_rate"`
+
+	// UploadWindows restricts the uploads to the given time-of-day windows (e.g. "01:00-07:00" or "22:00-06:00", in
+	// local time), the blobs and packs are queued in the meantime (unless a flush is requested)
+	UploadWindows []string `yaml:"upload_windows"`
+
+	// Tiering enables the tiered storage mode (only the data blobs are evicted, meta and filetree node blobs are always
+	// kept locally)
+	Tiering *Tiering `yaml:"tiering"`
+}
+
+// Tiering holds the tiered storage config, the evicted blobs are fetched back from S3 on demand
+type Tiering struct {
+	// MaxAge is the duration after which a data blob that has not been read is evicted (e.g. "720h")
+	MaxAge string `yaml:"max_age"`
+
+	// MaxSize is the local size budget (e.g. "50GB"), the least recently read data blobs are evicted first
+	MaxSize string `yaml:"max_size"`
+
+	// Recache re-saves the blobs fetched from S3 locally
+	Recache bool `yaml:"recache"`
+
+	// Interval between two eviction runs (defaults to "1h")
+	Interval string `yaml:"interval"`
+}
+
+// Scrub holds the background scrubber config
+type Scrub struct {
+	// Rate is the maximum read rate in bytes per second (e.g. "10MB"), unlimited if empty
+	Rate string `yaml:"rate"`
+
+	// Interval between the start of two scrubs (defaults to "168h")
+	Interval string `yaml:"interval"`
+}
+
+// Quota holds the storage limits of a namespace or an auth ID: a warning is logged once a soft limit is reached, and
+// the writes are rejected once a hard limit is reached
+type Quota struct {
+	// Sizes of the blobs (e.g. "10GB")
+	SoftSize string `yaml:"soft_size"`
+	HardSize string `yaml:"hard_size"`
+
+	// Number of docstore documents (all collections)
+	SoftDocs int64 `yaml:"soft_docs"`
+	HardDocs int64 `yaml:"hard_docs"`
+}
+
+// Quotas holds the quotas by namespace (the root namespace is "_root") and by auth ID
+type Quotas struct {
+	Namespaces map[string]*Quota `yaml:"namespaces"`
+	Auths      map[string]*Quota `yaml:"auths"`
 }
 
 type Replication struct {
 	EnableOplog bool `yaml:"enable_oplog"`
+
+	// OplogRetention is how long the oplog events are kept (e.g. "720h", defaults to "168h"), a client that was
+	// disconnected for longer has to do a full sync
+	OplogRetention string `yaml:"oplog_retention"`
 }
 
 type ReplicateFrom struct {
 	URL    string `yaml:"url"`
 	APIKey string `yaml:"api_key"`
+
+	// Include and Exclude enable the selective replication: only the kv entries matching the rules (and the blobs
+	// reachable from them) are replicated, instead of mirroring every blob of the remote instance
+	Include *ReplicationRules `yaml:"include"`
+	Exclude *ReplicationRules `yaml:"exclude"`
+}
+
+// ReplicationRules selects data to replicate from the remote instance
+type ReplicationRules struct {
+	FS            []string `yaml:"fs"`             // Filetree FS names
+	Collections   []string `yaml:"collections"`    // Docstore collections
+	KvPrefixes    []string `yaml:"kv_prefixes"`    // Prefixes of the other kv keys
+	GitNamespaces []string `yaml:"git_namespaces"` // Gitserver namespaces
+}
+
+// Selective returns true if only some of the remote data must be replicated
+func (r *ReplicateFrom) Selective() bool {
+	return r.Include != nil || r.Exclude != nil
+}
+
+// ReplicateTo is a peer the new blobs are pushed to
+type ReplicateTo struct {
+	Name   string `yaml:"name"`
+	URL    string `yaml:"url"`
+	APIKey string `yaml:"api_key"`
+
+	// BatchSize is the max number of blobs sent per upload request (defaults to 100)
+	BatchSize int `yaml:"batch_size"`
+
+	// ReconcileInterval is the interval between the Merkle reconciliations with the peer, which upload the blobs
+	// that may have been missed by the queue (e.g. "6h", defaults to "1h")
+	ReconcileInterval string `yaml:"reconcile_interval"`
+}
+
+// ReplicateToPeers holds the `replicate_to` peers
+type ReplicateToPeers []*ReplicateTo
+
+// Validate ensures the peers can be told apart (by their name)
+func (p ReplicateToPeers) Validate() error {
+	names := map[string]bool{}
+	for _, peer := range p {
+		if peer.Name == "" || strings.ContainsAny(peer.Name, "/\\") {
+			return fmt.Errorf("replicate_to: invalid peer name %q", peer.Name)
+		}
+		if names[peer.Name] {
+			return fmt.Errorf("replicate_to: duplicate peer name %q", peer.Name)
+		}
+		names[peer.Name] = true
+		if peer.URL == "" {
+			return fmt.Errorf("replicate_to: missing url for peer %q", peer.Name)
+		}
+		if peer.ReconcileInterval != "" {
+			if _, err := time.ParseDuration(peer.ReconcileInterval); err != nil {
+				return fmt.Errorf("replicate_to: invalid reconcile interval for peer %q: %v", peer.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Enabled returns true if a replication target (a bucket or a directory) is configured
+func (s3 *S3Repl) Enabled() bool {
+	return s3 != nil && (s3.Bucket != "" || s3.Dir != "")
+}
+
+// TargetName returns the name of the target ("default" for an unnamed target)
+func (s3 *S3Repl) TargetName() string {
+	if s3.Name == "" {
+		return "default"
+	}
+	return s3.Name
+}
+
+// Suffix returns the suffix of the target local files (empty for an unnamed target, to stay compatible with the
+// single target config)
+func (s3 *S3Repl) Suffix() string {
+	if s3.Name == "" {
+		return ""
+	}
+	return "." + s3.Name
+}
+
+// S3Repls holds the replication targets, `s3_replication` can either be a single target or a list
+type S3Repls []*S3Repl
+
+// UnmarshalYAML implements `yaml.Unmarshaler` to support the single target config
+func (r *S3Repls) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	targets := []*S3Repl{}
+	if err := unmarshal(&targets); err == nil {
+		*r = targets
+		return nil
+	}
+	target := &S3Repl{}
+	if err := unmarshal(target); err != nil {
+		return err
+	}
+	*r = S3Repls{target}
+	return nil
+}
+
+// Enabled returns the enabled targets
+func (r S3Repls) Enabled() []*S3Repl {
+	out := []*S3Repl{}
+	for _, target := range r {
+		if target.Enabled() {
+			out = append(out, target)
+		}
+	}
+	return out
+}
+
+// Validate ensures the targets can be told apart (by their name), and that at most one enables the tiered storage
+func (r S3Repls) Validate() error {
+	names := map[string]bool{}
+	var tiering int
+	for _, target := range r {
+		if len(r) > 1 && target.Name == "" {
+			return fmt.Errorf("s3_replication: a name is required for every target when there are multiple targets")
+		}
+		if strings.ContainsAny(target.Name, "/\\") {
+			return fmt.Errorf("s3_replication: invalid target name %q", target.Name)
+		}
+		if names[target.Name] {
+			return fmt.Errorf("s3_replication: duplicate target name %q", target.Name)
+		}
+		names[target.Name] = true
+		if target.Tiering != nil {
+			tiering++
+		}
+	}
+	if tiering > 1 {
+		return fmt.Errorf("s3_replication: the tiered storage can only be enabled for one target")
+	}
+	return nil
 }
 
 func (s3 *S3Repl) Key() (*[32]byte, error) {
 	if s3.KeyFile == "" {
 		return nil, nil
 	}
+	return readKey(s3.KeyFile)
+}
+
+// Keyring returns the active key along with the old keys (nil if encryption is disabled)
+func (s3 *S3Repl) Keyring() (*crypto.Keyring, error) {
+	key, err := s3.Key()
+	if err != nil || key == nil {
+		return nil, err
+	}
+	old := []*[32]byte{}
+	for _, path := range s3.OldKeyFiles {
+		okey, err := readKey(path)
+		if err != nil {
+			return nil, err
+		}
+		old = append(old, okey)
+	}
+	return crypto.NewKeyring(key, old...), nil
+}
+
+func readKey(path string) (*[32]byte, error) {
 	var out [32]byte
-	data, err := ioutil.ReadFile(s3.KeyFile)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -105,12 +335,26 @@ type Config struct {
 
 	SharingKey string  `yaml:"sharing_key"`
 	DataDir    string  `yaml:"data_dir"`
-	S3Repl     *S3Repl `yaml:"s3_replication"`
+	S3Repls    S3Repls `yaml:"s3_replication"`
+
+	// StorageEngine selects the local storage engine ("blobsfile" (the default) or "dir")
+	StorageEngine string `yaml:"storage_engine"`
 
-	Apps          []*AppConfig    `yaml:"apps"`
-	Docstore      *DocstoreConfig `yaml:"docstore"`
-	Replication   *Replication    `yaml:"replication"`
-	ReplicateFrom *ReplicateFrom  `yaml:"replicate_from"`
+	// HashAlgorithm selects the hash algorithm for new blobs ("blake2b-256" (the default) or "sha2-256"), it can be
+	// changed on an existing instance as blobs hashed with both algorithms can always be read
+	HashAlgorithm string `yaml:"hash_algorithm"`
+
+	// SyncTreeDepth sets the depth of the Merkle tree used by the sync API (3 by default, between 2 and 6, each level
+	// is one more hex char of the hashes), deeper trees ship fewer hashes when they diverge but use more memory
+	SyncTreeDepth int `yaml:"sync_tree_depth"`
+
+	Apps          []*AppConfig     `yaml:"apps"`
+	Docstore      *DocstoreConfig  `yaml:"docstore"`
+	Replication   *Replication     `yaml:"replication"`
+	ReplicateFrom *ReplicateFrom   `yaml:"replicate_from"`
+	ReplicateTo   ReplicateToPeers `yaml:"replicate_to"`
+	Scrub         *Scrub           `yaml:"scrub"`
+	Quotas        *Quotas          `yaml:"quotas"`
 
 	SecretKey string `yaml:"secret_key"`
 
@@ -119,6 +363,8 @@ type Config struct {
 	ScanMode                   bool `yaml:"-"`
 	S3ScanMode                 bool `yaml:"-"`
 	S3RestoreMode              bool `yaml:"-"`
+	S3AuditMode                bool `yaml:"-"`
+	S3AuditRequeueMode         bool `yaml:"-"`
 	DocstoreIndexesReindexMode bool `yaml:"-"`
 }
 
@@ -213,10 +459,19 @@ func (c *Config) Init() error {
 	if c.SharingKey == "" {
 		return fmt.Errorf("missing `sharing_key` config item")
 	}
-	if c.S3Repl != nil {
+	if err := c.S3Repls.Validate(); err != nil {
+		return err
+	}
+	if err := c.ReplicateTo.Validate(); err != nil {
+		return err
+	}
+	if c.SyncTreeDepth != 0 && (c.SyncTreeDepth < 2 || c.SyncTreeDepth > MaxSyncTreeDepth) {
+		return fmt.Errorf("invalid `sync_tree_depth` %d, must be between 2 and %d", c.SyncTreeDepth, MaxSyncTreeDepth)
+	}
+	for _, target := range c.S3Repls {
 		// Set default region
-		if c.S3Repl.Region == "" {
-			c.S3Repl.Region = "us-east-1"
+		if target.Region == "" {
+			target.Region = "us-east-1"
 		}
 	}
 	c.init = true
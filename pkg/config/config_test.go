@@ -0,0 +1,49 @@
+package config
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestS3ReplicationTargets(t *testing.T) {
+	// The single target config is still supported
+	conf := &Config{}
+	if err := yaml.Unmarshal([]byte("s3_replication:\n  bucket: backups\n"), conf); err != nil {
+		panic(err)
+	}
+	if len(conf.S3Repls) != 1 || conf.S3Repls[0].Bucket != "backups" || conf.S3Repls[0].Suffix() != "" {
+		t.Errorf("unexpected targets %+v", conf.S3Repls)
+	}
+	if err := conf.S3Repls.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	conf = &Config{}
+	if err := yaml.Unmarshal([]byte(`s3_replication:
+  - name: aws
+    bucket: backups
+  - name: usb
+    dir: /mnt/usb
+  - name: disabled
+`), conf); err != nil {
+		panic(err)
+	}
+	enabled := conf.S3Repls.Enabled()
+	if len(enabled) != 2 || enabled[1].Dir != "/mnt/usb" || enabled[1].Suffix() != ".usb" {
+		t.Errorf("unexpected targets %+v", enabled)
+	}
+	if err := conf.S3Repls.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, invalid := range []S3Repls{
+		{&S3Repl{Name: "a"}, &S3Repl{Name: "a"}},
+		{&S3Repl{Name: "a"}, &S3Repl{}},
+		{&S3Repl{Name: "a", Tiering: &Tiering{}}, &S3Repl{Name: "b", Tiering: &Tiering{}}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", invalid)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -18,10 +19,42 @@ const nonceLength = 24
 // The length of the encryption key for the secretbox implementation.
 const keyLength = 32
 
+// The size of the plain-text chunks
+const chunkSize = 16 * 1024
+
 var (
 	header = []byte("#blobstash/encrypted_blobsfile\n")
+	// Same length as the legacy header, followed by the key ID
+	headerV2 = []byte("#blobstash/encrypted_blobsfile2")
 )
 
+// HeaderSize is the size of the header of a pack, enough to read its key ID
+const HeaderSize = 31 + KeyIDLength
+
+// ErrUnknownKey is returned when the key used to encrypt is not in the keyring
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// PackKeyID returns the ID of the key used to encrypt the pack (nil for the packs encrypted before the key IDs were
+// introduced)
+func PackKeyID(r io.Reader) ([]byte, error) {
+	h := make([]byte, len(header))
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(header, h):
+		return nil, nil
+	case bytes.Equal(headerV2, h):
+		id := make([]byte, KeyIDLength)
+		if _, err := io.ReadFull(r, id); err != nil {
+			return nil, err
+		}
+		return id, nil
+	default:
+		return nil, fmt.Errorf("invalid header %v", h)
+	}
+}
+
 func Seal(nkey *[32]byte, path string) (string, error) {
 	var nonce [nonceLength]byte
 	if _, err := rand.Reader.Read(nonce[:]); err != nil {
@@ -37,11 +70,14 @@ func Seal(nkey *[32]byte, path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	if _, err := tmpfile.Write(header); err != nil {
+	if _, err := tmpfile.Write(headerV2); err != nil {
+		return "", err
+	}
+	if _, err := tmpfile.Write(KeyID(nkey)); err != nil {
 		return "", err
 	}
 
-	buf := make([]byte, 16*1024)
+	buf := make([]byte, chunkSize)
 	chunklen := make([]byte, 4)
 L:
 	for {
@@ -69,7 +105,52 @@ L:
 	return tmpfile.Name(), nil
 }
 
-func Open(nkey *[32]byte, path string) (string, error) {
+// CheckSize is the number of bytes needed by `Check` (the header and the first chunk)
+const CheckSize = HeaderSize + 4 + nonceLength + chunkSize + secretbox.Overhead
+
+// Check decrypts the first chunk of the pack, enough to detect an unknown key or a corrupted pack without downloading
+// it entirely
+func Check(keyring *Keyring, r io.Reader) error {
+	id, err := PackKeyID(r)
+	if err != nil {
+		return err
+	}
+	keys := keyring.Keys()
+	if id != nil {
+		key, ok := keyring.Key(id)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownKey, FormatKeyID(id))
+		}
+		keys = []*[32]byte{key}
+	}
+	chunklenBytes := make([]byte, 4)
+	if _, err := io.ReadFull(r, chunklenBytes); err != nil {
+		if err == io.EOF {
+			// Empty pack
+			return nil
+		}
+		return err
+	}
+	chunklen := binary.BigEndian.Uint32(chunklenBytes)
+	if chunklen < nonceLength {
+		return fmt.Errorf("invalid chunk length %d", chunklen)
+	}
+	chunk := make([]byte, chunklen)
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		return err
+	}
+	var nonce [nonceLength]byte
+	copy(nonce[:], chunk[:nonceLength])
+	for _, key := range keys {
+		if _, ok := secretbox.Open(nil, chunk[nonceLength:], &nonce, key); ok {
+			return nil
+		}
+	}
+	return errors.New("decryption error")
+}
+
+// Open decrypts the pack with the key from the keyring it was encrypted with
+func Open(keyring *Keyring, path string) (string, error) {
 	var nonce [nonceLength]byte
 	// Actually decrypt the cipher text
 
@@ -78,44 +159,68 @@ func Open(nkey *[32]byte, path string) (string, error) {
 		return "", err
 	}
 	defer f.Close()
-	h := make([]byte, len(header))
-	if _, err := f.Read(h); err != nil {
+	id, err := PackKeyID(f)
+	if err != nil {
 		return "", err
 	}
-	if !bytes.Equal(header, h) {
-		return "", fmt.Errorf("invalid header %v", h)
+	// The legacy packs have no key ID, all the keys are tried on the first chunk
+	var nkey *[32]byte
+	if id != nil {
+		var ok bool
+		if nkey, ok = keyring.Key(id); !ok {
+			return "", fmt.Errorf("%w: %s", ErrUnknownKey, FormatKeyID(id))
+		}
 	}
 	tmpfile, err := ioutil.TempFile("", "blobstash_secretbox")
 	if err != nil {
 		return "", err
 	}
+	defer tmpfile.Close()
 
 	chunklenBytes := make([]byte, 4)
 	var chunklen uint32
 L:
 	for {
-		_, err = f.Read(chunklenBytes)
+		_, err = io.ReadFull(f, chunklenBytes)
 		switch err {
 		case nil:
 		case io.EOF:
 			break L
 		default:
+			os.Remove(tmpfile.Name())
 			return "", err
 		}
 		chunklen = binary.BigEndian.Uint32(chunklenBytes[:])
+		if chunklen < nonceLength {
+			os.Remove(tmpfile.Name())
+			return "", fmt.Errorf("invalid chunk length %d", chunklen)
+		}
 		chunk := make([]byte, chunklen)
-		_, err = f.Read(chunk)
-		if err != nil {
+		if _, err = io.ReadFull(f, chunk); err != nil {
+			os.Remove(tmpfile.Name())
 			return "", err
 		}
 
 		copy(nonce[:], chunk[:24])
-		decrypted, ok := secretbox.Open(nil, chunk[24:], &nonce, nkey)
+		var decrypted []byte
+		ok := false
+		if nkey != nil {
+			decrypted, ok = secretbox.Open(nil, chunk[24:], &nonce, nkey)
+		} else {
+			for _, key := range keyring.Keys() {
+				if decrypted, ok = secretbox.Open(nil, chunk[24:], &nonce, key); ok {
+					nkey = key
+					break
+				}
+			}
+		}
 		if !ok {
-			panic("decryption error")
+			os.Remove(tmpfile.Name())
+			return "", errors.New("decryption error")
 		}
 
 		if _, err = tmpfile.Write(decrypted); err != nil {
+			os.Remove(tmpfile.Name())
 			return "", err
 		}
 
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -40,7 +41,7 @@ func TestCrypto(t *testing.T) {
 	}
 	defer os.Remove(sealed)
 	t.Logf("sealed=%v", sealed)
-	unsealed, err := Open(&secretKey, sealed)
+	unsealed, err := Open(NewKeyring(&secretKey), sealed)
 	if err != nil {
 		panic(err)
 	}
@@ -54,3 +55,59 @@ func TestCrypto(t *testing.T) {
 		t.Errorf("failed to decrypt input")
 	}
 }
+
+func TestCryptoKeyring(t *testing.T) {
+	var oldKey, newKey [32]byte
+	if _, err := rand.Reader.Read(oldKey[:]); err != nil {
+		panic(err)
+	}
+	if _, err := rand.Reader.Read(newKey[:]); err != nil {
+		panic(err)
+	}
+	tmpfile, err := ioutil.TempFile("", "blobstash_secretbox")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	if _, err := tmpfile.Write([]byte("hello")); err != nil {
+		panic(err)
+	}
+	tmpfile.Close()
+
+	sealed, err := Seal(&oldKey, tmpfile.Name())
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(sealed)
+
+	f, err := os.Open(sealed)
+	if err != nil {
+		panic(err)
+	}
+	id, err := PackKeyID(f)
+	f.Close()
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(id, KeyID(&oldKey)) {
+		t.Errorf("unexpected key ID %x", id)
+	}
+
+	// The old key is still in the keyring
+	keyring := NewKeyring(&newKey, &oldKey)
+	if keyring.IsActive(id) {
+		t.Errorf("the old key should not be active")
+	}
+	unsealed, err := Open(keyring, sealed)
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(unsealed)
+	if dat, err := ioutil.ReadFile(unsealed); err != nil || string(dat) != "hello" {
+		t.Errorf("failed to decrypt input: %q %v", dat, err)
+	}
+
+	if _, err := Open(NewKeyring(&newKey), sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
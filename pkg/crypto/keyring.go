@@ -0,0 +1,71 @@
+package crypto // import "a4.io/blobstash/pkg/crypto"
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// KeyIDLength is the length of the key ID stored in the header of the encrypted packs and blobs
+const KeyIDLength = 8
+
+// KeyID returns the ID of the key (the first bytes of its BLAKE2b-256 hash, so the key cannot be guessed from it)
+func KeyID(key *[32]byte) []byte {
+	sum := blake2b.Sum256(key[:])
+	return sum[:KeyIDLength]
+}
+
+// Keyring holds the active key (used to encrypt) and the old keys (only used to decrypt)
+type Keyring struct {
+	keys []*[32]byte
+}
+
+// NewKeyring returns a keyring with the given active key and old keys
+func NewKeyring(active *[32]byte, old ...*[32]byte) *Keyring {
+	return &Keyring{keys: append([]*[32]byte{active}, old...)}
+}
+
+// Active returns the key used to encrypt
+func (k *Keyring) Active() *[32]byte {
+	return k.keys[0]
+}
+
+// ActiveID returns the ID of the active key
+func (k *Keyring) ActiveID() []byte {
+	return KeyID(k.keys[0])
+}
+
+// HasOldKeys returns true if the keyring contains keys that should be rotated out
+func (k *Keyring) HasOldKeys() bool {
+	return len(k.keys) > 1
+}
+
+// IsActive returns true if the key ID is the ID of the active key (a nil key ID, written before the key IDs were
+// introduced, is never active)
+func (k *Keyring) IsActive(id []byte) bool {
+	return bytes.Equal(id, k.ActiveID())
+}
+
+// Key returns the key with the given ID
+func (k *Keyring) Key(id []byte) (*[32]byte, bool) {
+	for _, key := range k.keys {
+		if bytes.Equal(KeyID(key), id) {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// Keys returns all the keys, the active key first
+func (k *Keyring) Keys() []*[32]byte {
+	return k.keys
+}
+
+// FormatKeyID returns the printable version of the key ID
+func FormatKeyID(id []byte) string {
+	if id == nil {
+		return "legacy"
+	}
+	return hex.EncodeToString(id)
+}
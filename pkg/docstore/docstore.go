@@ -44,13 +44,17 @@ import (
 	"a4.io/blobstash/pkg/asof"
 	"a4.io/blobstash/pkg/auth"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/docstore/id"
 	"a4.io/blobstash/pkg/filetree"
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/httputil/bewit"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/metrics"
 	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/rangedb"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/usage"
 	"a4.io/blobstash/pkg/vkv"
 )
 
@@ -113,6 +117,21 @@ const (
 	shareDuration = 30 * time.Minute
 )
 
+var (
+	queriesMetric       = metrics.NewCounterVec("blobstash_docstore_queries", "Docstore queries.", "collection", "engine", "index")
+	docsExaminedMetric  = metrics.NewCounterVec("blobstash_docstore_docs_examined", "Documents examined by the queries.", "collection")
+	docsReturnedMetric  = metrics.NewCounterVec("blobstash_docstore_docs_returned", "Documents returned by the queries.", "collection")
+	queryDurationMetric = metrics.NewHistogramVec("blobstash_docstore_query_duration_seconds", "Docstore queries latency.", nil, "collection", "engine")
+)
+
+// observe exports the execution stats of a query
+func (stats *executionStats) observe(collection string) {
+	queriesMetric.With(collection, stats.Engine, stats.Index).Inc()
+	docsExaminedMetric.With(collection).Add(float64(stats.TotalDocsExamined))
+	docsReturnedMetric.With(collection).Add(float64(stats.NReturned))
+	queryDurationMetric.With(collection, stats.Engine).Observe(time.Duration(stats.ExecutionTimeNano).Seconds())
+}
+
 type executionStats struct {
 	NReturned         int    `json:"nReturned"`
 	NQueryCached      int    `json:"nQueryCached"`
@@ -124,11 +143,32 @@ type executionStats struct {
 	Cursor            string `json:"cursor"`
 }
 
+// DocUpdateEvent represents an event fired on document insert/update/removal to the Oplog
+type DocUpdateEvent struct {
+	Collection string `json:"collection"`
+	ID         string `json:"_id"`
+	Version    int64  `json:"version"`
+	Type       string `json:"type"`
+	Namespace  string `json:"ns,omitempty"`
+}
+
+func (e *DocUpdateEvent) JSON() string {
+	js, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	return string(js)
+}
+
 // DocStore holds the docstore manager
 type DocStore struct {
 	kvStore   store.KvStore
 	blobStore store.BlobStore
 	filetree  *filetree.FileTree
+	hub       *hub.Hub
+
+	// Optional usage accounting (and docs quotas enforcement)
+	usage *usage.Usage
 
 	conf *config.Config
 
@@ -142,7 +182,7 @@ type DocStore struct {
 }
 
 // New initializes the `DocStoreExt`
-func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStore store.BlobStore, ft *filetree.FileTree) (*DocStore, error) {
+func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStore store.BlobStore, ft *filetree.FileTree, chub *hub.Hub, u *usage.Usage) (*DocStore, error) {
 	logger.Debug("init")
 
 	sortIndexes := map[string]map[string]Indexer{}
@@ -172,6 +212,8 @@ func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStor
 		kvStore:    kvStore,
 		blobStore:  blobStore,
 		filetree:   ft,
+		hub:        chub,
+		usage:      u,
 		conf:       conf,
 		locker:     newLocker(),
 		logger:     logger,
@@ -344,6 +386,46 @@ func (docstore *DocStore) fetchPointersRec(v interface{}, pointers map[string]in
 	}
 }
 
+// Pointers returns the blobs and the filetree nodes referenced by the pointers of the doc stored in the given kv entry,
+// it's used by the GC to mark the blobs referenced by the docs.
+func Pointers(kv *vkv.KeyValue) ([]string, []string, error) {
+	if !strings.HasPrefix(kv.Key, prefixKey) || len(kv.Data) < 2 {
+		return nil, nil, nil
+	}
+	doc := map[string]interface{}{}
+	if err := msgpack.Unmarshal(kv.Data[1:], &doc); err != nil {
+		return nil, nil, err
+	}
+	blobs := []string{}
+	nodes := []string{}
+	var rec func(interface{})
+	rec = func(v interface{}) {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			for _, value := range vv {
+				rec(value)
+			}
+		case map[interface{}]interface{}:
+			for _, value := range vv {
+				rec(value)
+			}
+		case []interface{}:
+			for _, item := range vv {
+				rec(item)
+			}
+		case string:
+			switch {
+			case strings.HasPrefix(vv, pointerBlobJSON):
+				blobs = append(blobs, vv[len(pointerBlobJSON):])
+			case strings.HasPrefix(vv, pointerFiletreeRef):
+				nodes = append(nodes, vv[len(pointerFiletreeRef):])
+			}
+		}
+	}
+	rec(doc)
+	return blobs, nodes, nil
+}
+
 // Expand a doc keys (fetch the blob as JSON, or a filesystem reference)
 // e.g: {"ref": "@blobstash/json:<hash>"}
 //      => {"ref": {"blob": "json decoded"}}
@@ -482,8 +564,24 @@ func isQueryAll(q string) bool {
 	return false
 }
 
+// notify fires the oplog event for the given doc
+func (docstore *DocStore) notify(ctx context.Context, evtType, collection string, _id *id.ID) error {
+	if docstore.hub == nil {
+		return nil
+	}
+	ns, _ := ctxutil.Namespace(ctx)
+	updateEvent := &DocUpdateEvent{
+		Collection: collection,
+		ID:         _id.String(),
+		Version:    _id.Version(),
+		Type:       evtType,
+		Namespace:  ns,
+	}
+	return docstore.hub.DocstoreUpdateEvent(ctx, nil, updateEvent.JSON())
+}
+
 // Insert the given doc (`*map[string]interface{}` for now) in the given collection
-func (docstore *DocStore) Insert(collection string, doc map[string]interface{}) (*id.ID, error) {
+func (docstore *DocStore) Insert(ctx context.Context, collection string, doc map[string]interface{}) (*id.ID, error) {
 	// If there's already an "_id" field in the doc, remove it
 	if _, ok := doc["_id"]; ok {
 		delete(doc, "_id")
@@ -510,11 +608,23 @@ func (docstore *DocStore) Insert(collection string, doc map[string]interface{})
 	}
 	_id.SetFlag(flagNoop)
 
+	// Account the doc before inserting it (so concurrent inserts can't exceed the quota)
+	if docstore.usage != nil {
+		if err := docstore.usage.ReserveDoc(ctx, collection, _id.String()); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create a pointer in the key-value store
 	kv, err := docstore.kvStore.Put(
-		context.TODO(), fmt.Sprintf(keyFmt, collection, _id.String()), "", append([]byte{_id.Flag()}, data...), now.UnixNano(),
+		ctx, fmt.Sprintf(keyFmt, collection, _id.String()), "", append([]byte{_id.Flag()}, data...), now.UnixNano(),
 	)
 	if err != nil {
+		if docstore.usage != nil {
+			if uerr := docstore.usage.ReleaseDoc(collection, _id.String()); uerr != nil {
+				docstore.logger.Error("failed to release the doc usage", "id", _id.String(), "err", uerr)
+			}
+		}
 		return nil, err
 	}
 	_id.SetVersion(kv.Version)
@@ -524,6 +634,10 @@ func (docstore *DocStore) Insert(collection string, doc map[string]interface{})
 		panic(err)
 	}
 
+	if err := docstore.notify(ctx, "doc-inserted", collection, _id); err != nil {
+		return nil, err
+	}
+
 	return _id, nil
 }
 
@@ -607,10 +721,14 @@ func (docstore *DocStore) Update(collection, sid string, newDoc map[string]inter
 		panic(err)
 	}
 
+	if err := docstore.notify(ctx, "doc-updated", collection, _id); err != nil {
+		return nil, err
+	}
+
 	return _id, nil
 }
 
-func (docstore *DocStore) Remove(collection, sid string) (*id.ID, error) {
+func (docstore *DocStore) Remove(ctx context.Context, collection, sid string) (*id.ID, error) {
 	docstore.locker.Lock(sid)
 	defer docstore.locker.Unlock(sid)
 
@@ -622,7 +740,7 @@ func (docstore *DocStore) Remove(collection, sid string) (*id.ID, error) {
 		return nil, err
 	}
 
-	kv, err := docstore.kvStore.Put(context.TODO(), fmt.Sprintf(keyFmt, collection, sid), "", []byte{flagDeleted}, -1)
+	kv, err := docstore.kvStore.Put(ctx, fmt.Sprintf(keyFmt, collection, sid), "", []byte{flagDeleted}, -1)
 	if err != nil {
 		return nil, err
 	}
@@ -630,10 +748,20 @@ func (docstore *DocStore) Remove(collection, sid string) (*id.ID, error) {
 	_id.SetVersion(kv.Version)
 	_id.SetFlag(flagDeleted)
 
+	if docstore.usage != nil {
+		if err := docstore.usage.RemoveDoc(collection, sid); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := docstore.IndexDoc(collection, _id, nil); err != nil {
 		panic(err)
 	}
 
+	if err := docstore.notify(ctx, "doc-removed", collection, _id); err != nil {
+		return nil, err
+	}
+
 	return _id, nil
 }
 
@@ -775,6 +903,7 @@ QUERY:
 	duration := time.Since(tstart)
 	qLogger.Debug("scan done", "duration", duration, "nReturned", stats.NReturned, "nQueryCached", stats.NQueryCached, "scanned", stats.TotalDocsExamined, "cursor", stats.Cursor)
 	stats.ExecutionTimeNano = duration.Nanoseconds()
+	stats.observe(collection)
 	return docs, pointers, stats, nil
 }
 
@@ -1039,12 +1168,17 @@ func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request)
 			}
 
 			// Actually insert the doc
-			_id, err := docstore.Insert(collection, doc)
+			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			_id, err := docstore.Insert(ctx, collection, doc)
 			if err == ErrUnprocessableEntity {
 				// FIXME(tsileo): returns an object with field errors (set via the Lua API in the hook)
 				w.WriteHeader(http.StatusUnprocessableEntity)
 				return
 			}
+			if errors.Is(err, usage.ErrQuotaExceeded) {
+				httputil.WriteJSONError(w, http.StatusInsufficientStorage, err.Error())
+				return
+			}
 			if err != nil {
 				panic(err)
 			}
@@ -1567,7 +1701,8 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 				return
 			}
 
-			_, err := docstore.Remove(collection, sid)
+			ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+			_, err := docstore.Remove(ctx, collection, sid)
 			switch err {
 			case nil:
 				w.WriteHeader(http.StatusNoContent)
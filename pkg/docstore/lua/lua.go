@@ -1,6 +1,7 @@
 package lua // import "a4.io/blobstash/pkg/docstore/lua"
 
 import (
+	"context"
 	"strconv"
 	"time"
 
@@ -10,14 +11,14 @@ import (
 	"a4.io/blobstash/pkg/docstore"
 )
 
-func setupDocStore(dc *docstore.DocStore) func(*lua.LState) int {
+func setupDocStore(ctx context.Context, dc *docstore.DocStore) func(*lua.LState) int {
 	return func(L *lua.LState) int {
 		// register functions to the table
 		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 			"col": func(L *lua.LState) int {
 				name := L.ToString(1)
 				ud := L.NewUserData()
-				ud.Value = &col{dc, name}
+				ud.Value = &col{ctx, dc, name}
 				L.SetMetatable(ud, L.GetTypeMetatable("col"))
 				L.Push(ud)
 				return 1
@@ -59,7 +60,8 @@ func setupDocStore(dc *docstore.DocStore) func(*lua.LState) int {
 	}
 }
 
-func Setup(L *lua.LState, dc *docstore.DocStore) {
+// Setup registers the `docstore` module, the writes are done with the given (request) context
+func Setup(ctx context.Context, L *lua.LState, dc *docstore.DocStore) {
 	mtCol := L.NewTypeMetatable("col")
 	L.SetField(mtCol, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 		"remove":   colRemove,
@@ -69,10 +71,11 @@ func Setup(L *lua.LState, dc *docstore.DocStore) {
 		"get":      colGet,
 		"versions": colVersions,
 	}))
-	L.PreloadModule("docstore", setupDocStore(dc))
+	L.PreloadModule("docstore", setupDocStore(ctx, dc))
 }
 
 type col struct {
+	ctx  context.Context
 	dc   *docstore.DocStore
 	name string
 }
@@ -92,7 +95,7 @@ func colInsert(L *lua.LState) int {
 		return 0
 	}
 	t := luautil.TableToMap(L, L.ToTable(2))
-	id, err := col.dc.Insert(col.name, t)
+	id, err := col.dc.Insert(col.ctx, col.name, t)
 	if err != nil {
 		panic(err)
 	}
@@ -146,7 +149,7 @@ func colRemove(L *lua.LState) int {
 		return 0
 	}
 	docID := L.ToString(2)
-	if _, err := col.dc.Remove(col.name, docID); err != nil {
+	if _, err := col.dc.Remove(col.ctx, col.name, docID); err != nil {
 		panic(err)
 	}
 	return 0
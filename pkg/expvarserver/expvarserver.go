@@ -5,8 +5,10 @@ import (
 	"net/http"
 
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/metrics"
 )
 
 func Enable(conf *config.Config) error {
+	http.Handle("/metrics", metrics.Handler())
 	return http.ListenAndServe(conf.ExpvarListen, http.DefaultServeMux)
 }
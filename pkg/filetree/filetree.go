@@ -7,6 +7,7 @@ import (
 	"container/list"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -44,6 +45,7 @@ import (
 	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/queue"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/usage"
 	"a4.io/blobstash/pkg/vkv"
 )
 
@@ -90,6 +92,9 @@ type FileTree struct {
 
 	hub *hub.Hub
 
+	// Optional, used to reject the uploads early when a hard quota is reached
+	usage *usage.Usage
+
 	authFunc    func(*http.Request) bool
 	sharingCred *bewit.Cred
 	shareTTL    time.Duration
@@ -105,6 +110,18 @@ type FileTree struct {
 	log log.Logger
 }
 
+// checkQuota writes a 507 error and returns false if the upload would exceed a hard quota
+func (ft *FileTree) checkQuota(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == nil && ft.usage != nil && r.ContentLength > 0 {
+		err = ft.usage.CheckBlob(ctx, int(r.ContentLength))
+	}
+	if errors.Is(err, usage.ErrQuotaExceeded) {
+		httputil.WriteJSONError(w, http.StatusInsufficientStorage, err.Error())
+		return false
+	}
+	return true
+}
+
 func (ft *FileTree) SharingCred() *bewit.Cred {
 	return ft.sharingCred
 }
@@ -132,7 +149,8 @@ func (bs *BlobStore) Stat(ctx context.Context, hash string) (bool, error) {
 }
 
 func (bs *BlobStore) Put(ctx context.Context, hash string, data []byte) error {
-	_, err := bs.blobStore.Put(ctx, &blob.Blob{Hash: hash, Data: data})
+	// Use the request context (the uploader does not have one) for the stash/usage accounting
+	_, err := bs.blobStore.Put(bs.ctx, &blob.Blob{Hash: hash, Data: data})
 	return err
 }
 
@@ -160,7 +178,7 @@ func NewFS(ref string, ft *FileTree) *FS {
 }
 
 // New initializes the `DocStoreExt`
-func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bool, kvStore store.KvStore, blobStore store.BlobStore, chub *hub.Hub) (*FileTree, error) {
+func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bool, kvStore store.KvStore, blobStore store.BlobStore, chub *hub.Hub, u *usage.Usage) (*FileTree, error) {
 	logger.Debug("init")
 	// FIXME(tsileo): make the number of thumbnails to keep in memory a config item
 	thumbscache, err := cache.New(conf.VarDir(), "filetree_thumbs.cache", 512<<20)
@@ -201,10 +219,14 @@ func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bo
 		authFunc:      authFunc,
 		shareTTL:      1 * time.Hour,
 		hub:           chub,
+		usage:         u,
 		log:           logger,
 	}
 
-	chub.Subscribe(hub.NewFiletreeNode, "webm", ft.webmHubCallback)
+	// The webm callback only enqueues the video, it does not need to block the upload
+	if err := chub.SubscribeAsync(hub.NewFiletreeNode, "webm", ft.webmHubCallback); err != nil {
+		return nil, err
+	}
 	go ft.webmWorker()
 
 	return ft, nil
@@ -949,6 +971,9 @@ func (ft *FileTree) uploadHandler() func(http.ResponseWriter, *http.Request) {
 		}
 		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
 		ctx = ctxutil.WithNamespace(ctx, r.Header.Get(ctxutil.NamespaceHeader))
+		if !ft.checkQuota(ctx, w, r, nil) {
+			return
+		}
 		// Try to parse the metadata (JSON encoded in the `data` query argument)
 		var data map[string]interface{}
 		if d := r.URL.Query().Get("data"); d != "" {
@@ -975,6 +1000,9 @@ func (ft *FileTree) uploadHandler() func(http.ResponseWriter, *http.Request) {
 		}
 		reader := bytes.NewReader(fdata)
 		meta, err := uploader.PutReader(handler.Filename, reader, data)
+		if !ft.checkQuota(ctx, w, r, err) {
+			return
+		}
 		if err != nil {
 			panic(err)
 		}
@@ -1355,6 +1383,9 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 
 		case "POST":
 			// FIXME(tsileo): add a way to upload a file as public ? like AWS S3 public-read canned ACL
+			if !ft.checkQuota(ctx, w, r, nil) {
+				return
+			}
 			// Add a new node in the FS at the given path
 			node, _, created, err := fs.Path(ctx, path, 1, true, mtime)
 			if err != nil {
@@ -1380,6 +1411,9 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 
 			// Create/save me Meta
 			meta, err := uploader.PutReader(filepath.Base(path), file, nil)
+			if !ft.checkQuota(ctx, w, r, err) {
+				return
+			}
 			if err != nil {
 				panic(err)
 			}
@@ -1817,6 +1851,15 @@ func (ft *FileTree) TreeBlobs(ctx context.Context, node *Node) ([]string, error)
 	return out, nil
 }
 
+// TreeBlobsByRef returns all the blobs of the tree rooted at the given node ref
+func (ft *FileTree) TreeBlobsByRef(ctx context.Context, ref string) ([]string, error) {
+	n, err := ft.nodeByRef(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return ft.TreeBlobs(ctx, n)
+}
+
 func (ft *FileTree) webmHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" && r.Method != "HEAD" {
@@ -1910,10 +1953,11 @@ func (ft *FileTree) serveFile(ctx context.Context, w http.ResponseWriter, r *htt
 		panic(httputil.NewPublicErrorFmt("node is not a file (%s)", m.Type))
 	}
 
-	// Initialize a new `File`
+	// Initialize a new `File` (the chunks will be streamed as the blobstore supports `GetReader`)
 	var f io.ReadSeeker
-	// FIXME(tsileo): ctx
-	f = filereader.NewFile(ctx, ft.blobStore, m, nil)
+	file := filereader.NewFile(ctx, ft.blobStore, m, nil)
+	defer file.Close()
+	f = file
 
 	// Check if the file is requested for download (?dl=1)
 	httputil.SetAttachment(m.Name, r, w)
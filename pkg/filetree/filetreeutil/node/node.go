@@ -12,7 +12,8 @@ import (
 	"path/filepath"
 
 	"github.com/vmihailenco/msgpack"
-	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/hashutil"
 )
 
 var (
@@ -118,8 +119,7 @@ func (n *RawNode) Encode() (string, []byte) {
 	}
 	data := append(NodeBlobHeader, NodeBlobMsgpackEncoding)
 	data = append(data, js...)
-	h := fmt.Sprintf("%x", blake2b.Sum256(data))
-	return h, data
+	return hashutil.Compute(data), data
 }
 
 func (n *RawNode) AddIndexedRef(index int, hash string) {
@@ -5,8 +5,10 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	"golang.org/x/crypto/blake2b"
 
 	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/hashutil"
 )
 
 // FIXME(tsileo): implements os.FileInfo
@@ -28,6 +31,12 @@ type BlobStore interface {
 	Get(context.Context, string) ([]byte, error)
 }
 
+// ReaderBlobStore is implemented by the blob stores that can stream blobs, `File` will then stream the chunks on
+// sequential reads (when no cache is used) instead of fetching the whole chunk for each `Read` call
+type ReaderBlobStore interface {
+	GetReader(context.Context, string) (io.ReadCloser, int, error)
+}
+
 // Download a file by its hash to path
 func GetFile(ctx context.Context, bs BlobStore, hash, path string) error {
 	// FIXME(tsileo): take a `*meta.Meta` as argument instead of the hash
@@ -103,6 +112,10 @@ type File struct {
 
 	lru *lru.Cache
 	ctx context.Context
+
+	// The reader of the current chunk (for streaming reads), and the file offset it's positioned at
+	cur       io.ReadCloser
+	curOffset int64
 }
 
 // NewFile creates a new File instance.
@@ -181,6 +194,11 @@ func (f *File) PreloadChunks() {
 
 // Close implements io.Closer
 func (f *File) Close() error {
+	if f.cur != nil {
+		err := f.cur.Close()
+		f.cur = nil
+		return err
+	}
 	return nil
 }
 
@@ -316,6 +334,9 @@ func (f *File) Read(p []byte) (n int, err error) {
 	if f.size == 0 || f.offset >= f.size {
 		return 0, io.EOF
 	}
+	if rbs, ok := f.bs.(ReaderBlobStore); ok && f.lru == nil {
+		return f.streamRead(rbs, p)
+	}
 	n = 0
 	limit := len(p)
 	if limit > int(f.size-f.offset) {
@@ -333,6 +354,63 @@ func (f *File) Read(p []byte) (n int, err error) {
 	return
 }
 
+// streamRead reads from the current chunk reader, and opens the next chunk when needed
+func (f *File) streamRead(bs ReaderBlobStore, p []byte) (int, error) {
+	if f.cur != nil && f.curOffset != f.offset {
+		// The file has been seeked since the last read
+		f.cur.Close()
+		f.cur = nil
+	}
+	for f.offset < f.size {
+		if f.cur == nil {
+			if err := f.openChunk(bs); err != nil {
+				return 0, err
+			}
+		}
+		n, err := f.cur.Read(p)
+		f.offset += int64(n)
+		f.curOffset = f.offset
+		if err == io.EOF {
+			f.cur.Close()
+			f.cur = nil
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, io.EOF
+}
+
+// openChunk opens the chunk containing the current offset, the chunk is verified before being served
+func (f *File) openChunk(bs ReaderBlobStore) error {
+	i := sort.Search(len(f.lmrange), func(i int) bool { return f.lmrange[i].Index > f.offset })
+	if i == len(f.lmrange) {
+		return io.EOF
+	}
+	iv := f.lmrange[i]
+	r, size, err := bs.GetReader(f.ctx, iv.Value)
+	if err != nil {
+		return fmt.Errorf("failed to fetch blob %v: %v", iv.Value, err)
+	}
+	defer r.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("failed to read blob %v: %v", iv.Value, err)
+	}
+	ref := strings.TrimPrefix(iv.Value, "remote://")
+	if h, err := hashutil.ComputeLike(ref, data); err != nil || h != ref {
+		return fmt.Errorf("blob %v: hash mismatch", iv.Value)
+	}
+	// Skip the beginning of the chunk if the offset is in the middle of it
+	if skip := f.offset - (iv.Index - int64(size)); skip > 0 {
+		data = data[skip:]
+	}
+	f.cur = ioutil.NopCloser(bytes.NewReader(data))
+	f.curOffset = f.offset
+	return nil
+}
+
 // Seek implements io.Seeker
 func (f *File) Seek(offset int64, whence int) (int64, error) {
 	switch whence {
@@ -0,0 +1,99 @@
+package filereader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+type memBlobStore map[string][]byte
+
+func (bs memBlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	data, ok := bs[hash]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", hash)
+	}
+	return data, nil
+}
+
+func (bs memBlobStore) GetReader(ctx context.Context, hash string) (io.ReadCloser, int, error) {
+	data, err := bs.Get(ctx, hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), len(data), nil
+}
+
+func TestFileStreamRead(t *testing.T) {
+	bs := memBlobStore{}
+	meta := &node.RawNode{Type: "file", Name: "test.txt"}
+	var content []byte
+	for i := 0; i < 10; i++ {
+		chunk := bytes.Repeat([]byte(fmt.Sprintf("chunk%d", i)), 100*(i+1))
+		h := hashutil.Compute(chunk)
+		bs[h] = chunk
+		content = append(content, chunk...)
+		meta.AddIndexedRef(len(content), h)
+	}
+	meta.Size = len(content)
+
+	f := NewFile(context.Background(), bs, meta, nil)
+	defer f.Close()
+
+	// Sequential read
+	out, err := ioutil.ReadAll(f)
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(out, content) {
+		t.Errorf("content mismatch, got %d bytes, expected %d bytes", len(out), len(content))
+	}
+
+	// Seek in the middle of a chunk and read again
+	for _, offset := range []int64{0, 1, 650, 700, int64(len(content)) - 1} {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			panic(err)
+		}
+		out, err := ioutil.ReadAll(f)
+		if err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(out, content[offset:]) {
+			t.Errorf("content mismatch at offset %d", offset)
+		}
+	}
+}
+
+func TestFileStreamReadCorrupted(t *testing.T) {
+	bs := memBlobStore{}
+	meta := &node.RawNode{Type: "file", Name: "test.txt"}
+	var content []byte
+	var refs []string
+	for i := 0; i < 3; i++ {
+		chunk := bytes.Repeat([]byte(fmt.Sprintf("chunk%d", i)), 100)
+		h := hashutil.Compute(chunk)
+		bs[h] = chunk
+		refs = append(refs, h)
+		content = append(content, chunk...)
+		meta.AddIndexedRef(len(content), h)
+	}
+	meta.Size = len(content)
+	bs[refs[1]] = bytes.Repeat([]byte("corrupt"), 100)
+
+	f := NewFile(context.Background(), bs, meta, nil)
+	defer f.Close()
+
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, f); err == nil {
+		t.Errorf("the corrupted chunk should fail the read")
+	}
+	if !bytes.Equal(out.Bytes(), content[:len(bs[refs[0]])]) {
+		t.Errorf("only the first chunk should have been written, got %d bytes", out.Len())
+	}
+}
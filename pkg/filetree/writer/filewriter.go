@@ -50,7 +50,7 @@ func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*W
 		}
 		if !exists {
 			if err := up.bs.Put(ctx, chunkHash, chunk.Data); err != nil {
-				panic(fmt.Errorf("failed to PUT blob %v", err))
+				return fmt.Errorf("failed to put blob %v: %w", chunkHash, err)
 			}
 		}
 
@@ -131,7 +131,7 @@ func (up *Uploader) putFile(path, filename string, extraMeta bool) (*rnode.RawNo
 	// wr.Size += len(mjs)
 	if !mexists {
 		if err := up.bs.Put(ctx, mhash, mjs); err != nil {
-			return nil, fmt.Errorf("failed to put blob %v: %v", mhash, err)
+			return nil, fmt.Errorf("failed to put blob %v: %w", mhash, err)
 		}
 		// wr.BlobsCount++
 		// wr.BlobsUploaded++
@@ -154,7 +154,7 @@ func (up *Uploader) PutMeta(meta *rnode.RawNode) error {
 	// wr.Size += len(mjs)
 	if !mexists {
 		if err := up.bs.Put(ctx, mhash, mjs); err != nil {
-			return fmt.Errorf("failed to put blob %v: %v", mhash, err)
+			return fmt.Errorf("failed to put blob %v: %w", mhash, err)
 		}
 		// wr.BlobsCount++
 		// wr.BlobsUploaded++
@@ -178,7 +178,7 @@ func (up *Uploader) RenameMeta(meta *rnode.RawNode, name string) error {
 	// wr.Size += len(mjs)
 	if !mexists {
 		if err := up.bs.Put(ctx, mhash, mjs); err != nil {
-			return fmt.Errorf("failed to put blob %v: %v", mhash, err)
+			return fmt.Errorf("failed to put blob %v: %w", mhash, err)
 		}
 		// wr.BlobsCount++
 		// wr.BlobsUploaded++
@@ -218,7 +218,7 @@ func (up *Uploader) PutReader(name string, reader io.Reader, data map[string]int
 	// wr.Size += len(mjs)
 	if !mexists {
 		if err := up.bs.Put(ctx, mhash, mjs); err != nil {
-			return nil, fmt.Errorf("failed to put blob %v: %v", mhash, err)
+			return nil, fmt.Errorf("failed to put blob %v: %w", mhash, err)
 		}
 		// wr.BlobsCount++
 		// wr.BlobsUploaded++
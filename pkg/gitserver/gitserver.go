@@ -5,6 +5,9 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -44,6 +47,22 @@ import (
 
 var remoteMaster = "refs/remotes/origin/master"
 
+// RepoUpdateEvent represents an event fired on push/fetch to the Oplog
+type RepoUpdateEvent struct {
+	Namespace string `json:"ns"`
+	Repo      string `json:"repo"`
+	Type      string `json:"type"`
+	Time      int64  `json:"event_time"`
+}
+
+func (e *RepoUpdateEvent) JSON() string {
+	js, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	return string(js)
+}
+
 type GitServer struct {
 	kvStore   store.KvStore
 	blobStore store.BlobStore
@@ -72,6 +91,17 @@ func (gs *GitServer) Close() error {
 	return nil
 }
 
+// notify fires the oplog event for the given repo
+func (gs *GitServer) notify(ctx context.Context, evtType, ns, repo string) error {
+	updateEvent := &RepoUpdateEvent{
+		Namespace: ns,
+		Repo:      repo,
+		Type:      evtType,
+		Time:      time.Now().UTC().Unix(),
+	}
+	return gs.hub.GitUpdateEvent(ctx, nil, updateEvent.JSON())
+}
+
 // RegisterRoute registers all the HTTP handlers for the extension
 func (gs *GitServer) Register(r *mux.Router, root *mux.Router, basicAuth func(http.Handler) http.Handler) {
 	r.Handle("/", basicAuth(http.HandlerFunc(gs.rootHandler)))
@@ -171,25 +201,44 @@ func (s *storage) SetConfig(c *gconfig.Config) error {
 
 // SetReference implements the storer.ReferenceStorer interface
 func (s *storage) SetReference(ref *plumbing.Reference) error {
-	parts := ref.Strings()
-	if _, err := s.kvStore.Put(context.TODO(), s.key("r", ref.Name().String()), "", []byte(parts[1]), -1); err != nil {
+	return s.setReference(ref, nil)
+}
+
+// CheckAndSetReference implements the storer.ReferenceStorer interface, the reference is only updated if it still
+// points to `old` (if set)
+func (s *storage) CheckAndSetReference(new, old *plumbing.Reference) error {
+	var cond *vkv.Condition
+	if old != nil {
+		cond = &vkv.Condition{Hash: hashutil.Compute([]byte(old.Strings()[1]))}
+	}
+	if err := s.setReference(new, cond); err != nil {
+		if errors.Is(err, vkv.ErrConditionFailed) {
+			return gstorage.ErrReferenceHasChanged
+		}
 		return err
 	}
+	return nil
+}
+
+func (s *storage) setReference(ref *plumbing.Reference, cond *vkv.Condition) error {
+	parts := ref.Strings()
 	// If we're updating the remote master (during a fetch)
 	if ref.Name().String() == remoteMaster {
-		// Also update the local master/HEAD
-		if _, err := s.kvStore.Put(context.TODO(), s.key("r", plumbing.Master.String()), "", []byte(parts[1]), -1); err != nil {
+		// Also update the local master/HEAD (in the same batch)
+		if _, err := s.kvStore.Batch(context.TODO(), []*vkv.BatchEntry{
+			&vkv.BatchEntry{Key: s.key("r", ref.Name().String()), Data: []byte(parts[1]), Cond: cond},
+			&vkv.BatchEntry{Key: s.key("r", plumbing.Master.String()), Data: []byte(parts[1])},
+		}); err != nil {
 			return err
 		}
+		return nil
+	}
+	if _, err := s.kvStore.PutIf(context.TODO(), s.key("r", ref.Name().String()), "", []byte(parts[1]), -1, cond); err != nil {
+		return err
 	}
 	return nil
 }
 
-// CheckAndSetReference implements the storer.ReferenceStorer interface
-func (s *storage) CheckAndSetReference(new, old *plumbing.Reference) error {
-	return s.SetReference(new)
-}
-
 func (s *storage) RemoveReference(n plumbing.ReferenceName) error {
 	if _, err := s.kvStore.Put(context.TODO(), s.key("r", n.String()), "", nil, -1); err != nil {
 		return err
@@ -269,7 +318,7 @@ func (s *storage) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, e
 	// Chunk the file the same way the filetree API does to share the "dedup"'d data
 	if obj.Type() == plumbing.BlobObject {
 		// reuse this buffer
-		refs := [][32]byte{}
+		refs := []string{}
 		if obj.Size() > 512*1024 {
 			s.chunker.Reset(bytes.NewReader(content), writer.Pol)
 			chunkSplitter := s.chunker
@@ -278,15 +327,15 @@ func (s *storage) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, e
 				if err == io.EOF {
 					break
 				}
-				chunkHash := hashutil.ComputeRaw(chunk.Data)
-				if _, err := s.blobStore.Put(context.TODO(), &blob.Blob{Hash: fmt.Sprintf("%x", chunkHash), Data: chunk.Data}); err != nil {
+				chunkHash := hashutil.Compute(chunk.Data)
+				if _, err := s.blobStore.Put(context.TODO(), &blob.Blob{Hash: chunkHash, Data: chunk.Data}); err != nil {
 					return plumbing.ZeroHash, err
 				}
 				refs = append(refs, chunkHash)
 			}
 		} else {
-			chunkHash := hashutil.ComputeRaw(content)
-			if _, err := s.blobStore.Put(context.TODO(), &blob.Blob{Hash: fmt.Sprintf("%x", chunkHash), Data: content}); err != nil {
+			chunkHash := hashutil.Compute(content)
+			if _, err := s.blobStore.Put(context.TODO(), &blob.Blob{Hash: chunkHash, Data: content}); err != nil {
 				return plumbing.ZeroHash, err
 			}
 			refs = append(refs, chunkHash)
@@ -311,12 +360,12 @@ func (s *storage) objFromKv(kv *vkv.KeyValue) (plumbing.EncodedObject, error) {
 	obj.SetType(objType)
 
 	if objType == plumbing.BlobObject {
-		refs := [][32]byte{}
-		if err := msgpack.Unmarshal(kv.Data[1:], &refs); err != nil {
+		refs, err := chunkRefs(kv.Data[1:])
+		if err != nil {
 			return nil, err
 		}
 		for _, rref := range refs {
-			blob, err := s.blobStore.Get(context.TODO(), fmt.Sprintf("%x", rref))
+			blob, err := s.blobStore.Get(context.TODO(), rref)
 			if err != nil {
 				return nil, err
 			}
@@ -334,6 +383,39 @@ func (s *storage) objFromKv(kv *vkv.KeyValue) (plumbing.EncodedObject, error) {
 	return obj, nil
 }
 
+// ObjectBlobs returns the refs of the chunks of the git blob object stored in the given kv entry (returns nil if the
+// entry is not a git blob object), it's used by the GC to mark the blobs referenced by the repositories.
+func ObjectBlobs(kv *vkv.KeyValue) ([]string, error) {
+	if !strings.HasPrefix(kv.Key, "_git:") || !strings.Contains(kv.Key, "!o!") || len(kv.Data) == 0 {
+		return nil, nil
+	}
+	if plumbing.ObjectType(kv.Data[0]) != plumbing.BlobObject {
+		return nil, nil
+	}
+	return chunkRefs(kv.Data[1:])
+}
+
+// chunkRefs decodes the refs of the chunks of a git blob object, the older objects store raw BLAKE2b-256 digests and
+// the newer ones store the refs (hashed with the current algorithm)
+func chunkRefs(data []byte) ([]string, error) {
+	rawRefs := []interface{}{}
+	if err := msgpack.Unmarshal(data, &rawRefs); err != nil {
+		return nil, err
+	}
+	out := make([]string, len(rawRefs))
+	for i, rref := range rawRefs {
+		switch ref := rref.(type) {
+		case []byte:
+			out[i] = hex.EncodeToString(ref)
+		case string:
+			out[i] = ref
+		default:
+			return nil, fmt.Errorf("invalid chunk ref %v", rref)
+		}
+	}
+	return out, nil
+}
+
 func (s *storage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
 	key := s.key("o", h.String())
 
@@ -1133,6 +1215,9 @@ func (gs *GitServer) gitCloneOrPullHandler(w http.ResponseWriter, r *http.Reques
 	switch err {
 	case nil:
 		httputil.HeaderLog(w, "clone succeeded")
+		if err := gs.notify(r.Context(), "repo-cloned", vars["ns"], vars["repo"]); err != nil {
+			panic(err)
+		}
 		w.WriteHeader(http.StatusCreated)
 	case git.ErrRepositoryAlreadyExists:
 		httputil.HeaderLog(w, "git fetch")
@@ -1147,6 +1232,9 @@ func (gs *GitServer) gitCloneOrPullHandler(w http.ResponseWriter, r *http.Reques
 		switch err := repo.Fetch(&git.FetchOptions{}); err {
 		case nil:
 			httputil.HeaderLog(w, "fetch succeeded")
+			if err := gs.notify(r.Context(), "repo-fetched", vars["ns"], vars["repo"]); err != nil {
+				panic(err)
+			}
 			w.WriteHeader(http.StatusResetContent)
 		case git.NoErrAlreadyUpToDate:
 			httputil.HeaderLog(w, err.Error())
@@ -1213,6 +1301,10 @@ func (gs *GitServer) gitServiceHandler(w http.ResponseWriter, r *http.Request) {
 			panic(err)
 		}
 
+		if err := gs.notify(r.Context(), "repo-pushed", vars["ns"], vars["repo"]); err != nil {
+			panic(err)
+		}
+
 		if err := status.Encode(w); err != nil {
 			panic(err)
 		}
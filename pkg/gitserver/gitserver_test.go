@@ -0,0 +1,42 @@
+package gitserver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+func TestChunkRefs(t *testing.T) {
+	data := []byte("hello")
+	expected := []string{hashutil.ComputeWith(hashutil.BLAKE2b256, data)}
+
+	// Older objects store the raw BLAKE2b-256 digests
+	old, err := msgpack.Marshal(&[][32]byte{hashutil.ComputeRaw(data)})
+	if err != nil {
+		panic(err)
+	}
+	refs, err := chunkRefs(old)
+	if err != nil {
+		panic(err)
+	}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Errorf("unexpected refs %v, expected %v", refs, expected)
+	}
+
+	// Newer ones store the refs, whatever the algorithm
+	expected = append(expected, hashutil.ComputeWith(hashutil.SHA256, data))
+	encoded, err := msgpack.Marshal(&expected)
+	if err != nil {
+		panic(err)
+	}
+	refs, err = chunkRefs(encoded)
+	if err != nil {
+		panic(err)
+	}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Errorf("unexpected refs %v, expected %v", refs, expected)
+	}
+}
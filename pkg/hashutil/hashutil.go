@@ -1,17 +1,137 @@
 package hashutil // import "a4.io/blobstash/pkg/hashutil"
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
+	"strings"
 
 	"golang.org/x/crypto/blake2b"
 )
 
-// ComputeRaw returns the Blake2B hash hex-encoded
+// Supported hash algorithms
+const (
+	BLAKE2b256 = "blake2b-256"
+	SHA256     = "sha2-256"
+)
+
+// SHA-256 refs are self-describing: the hex-encoded digest is prefixed with the multihash code and length (0x12 0x20),
+// BLAKE2b-256 refs are kept as bare hex-encoded digests for backward compatibility.
+const sha256Prefix = "1220"
+
+// DigestSize is the size of the digest for all the supported algorithms
+const DigestSize = 32
+
+// ErrUnknownAlgorithm is returned when a ref or an algorithm name is not supported
+var ErrUnknownAlgorithm = fmt.Errorf("unknown hash algorithm")
+
+// The algorithm used by `Compute` (i.e. to write new blobs)
+var algorithm = BLAKE2b256
+
+// SetAlgorithm sets the algorithm used to compute the hash of new blobs (defaults to BLAKE2b-256), blobs hashed with
+// any supported algorithm can always be read.
+func SetAlgorithm(algo string) error {
+	switch algo {
+	case "":
+		algorithm = BLAKE2b256
+	case BLAKE2b256, SHA256:
+		algorithm = algo
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownAlgorithm, algo)
+	}
+	return nil
+}
+
+// Algorithm returns the algorithm used to compute the hash of new blobs
+func Algorithm() string {
+	return algorithm
+}
+
+// AlgorithmOf returns the algorithm of the given ref
+func AlgorithmOf(ref string) (string, error) {
+	switch {
+	case len(ref) == 2*DigestSize:
+		return BLAKE2b256, nil
+	case len(ref) == 2*DigestSize+len(sha256Prefix) && strings.HasPrefix(ref, sha256Prefix):
+		return SHA256, nil
+	default:
+		return "", fmt.Errorf("%w: invalid ref %q", ErrUnknownAlgorithm, ref)
+	}
+}
+
+// Digest returns the raw digest of the ref along with its algorithm
+func Digest(ref string) (string, []byte, error) {
+	algo, err := AlgorithmOf(ref)
+	if err != nil {
+		return "", nil, err
+	}
+	digest, err := hex.DecodeString(ref[len(ref)-2*DigestSize:])
+	if err != nil {
+		return "", nil, err
+	}
+	return algo, digest, nil
+}
+
+// HexDigest returns the hex-encoded digest of the ref (i.e. without the algorithm prefix), an invalid ref is returned
+// as is
+func HexDigest(ref string) string {
+	if _, err := AlgorithmOf(ref); err != nil {
+		return ref
+	}
+	return ref[len(ref)-2*DigestSize:]
+}
+
+// RefPrefixes returns the prefixes of the refs whose hex-encoded digest starts with `digestPrefix` (one prefix for each
+// supported algorithm)
+func RefPrefixes(digestPrefix string) []string {
+	return []string{digestPrefix, sha256Prefix + digestPrefix}
+}
+
+// Ref formats a raw digest as a ref
+func Ref(algo string, digest []byte) string {
+	if algo == SHA256 {
+		return sha256Prefix + hex.EncodeToString(digest)
+	}
+	return hex.EncodeToString(digest)
+}
+
+// ComputeRaw returns the Blake2B hash (always BLAKE2b-256, for the refs stored as raw 32 bytes digests)
 func ComputeRaw(data []byte) [32]byte {
 	return blake2b.Sum256(data)
 }
 
-// Compute returns the Blake2B hash hex-encoded
+// Compute returns the hash of the data with the current algorithm (see `SetAlgorithm`)
 func Compute(data []byte) string {
+	return ComputeWith(algorithm, data)
+}
+
+// ComputeWith returns the ref of the data for the given algorithm
+func ComputeWith(algo string, data []byte) string {
+	if algo == SHA256 {
+		sum := sha256.Sum256(data)
+		return Ref(SHA256, sum[:])
+	}
 	return fmt.Sprintf("%x", blake2b.Sum256(data))
 }
+
+// ComputeLike returns the hash of the data computed with the same algorithm as the given ref (used to verify blobs)
+func ComputeLike(ref string, data []byte) (string, error) {
+	algo, err := AlgorithmOf(ref)
+	if err != nil {
+		return "", err
+	}
+	return ComputeWith(algo, data), nil
+}
+
+// NewHash returns a `hash.Hash` for the given algorithm (for hashing streams), use `Ref` to format the sum
+func NewHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case BLAKE2b256:
+		return blake2b.New256(nil)
+	case SHA256:
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAlgorithm, algo)
+	}
+}
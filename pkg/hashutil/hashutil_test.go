@@ -0,0 +1,84 @@
+package hashutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestRefs(t *testing.T) {
+	data := []byte("hello")
+	defer SetAlgorithm(BLAKE2b256)
+
+	legacy := Compute(data)
+	if len(legacy) != 64 {
+		t.Errorf("BLAKE2b-256 refs must be bare hex digests, got %q", legacy)
+	}
+
+	if err := SetAlgorithm(SHA256); err != nil {
+		panic(err)
+	}
+	ref := Compute(data)
+	sum := sha256.Sum256(data)
+	if expected := "1220" + hex.EncodeToString(sum[:]); ref != expected {
+		t.Errorf("bad SHA-256 ref, got %q, expected %q", ref, expected)
+	}
+
+	// Both refs can still be verified
+	for _, tc := range []struct {
+		ref  string
+		algo string
+	}{
+		{legacy, BLAKE2b256},
+		{ref, SHA256},
+	} {
+		algo, digest, err := Digest(tc.ref)
+		if err != nil {
+			panic(err)
+		}
+		if algo != tc.algo {
+			t.Errorf("bad algorithm for %q, got %q, expected %q", tc.ref, algo, tc.algo)
+		}
+		if Ref(algo, digest) != tc.ref {
+			t.Errorf("failed to format ref %q", tc.ref)
+		}
+		chash, err := ComputeLike(tc.ref, data)
+		if err != nil {
+			panic(err)
+		}
+		if chash != tc.ref {
+			t.Errorf("ComputeLike(%q) returned %q", tc.ref, chash)
+		}
+		h, err := NewHash(algo)
+		if err != nil {
+			panic(err)
+		}
+		h.Write(data)
+		if Ref(algo, h.Sum(nil)) != tc.ref {
+			t.Errorf("streaming hash mismatch for %q", tc.ref)
+		}
+		if HexDigest(tc.ref) != hex.EncodeToString(digest) {
+			t.Errorf("bad hex digest for %q, got %q", tc.ref, HexDigest(tc.ref))
+		}
+		prefix := HexDigest(tc.ref)[:3]
+		var matched bool
+		for _, refPrefix := range RefPrefixes(prefix) {
+			if strings.HasPrefix(tc.ref, refPrefix) {
+				matched = true
+			}
+		}
+		if !matched {
+			t.Errorf("%q should match one of the prefixes of %q", tc.ref, prefix)
+		}
+	}
+
+	for _, invalid := range []string{"", "abcd", "1220", legacy + "00"} {
+		if _, err := AlgorithmOf(invalid); err == nil {
+			t.Errorf("ref %q should be invalid", invalid)
+		}
+	}
+	if err := SetAlgorithm("md5"); err == nil {
+		t.Errorf("md5 should not be supported")
+	}
+}
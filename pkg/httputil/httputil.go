@@ -1,8 +1,10 @@
 package httputil // import "a4.io/blobstash/pkg/httputil"
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -60,6 +62,18 @@ func Read(r *http.Request) ([]byte, error) {
 	return body, nil
 }
 
+// Reader returns a reader for the request body (snappy encoded body are decoded first)
+func Reader(r *http.Request) (io.Reader, error) {
+	if r.Header.Get("Content-Type") == "snappy" {
+		data, err := Read(r)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	}
+	return r.Body, nil
+}
+
 // Same as Write, but assume data is already snappy encoded
 func WriteEncoded(r *http.Request, w http.ResponseWriter, data []byte, writeOptions ...func(http.ResponseWriter)) {
 	w.Header().Set("Cache-Control", "no-cache")
@@ -99,6 +113,30 @@ func Write(r *http.Request, w http.ResponseWriter, data []byte, writeOptions ...
 	}
 }
 
+// WriteReader is the streaming version of `Write`, the content is streamed as-is unless a snappy encoded response was
+// requested
+func WriteReader(r *http.Request, w http.ResponseWriter, rd io.Reader, size int, writeOptions ...func(http.ResponseWriter)) {
+	if r.Header.Get("Accept-Encoding") == "snappy" {
+		data, err := ioutil.ReadAll(rd)
+		if err != nil {
+			panic(err)
+		}
+		Write(r, w, data, writeOptions...)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+
+	for _, wo := range writeOptions {
+		wo(w)
+	}
+
+	if _, err := io.Copy(w, rd); err != nil {
+		panic(err)
+	}
+}
+
 func MarshalAndWrite(r *http.Request, w http.ResponseWriter, data interface{}, writeOptions ...func(http.ResponseWriter)) bool {
 	responseFormat := jsonMimeType
 	if f := r.Header.Get("Accept"); f != "" && f != "*/*" {
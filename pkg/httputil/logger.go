@@ -5,13 +5,20 @@ import (
 	"encoding/hex"
 	"expvar"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/gorilla/mux"
 	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/metrics"
 )
 
 var (
 	apiReqsVar = expvar.NewInt("api-reqs")
+
+	reqDurationMetric = metrics.NewHistogramVec("blobstash_http_request_duration_seconds", "HTTP requests latency by route.",
+		nil, "route", "method", "code")
 )
 
 func newReqID() string {
@@ -31,6 +38,27 @@ func ExpvarsMiddleware(m *expvar.Map) func(next http.Handler) http.Handler {
 	}
 }
 
+// MetricsMiddleware records the latency of the requests by route template, must be registered as a router middleware
+// (via `Use`), and the status code is only known if the `LoggerMiddleware` is used too.
+func MetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+
+		route := "unknown"
+		if cr := mux.CurrentRoute(r); cr != nil {
+			if tpl, err := cr.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		code := "unknown"
+		if rw, ok := w.(*crw); ok {
+			code = strconv.Itoa(rw.statusCode)
+		}
+		reqDurationMetric.With(route, r.Method, code).Observe(time.Since(start).Seconds())
+	})
+}
+
 func newCustomResponseWriter(w http.ResponseWriter) *crw {
 	return &crw{
 		reqID:          newReqID(),
@@ -0,0 +1,92 @@
+package hub // import "a4.io/blobstash/pkg/hub"
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// ParseEventType returns the event type from its name (as returned by `EventType.String`)
+func ParseEventType(name string) (EventType, error) {
+	for etype, n := range eventTypes {
+		if n == name {
+			return etype, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown event type %q", name)
+}
+
+func canAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !auth.Can(
+		w,
+		r,
+		perms.Action(perms.Admin, perms.Blob),
+		perms.Resource(perms.BlobStore, perms.Blob),
+	) {
+		auth.Forbidden(w)
+		return false
+	}
+	return true
+}
+
+// Register registers the admin endpoints (the subscribers status and their dead letters)
+func (h *Hub) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/", basicAuth(http.HandlerFunc(h.statusHandler())))
+	r.Handle("/{type}/{name}/dead_letters", basicAuth(http.HandlerFunc(h.deadLettersHandler())))
+}
+
+func (h *Hub) statusHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !canAdmin(w, r) {
+			return
+		}
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		status, err := h.Status()
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": status,
+		})
+	}
+}
+
+func (h *Hub) deadLettersHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !canAdmin(w, r) {
+			return
+		}
+		vars := mux.Vars(r)
+		etype, err := ParseEventType(vars["type"])
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			dls, err := h.DeadLetters(etype, vars["name"])
+			if err != nil {
+				panic(err)
+			}
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": dls,
+			})
+		case "DELETE":
+			if err := h.PurgeDeadLetters(etype, vars["name"]); err != nil {
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package hub // import "a4.io/blobstash/pkg/hub"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/queue"
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// Retry policy for the async subscribers, once all the attempts failed, the event is moved to the dead letters.
+const (
+	maxAttempts   = 5
+	retryDelay    = 1 * time.Second
+	maxRetryDelay = 1 * time.Minute
+)
+
+// Event is an event persisted for the async subscribers.
+//
+// Only the hash of the blob is stored (except for the filetree nodes, which are tiny), async subscribers must fetch
+// the blob from the blobstore if they need its content.
+type Event struct {
+	Type     EventType       `json:"type"`
+	Hash     string          `json:"hash,omitempty"`
+	BlobData []byte          `json:"blob_data,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+func newEvent(etype EventType, b *blob.Blob, data interface{}) (*Event, error) {
+	e := &Event{Type: etype}
+	if b != nil {
+		e.Hash = b.Hash
+		if etype == NewFiletreeNode {
+			e.BlobData = b.Data
+		}
+	}
+	if data != nil && etype != NewFiletreeNode {
+		js, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		e.Data = js
+	}
+	return e, nil
+}
+
+// decode returns the callback args (the data is decoded for the known events, or returned as a `json.RawMessage`)
+func (e *Event) decode() (*blob.Blob, interface{}, error) {
+	var b *blob.Blob
+	if e.Hash != "" {
+		b = &blob.Blob{Hash: e.Hash, Data: e.BlobData}
+	}
+	switch e.Type {
+	case NewFiletreeNode:
+		n, err := node.NewNodeFromBlob(e.Hash, e.BlobData)
+		return b, n, err
+	case FiletreeFSUpdate, KvUpdate, DocstoreUpdate, GitUpdate:
+		var s string
+		if err := json.Unmarshal(e.Data, &s); err != nil {
+			return nil, nil, err
+		}
+		return b, s, nil
+	case GarbageCollection:
+		ref := &blob.SizedBlobRef{}
+		if err := json.Unmarshal(e.Data, ref); err != nil {
+			return nil, nil, err
+		}
+		return b, ref, nil
+	}
+	if len(e.Data) == 0 {
+		return b, nil, nil
+	}
+	return b, e.Data, nil
+}
+
+// DeadLetter is an event that could not be delivered to an async subscriber
+type DeadLetter struct {
+	Event    *Event `json:"event"`
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	FailedAt string `json:"failed_at"`
+}
+
+// SubscriberStatus holds the delivery stats of a subscriber
+type SubscriberStatus struct {
+	Name            string `json:"name"`
+	Type            string `json:"type"`
+	Async           bool   `json:"async"`
+	Lag             int    `json:"lag"`
+	Delivered       int64  `json:"delivered"`
+	Failures        int64  `json:"failures"`
+	Attempt         int    `json:"attempt"`
+	DeadLetters     int    `json:"dead_letters"`
+	LastDeliveredAt string `json:"last_delivered_at,omitempty"`
+	LastError       string `json:"last_error,omitempty"`
+	LastErrorAt     string `json:"last_error_at,omitempty"`
+}
+
+// State keys prefixes
+const (
+	flagCursor     byte = iota // <flag><type>\x00<name> => <queue key>
+	flagDeadLetter             // <flag><type>\x00<name>\x00<queue key> => <JSON dead letter>
+)
+
+func stateKey(flag byte, etype EventType, name string) []byte {
+	return []byte(fmt.Sprintf("%c%s\x00%s", flag, etype, name))
+}
+
+func deadLetterKey(etype EventType, name string, k []byte) []byte {
+	return append(append(stateKey(flagDeadLetter, etype, name), 0), k...)
+}
+
+// queues holds one disk-backed queue per event type (shared by all the async subscribers of the type), along with a
+// cursor for each subscriber.
+type queues struct {
+	dir   string
+	state *rangedb.RangeDB
+	mu    sync.Mutex
+
+	queues map[EventType]*queue.Queue
+
+	// Retry policy (only updated in the tests)
+	maxAttempts   int
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+}
+
+// EnableAsync enables the async subscribers (see `SubscribeAsync`), the events are stored in `dir`.
+func (h *Hub) EnableAsync(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	state, err := rangedb.New(filepath.Join(dir, "state"))
+	if err != nil {
+		return err
+	}
+	h.queues = &queues{
+		dir:           dir,
+		state:         state,
+		queues:        map[EventType]*queue.Queue{},
+		maxAttempts:   maxAttempts,
+		retryDelay:    retryDelay,
+		maxRetryDelay: maxRetryDelay,
+	}
+	return nil
+}
+
+// SubscribeAsync registers a callback that will be called in the background, from a disk-backed queue.
+//
+// Each subscriber keeps its own cursor in the queue, the events are retried with an exponential backoff, and the
+// events still failing after 5 attempts are moved to the dead letters. The callback is called with a background
+// context and only receives the hash of the blob (see `Event`).
+// Falls back to a sync subscription if async delivery is not enabled.
+func (h *Hub) SubscribeAsync(etype EventType, name string, callback func(context.Context, *blob.Blob, interface{}) error) error {
+	if h.queues == nil {
+		h.log.Warn("async delivery is not enabled, falling back to sync", "type", etype, "name", name)
+		h.Subscribe(etype, name, callback)
+		return nil
+	}
+	h.log.Info("new async subscription", "type", etype, "name", name)
+	q, err := h.queues.open(etype)
+	if err != nil {
+		return err
+	}
+	sub := &subscriber{name: name, etype: etype, callback: callback}
+	if err := h.queues.init(sub); err != nil {
+		return err
+	}
+	sub.async = &asyncSubscriber{
+		sub:    sub,
+		queues: h.queues,
+		queue:  q,
+		log:    h.log.New("subscriber", name, "type", etype),
+		wake:   make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	h.mu.Lock()
+	old := h.subscribers[etype][name]
+	h.subscribers[etype][name] = sub
+	h.mu.Unlock()
+	if old != nil && old.async != nil {
+		old.async.stop()
+	}
+
+	go sub.async.run()
+	return nil
+}
+
+// Status returns the status of all the subscribers
+func (h *Hub) Status() ([]*SubscriberStatus, error) {
+	out := []*SubscriberStatus{}
+	for etype := range eventTypes {
+		for _, sub := range h.list(etype) {
+			status := &SubscriberStatus{Name: sub.name, Type: etype.String()}
+			if sub.async != nil {
+				if err := sub.async.status(status); err != nil {
+					return nil, err
+				}
+				lagMetric.With(status.Type, status.Name).Set(float64(status.Lag))
+				deadLettersMetric.With(status.Type, status.Name).Set(float64(status.DeadLetters))
+			}
+			out = append(out, status)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Type != out[j].Type {
+			return out[i].Type < out[j].Type
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+// DeadLetters returns the events that failed to be delivered to the given subscriber
+func (h *Hub) DeadLetters(etype EventType, name string) ([]*DeadLetter, error) {
+	if h.queues == nil {
+		return []*DeadLetter{}, nil
+	}
+	return h.queues.deadLetters(etype, name, true)
+}
+
+// PurgeDeadLetters removes the dead letters of the given subscriber
+func (h *Hub) PurgeDeadLetters(etype EventType, name string) error {
+	if h.queues == nil {
+		return nil
+	}
+	prefix := append(stateKey(flagDeadLetter, etype, name), 0)
+	return h.queues.deletePrefix(prefix)
+}
+
+func (qs *queues) open(etype EventType) (*queue.Queue, error) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if q, ok := qs.queues[etype]; ok {
+		return q, nil
+	}
+	q, err := queue.New(filepath.Join(qs.dir, etype.String()+".queue"))
+	if err != nil {
+		return nil, err
+	}
+	qs.queues[etype] = q
+	return q, nil
+}
+
+func (qs *queues) enqueue(etype EventType, b *blob.Blob, data interface{}) error {
+	q, err := qs.open(etype)
+	if err != nil {
+		return err
+	}
+	e, err := newEvent(etype, b, data)
+	if err != nil {
+		return err
+	}
+	_, err = q.Enqueue(e)
+	return err
+}
+
+// init creates the cursor of a new subscriber (new subscribers start at the oldest event still queued)
+func (qs *queues) init(sub *subscriber) error {
+	key := stateKey(flagCursor, sub.etype, sub.name)
+	exists, err := qs.state.Has(key)
+	if err != nil || exists {
+		return err
+	}
+	return qs.state.Set(key, []byte{})
+}
+
+func (qs *queues) cursor(sub *subscriber) ([]byte, error) {
+	return qs.state.Get(stateKey(flagCursor, sub.etype, sub.name))
+}
+
+// advance moves the cursor of the subscriber, and removes the events delivered to all the subscribers
+func (qs *queues) advance(sub *subscriber, k []byte) error {
+	if err := qs.state.Set(stateKey(flagCursor, sub.etype, sub.name), k); err != nil {
+		return err
+	}
+	return qs.trim(sub.etype)
+}
+
+func (qs *queues) trim(etype EventType) error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	q, ok := qs.queues[etype]
+	if !ok {
+		return nil
+	}
+
+	// Find the oldest cursor
+	var min []byte
+	c := qs.state.PrefixRange(append([]byte{flagCursor}, []byte(etype.String()+"\x00")...), false)
+	defer c.Close()
+	_, v, err := c.Next()
+	if err == io.EOF {
+		// No more subscribers
+		min = []byte{0xff}
+	}
+	for ; err == nil; _, v, err = c.Next() {
+		if min == nil || bytes.Compare(v, min) < 0 {
+			min = v
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	if len(min) == 0 {
+		return nil
+	}
+	return q.Trim(min)
+}
+
+// remove deletes the cursor of an unsubscribed subscriber
+func (qs *queues) remove(sub *subscriber) error {
+	if err := qs.state.Delete(stateKey(flagCursor, sub.etype, sub.name)); err != nil {
+		return err
+	}
+	return qs.trim(sub.etype)
+}
+
+func (qs *queues) lag(sub *subscriber, q *queue.Queue) (int, error) {
+	cursor, err := qs.cursor(sub)
+	if err != nil {
+		return 0, err
+	}
+	return q.SizeAfter(cursor)
+}
+
+func (qs *queues) deadLetter(sub *subscriber, k []byte, dl *DeadLetter) error {
+	js, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	return qs.state.Set(deadLetterKey(sub.etype, sub.name, k), js)
+}
+
+// deadLetters returns the dead letters of the subscriber (only counted if `load` is false)
+func (qs *queues) deadLetters(etype EventType, name string, load bool) ([]*DeadLetter, error) {
+	out := []*DeadLetter{}
+	c := qs.state.PrefixRange(append(stateKey(flagDeadLetter, etype, name), 0), false)
+	defer c.Close()
+	_, v, err := c.Next()
+	for ; err == nil; _, v, err = c.Next() {
+		dl := &DeadLetter{}
+		if load {
+			if err := json.Unmarshal(v, dl); err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, dl)
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (qs *queues) deletePrefix(prefix []byte) error {
+	c := qs.state.PrefixRange(prefix, false)
+	defer c.Close()
+	k, _, err := c.Next()
+	for ; err == nil; k, _, err = c.Next() {
+		if err := qs.state.Delete(k); err != nil {
+			return err
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (qs *queues) Close() error {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	for _, q := range qs.queues {
+		if err := q.Close(); err != nil {
+			return err
+		}
+	}
+	return qs.state.Close()
+}
+
+// asyncSubscriber delivers the events to an async subscriber in the background
+type asyncSubscriber struct {
+	sub    *subscriber
+	queues *queues
+	queue  *queue.Queue
+	log    log.Logger
+
+	wake     chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu              sync.Mutex
+	delivered       int64
+	failures        int64
+	attempt         int
+	lastDeliveredAt time.Time
+	lastError       string
+	lastErrorAt     time.Time
+}
+
+func (as *asyncSubscriber) notify() {
+	select {
+	case as.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (as *asyncSubscriber) stop() {
+	as.stopOnce.Do(func() {
+		close(as.quit)
+	})
+	<-as.done
+}
+
+// wait returns false if the subscriber has been stopped
+func (as *asyncSubscriber) wait(d time.Duration) bool {
+	var timeout <-chan time.Time
+	if d > 0 {
+		timeout = time.After(d)
+	}
+	select {
+	case <-as.wake:
+		return true
+	case <-timeout:
+		return true
+	case <-as.quit:
+		return false
+	}
+}
+
+func (as *asyncSubscriber) run() {
+	defer close(as.done)
+	as.log.Debug("starting worker")
+	cursor, err := as.queues.cursor(as.sub)
+	if err != nil {
+		as.log.Error("failed to load the cursor", "err", err)
+		return
+	}
+	for {
+		e := &Event{}
+		k, ok, err := as.queue.Next(cursor, e)
+		if err != nil {
+			as.log.Error("failed to read the queue", "err", err)
+			if !as.wait(as.queues.maxRetryDelay) {
+				return
+			}
+			continue
+		}
+		if !ok {
+			if !as.wait(0) {
+				return
+			}
+			continue
+		}
+
+		if !as.deliver(k, e) {
+			return
+		}
+		if err := as.queues.advance(as.sub, k); err != nil {
+			as.log.Error("failed to update the cursor", "err", err)
+		}
+		cursor = k
+	}
+}
+
+// deliver calls the callback until it succeeds or the max attempts is reached, returns false if the subscriber has
+// been stopped before
+func (as *asyncSubscriber) deliver(k []byte, e *Event) bool {
+	delay := as.queues.retryDelay
+	for attempt := 1; ; attempt++ {
+		b, data, err := e.decode()
+		if err == nil {
+			err = as.sub.call(context.Background(), b, data)
+		}
+
+		as.mu.Lock()
+		if err == nil {
+			as.delivered++
+			as.attempt = 0
+			as.lastDeliveredAt = time.Now()
+			as.mu.Unlock()
+			return true
+		}
+		as.failures++
+		as.attempt = attempt
+		as.lastError = err.Error()
+		as.lastErrorAt = time.Now()
+		as.mu.Unlock()
+
+		if attempt >= as.queues.maxAttempts {
+			as.log.Error("giving up, moving the event to the dead letters", "hash", e.Hash, "err", err)
+			if err := as.queues.deadLetter(as.sub, k, &DeadLetter{
+				Event:    e,
+				Error:    err.Error(),
+				Attempts: attempt,
+				FailedAt: time.Now().UTC().Format(time.RFC3339),
+			}); err != nil {
+				as.log.Error("failed to save the dead letter", "err", err)
+			}
+			as.mu.Lock()
+			as.attempt = 0
+			as.mu.Unlock()
+			return true
+		}
+
+		as.log.Info("callback failed, will retry", "hash", e.Hash, "attempt", attempt, "delay", delay, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-as.quit:
+			return false
+		}
+		delay *= 2
+		if delay > as.queues.maxRetryDelay {
+			delay = as.queues.maxRetryDelay
+		}
+	}
+}
+
+func (as *asyncSubscriber) status(status *SubscriberStatus) error {
+	status.Async = true
+	lag, err := as.queues.lag(as.sub, as.queue)
+	if err != nil {
+		return err
+	}
+	status.Lag = lag
+	dls, err := as.queues.deadLetters(as.sub.etype, as.sub.name, false)
+	if err != nil {
+		return err
+	}
+	status.DeadLetters = len(dls)
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	status.Delivered = as.delivered
+	status.Failures = as.failures
+	status.Attempt = as.attempt
+	status.LastError = as.lastError
+	if !as.lastDeliveredAt.IsZero() {
+		status.LastDeliveredAt = as.lastDeliveredAt.UTC().Format(time.RFC3339)
+	}
+	if !as.lastErrorAt.IsZero() {
+		status.LastErrorAt = as.lastErrorAt.UTC().Format(time.RFC3339)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out")
+}
+
+func TestAsyncSubscribers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_hub_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+
+	h := New(logger, true)
+	if err := h.EnableAsync(dir); err != nil {
+		panic(err)
+	}
+	h.queues.retryDelay = time.Millisecond
+
+	var mu sync.Mutex
+	received := []string{}
+	if err := h.SubscribeAsync(NewBlob, "ok", func(_ context.Context, b *blob.Blob, _ interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, b.Hash)
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	if err := h.SubscribeAsync(NewBlob, "failing", func(_ context.Context, b *blob.Blob, _ interface{}) error {
+		return fmt.Errorf("failed")
+	}); err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := h.NewBlobEvent(context.Background(), blob.New([]byte(fmt.Sprintf("hello%d", i))), nil); err != nil {
+			t.Fatalf("a failing async subscriber must not fail the event: %v", err)
+		}
+	}
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		dls, err := h.DeadLetters(NewBlob, "failing")
+		if err != nil {
+			panic(err)
+		}
+		return len(received) == 3 && len(dls) == 3
+	})
+
+	status, err := h.Status()
+	if err != nil {
+		panic(err)
+	}
+	for _, s := range status {
+		if s.Lag != 0 {
+			t.Errorf("%s should not lag, got %d", s.Name, s.Lag)
+		}
+		if s.Name == "failing" && (s.Failures != 15 || s.LastError != "failed") {
+			t.Errorf("unexpected status %+v", s)
+		}
+	}
+
+	// Events are kept on disk until delivered
+	if err := h.Unsubscribe(NewBlob, "ok"); err != nil {
+		panic(err)
+	}
+	h.queues.retryDelay = time.Hour
+	if err := h.SubscribeAsync(NewBlob, "late", func(_ context.Context, b *blob.Blob, _ interface{}) error {
+		return fmt.Errorf("not yet")
+	}); err != nil {
+		panic(err)
+	}
+	if err := h.NewBlobEvent(context.Background(), blob.New([]byte("hello4")), nil); err != nil {
+		panic(err)
+	}
+	if err := h.Close(); err != nil {
+		panic(err)
+	}
+
+	h2 := New(logger, true)
+	if err := h2.EnableAsync(dir); err != nil {
+		panic(err)
+	}
+	defer h2.Close()
+	done := make(chan string, 1)
+	if err := h2.SubscribeAsync(NewBlob, "late", func(_ context.Context, b *blob.Blob, _ interface{}) error {
+		done <- b.Hash
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	select {
+	case hash := <-done:
+		if hash != blob.New([]byte("hello4")).Hash {
+			t.Errorf("unexpected event %s", hash)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("the pending event was not delivered after restart")
+	}
+}
+
+func TestAsyncConcurrentEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_hub_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+
+	h := New(logger, true)
+	if err := h.EnableAsync(dir); err != nil {
+		panic(err)
+	}
+	defer h.Close()
+	h.queues.retryDelay = time.Millisecond
+
+	var mu sync.Mutex
+	received := map[string]int{}
+	if err := h.SubscribeAsync(NewBlob, "ok", func(_ context.Context, b *blob.Blob, _ interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received[b.Hash]++
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+
+	// Events enqueued concurrently must all be delivered (none can be skipped by the subscriber cursor, nor trimmed
+	// before being delivered)
+	expected := map[string]struct{}{}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		blobs := []*blob.Blob{}
+		for j := 0; j < 25; j++ {
+			b := blob.New([]byte(fmt.Sprintf("hello%d-%d", i, j)))
+			expected[b.Hash] = struct{}{}
+			blobs = append(blobs, b)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, b := range blobs {
+				if err := h.NewBlobEvent(context.Background(), b, nil); err != nil {
+					panic(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == len(expected)
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	for hash := range expected {
+		if received[hash] != 1 {
+			t.Errorf("blob %s delivered %d times", hash, received[hash])
+		}
+	}
+}
@@ -2,12 +2,29 @@ package hub // import "a4.io/blobstash/pkg/hub"
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 
 	log "github.com/inconshreveable/log15"
 
 	"a4.io/blobstash/pkg/blob"
 	_ "a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/metrics"
+)
+
+var (
+	callbackDurationMetric = metrics.NewHistogramVec("blobstash_hub_callback_duration_seconds", "Hub callbacks latency.", nil,
+		"type", "subscriber", "mode")
+	callbackErrorsMetric = metrics.NewCounterVec("blobstash_hub_callback_errors", "Failed hub callbacks.", "type",
+		"subscriber", "mode")
+
+	// Updated by `Status`
+	lagMetric = metrics.NewGaugeVec("blobstash_hub_subscriber_lag", "Events waiting to be delivered to async subscribers.",
+		"type", "subscriber")
+	deadLettersMetric = metrics.NewGaugeVec("blobstash_hub_dead_letters", "Dead letters of the async subscribers.", "type",
+		"subscriber")
 )
 
 type EventType int
@@ -20,27 +37,129 @@ const (
 	FiletreeFSUpdate // TODO(tsileo): remove these events
 	SyncRemoteBlob
 	DeleteRemoteBlob
+	KvUpdate
+	DocstoreUpdate
+	GitUpdate
 )
 
+var eventTypes = map[EventType]string{
+	NewBlob:           "new_blob",
+	ScanBlob:          "scan_blob",
+	GarbageCollection: "garbage_collection",
+	NewFiletreeNode:   "new_filetree_node",
+	FiletreeFSUpdate:  "filetree_fs_update",
+	SyncRemoteBlob:    "sync_remote_blob",
+	DeleteRemoteBlob:  "delete_remote_blob",
+	KvUpdate:          "kv_update",
+	DocstoreUpdate:    "docstore_update",
+	GitUpdate:         "git_update",
+}
+
+func (e EventType) String() string {
+	if name, ok := eventTypes[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_%d", int(e))
+}
+
+// Callback is called for each new event
+type Callback func(context.Context, *blob.Blob, interface{}) error
+
+// call runs the callback and records its metrics
+func (sub *subscriber) call(ctx context.Context, b *blob.Blob, data interface{}) error {
+	mode := "sync"
+	if sub.async != nil {
+		mode = "async"
+	}
+	start := time.Now()
+	err := sub.callback(ctx, b, data)
+	callbackDurationMetric.With(sub.etype.String(), sub.name, mode).Observe(time.Since(start).Seconds())
+	if err != nil {
+		callbackErrorsMetric.With(sub.etype.String(), sub.name, mode).Inc()
+	}
+	return err
+}
+
+type subscriber struct {
+	name     string
+	etype    EventType
+	callback Callback
+
+	// Only set for async subscribers
+	async *asyncSubscriber
+}
+
 type Hub struct {
 	root        bool
 	log         log.Logger
-	subscribers map[EventType]map[string]func(context.Context, *blob.Blob, interface{}) error
+	subscribers map[EventType]map[string]*subscriber
+	mu          sync.RWMutex
+
+	// Only set if async delivery is enabled (see `EnableAsync`)
+	queues *queues
 }
 
+// Subscribe registers a synchronous callback, the event fails if the callback returns an error.
 func (h *Hub) Subscribe(etype EventType, name string, callback func(context.Context, *blob.Blob, interface{}) error) {
 	h.log.Info("new subscription", "type", etype, "name", name)
-	h.subscribers[etype][name] = callback
+	h.mu.Lock()
+	old := h.subscribers[etype][name]
+	h.subscribers[etype][name] = &subscriber{name: name, etype: etype, callback: callback}
+	h.mu.Unlock()
+	if old != nil && old.async != nil {
+		old.async.stop()
+	}
+}
+
+// Unsubscribe removes the subscription, for async subscribers, the pending events are dropped.
+func (h *Hub) Unsubscribe(etype EventType, name string) error {
+	h.log.Info("unsubscribe", "type", etype, "name", name)
+	h.mu.Lock()
+	sub, ok := h.subscribers[etype][name]
+	delete(h.subscribers[etype], name)
+	h.mu.Unlock()
+	if !ok || sub.async == nil {
+		return nil
+	}
+	sub.async.stop()
+	return h.queues.remove(sub)
+}
+
+// list returns a snapshot of the subscribers for the given event type
+func (h *Hub) list(etype EventType) []*subscriber {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	subs := make([]*subscriber, 0, len(h.subscribers[etype]))
+	for _, sub := range h.subscribers[etype] {
+		subs = append(subs, sub)
+	}
+	return subs
 }
 
 func (h *Hub) newEvent(ctx context.Context, etype EventType, blob *blob.Blob, data interface{}) error {
 	l := h.log.New("type", etype, "blob", blob, "data", data)
 	l.Debug("new event")
-	for name, callback := range h.subscribers[etype] {
-		h.log.Debug("triggering callback", "name", name)
-		if err := callback(ctx, blob, data); err != nil {
+	subs := h.list(etype)
+	var hasAsync bool
+	for _, sub := range subs {
+		if sub.async != nil {
+			hasAsync = true
+			continue
+		}
+		h.log.Debug("triggering callback", "name", sub.name)
+		if err := sub.call(ctx, blob, data); err != nil {
+			return err
+		}
+	}
+	if hasAsync {
+		if err := h.queues.enqueue(etype, blob, data); err != nil {
 			return err
 		}
+		for _, sub := range subs {
+			if sub.async != nil {
+				sub.async.notify()
+			}
+		}
 	}
 	return nil
 }
@@ -70,10 +189,26 @@ func (h *Hub) ScanBlobEvent(ctx context.Context, blob *blob.Blob, data interface
 	return h.newEvent(ctx, ScanBlob, blob, data)
 }
 
+func (h *Hub) GarbageCollectionEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
+	return h.newEvent(ctx, GarbageCollection, blob, data)
+}
+
 func (h *Hub) FiletreeFSUpdateEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
 	return h.newEvent(ctx, FiletreeFSUpdate, blob, data)
 }
 
+func (h *Hub) KvUpdateEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
+	return h.newEvent(ctx, KvUpdate, blob, data)
+}
+
+func (h *Hub) DocstoreUpdateEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
+	return h.newEvent(ctx, DocstoreUpdate, blob, data)
+}
+
+func (h *Hub) GitUpdateEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
+	return h.newEvent(ctx, GitUpdate, blob, data)
+}
+
 func (h *Hub) NewDeleteRemoteBlobEvent(ctx context.Context, blob *blob.Blob, data interface{}) error {
 	return h.newEvent(ctx, DeleteRemoteBlob, blob, data)
 }
@@ -82,18 +217,30 @@ func (h *Hub) NewSyncRemoteBlobEvent(ctx context.Context, blob *blob.Blob, data
 	return h.newEvent(ctx, SyncRemoteBlob, blob, data)
 }
 
+// Close stops the async subscribers and closes the queues
+func (h *Hub) Close() error {
+	for etype := range eventTypes {
+		for _, sub := range h.list(etype) {
+			if sub.async != nil {
+				sub.async.stop()
+			}
+		}
+	}
+	if h.queues != nil {
+		return h.queues.Close()
+	}
+	return nil
+}
+
 func New(logger log.Logger, root bool) *Hub {
 	logger.Debug("init")
+	subscribers := map[EventType]map[string]*subscriber{}
+	for etype := range eventTypes {
+		subscribers[etype] = map[string]*subscriber{}
+	}
 	return &Hub{
-		root: root,
-		log:  logger,
-		subscribers: map[EventType]map[string]func(context.Context, *blob.Blob, interface{}) error{
-			NewBlob:          map[string]func(context.Context, *blob.Blob, interface{}) error{},
-			ScanBlob:         map[string]func(context.Context, *blob.Blob, interface{}) error{},
-			FiletreeFSUpdate: map[string]func(context.Context, *blob.Blob, interface{}) error{},
-			SyncRemoteBlob:   map[string]func(context.Context, *blob.Blob, interface{}) error{},
-			NewFiletreeNode:  map[string]func(context.Context, *blob.Blob, interface{}) error{},
-			DeleteRemoteBlob: map[string]func(context.Context, *blob.Blob, interface{}) error{},
-		},
+		root:        root,
+		log:         logger,
+		subscribers: subscribers,
 	}
 }
@@ -1,8 +1,12 @@
 package api // import "a4.io/blobstash/pkg/kvstore/api"
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 
@@ -15,21 +19,61 @@ import (
 )
 
 type keyValue struct {
-	Key     string `json:"key"`
-	Version int64  `json:"version"`
-	Hash    string `json:"hash,omitempty"`
-	Data    []byte `json:"data,omitempty"`
+	Key       string `json:"key"`
+	Version   int64  `json:"version"`
+	Hash      string `json:"hash,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+	TTL       int64  `json:"ttl,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
 }
 
 func toKeyValue(okv *vkv.KeyValue) *keyValue {
 	return &keyValue{
-		Key:     okv.Key,
-		Version: okv.Version,
-		Hash:    okv.HexHash(),
-		Data:    okv.Data,
+		Key:       okv.Key,
+		Version:   okv.Version,
+		Hash:      okv.HexHash(),
+		Data:      okv.Data,
+		TTL:       okv.TTL,
+		ExpiresAt: okv.ExpiresAt,
 	}
 }
 
+// errInvalidTTL is returned when the TTL (in seconds) is negative
+var errInvalidTTL = errors.New("the TTL must be a positive number of seconds")
+
+// condition builds the condition of a conditional put from the request headers:
+//
+//	If-Match: <version>       the latest version must be this one
+//	If-Match: <hash>          the ref (or the hash of the value) of the latest version must be this one
+//	If-None-Match: *          the key must not exist
+//
+// It returns nil if the put is not conditional.
+func condition(r *http.Request) (*vkv.Condition, error) {
+	return parseCondition(r.Header.Get("If-Match"), r.Header.Get("If-None-Match"))
+}
+
+func parseCondition(ifMatch, ifNoneMatch string) (*vkv.Condition, error) {
+	var cond *vkv.Condition
+	if etag := strings.Trim(strings.TrimPrefix(ifMatch, "W/"), "\""); etag != "" {
+		cond = &vkv.Condition{}
+		if version, err := strconv.ParseInt(etag, 10, 64); err == nil {
+			cond.Version = version
+		} else {
+			cond.Hash = etag
+		}
+	}
+	if etag := ifNoneMatch; etag != "" {
+		if etag != "*" {
+			return nil, fmt.Errorf("only \"If-None-Match: *\" is supported")
+		}
+		if cond == nil {
+			cond = &vkv.Condition{}
+		}
+		cond.Absent = true
+	}
+	return cond, nil
+}
+
 type KvStoreAPI struct {
 	kv store.KvStore
 }
@@ -180,6 +224,7 @@ func (kv *KvStoreAPI) getHandler() func(http.ResponseWriter, *http.Request) {
 				}
 				panic(err)
 			}
+			w.Header().Set("ETag", strconv.FormatInt(item.Version, 10))
 			if r.Method == "GET" {
 				httputil.MarshalAndWrite(r, w, toKeyValue(item))
 			}
@@ -213,11 +258,27 @@ func (kv *KvStoreAPI) getHandler() func(http.ResponseWriter, *http.Request) {
 				httputil.Error(w, err)
 				return
 			}
-			res, err := kv.kv.Put(ctx, key, ref, []byte(data), version)
+			// Optional TTL in seconds, the key is hidden once expired
+			ttl, err := q.GetInt64Default("ttl", 0)
+			if err != nil || ttl < 0 {
+				httputil.WriteJSONError(w, http.StatusBadRequest, errInvalidTTL.Error())
+				return
+			}
+			cond, err := condition(r)
 			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			res, err := kv.kv.PutWithTTL(ctx, key, ref, []byte(data), version, ttl, cond)
+			if err != nil {
+				if err == vkv.ErrConditionFailed {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
 				httputil.Error(w, err)
 				return
 			}
+			w.Header().Set("ETag", strconv.FormatInt(res.Version, 10))
 			httputil.MarshalAndWrite(r, w, toKeyValue(res))
 			// TODO(tsileo): switch to StatusCreated
 		default:
@@ -226,8 +287,92 @@ func (kv *KvStoreAPI) getHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// maxBatchSize is the maximum number of entries of a batch
+const maxBatchSize = 1000
+
+// batchEntry is an entry of a batch request, `if_match` and `if_none_match` work like the headers of a single put
+type batchEntry struct {
+	Key         string `json:"key"`
+	Ref         string `json:"ref,omitempty"`
+	Data        string `json:"data,omitempty"`
+	Version     int64  `json:"version,omitempty"`
+	TTL         int64  `json:"ttl,omitempty"`
+	IfMatch     string `json:"if_match,omitempty"`
+	IfNoneMatch string `json:"if_none_match,omitempty"`
+}
+
+// batchHandler saves all the entries of the batch, or none of them (412 if a condition is not met)
+func (kv *KvStoreAPI) batchHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		req := &struct {
+			Entries []*batchEntry `json:"entries"`
+		}{}
+		if err := httputil.Unmarshal(r, req); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(req.Entries) == 0 || len(req.Entries) > maxBatchSize {
+			httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("a batch must have between 1 and %d entries", maxBatchSize))
+			return
+		}
+
+		entries := []*vkv.BatchEntry{}
+		for _, e := range req.Entries {
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.Write, perms.KVEntry),
+				perms.ResourceWithID(perms.KvStore, perms.KVEntry, e.Key),
+			) {
+				auth.Forbidden(w)
+				return
+			}
+			if e.TTL < 0 {
+				httputil.WriteJSONError(w, http.StatusBadRequest, errInvalidTTL.Error())
+				return
+			}
+			cond, err := parseCondition(e.IfMatch, e.IfNoneMatch)
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			entries = append(entries, &vkv.BatchEntry{
+				Key:     e.Key,
+				Ref:     e.Ref,
+				Data:    []byte(e.Data),
+				Version: e.Version,
+				TTL:     e.TTL,
+				Cond:    cond,
+			})
+		}
+
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		kvs, err := kv.kv.Batch(ctx, entries)
+		if err != nil {
+			if errors.Is(err, vkv.ErrConditionFailed) {
+				httputil.WriteJSONError(w, http.StatusPreconditionFailed, err.Error())
+				return
+			}
+			httputil.Error(w, err)
+			return
+		}
+		out := []*keyValue{}
+		for _, res := range kvs {
+			out = append(out, toKeyValue(res))
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": out,
+		})
+	}
+}
+
 func (kv *KvStoreAPI) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
 	r.Handle("/keys", basicAuth(http.HandlerFunc(kv.keysHandler())))
+	r.Handle("/_batch", basicAuth(http.HandlerFunc(kv.batchHandler())))
 	r.Handle("/key/{key}", basicAuth(http.HandlerFunc(kv.getHandler())))
 	r.Handle("/key/{key}/_versions", basicAuth(http.HandlerFunc(kv.versionsHandler())))
 }
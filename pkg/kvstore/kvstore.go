@@ -2,15 +2,19 @@ package kvstore // import "a4.io/blobstash/pkg/kvstore"
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/inconshreveable/log15"
 
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/meta"
 	"a4.io/blobstash/pkg/stash/store"
 	"a4.io/blobstash/pkg/vkv"
@@ -20,6 +24,27 @@ const KvType = "kv"
 
 var ErrInvalidKey = errors.New("/ is a forbidden character for keys")
 
+var ErrInvalidTTL = errors.New("the TTL must be a positive number of seconds")
+
+// SweepInterval is the delay between two runs of the sweeper writing the tombstones of the expired keys
+var SweepInterval = 1 * time.Minute
+
+// UpdateEvent represents an event fired on key update to the Oplog
+type UpdateEvent struct {
+	Key       string `json:"key"`
+	Version   int64  `json:"version"`
+	Ref       string `json:"ref,omitempty"`
+	Namespace string `json:"ns,omitempty"`
+}
+
+func (e *UpdateEvent) JSON() string {
+	js, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	return string(js)
+}
+
 // FIXME(tsileo): take a ctx as first arg for each method
 
 type KvStore struct {
@@ -27,10 +52,22 @@ type KvStore struct {
 	meta      *meta.Meta
 	log       log.Logger
 
+	// Optional, used to notify the oplog
+	hub *hub.Hub
+
 	vkv *vkv.DB
+
+	// Serializes the writes so the conditional puts are atomic
+	mu sync.Mutex
+
+	// Meta blobs of the batches being saved (indexed by `Batch` once the conditions are checked)
+	pendingBatches map[string]struct{}
+
+	stop chan struct{}
+	wg   sync.WaitGroup
 }
 
-func New(logger log.Logger, dir string, blobStore store.BlobStore, metaHandler *meta.Meta) (*KvStore, error) {
+func New(logger log.Logger, dir string, blobStore store.BlobStore, metaHandler *meta.Meta, chub *hub.Hub) (*KvStore, error) {
 	logger.Debug("init")
 	kv, err := vkv.New(filepath.Join(dir, "vkv"))
 	if err != nil {
@@ -40,12 +77,71 @@ func New(logger log.Logger, dir string, blobStore store.BlobStore, metaHandler *
 		blobStore: blobStore,
 		meta:      metaHandler,
 		log:       logger,
+		hub:       chub,
 		vkv:       kv,
+		stop:      make(chan struct{}),
+
+		pendingBatches: map[string]struct{}{},
 	}
 	metaHandler.RegisterApplyFunc(KvType, kvStore.applyMetaFunc)
+	metaHandler.RegisterApplyFunc(vkv.BatchKvType, kvStore.applyBatchMetaFunc)
+	kvStore.wg.Add(1)
+	go kvStore.sweeper()
 	return kvStore, nil
 }
 
+// sweeper periodically writes the tombstones of the expired keys
+func (kv *KvStore) sweeper() {
+	defer kv.wg.Done()
+	t := time.NewTicker(SweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-kv.stop:
+			return
+		case <-t.C:
+			if err := kv.Sweep(context.Background()); err != nil {
+				kv.log.Error("failed to sweep the expired keys", "err", err)
+			}
+		}
+	}
+}
+
+// Sweep writes a tombstone (an empty version) for each expired key (they're already hidden by `Get` and `Keys`, but
+// the tombstone is saved in a meta blob and notifies the oplog)
+func (kv *KvStore) Sweep(ctx context.Context) error {
+	for {
+		expired, err := kv.vkv.Expired(time.Now().UTC().UnixNano(), 100)
+		if err != nil {
+			return err
+		}
+		if len(expired) == 0 {
+			return nil
+		}
+		for _, e := range expired {
+			latest, err := kv.vkv.Latest(e.Key)
+			if err != nil && err != vkv.ErrNotFound {
+				return err
+			}
+			// Only the latest version needs a tombstone (the key may have been updated since)
+			if latest != nil && latest.Version == e.Version {
+				// The key is hidden as it's expired, the condition fails if a new version was written in the meantime
+				_, err := kv.PutIf(ctx, e.Key, "", nil, -1, &vkv.Condition{Absent: true})
+				switch {
+				case err == nil:
+					kv.log.Debug("expired key", "key", e.Key, "version", e.Version)
+				case errors.Is(err, vkv.ErrConditionFailed):
+				default:
+					return err
+				}
+			}
+			if err := kv.vkv.RemoveExpiry(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
 func (kv *KvStore) GetMetaBlob(ctx context.Context, key string, version int64) (string, error) {
 	return kv.vkv.GetMetaBlob(key, version)
 }
@@ -71,7 +167,8 @@ func (kv *KvStore) applyMetaFunc(hash string, data []byte) error {
 		return nil
 	}
 
-	if _, err := kv.Put(context.Background(), rkv.Key, rkv.HexHash(), rkv.Data, rkv.Version); err != nil {
+	// The key value is saved as is (keeping its expiration date)
+	if err := kv.putKeyValue(context.Background(), rkv, nil); err != nil {
 		return fmt.Errorf("failed to put: %v", err)
 	}
 	kv.log.Debug("Applied meta", "kv", rkv)
@@ -79,7 +176,77 @@ func (kv *KvStore) applyMetaFunc(hash string, data []byte) error {
 	return nil
 }
 
+func (kv *KvStore) applyBatchMetaFunc(hash string, data []byte) error {
+	kv.log.Debug("Apply batch meta init", "hash", hash)
+	batch, err := vkv.UnserializeBatchBlob(data)
+	if err != nil {
+		return fmt.Errorf("failed to unserialize blob: %v", err)
+	}
+	if len(batch.KeyValues) == 0 {
+		return nil
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	// The batch is being saved by `Batch` (which indexes it only if the conditions are met)
+	if _, ok := kv.pendingBatches[hash]; ok {
+		return nil
+	}
+	// Skip the batch only if all the entries were already applied
+	applied := true
+	for _, e := range batch.KeyValues {
+		metaBlobHash, err := kv.vkv.GetMetaBlob(e.Key, e.Version)
+		if err != nil {
+			return err
+		}
+		if metaBlobHash == "" {
+			applied = false
+			break
+		}
+	}
+	if applied {
+		kv.log.Debug("batch already applied")
+		return nil
+	}
+
+	// Only re-index the entries, the meta blob is already saved (and the update events were already emitted)
+	if err := kv.vkv.PutBatch(batch.KeyValues, hash); err != nil {
+		return fmt.Errorf("failed to apply batch: %v", err)
+	}
+	kv.log.Debug("Applied batch meta", "kvs", len(batch.KeyValues))
+	return nil
+}
+
+// check returns `vkv.ErrConditionFailed` if the latest version of the key does not match the condition (must be
+// called with the lock held)
+func (kv *KvStore) check(key string, cond *vkv.Condition) error {
+	if cond == nil {
+		return nil
+	}
+	current, err := kv.vkv.Get(key, -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		current = nil
+	default:
+		return err
+	}
+	return cond.Check(current)
+}
+
+// put checks the condition and saves the new version in the index
+func (kv *KvStore) put(res *vkv.KeyValue, cond *vkv.Condition) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if err := kv.check(res.Key, cond); err != nil {
+		return err
+	}
+	return kv.vkv.Put(res)
+}
+
 func (kv *KvStore) Close() error {
+	close(kv.stop)
+	kv.wg.Wait()
 	return kv.vkv.Close()
 }
 
@@ -120,9 +287,24 @@ func (kv *KvStore) ReverseKeys(ctx context.Context, start, end string, limit int
 }
 
 func (kv *KvStore) Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error) {
+	return kv.PutIf(ctx, key, ref, data, version, nil)
+}
+
+// PutIf saves a new version only if the latest version of the key matches the condition (`vkv.ErrConditionFailed` is
+// returned otherwise), a nil condition always matches
+func (kv *KvStore) PutIf(ctx context.Context, key, ref string, data []byte, version int64, cond *vkv.Condition) (*vkv.KeyValue, error) {
+	return kv.PutWithTTL(ctx, key, ref, data, version, 0, cond)
+}
+
+// PutWithTTL saves a new version that expires after `ttl` seconds (0 for no expiration), the optional condition is
+// checked like in `PutIf`
+func (kv *KvStore) PutWithTTL(ctx context.Context, key, ref string, data []byte, version, ttl int64, cond *vkv.Condition) (*vkv.KeyValue, error) {
 	if strings.Contains(key, "/") {
 		return nil, ErrInvalidKey
 	}
+	if ttl < 0 {
+		return nil, ErrInvalidTTL
+	}
 	// _, fromHttp := ctxutil.Request(ctx)
 	// kv.log.Info("OP Put", "from_http", fromHttp, "key", key, "value", value, "version", version)
 	res := &vkv.KeyValue{
@@ -130,26 +312,129 @@ func (kv *KvStore) Put(ctx context.Context, key, ref string, data []byte, versio
 		Version: version,
 		Data:    data,
 	}
+	res.SetTTL(ttl, time.Now().UTC().UnixNano())
 	if ref != "" {
 		res.SetHexHash(ref)
 	}
-	if err := kv.vkv.Put(res); err != nil {
+	if err := kv.putKeyValue(ctx, res, cond); err != nil {
 		return nil, err
 	}
 
+	return res, nil
+}
+
+// putKeyValue checks the condition, saves the key value in the index and in a meta blob
+func (kv *KvStore) putKeyValue(ctx context.Context, res *vkv.KeyValue, cond *vkv.Condition) error {
+	if err := kv.put(res, cond); err != nil {
+		return err
+	}
+
 	metaBlob, err := kv.meta.Build(res)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if err := kv.vkv.SetMetaBlob(key, res.Version, metaBlob.Hash); err != nil {
-		return nil, err
+	if err := kv.vkv.SetMetaBlob(res.Key, res.Version, metaBlob.Hash); err != nil {
+		return err
 	}
 
 	// XXX(tsileo): notify the blobstore it does not need to exec the meta hook for this one?
 	if _, err := kv.blobStore.Put(ctx, metaBlob); err != nil {
+		return err
+	}
+
+	if kv.hub != nil {
+		ns, _ := ctxutil.Namespace(ctx)
+		updateEvent := &UpdateEvent{Key: res.Key, Version: res.Version, Ref: res.HexHash(), Namespace: ns}
+		if err := kv.hub.KvUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Batch saves all the entries (or none of them) in a single meta blob, the entries without a version share the same
+// one, and the batch fails with `vkv.ErrConditionFailed` if the condition of any entry is not met
+func (kv *KvStore) Batch(ctx context.Context, entries []*vkv.BatchEntry) ([]*vkv.KeyValue, error) {
+	now := time.Now().UTC().UnixNano()
+	batch := &vkv.KeyValueBatch{}
+	for _, e := range entries {
+		if strings.Contains(e.Key, "/") {
+			return nil, ErrInvalidKey
+		}
+		if e.TTL < 0 {
+			return nil, ErrInvalidTTL
+		}
+		res := &vkv.KeyValue{
+			Key:     e.Key,
+			Version: e.Version,
+			Data:    e.Data,
+		}
+		res.SetTTL(e.TTL, now)
+		if res.Version < 1 {
+			res.Version = now
+		}
+		if e.Ref != "" {
+			if err := res.SetHexHash(e.Ref); err != nil {
+				return nil, err
+			}
+		}
+		batch.KeyValues = append(batch.KeyValues, res)
+	}
+
+	// The meta blob is built first as its hash is saved along with the entries
+	metaBlob, err := kv.meta.Build(batch)
+	if err != nil {
 		return nil, err
 	}
 
-	return res, nil
+	checkAll := func() error {
+		for _, e := range entries {
+			if err := kv.check(e.Key, e.Cond); err != nil {
+				return fmt.Errorf("key %q: %w", e.Key, err)
+			}
+		}
+		return nil
+	}
+
+	// The conditions are checked a first time so a failed batch does not save its meta blob (unless a concurrent
+	// write is done while the meta blob is saved)
+	kv.mu.Lock()
+	if err := checkAll(); err != nil {
+		kv.mu.Unlock()
+		return nil, err
+	}
+	kv.pendingBatches[metaBlob.Hash] = struct{}{}
+	kv.mu.Unlock()
+
+	// The meta blob is saved before the entries are indexed (so the index never references a missing meta blob)
+	_, putErr := kv.blobStore.Put(ctx, metaBlob)
+
+	if err := func() error {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		delete(kv.pendingBatches, metaBlob.Hash)
+		if putErr != nil {
+			return putErr
+		}
+		if err := checkAll(); err != nil {
+			return err
+		}
+		return kv.vkv.PutBatch(batch.KeyValues, metaBlob.Hash)
+	}(); err != nil {
+		return nil, err
+	}
+
+	if kv.hub != nil {
+		ns, _ := ctxutil.Namespace(ctx)
+		for _, res := range batch.KeyValues {
+			updateEvent := &UpdateEvent{Key: res.Key, Version: res.Version, Ref: res.HexHash(), Namespace: ns}
+			if err := kv.hub.KvUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return batch.KeyValues, nil
 }
@@ -0,0 +1,240 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func newTestKvStore(logger log.Logger, dir string) (*KvStore, *blobstore.BlobStore) {
+	h := hub.New(logger, true)
+	metaHandler, err := meta.New(logger, h)
+	if err != nil {
+		panic(err)
+	}
+	bs, err := blobstore.New(logger, true, dir, &config.Config{DataDir: dir, StorageEngine: blobstore.DirEngine}, h)
+	if err != nil {
+		panic(err)
+	}
+	kvs, err := New(logger, dir, bs, metaHandler, nil)
+	if err != nil {
+		panic(err)
+	}
+	return kvs, bs
+}
+
+func TestBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_kvstore_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	kvs, bs := newTestKvStore(logger, filepath.Join(dir, "1"))
+	defer bs.Close()
+	defer kvs.Close()
+	ctx := context.Background()
+
+	old, err := kvs.Put(ctx, "k1", "", []byte("old"), -1)
+	if err != nil {
+		panic(err)
+	}
+
+	// A failed condition aborts the whole batch
+	_, err = kvs.Batch(ctx, []*vkv.BatchEntry{
+		&vkv.BatchEntry{Key: "k2", Data: []byte("b")},
+		&vkv.BatchEntry{Key: "k1", Data: []byte("a"), Cond: &vkv.Condition{Absent: true}},
+	})
+	if !errors.Is(err, vkv.ErrConditionFailed) {
+		t.Errorf("expected a failed condition, got %v", err)
+	}
+	if _, err := kvs.Get(ctx, "k2", -1); err != vkv.ErrNotFound {
+		t.Errorf("k2 should not exist, got %v", err)
+	}
+
+	res, err := kvs.Batch(ctx, []*vkv.BatchEntry{
+		&vkv.BatchEntry{Key: "k2", Data: []byte("b")},
+		&vkv.BatchEntry{Key: "k1", Data: []byte("a"), Cond: &vkv.Condition{Version: old.Version}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	if len(res) != 2 || res[0].Version != res[1].Version {
+		t.Errorf("the entries should share the same version, got %+v", res)
+	}
+	metaBlobHash, err := kvs.GetMetaBlob(ctx, "k1", res[1].Version)
+	if err != nil {
+		panic(err)
+	}
+	if h, _ := kvs.GetMetaBlob(ctx, "k2", res[0].Version); h != metaBlobHash || h == "" {
+		t.Errorf("the entries should share the same meta blob")
+	}
+
+	// The batch can be replayed from its meta blob
+	data, err := bs.Get(ctx, metaBlobHash)
+	if err != nil {
+		panic(err)
+	}
+	metaType, metaData, ok := meta.IsMetaBlob(data)
+	if !ok || metaType != vkv.BatchKvType {
+		t.Fatalf("unexpected meta blob type %q", metaType)
+	}
+	kvs2, bs2 := newTestKvStore(logger, filepath.Join(dir, "2"))
+	defer bs2.Close()
+	defer kvs2.Close()
+	if err := kvs2.applyBatchMetaFunc(metaBlobHash, metaData); err != nil {
+		panic(err)
+	}
+	for _, expected := range res {
+		kv, err := kvs2.Get(ctx, expected.Key, -1)
+		if err != nil {
+			panic(err)
+		}
+		if kv.Version != expected.Version || string(kv.Data) != string(expected.Data) {
+			t.Errorf("unexpected replayed entry %+v", kv)
+		}
+	}
+	if h, _ := kvs2.GetMetaBlob(ctx, "k1", res[1].Version); h != metaBlobHash {
+		t.Errorf("the replayed batch should have the same meta blob, got %q", h)
+	}
+	// Replaying only re-indexes the entries
+	if ok, err := bs2.Stat(ctx, metaBlobHash); err != nil || ok {
+		t.Errorf("the meta blob should not have been saved again (%v)", err)
+	}
+
+	// A partially applied batch is applied again
+	kvs3, bs3 := newTestKvStore(logger, filepath.Join(dir, "3"))
+	defer bs3.Close()
+	defer kvs3.Close()
+	if err := kvs3.vkv.PutBatch(res[:1], metaBlobHash); err != nil {
+		panic(err)
+	}
+	if err := kvs3.applyBatchMetaFunc(metaBlobHash, metaData); err != nil {
+		panic(err)
+	}
+	for _, expected := range res {
+		if h, _ := kvs3.GetMetaBlob(ctx, expected.Key, expected.Version); h != metaBlobHash {
+			t.Errorf("the key %q should have been applied, got %q", expected.Key, h)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_kvstore_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	kvs, bs := newTestKvStore(logger, filepath.Join(dir, "1"))
+	defer bs.Close()
+	defer kvs.Close()
+	ctx := context.Background()
+
+	// Already expired (written with an expiration date in the past, like a replayed meta blob)
+	past := time.Now().Add(-1 * time.Minute).UnixNano()
+	expired := &vkv.KeyValue{Key: "k1", Version: past, Data: []byte("expired")}
+	expired.SetTTL(10, past)
+	if err := kvs.putKeyValue(ctx, expired, nil); err != nil {
+		panic(err)
+	}
+	if _, err := kvs.PutWithTTL(ctx, "k2", "", []byte("alive"), -1, 3600, nil); err != nil {
+		panic(err)
+	}
+	updated := &vkv.KeyValue{Key: "k3", Version: past, Data: []byte("updated")}
+	updated.SetTTL(10, past)
+	if err := kvs.putKeyValue(ctx, updated, nil); err != nil {
+		panic(err)
+	}
+	if _, err := kvs.Put(ctx, "k3", "", []byte("updated"), -1); err != nil {
+		panic(err)
+	}
+	if _, err := kvs.PutWithTTL(ctx, "k4", "", nil, -1, -1, nil); err != ErrInvalidTTL {
+		t.Errorf("expected ErrInvalidTTL, got %v", err)
+	}
+	// The TTL starts from the write, not from an explicit version
+	if _, err := kvs.PutWithTTL(ctx, "k5", "", []byte("alive"), 1, 3600, nil); err != nil {
+		panic(err)
+	}
+	res, err := kvs.Batch(ctx, []*vkv.BatchEntry{&vkv.BatchEntry{Key: "k6", Data: []byte("alive"), Version: 1, TTL: 3600}})
+	if err != nil {
+		panic(err)
+	}
+	if res[0].ExpiresAt < time.Now().Add(59*time.Minute).UnixNano() {
+		t.Errorf("unexpected expiration date %d", res[0].ExpiresAt)
+	}
+
+	// The expired key is hidden, but its versions are still available
+	if _, err := kvs.Get(ctx, "k1", -1); err != vkv.ErrNotFound {
+		t.Errorf("k1 should be expired, got %v", err)
+	}
+	if kv, err := kvs.Get(ctx, "k1", expired.Version); err != nil || kv.TTL != 10 {
+		t.Errorf("failed to get the expired version: %+v %v", kv, err)
+	}
+	keys, _, err := kvs.Keys(ctx, "", "\xff", 0)
+	if err != nil {
+		panic(err)
+	}
+	if len(keys) != 4 || keys[0].Key != "k2" || keys[1].Key != "k3" || keys[2].Key != "k5" || keys[3].Key != "k6" {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+
+	// The TTL survives a rescan
+	metaBlobHash, err := kvs.GetMetaBlob(ctx, "k1", expired.Version)
+	if err != nil {
+		panic(err)
+	}
+	data, err := bs.Get(ctx, metaBlobHash)
+	if err != nil {
+		panic(err)
+	}
+	_, metaData, _ := meta.IsMetaBlob(data)
+	kvs2, bs2 := newTestKvStore(logger, filepath.Join(dir, "2"))
+	defer bs2.Close()
+	defer kvs2.Close()
+	if err := kvs2.applyMetaFunc(metaBlobHash, metaData); err != nil {
+		panic(err)
+	}
+	if _, err := kvs2.Get(ctx, "k1", -1); err != vkv.ErrNotFound {
+		t.Errorf("the replayed k1 should be expired, got %v", err)
+	}
+
+	// The sweeper only writes a tombstone for k1 (k3 was updated since)
+	if err := kvs.Sweep(ctx); err != nil {
+		panic(err)
+	}
+	kv, err := kvs.Get(ctx, "k1", -1)
+	if err != nil {
+		panic(err)
+	}
+	if kv.Version <= expired.Version || len(kv.Data) > 0 || kv.TTL != 0 {
+		t.Errorf("unexpected tombstone %+v", kv)
+	}
+	if kv, err := kvs.Get(ctx, "k3", -1); err != nil || string(kv.Data) != "updated" {
+		t.Errorf("k3 should not be deleted: %+v %v", kv, err)
+	}
+	versions, _, err := kvs.Versions(ctx, "k3", "0", 0)
+	if err != nil {
+		panic(err)
+	}
+	if len(versions.Versions) != 2 {
+		t.Errorf("k3 should have 2 versions, got %d", len(versions.Versions))
+	}
+	if left, err := kvs.vkv.Expired(time.Now().UnixNano(), 0); err != nil || len(left) != 0 {
+		t.Errorf("the expiry index should be empty: %+v %v", left, err)
+	}
+}
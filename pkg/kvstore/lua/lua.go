@@ -12,15 +12,31 @@ import (
 )
 
 func convertKv(L *lua.LState, kv *vkv.KeyValue) *lua.LTable {
-	tbl := L.CreateTable(0, 5)
+	tbl := L.CreateTable(0, 7)
 	tbl.RawSetH(lua.LString("key"), lua.LString(kv.Key))
 	tbl.RawSetH(lua.LString("version"), lua.LString(strconv.FormatInt(kv.Version, 10)))
 	tbl.RawSetH(lua.LString("version_human"), lua.LString(time.Unix(0, kv.Version).Format(time.RFC3339)))
 	tbl.RawSetH(lua.LString("ref"), lua.LString(kv.HexHash()))
 	tbl.RawSetH(lua.LString("data"), lua.LString(kv.Data))
+	tbl.RawSetH(lua.LString("ttl"), lua.LNumber(kv.TTL))
+	tbl.RawSetH(lua.LString("expires_at"), lua.LString(strconv.FormatInt(kv.ExpiresAt, 10)))
 	return tbl
 }
 
+// luaCondition converts a condition table (`{version=..., absent=true, hash=...}`)
+func luaCondition(tbl *lua.LTable) (*vkv.Condition, error) {
+	cond := &vkv.Condition{Hash: lua.LVAsString(tbl.RawGetString("hash"))}
+	if v := lua.LVAsString(tbl.RawGetString("version")); v != "" {
+		version, err := strconv.ParseInt(v, 10, 0)
+		if err != nil {
+			return nil, err
+		}
+		cond.Version = version
+	}
+	cond.Absent = lua.LVAsBool(tbl.RawGetString("absent"))
+	return cond, nil
+}
+
 func setupKvStore(L *lua.LState, kvs store.KvStore, ctx context.Context) func(*lua.LState) int {
 	return func(L *lua.LState) int {
 		// register functions to the table
@@ -72,6 +88,50 @@ func setupKvStore(L *lua.LState, kvs store.KvStore, ctx context.Context) func(*l
 
 			},
 
+			// put(key, data, ref[, version[, ttl]]), the key expires after `ttl` seconds if set
+			"put": func(L *lua.LState) int {
+				version, err := strconv.ParseInt(L.OptString(4, "-1"), 10, 0)
+				if err != nil {
+					L.ArgError(4, "version must be a valid int")
+					return 0
+				}
+				ttl := L.OptInt64(5, 0)
+				if ttl < 0 {
+					L.ArgError(5, "ttl must be a positive number of seconds")
+					return 0
+				}
+				fkv, err := kvs.PutWithTTL(ctx, L.ToString(1), L.ToString(3), []byte(L.ToString(2)), version, ttl, nil)
+				if err != nil {
+					panic(err)
+				}
+				L.Push(convertKv(L, fkv))
+				return 1
+			},
+			// put_if(key, data, ref, condition[, ttl]) returns nil and an error message if the condition is not met
+			"put_if": func(L *lua.LState) int {
+				cond, err := luaCondition(L.CheckTable(4))
+				if err != nil {
+					L.ArgError(4, "version must be a valid int")
+					return 0
+				}
+				ttl := L.OptInt64(5, 0)
+				if ttl < 0 {
+					L.ArgError(5, "ttl must be a positive number of seconds")
+					return 0
+				}
+				fkv, err := kvs.PutWithTTL(ctx, L.ToString(1), L.ToString(3), []byte(L.ToString(2)), -1, ttl, cond)
+				switch err {
+				case nil:
+				case vkv.ErrConditionFailed:
+					L.Push(lua.LNil)
+					L.Push(lua.LString(err.Error()))
+					return 2
+				default:
+					panic(err)
+				}
+				L.Push(convertKv(L, fkv))
+				return 1
+			},
 			"get": func(L *lua.LState) int {
 				version, err := strconv.ParseInt(L.ToString(2), 10, 0)
 				if err != nil {
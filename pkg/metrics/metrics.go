@@ -0,0 +1,371 @@
+/*
+
+Package metrics implements labelled counters, gauges and histograms exported in the OpenMetrics text format.
+
+*/
+package metrics // import "a4.io/blobstash/pkg/metrics"
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the OpenMetrics text format
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// DefBuckets are the default histogram buckets (in seconds)
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Registry holds the metrics families
+type Registry struct {
+	mu        sync.Mutex
+	families  map[string]family
+	onCollect []func()
+}
+
+// NewRegistry initializes an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]family{}}
+}
+
+// Default is the registry used by the package-level functions, and served at `/metrics`
+var Default = NewRegistry()
+
+type family interface {
+	write(w io.Writer)
+}
+
+func (r *Registry) register(name string, f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[name]; ok {
+		panic(fmt.Sprintf("metric %q already registered", name))
+	}
+	r.families[name] = f
+}
+
+// OnCollect registers a func called before each collection (to update the gauges that are expensive to compute)
+func (r *Registry) OnCollect(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onCollect = append(r.onCollect, f)
+}
+
+// OnCollect registers a collect func on the default registry
+func OnCollect(f func()) {
+	Default.OnCollect(f)
+}
+
+// Write outputs all the metrics in the OpenMetrics text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	hooks := append([]func(){}, r.onCollect...)
+	r.mu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		r.families[name].write(&buf)
+	}
+	r.mu.Unlock()
+	buf.WriteString("# EOF\n")
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Handler returns the HTTP handler serving the metrics of the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		if err := r.Write(w); err != nil {
+			panic(err)
+		}
+	})
+}
+
+// Handler serves the default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// vec holds the children of a metric family, indexed by their labels values
+type vec struct {
+	name, help, typ string
+	labels          []string
+
+	mu       sync.Mutex
+	children map[string]interface{}
+	values   map[string][]string
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	return &vec{
+		name:     name,
+		help:     help,
+		typ:      typ,
+		labels:   labels,
+		children: map[string]interface{}{},
+		values:   map[string][]string{},
+	}
+}
+
+func (v *vec) child(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %q expects %d labels, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok := v.children[key]; ok {
+		return c
+	}
+	c := create()
+	v.children[key] = c
+	v.values[key] = append([]string{}, values...)
+	return c
+}
+
+// each iterates the children sorted by labels
+func (v *vec) each(f func(values []string, child interface{})) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f(v.values[k], v.children[k])
+	}
+}
+
+func (v *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+	if v.help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", v.name, escape(v.help, false))
+	}
+}
+
+func escape(s string, quote bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quote {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	parts := []string{}
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", name, escape(values[i], true)))
+	}
+	for i := 0; i < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", extra[i], escape(extra[i+1], true)))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// value is a float64 safe for concurrent use
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (v *value) add(d float64) {
+	v.mu.Lock()
+	v.v += d
+	v.mu.Unlock()
+}
+
+func (v *value) set(f float64) {
+	v.mu.Lock()
+	v.v = f
+	v.mu.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.v
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v value
+}
+
+// Inc increments the counter by 1
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add increments the counter by the given (non-negative) value
+func (c *Counter) Add(d float64) {
+	if d < 0 {
+		panic("counters cannot decrease")
+	}
+	c.v.add(d)
+}
+
+// CounterVec is a counter family partitioned by labels
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec registers a new counter family in the default registry, the name must not include the `_total`
+// suffix (it's added when exported)
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels)}
+	Default.register(name, c)
+	return c
+}
+
+// With returns the counter for the given labels values
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.child(values, func() interface{} { return &Counter{} }).(*Counter)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.header(w)
+	c.each(func(values []string, child interface{}) {
+		fmt.Fprintf(w, "%s_total%s %s\n", c.name, formatLabels(c.labels, values), formatFloat(child.(*Counter).v.get()))
+	})
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	v value
+}
+
+// Set sets the gauge to the given value
+func (g *Gauge) Set(f float64) {
+	g.v.set(f)
+}
+
+// Add adds the given value (can be negative) to the gauge
+func (g *Gauge) Add(d float64) {
+	g.v.add(d)
+}
+
+// GaugeVec is a gauge family partitioned by labels
+type GaugeVec struct {
+	*vec
+}
+
+// NewGaugeVec registers a new gauge family in the default registry
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labels)}
+	Default.register(name, g)
+	return g
+}
+
+// With returns the gauge for the given labels values
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.child(values, func() interface{} { return &Gauge{} }).(*Gauge)
+}
+
+// Reset removes all the children (useful when the labels values are dynamic, before setting them in a collect func)
+func (g *GaugeVec) Reset() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.children = map[string]interface{}{}
+	g.values = map[string][]string{}
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.header(w)
+	g.each(func(values []string, child interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, values), formatFloat(child.(*Gauge).v.get()))
+	})
+}
+
+// Histogram samples observations in buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Observe adds an observation to the histogram
+func (h *Histogram) Observe(f float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if f <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += f
+}
+
+// HistogramVec is a histogram family partitioned by labels
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+// NewHistogramVec registers a new histogram family in the default registry (`DefBuckets` is used if buckets is nil)
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	h := &HistogramVec{newVec(name, help, "histogram", labels), buckets}
+	Default.register(name, h)
+	return h
+}
+
+// With returns the histogram for the given labels values
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.child(values, func() interface{} {
+		return &Histogram{buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+	}).(*Histogram)
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.header(w)
+	h.each(func(values []string, child interface{}) {
+		hist := child.(*Histogram)
+		hist.mu.Lock()
+		defer hist.mu.Unlock()
+		for i, b := range hist.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatFloat(b)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatFloat(hist.sum))
+	})
+}
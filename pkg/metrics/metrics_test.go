@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOpenMetricsFormat(t *testing.T) {
+	c := NewCounterVec("test_ops", "Test ops.", "op")
+	c.With("put").Inc()
+	c.With("put").Add(2)
+	c.With(`ge"t`).Inc()
+
+	g := NewGaugeVec("test_queue", "")
+	OnCollect(func() {
+		g.With().Set(12)
+	})
+
+	h := NewHistogramVec("test_duration_seconds", "Test latency.", []float64{0.1, 1}, "op")
+	h.With("put").Observe(0.05)
+	h.With("put").Observe(0.5)
+	h.With("put").Observe(5)
+
+	var buf bytes.Buffer
+	if err := Default.Write(&buf); err != nil {
+		panic(err)
+	}
+	out := buf.String()
+	for _, expected := range []string{
+		"# TYPE test_ops counter\n# HELP test_ops Test ops.\n",
+		"test_ops_total{op=\"ge\\\"t\"} 1\ntest_ops_total{op=\"put\"} 3\n",
+		"# TYPE test_queue gauge\ntest_queue 12\n",
+		"test_duration_seconds_bucket{op=\"put\",le=\"0.1\"} 1\n",
+		"test_duration_seconds_bucket{op=\"put\",le=\"1\"} 2\n",
+		"test_duration_seconds_bucket{op=\"put\",le=\"+Inf\"} 3\n",
+		"test_duration_seconds_count{op=\"put\"} 3\ntest_duration_seconds_sum{op=\"put\"} 5.55\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("missing %q in:\n%s", expected, out)
+		}
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("the output must end with \"# EOF\"")
+	}
+}
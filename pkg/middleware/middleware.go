@@ -9,6 +9,7 @@ import (
 
 	"a4.io/blobstash/pkg/auth"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/httputil"
 
 	_ "github.com/carbocation/interpose/middleware"
@@ -69,6 +70,11 @@ func NewBasicAuth(conf *config.Config) (func(*http.Request) bool, func(http.Hand
 			fmt.Printf("headers=%+v\n", r.Header)
 			if authFunc(r) {
 				apiAuthSuccess.Add(1)
+				// Make the auth available to the lower layers (e.g. for the usage accounting)
+				if a, ok := auth.FromRequest(r); ok {
+					auth.ServeWithContext(ctxutil.WithAuth(r.Context(), a), next, w, r)
+					return
+				}
 				next.ServeHTTP(w, r)
 				return
 			}
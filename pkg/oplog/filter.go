@@ -0,0 +1,165 @@
+package oplog // import "a4.io/blobstash/pkg/oplog"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Event types
+const (
+	EventBlob     = "blob"
+	EventFiletree = "filetree"
+	EventKv       = "kv"
+	EventDocstore = "docstore"
+	EventGit      = "git"
+)
+
+// defaultTypes are the event types streamed if none are requested
+var defaultTypes = []string{EventBlob, EventFiletree}
+
+// filter selects the events streamed to a client, using the query arguments:
+//
+//	types=<comma-separated event types>
+//	prefix=<kv key prefix>
+//	collection=<docstore collection>
+//	fs=<filetree FS name>
+//	ns=<namespace of the kv and docstore events, the root namespace by default>
+//
+// If `types` is not set, the filters select their event types (and blob and filetree are streamed if there is no
+// filters).
+type filter struct {
+	types      map[string]bool
+	prefix     string
+	collection string
+	fs         string
+	namespace  string
+}
+
+// opAttrs holds the fields of the events data used for the filtering and the permissions checks
+type opAttrs struct {
+	FSName     string `json:"fs_name"`
+	Key        string `json:"key"`
+	Collection string `json:"collection"`
+	Namespace  string `json:"ns"` // The git namespace for the git events
+	Repo       string `json:"repo"`
+}
+
+func newFilter(q url.Values) (*filter, error) {
+	f := &filter{
+		types:      map[string]bool{},
+		prefix:     q.Get("prefix"),
+		collection: q.Get("collection"),
+		fs:         q.Get("fs"),
+		namespace:  q.Get("ns"),
+	}
+	var types []string
+	if t := q.Get("types"); t != "" {
+		types = strings.Split(t, ",")
+	} else {
+		if f.prefix != "" {
+			types = append(types, EventKv)
+		}
+		if f.collection != "" {
+			types = append(types, EventDocstore)
+		}
+		if f.fs != "" {
+			types = append(types, EventFiletree)
+		}
+		if len(types) == 0 {
+			types = defaultTypes
+		}
+	}
+	for _, t := range types {
+		switch t = strings.TrimSpace(t); t {
+		case EventBlob, EventFiletree, EventKv, EventDocstore, EventGit:
+			f.types[t] = true
+		default:
+			return nil, fmt.Errorf("unknown event type %q", t)
+		}
+	}
+	return f, nil
+}
+
+// check returns false if the client cannot read the requested collection or FS (so it can be rejected instead of
+// receiving an empty stream)
+func (f *filter) check(w http.ResponseWriter, r *http.Request) bool {
+	if f.collection != "" && f.types[EventDocstore] && !auth.Can(
+		w,
+		r,
+		perms.Action(perms.Read, perms.JSONCollection),
+		perms.ResourceWithID(perms.DocStore, perms.JSONCollection, f.collection),
+	) {
+		return false
+	}
+	if f.fs != "" && f.types[EventFiletree] && !auth.Can(
+		w,
+		r,
+		perms.Action(perms.Read, perms.FS),
+		perms.ResourceWithID(perms.Filetree, perms.FS, f.fs),
+	) {
+		return false
+	}
+	return true
+}
+
+// match returns true if the event must be streamed to the client, events the client is not allowed to read are
+// always skipped
+func (f *filter) match(r *http.Request, op *Op) bool {
+	if !f.types[op.Event] {
+		return false
+	}
+	if op.Event == EventBlob {
+		return auth.Allowed(
+			r,
+			perms.Action(perms.Read, perms.Blob),
+			perms.ResourceWithID(perms.BlobStore, perms.Blob, op.Data),
+		)
+	}
+
+	attrs := &opAttrs{}
+	if err := json.Unmarshal([]byte(op.Data), attrs); err != nil {
+		return false
+	}
+	switch op.Event {
+	case EventFiletree:
+		if f.fs != "" && attrs.FSName != f.fs {
+			return false
+		}
+		return auth.Allowed(
+			r,
+			perms.Action(perms.Read, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, attrs.FSName),
+		)
+	case EventKv:
+		if attrs.Namespace != f.namespace || !strings.HasPrefix(attrs.Key, f.prefix) {
+			return false
+		}
+		return auth.Allowed(
+			r,
+			perms.Action(perms.Read, perms.KVEntry),
+			perms.ResourceWithID(perms.KvStore, perms.KVEntry, attrs.Key),
+		)
+	case EventDocstore:
+		if attrs.Namespace != f.namespace || (f.collection != "" && attrs.Collection != f.collection) {
+			return false
+		}
+		return auth.Allowed(
+			r,
+			perms.Action(perms.Read, perms.JSONCollection),
+			perms.ResourceWithID(perms.DocStore, perms.JSONCollection, attrs.Collection),
+		)
+	case EventGit:
+		return auth.Allowed(
+			r,
+			perms.Action(perms.Read, perms.GitRepo),
+			perms.ResourceWithID(perms.GitServer, perms.GitRepo, fmt.Sprintf("%s/%s", attrs.Namespace, attrs.Repo)),
+		)
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package oplog
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/perms"
+)
+
+var testOps = []*Op{
+	&Op{Event: EventBlob, Data: "deadbeef"},
+	&Op{Event: EventFiletree, Data: `{"fs_name":"photos"}`},
+	&Op{Event: EventKv, Data: `{"key":"app:conf","version":1}`},
+	&Op{Event: EventKv, Data: `{"key":"other","version":1}`},
+	&Op{Event: EventDocstore, Data: `{"collection":"notes","_id":"a"}`},
+	&Op{Event: EventDocstore, Data: `{"collection":"todos","_id":"b"}`},
+	&Op{Event: EventGit, Data: `{"ns":"tsileo","repo":"blobstash"}`},
+	&Op{Event: EventKv, Data: `{"key":"app:conf","version":2,"ns":"tmp"}`},
+	&Op{Event: EventDocstore, Data: `{"collection":"notes","_id":"c","ns":"tmp"}`},
+}
+
+func matching(f *filter, username string) []*Op {
+	r := httptest.NewRequest("GET", "/_oplog/", nil)
+	if username != "" {
+		r.SetBasicAuth(username, "pass")
+		if !auth.Check(r) {
+			panic("auth failed")
+		}
+	}
+	out := []*Op{}
+	for _, op := range testOps {
+		if f.match(r, op) {
+			out = append(out, op)
+		}
+	}
+	return out
+}
+
+func TestFilter(t *testing.T) {
+	for qs, expected := range map[string]int{
+		"":                                  2,
+		"types=kv":                          2,
+		"prefix=app:":                       1,
+		"collection=notes":                  1,
+		"types=docstore,git":                3,
+		"types=blob,kv&prefix=app:":         2,
+		"types=docstore&collection=unknown": 0,
+		"types=kv,docstore&ns=tmp":          2,
+		"collection=notes&ns=tmp":           1,
+	} {
+		q, err := url.ParseQuery(qs)
+		if err != nil {
+			panic(err)
+		}
+		f, err := newFilter(q)
+		if err != nil {
+			panic(err)
+		}
+		if ops := matching(f, ""); len(ops) != expected {
+			t.Errorf("%q: expected %d events, got %d", qs, expected, len(ops))
+		}
+	}
+	if _, err := newFilter(url.Values{"types": []string{"blob,nope"}}); err == nil {
+		t.Errorf("unknown event type should fail")
+	}
+}
+
+func TestFilterPerms(t *testing.T) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	conf := &config.Config{
+		Roles: []*config.Role{&config.Role{
+			Name: "oplog-notes",
+			Perms: []*config.Perm{&config.Perm{
+				Action:   perms.Action(perms.Read, perms.JSONCollection),
+				Resource: perms.ResourceWithID(perms.DocStore, perms.JSONCollection, "notes"),
+			}},
+		}},
+		Auth: []*config.BasicAuth{&config.BasicAuth{
+			ID:       "dashboard",
+			Roles:    []string{"oplog-notes"},
+			Username: "dashboard",
+			Password: "pass",
+		}},
+	}
+	if err := auth.Setup(conf, logger); err != nil {
+		panic(err)
+	}
+
+	f, err := newFilter(url.Values{"types": []string{"blob,filetree,kv,docstore,git"}})
+	if err != nil {
+		panic(err)
+	}
+	ops := matching(f, "dashboard")
+	if len(ops) != 1 || ops[0] != testOps[4] {
+		t.Errorf("only the notes collection should be streamed, got %+v", ops)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/_oplog/?collection=todos", nil)
+	r.SetBasicAuth("dashboard", "pass")
+	auth.Check(r)
+	if f, _ := newFilter(r.URL.Query()); f.check(w, r) {
+		t.Errorf("filtering on a forbidden collection should fail")
+	}
+}
@@ -2,6 +2,11 @@
 
 Package oplog provides an HTTP Server-Sent Events (SSE) endpoint for real-time replication of the BlobStore.
 
+The events are persisted (for a configurable retention), the clients can resume from the last event they received.
+
+Besides the blob and filetree events, the kvstore, docstore and gitserver updates are logged too, the clients select
+the event types they want (and can filter them by key prefix, collection or FS name), see `filter`.
+
 */
 package oplog // import "a4.io/blobstash/pkg/oplog"
 
@@ -9,182 +14,290 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
+	"a4.io/blobstash/pkg/auth"
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/hub"
 
 	"github.com/gorilla/mux"
 	log "github.com/inconshreveable/log15"
 )
 
+// DefaultRetention is how long the events are kept if `oplog_retention` is not set
+const DefaultRetention = 168 * time.Hour
+
+// Oplog persists the BlobStore events, so the clients can resume from the last event they received (using the SSE
+// `Last-Event-ID` header)
 type Oplog struct {
 	broker    *Broker
+	store     *store
 	hub       *hub.Hub
 	log       log.Logger
-	heartbeat *time.Ticker
+	retention time.Duration
+	stop      chan struct{}
+	wg        sync.WaitGroup
 }
 
+// Op is an oplog event, the persisted events have an ID (the heartbeats have none)
 type Op struct {
-	Event, Data string
+	ID    uint64 `json:"id"`
+	Event string `json:"e"`
+	Data  string `json:"d"`
+	Time  int64  `json:"t"`
 }
 
 func New(logger log.Logger, conf *config.Config, h *hub.Hub) (*Oplog, error) {
 	logger.Debug("init")
+	retention := DefaultRetention
+	if conf.Replication != nil && conf.Replication.OplogRetention != "" {
+		var err error
+		if retention, err = time.ParseDuration(conf.Replication.OplogRetention); err != nil {
+			return nil, fmt.Errorf("invalid oplog retention: %v", err)
+		}
+	}
+	st, err := newStore(filepath.Join(conf.VarDir(), "oplog"))
+	if err != nil {
+		return nil, err
+	}
 	oplog := &Oplog{
 		log:       logger,
-		heartbeat: time.NewTicker(20 * time.Second),
+		store:     st,
+		retention: retention,
+		stop:      make(chan struct{}),
 		broker: &Broker{
-			log:            logger.New("submodule", "broker"),
-			clients:        make(map[chan *Op]bool),
-			newClients:     make(chan (chan *Op)),
-			defunctClients: make(chan (chan *Op)),
-			ops:            make(chan *Op),
+			log:     logger.New("submodule", "broker"),
+			clients: make(map[chan struct{}]bool),
 		},
 		hub: h,
 	}
-	oplog.init()
+	if err := oplog.init(); err != nil {
+		return nil, err
+	}
 	return oplog, nil
 }
 
-func (o *Oplog) newBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{}) error {
-	// Send the blob hash to the broker
-	o.broker.ops <- &Op{Event: "blob", Data: blob.Hash}
+// append persists the event and notifies the connected clients
+func (o *Oplog) append(event, data string) error {
+	op, err := o.store.append(event, data)
+	if err != nil {
+		return err
+	}
+	o.broker.notify()
+	o.log.Debug("event appended", "id", op.ID, "event", event)
 	return nil
 }
 
-func (o *Oplog) filetreeFSUpdateCallback(ctx context.Context, _ *blob.Blob, event interface{}) error {
-	// Send the blob hash to the broker
-	o.broker.ops <- &Op{Event: "filetree", Data: event.(string)}
-	return nil
+func (o *Oplog) newBlobCallback(ctx context.Context, blob *blob.Blob, _ interface{}) error {
+	return o.append(EventBlob, blob.Hash)
+}
+
+// updateCallback returns a callback that appends the JSON-encoded update event
+func (o *Oplog) updateCallback(event string) hub.Callback {
+	return func(ctx context.Context, _ *blob.Blob, data interface{}) error {
+		return o.append(event, data.(string))
+	}
 }
 
 func (o *Oplog) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
 	// Register the SSE HTTP endpoint
-	r.Handle("/", basicAuth(o.broker))
+	r.Handle("/", basicAuth(http.HandlerFunc(o.streamHandler())))
+}
+
+// Close stops the retention worker and closes the log
+func (o *Oplog) Close() error {
+	close(o.stop)
+	o.wg.Wait()
+	return o.store.close()
 }
 
-func (o *Oplog) init() {
-	// Start the SSE broker worker
-	go o.broker.start()
-	// Register to the new blob event
-	o.hub.Subscribe(hub.NewBlob, "oplog", o.newBlobCallback)
-	o.hub.Subscribe(hub.FiletreeFSUpdate, "oplog", o.filetreeFSUpdateCallback)
+func (o *Oplog) init() error {
+	// Register to the new blob event (async, so the events are persisted even if the oplog is unavailable for a while)
+	if err := o.hub.SubscribeAsync(hub.NewBlob, "oplog", o.newBlobCallback); err != nil {
+		return err
+	}
+	for etype, event := range map[hub.EventType]string{
+		hub.FiletreeFSUpdate: EventFiletree,
+		hub.KvUpdate:         EventKv,
+		hub.DocstoreUpdate:   EventDocstore,
+		hub.GitUpdate:        EventGit,
+	} {
+		if err := o.hub.SubscribeAsync(etype, "oplog", o.updateCallback(event)); err != nil {
+			return err
+		}
+	}
 
+	// Remove the events older than the retention
+	o.wg.Add(1)
 	go func() {
+		defer o.wg.Done()
+		t := time.NewTicker(1 * time.Hour)
+		defer t.Stop()
 		for {
-			<-o.heartbeat.C
-			// Only send the heartbeat if there is any client
-			o.broker.mu.Lock()
-			clientsCnt := len(o.broker.clients)
-			o.broker.mu.Unlock()
-			if clientsCnt > 0 {
-				o.broker.ops <- &Op{Event: "heartbeat", Data: ""}
+			cnt, err := o.store.prune(time.Now().Add(-o.retention))
+			if err != nil {
+				o.log.Error("failed to prune the oplog", "err", err)
+			} else if cnt > 0 {
+				o.log.Info("oplog pruned", "events", cnt)
+			}
+			select {
+			case <-o.stop:
+				return
+			case <-t.C:
 			}
 		}
 	}()
+	return nil
 }
 
+// Broker notifies the connected clients that new events are available
 type Broker struct {
 	log log.Logger
 
-	clients map[chan *Op]bool
+	clients map[chan struct{}]bool
 	mu      sync.Mutex // for guarding clients
+}
 
-	newClients     chan chan *Op
-	defunctClients chan chan *Op
-	ops            chan *Op
+func (b *Broker) subscribe() chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := make(chan struct{}, 1)
+	b.clients[c] = true
+	b.log.Debug("added new client")
+	return c
 }
 
-func (b *Broker) start() {
-	for {
+func (b *Broker) unsubscribe(c chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.clients, c)
+	b.log.Debug("removed client")
+}
+
+func (b *Broker) notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		// The client will read all the events since its last one anyway
 		select {
-		case s := <-b.newClients:
-			// There is a new client attached and we
-			// want to start sending them messages.
-			b.mu.Lock()
-			b.clients[s] = true
-			b.mu.Unlock()
-			b.log.Debug("added new client")
-
-		case s := <-b.defunctClients:
-			// A client has dettached and we want to
-			// stop sending them messages.
-			b.mu.Lock()
-			delete(b.clients, s)
-			b.mu.Unlock()
-			close(s)
-			b.log.Debug("removed client")
-
-		case op := <-b.ops:
-			// There is a new message to send.  For each
-			// attached client, push the new message
-			// into the client's message channel.
-			b.mu.Lock()
-			for s, _ := range b.clients {
-				s <- op
-			}
-			b.mu.Unlock()
-			b.log.Info("message sent", "op", op, "clients_count", len(b.clients))
+		case c <- struct{}{}:
+		default:
 		}
 	}
 }
 
-func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-
-	f, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
-		return
+func writeOp(w http.ResponseWriter, op *Op) {
+	if op.ID > 0 {
+		fmt.Fprintf(w, "id: %d\n", op.ID)
 	}
+	fmt.Fprintf(w, "event: %s\n", op.Event)
+	fmt.Fprintf(w, "data: %s\n\n", op.Data)
+}
 
-	// Create a new channel, over which the broker can
-	// send this client messages.
-	opChan := make(chan *Op)
-
-	// Add this client to the map of those that should
-	// receive updates
-	b.newClients <- opChan
-
-	// Listen to the closing of the http connection via the CloseNotifier
-	notify := w.(http.CloseNotifier).CloseNotify()
-	go func() {
-		<-notify
-		// Remove this client from the map of attached clients
-		// when `EventHandler` exits.
-		b.defunctClients <- opChan
-	}()
+// streamHandler streams the events, starting after the `Last-Event-ID` header (or the `last_event_id` query
+// argument) if set, and with the new events otherwise, a "resync" event is sent first if some of the requested events
+// are not available anymore (the events can be filtered, see `filter`)
+func (o *Oplog) streamHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+			return
+		}
 
-	// Set the headers related to event streaming.
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+		filter, err := newFilter(r.URL.Query())
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !filter.check(w, r) {
+			auth.Forbidden(w)
+			return
+		}
 
-	// Send an initial heartbeat
-	fmt.Fprintf(w, "event: heartbeat\ndata: \n\n")
-	f.Flush()
+		// Subscribe first so no event can be missed
+		notify := o.broker.subscribe()
+		defer o.broker.unsubscribe(notify)
 
-	for {
+		cursor := o.store.last()
+		var resync bool
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("last_event_id")
+		}
+		if lastEventID != "" {
+			id, err := strconv.ParseUint(lastEventID, 10, 64)
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+				return
+			}
+			first, err := o.store.first()
+			if err != nil {
+				panic(err)
+			}
+			switch {
+			case id > cursor:
+				// The client comes from another log (or the log has been reset)
+				resync = true
+			case id < cursor && (first == 0 || id+1 < first):
+				// The events following the last one received by the client have been pruned
+				resync = true
+			default:
+				cursor = id
+			}
+		}
 
-		// Read from our messageChan.
-		op, open := <-opChan
+		// Set the headers related to event streaming.
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
 
-		if !open {
-			// If our messageChan was closed, this means that the client has
-			// disconnected.
-			break
+		// Send an initial heartbeat
+		writeOp(w, &Op{Event: "heartbeat"})
+		if resync {
+			// The ID lets the client resume from here once resynced
+			writeOp(w, &Op{ID: cursor, Event: "resync"})
 		}
+		f.Flush()
 
-		// FIXME(tsileo): add a way to whitelist event, like only blob or filetree (but make heartbeat part of the whitelist)
-
-		// Write to the ResponseWriter, `w`.
-		fmt.Fprintf(w, "event: %s\n", op.Event)
-		fmt.Fprintf(w, "data: %s\n\n", op.Data)
+		heartbeat := time.NewTicker(20 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			ops, err := o.store.since(cursor, 100)
+			if err != nil {
+				o.log.Error("failed to read the oplog", "err", err)
+				return
+			}
+			var sent bool
+			for _, op := range ops {
+				// The cursor moves forward even for the skipped events
+				cursor = op.ID
+				if filter.match(r, op) {
+					writeOp(w, op)
+					sent = true
+				}
+			}
+			if sent {
+				f.Flush()
+			}
+			if len(ops) == 100 {
+				continue
+			}
 
-		// Flush the response.  This is only possible if
-		// the response supports streaming.
-		f.Flush()
+			select {
+			case <-r.Context().Done():
+				// The client has disconnected
+				return
+			case <-notify:
+			case <-heartbeat.C:
+				writeOp(w, &Op{Event: "heartbeat"})
+				f.Flush()
+			}
+		}
 	}
 }
@@ -0,0 +1,152 @@
+package oplog // import "a4.io/blobstash/pkg/oplog"
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// lastIDKey stores the ID of the last event (so the IDs are not reused once all the events are pruned), it sorts
+// before the events as the IDs start at 1
+var lastIDKey = []byte{0}
+
+// store is the persisted log, the events are indexed by their ID (big-endian encoded so they're sorted)
+type store struct {
+	db     *rangedb.RangeDB
+	mu     sync.Mutex
+	lastID uint64
+}
+
+func encodeID(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+func newStore(path string) (*store, error) {
+	db, err := rangedb.New(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &store{db: db}
+
+	// Resume the IDs after the last event
+	v, err := db.Get(lastIDKey)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if len(v) == 8 {
+		s.lastID = binary.BigEndian.Uint64(v)
+		return s, nil
+	}
+
+	// The last ID was not persisted by older versions
+	r := db.PrefixRange(nil, true)
+	defer r.Close()
+	k, _, err := r.Next()
+	switch err {
+	case nil:
+		if len(k) == 8 {
+			s.lastID = binary.BigEndian.Uint64(k)
+		}
+	case io.EOF:
+	default:
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// append persists a new event
+func (s *store) append(event, data string) (*Op, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op := &Op{ID: s.lastID + 1, Event: event, Data: data, Time: time.Now().UnixNano()}
+	js, err := json.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	b := s.db.NewBatch()
+	b.Set(encodeID(op.ID), js)
+	b.Set(lastIDKey, encodeID(op.ID))
+	if err := s.db.Write(b); err != nil {
+		return nil, err
+	}
+	s.lastID = op.ID
+	return op, nil
+}
+
+// last returns the ID of the last event (0 if the log is empty)
+func (s *store) last() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastID
+}
+
+// first returns the ID of the oldest event still retained (0 if the log is empty)
+func (s *store) first() (uint64, error) {
+	r := s.db.PrefixRange(nil, false)
+	defer r.Close()
+	k, _, err := r.Seek(encodeID(1))
+	switch err {
+	case nil:
+		return binary.BigEndian.Uint64(k), nil
+	case io.EOF:
+		return 0, nil
+	default:
+		return 0, err
+	}
+}
+
+// since returns at most `limit` events with an ID greater than `id`
+func (s *store) since(id uint64, limit int) ([]*Op, error) {
+	ops := []*Op{}
+	r := s.db.PrefixRange(nil, false)
+	defer r.Close()
+	_, v, err := r.Seek(encodeID(id + 1))
+	for ; err == nil && len(ops) < limit; _, v, err = r.Next() {
+		op := &Op{}
+		if err := json.Unmarshal(v, op); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// prune removes the events older than `before`, the number of removed events is returned
+func (s *store) prune(before time.Time) (int, error) {
+	var cnt int
+	r := s.db.PrefixRange(nil, false)
+	defer r.Close()
+	k, v, err := r.Seek(encodeID(1))
+	for ; err == nil; k, v, err = r.Next() {
+		op := &Op{}
+		if err := json.Unmarshal(v, op); err != nil {
+			return cnt, err
+		}
+		if op.Time >= before.UnixNano() {
+			return cnt, nil
+		}
+		if err := s.db.Delete(k); err != nil {
+			return cnt, err
+		}
+		cnt++
+	}
+	if err != io.EOF {
+		return cnt, err
+	}
+	return cnt, nil
+}
+
+func (s *store) close() error {
+	return s.db.Close()
+}
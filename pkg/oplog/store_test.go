@@ -0,0 +1,89 @@
+package oplog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_oplog_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "oplog")
+
+	s, err := newStore(path)
+	if err != nil {
+		panic(err)
+	}
+	for _, hash := range []string{"a", "b", "c"} {
+		if _, err := s.append("blob", hash); err != nil {
+			panic(err)
+		}
+	}
+	ops, err := s.since(1, 100)
+	if err != nil {
+		panic(err)
+	}
+	if len(ops) != 2 || ops[0].ID != 2 || ops[0].Data != "b" || ops[1].ID != 3 {
+		t.Errorf("unexpected ops %+v", ops)
+	}
+	s.close()
+
+	// The IDs keep increasing after a restart
+	s, err = newStore(path)
+	if err != nil {
+		panic(err)
+	}
+	op, err := s.append("blob", "d")
+	if err != nil {
+		panic(err)
+	}
+	if op.ID != 4 {
+		t.Errorf("unexpected ID %d", op.ID)
+	}
+
+	cnt, err := s.prune(time.Now().Add(time.Hour))
+	if err != nil {
+		panic(err)
+	}
+	if cnt != 4 {
+		t.Errorf("unexpected pruned events count %d", cnt)
+	}
+	first, err := s.first()
+	if err != nil {
+		panic(err)
+	}
+	if first != 0 || s.last() != 4 {
+		t.Errorf("unexpected first/last %d/%d", first, s.last())
+	}
+	s.close()
+
+	// The IDs are not reused after a restart, even if all the events were pruned
+	s, err = newStore(path)
+	if err != nil {
+		panic(err)
+	}
+	if s.last() != 4 {
+		t.Errorf("unexpected last %d", s.last())
+	}
+	op, err = s.append("blob", "e")
+	if err != nil {
+		panic(err)
+	}
+	if op.ID != 5 {
+		t.Errorf("unexpected ID %d", op.ID)
+	}
+	ops, err = s.since(0, 100)
+	if err != nil {
+		panic(err)
+	}
+	if len(ops) != 1 || ops[0].ID != 5 {
+		t.Errorf("unexpected ops %+v", ops)
+	}
+	s.close()
+}
@@ -6,6 +6,8 @@ Package queue implements a basic FIFO queues.
 package queue // import "a4.io/blobstash/pkg/queue"
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -17,11 +19,18 @@ import (
 	"a4.io/blobstash/pkg/rangedb"
 )
 
+// seqKey stores the last sequence number, it sorts after every item key (items keys starts with the big endian
+// encoded sequence, that never reach 0xff)
+var seqKey = []byte("\xffseq")
+
 // Queue is a FIFO queue,
 type Queue struct {
 	db   *rangedb.RangeDB
 	path string
 	sync.Mutex
+
+	seqMu sync.Mutex
+	seq   int64
 }
 
 // New creates a new database.
@@ -31,10 +40,48 @@ func New(path string) (*Queue, error) {
 		return nil, err
 	}
 
-	return &Queue{
+	q := &Queue{
 		db:   db,
 		path: path,
-	}, nil
+	}
+	if err := q.loadSeq(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// loadSeq loads the last sequence number, fallbacks to the key of the last item for queues created before the
+// sequence was persisted
+func (q *Queue) loadSeq() error {
+	v, err := q.db.Get(seqKey)
+	if err != nil {
+		return err
+	}
+	if len(v) == 8 {
+		q.seq = int64(binary.BigEndian.Uint64(v))
+		return nil
+	}
+
+	c := q.db.Range([]byte{}, []byte{0xfe}, true)
+	defer c.Close()
+	k, _, err := c.Next()
+	switch {
+	case err == io.EOF:
+		return nil
+	case err != nil:
+		return err
+	}
+	if len(k) >= 8 {
+		q.seq = int64(binary.BigEndian.Uint64(k[:8]))
+	}
+	return nil
+}
+
+// items returns a range over all the items (skipping the sequence key)
+func (q *Queue) items() *rangedb.Range {
+	return q.db.Range([]byte{}, []byte{0xfe}, false)
 }
 
 // Close the underlying db file.
@@ -50,7 +97,7 @@ func (q *Queue) Remove() error {
 // Size returns the number of items currently enqueued
 func (q *Queue) Size() (int, error) {
 	cnt := 0
-	c := q.db.PrefixRange([]byte(""), false)
+	c := q.items()
 	defer c.Close()
 
 	// Iterate the range
@@ -67,7 +114,7 @@ func (q *Queue) RemoveBlobs(blobs []string) error {
 	for _, h := range blobs {
 		idx[h] = struct{}{}
 	}
-	c := q.db.PrefixRange([]byte(""), false)
+	c := q.items()
 	defer c.Close()
 
 	// Iterate the range
@@ -92,7 +139,7 @@ func (q *Queue) RemoveBlobs(blobs []string) error {
 func (q *Queue) Blobs() ([]*blob.Blob, error) {
 	out := []*blob.Blob{}
 
-	c := q.db.PrefixRange([]byte(""), false)
+	c := q.items()
 	defer c.Close()
 
 	// Iterate the range
@@ -109,18 +156,37 @@ func (q *Queue) Blobs() ([]*blob.Blob, error) {
 }
 
 // Enqueue the given `item`. Must be JSON serializable.
+//
+// Items are keyed by a monotonic sequence (never lower than the current time in nanoseconds), taken and written under
+// the same lock, so an item is always stored after all the previously enqueued ones (consumers relying on a cursor
+// won't skip it).
 func (q *Queue) Enqueue(item interface{}) (*id.ID, error) {
-	id, err := id.New(time.Now().UnixNano())
+	js, err := json.Marshal(item)
 	if err != nil {
 		return nil, err
 	}
 
-	js, err := json.Marshal(item)
+	q.seqMu.Lock()
+	defer q.seqMu.Unlock()
+
+	seq := q.seq + 1
+	if now := time.Now().UnixNano(); now > seq {
+		seq = now
+	}
+	id, err := id.New(seq)
 	if err != nil {
 		return nil, err
 	}
 
-	q.db.Set(id.Raw(), js)
+	rawSeq := make([]byte, 8)
+	binary.BigEndian.PutUint64(rawSeq, uint64(seq))
+	b := q.db.NewBatch()
+	b.Set(id.Raw(), js)
+	b.Set(seqKey, rawSeq)
+	if err := q.db.Write(b); err != nil {
+		return nil, err
+	}
+	q.seq = seq
 
 	return id, nil
 }
@@ -133,7 +199,7 @@ func (q *Queue) InstantDequeue(id *id.ID) error {
 // Dequeue the older item, unserialize the given item.
 // Returns false if the queue is empty.
 func (q *Queue) Dequeue(item interface{}) (bool, func(bool), error) {
-	c := q.db.PrefixRange([]byte(""), false)
+	c := q.items()
 	defer c.Close()
 
 	// Iterate the range
@@ -159,5 +225,83 @@ func (q *Queue) Dequeue(item interface{}) (bool, func(bool), error) {
 	return true, deqFunc, json.Unmarshal(js, item)
 }
 
+// Contains returns true if the item with the given key (as returned by `Next`) is still enqueued
+func (q *Queue) Contains(key []byte) (bool, error) {
+	return q.db.Has(key)
+}
+
+// Delete removes the item with the given key (as returned by `Next`)
+func (q *Queue) Delete(key []byte) error {
+	return q.db.Delete(key)
+}
+
+// Next unserializes the first item enqueued after the `cursor` key (or the first item if `cursor` is empty) without
+// removing it, and returns its key (to be used as the next cursor).
+// Returns false if there is no item after the cursor.
+func (q *Queue) Next(cursor []byte, item interface{}) ([]byte, bool, error) {
+	c := q.items()
+	defer c.Close()
+
+	var k, js []byte
+	var err error
+	if len(cursor) > 0 {
+		k, js, err = c.Seek(cursor)
+		if err == nil && bytes.Equal(k, cursor) {
+			k, js, err = c.Next()
+		}
+	} else {
+		k, js, err = c.Next()
+	}
+	switch {
+	case err == io.EOF:
+		return nil, false, nil
+	case err != nil:
+		return nil, false, fmt.Errorf("next failed: %v", err)
+	}
+
+	return k, true, json.Unmarshal(js, item)
+}
+
+// SizeAfter returns the number of items enqueued after the `cursor` key
+func (q *Queue) SizeAfter(cursor []byte) (int, error) {
+	cnt := 0
+	c := q.items()
+	defer c.Close()
+
+	var k []byte
+	var err error
+	if len(cursor) > 0 {
+		k, _, err = c.Seek(cursor)
+	} else {
+		k, _, err = c.Next()
+	}
+	for ; err == nil; k, _, err = c.Next() {
+		if !bytes.Equal(k, cursor) {
+			cnt++
+		}
+	}
+	if err != io.EOF {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+// Trim removes all the items up to the `cursor` key (included)
+func (q *Queue) Trim(cursor []byte) error {
+	c := q.items()
+	defer c.Close()
+
+	k, _, err := c.Next()
+	for ; err == nil && bytes.Compare(k, cursor) <= 0; k, _, err = c.Next() {
+		if err := q.db.Delete(k); err != nil {
+			return err
+		}
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
 // TODO(tsileo): func (q *Queue) Items() ([]*blob.Blob, error)
 // also use `*blob.Blob` instead if `interface{}`
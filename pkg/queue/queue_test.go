@@ -1,6 +1,7 @@
 package queue
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -76,3 +77,70 @@ func TestQueue(t *testing.T) {
 		t.Errorf("no item should have been dequeued, got \"%s\"", deq3.Val)
 	}
 }
+
+func TestQueueSequence(t *testing.T) {
+	q, err := New("queue_seq_test")
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+	defer q.Remove()
+
+	var last []byte
+	for i := 0; i < 100; i++ {
+		id, err := q.Enqueue(&Item{"ok"})
+		check(err)
+		if bytes.Compare(id.Raw(), last) <= 0 {
+			t.Fatalf("keys must be increasing")
+		}
+		last = id.Raw()
+	}
+	cnt, err := q.Size()
+	check(err)
+	if cnt != 100 {
+		t.Errorf("100 items should be queued, got %d", cnt)
+	}
+
+	// The sequence is persisted, even if all the items are removed
+	check(q.Trim(last))
+	check(q.Close())
+	q, err = New("queue_seq_test")
+	check(err)
+	id, err := q.Enqueue(&Item{"ok"})
+	check(err)
+	if bytes.Compare(id.Raw(), last) <= 0 {
+		t.Errorf("keys must be increasing after a restart")
+	}
+}
+
+func TestQueueDelete(t *testing.T) {
+	q, err := New("queue_delete_test")
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+	defer q.Remove()
+	_, err = q.Enqueue(&Item{"ok"})
+	check(err)
+	_, err = q.Enqueue(&Item{"ok2"})
+	check(err)
+
+	item := &Item{}
+	k, ok, err := q.Next(nil, item)
+	check(err)
+	if !ok || item.Val != "ok" {
+		t.Fatalf("the first item should be returned, got %+v", item)
+	}
+	queued, err := q.Contains(k)
+	check(err)
+	if !queued {
+		t.Errorf("the item should still be queued")
+	}
+	check(q.Delete(k))
+	queued, err = q.Contains(k)
+	check(err)
+	if queued {
+		t.Errorf("the item should have been removed")
+	}
+	if _, ok, err := q.Next(nil, item); err != nil || !ok || item.Val != "ok2" {
+		t.Errorf("the second item should be returned, got %+v", item)
+	}
+}
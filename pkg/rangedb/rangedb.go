@@ -44,6 +44,28 @@ func (db *RangeDB) Set(k, v []byte) error {
 	return db.db.Put(k, v, nil)
 }
 
+// Batch holds writes applied atomically by `RangeDB.Write`
+type Batch struct {
+	b *leveldb.Batch
+}
+
+func (db *RangeDB) NewBatch() *Batch {
+	return &Batch{new(leveldb.Batch)}
+}
+
+func (b *Batch) Set(k, v []byte) {
+	b.b.Put(k, v)
+}
+
+func (b *Batch) Delete(k []byte) {
+	b.b.Delete(k)
+}
+
+// Write applies all the writes of the batch (or none of them)
+func (db *RangeDB) Write(b *Batch) error {
+	return db.db.Write(b.b, nil)
+}
+
 func (db *RangeDB) Delete(k []byte) error {
 	return db.db.Delete(k, nil)
 }
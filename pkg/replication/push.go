@@ -0,0 +1,357 @@
+package replication // import "a4.io/blobstash/pkg/replication"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/docstore/id"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/metrics"
+	"a4.io/blobstash/pkg/queue"
+	"a4.io/blobstash/pkg/stash/store"
+	bsync "a4.io/blobstash/pkg/sync"
+)
+
+const (
+	defaultBatchSize         = 100
+	defaultReconcileInterval = 1 * time.Hour
+)
+
+var (
+	pushQueuedMetric = metrics.NewGaugeVec("blobstash_replication_push_queued", "Blobs waiting to be pushed to a peer.",
+		"peer")
+	pushLagMetric = metrics.NewGaugeVec("blobstash_replication_push_lag_seconds",
+		"Age of the oldest blob waiting to be pushed to a peer.", "peer")
+	pushedMetric = metrics.NewCounterVec("blobstash_replication_blobs_pushed", "Blobs pushed to a peer.", "peer")
+)
+
+// queuedBlob is the item of the outbound queues
+type queuedBlob struct {
+	Hash string `json:"hash"`
+	Time int64  `json:"t"`
+}
+
+// PeerStatus holds the state of the replication to a `replicate_to` peer
+type PeerStatus struct {
+	Name            string           `json:"name"`
+	URL             string           `json:"url"`
+	Queued          int              `json:"queued"`
+	Lag             float64          `json:"lag_seconds"`
+	BackoffAttempt  int              `json:"backoff_attempt"`
+	Pushed          int64            `json:"blobs_pushed"`
+	LastPushAt      string           `json:"last_push_at,omitempty"`
+	LastError       string           `json:"last_error,omitempty"`
+	LastErrorAt     string           `json:"last_error_at,omitempty"`
+	LastReconcileAt string           `json:"last_reconcile_at,omitempty"`
+	LastReconcile   *bsync.SyncStats `json:"last_reconcile,omitempty"`
+}
+
+// Push replicates the new blobs to the `replicate_to` peers
+type Push struct {
+	hub   *hub.Hub
+	peers []*peer
+	log   log.Logger
+}
+
+// peer pushes the blobs of its outbound queue (fed by the new blob events) in batches, and regularly reconciles with
+// the peer using the Merkle trees of the sync API
+type peer struct {
+	conf              *config.ReplicateTo
+	queue             *queue.Queue
+	client            *clientutil.ClientUtil
+	synctable         *bsync.Sync
+	blobstore         store.BlobStore
+	batchSize         int
+	reconcileInterval time.Duration
+	backoff           *Backoff
+	log               log.Logger
+
+	notify chan struct{}
+	stop   chan struct{}
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	status *PeerStatus
+}
+
+// NewPush starts the replication to the `replicate_to` peers
+func NewPush(logger log.Logger, conf *config.Config, h *hub.Hub, bs store.BlobStore, s *bsync.Sync) (*Push, error) {
+	logger.Debug("init")
+	p := &Push{hub: h, log: logger}
+	for _, pconf := range conf.ReplicateTo {
+		q, err := queue.New(filepath.Join(conf.VarDir(), "replicate_to", pconf.Name))
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		pr := &peer{
+			conf:              pconf,
+			queue:             q,
+			client:            clientutil.NewClientUtil(pconf.URL, clientutil.WithAPIKey(pconf.APIKey)),
+			synctable:         s,
+			blobstore:         bs,
+			batchSize:         pconf.BatchSize,
+			reconcileInterval: defaultReconcileInterval,
+			backoff: &Backoff{
+				delay:    1 * time.Second,
+				maxDelay: 120 * time.Second,
+				factor:   1.6,
+			},
+			log:    logger.New("peer", pconf.Name),
+			notify: make(chan struct{}, 1),
+			stop:   make(chan struct{}),
+			status: &PeerStatus{Name: pconf.Name, URL: pconf.URL},
+		}
+		if pr.batchSize <= 0 {
+			pr.batchSize = defaultBatchSize
+		}
+		if pconf.ReconcileInterval != "" {
+			if pr.reconcileInterval, err = time.ParseDuration(pconf.ReconcileInterval); err != nil {
+				p.Close()
+				return nil, err
+			}
+		}
+		p.peers = append(p.peers, pr)
+		h.Subscribe(hub.NewBlob, "replicate_to:"+pconf.Name, pr.newBlobCallback)
+		pr.wg.Add(1)
+		go pr.run()
+	}
+	metrics.OnCollect(func() {
+		p.Status()
+	})
+	return p, nil
+}
+
+// Status returns the status of each peer
+func (p *Push) Status() []*PeerStatus {
+	out := []*PeerStatus{}
+	for _, pr := range p.peers {
+		status, err := pr.getStatus()
+		if err != nil {
+			p.log.Error("failed to get the peer status", "peer", pr.conf.Name, "err", err)
+			continue
+		}
+		out = append(out, status)
+	}
+	return out
+}
+
+// Close stops the replication, the queued blobs will be pushed after a restart
+func (p *Push) Close() error {
+	for _, pr := range p.peers {
+		if err := p.hub.Unsubscribe(hub.NewBlob, "replicate_to:"+pr.conf.Name); err != nil {
+			return err
+		}
+		close(pr.stop)
+		pr.wg.Wait()
+		if err := pr.queue.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pr *peer) newBlobCallback(ctx context.Context, b *blob.Blob, _ interface{}) error {
+	if _, err := pr.queue.Enqueue(&queuedBlob{Hash: b.Hash, Time: time.Now().UnixNano()}); err != nil {
+		return err
+	}
+	select {
+	case pr.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (pr *peer) getStatus() (*PeerStatus, error) {
+	queued, err := pr.queue.SizeAfter(nil)
+	if err != nil {
+		return nil, err
+	}
+	var lag time.Duration
+	oldest := &queuedBlob{}
+	if _, ok, err := pr.queue.Next(nil, oldest); err != nil {
+		return nil, err
+	} else if ok {
+		lag = time.Since(time.Unix(0, oldest.Time))
+	}
+	pushQueuedMetric.With(pr.conf.Name).Set(float64(queued))
+	pushLagMetric.With(pr.conf.Name).Set(lag.Seconds())
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	status := *pr.status
+	status.Queued = queued
+	status.Lag = lag.Seconds()
+	status.BackoffAttempt = pr.backoff.Attempt()
+	return &status, nil
+}
+
+func (pr *peer) setError(err error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.status.LastError = err.Error()
+	pr.status.LastErrorAt = time.Now().Format(time.RFC3339)
+}
+
+// wait returns false if the peer has been stopped during the given delay
+func (pr *peer) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-pr.stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (pr *peer) run() {
+	defer pr.wg.Done()
+	pr.backoff.Reset()
+	// Reconcile first, the peer may have been added with existing blobs
+	nextReconcile := time.Now()
+	for {
+		if !time.Now().Before(nextReconcile) {
+			if err := pr.reconcile(); err != nil {
+				pr.log.Error("failed to reconcile", "err", err)
+				pr.setError(err)
+			}
+			nextReconcile = time.Now().Add(pr.reconcileInterval)
+		}
+
+		n, err := pr.push()
+		if err != nil {
+			pr.log.Error("failed to push", "err", err, "attempt", pr.backoff.Attempt())
+			pr.setError(err)
+			if !pr.wait(pr.backoff.Delay()) {
+				return
+			}
+			continue
+		}
+		pr.backoff.Reset()
+		if n == pr.batchSize {
+			continue
+		}
+
+		t := time.NewTimer(time.Until(nextReconcile))
+		select {
+		case <-pr.stop:
+			t.Stop()
+			return
+		case <-pr.notify:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// push uploads the next batch of queued blobs, and returns the number of blobs dequeued
+func (pr *peer) push() (int, error) {
+	var cursor []byte
+	keys := [][]byte{}
+	hashes := []string{}
+	for len(hashes) < pr.batchSize {
+		item := &queuedBlob{}
+		k, ok, err := pr.queue.Next(cursor, item)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		cursor = k
+		keys = append(keys, k)
+		hashes = append(hashes, item.Hash)
+	}
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+
+	cnt, err := pr.upload(hashes)
+	if err != nil {
+		return 0, err
+	}
+	// Only the pushed blobs are removed (blobs may have been enqueued in the meantime)
+	for _, k := range keys {
+		if err := pr.queue.InstantDequeue(id.FromRaw(k)); err != nil {
+			return 0, err
+		}
+	}
+	pushedMetric.With(pr.conf.Name).Add(float64(cnt))
+	pr.mu.Lock()
+	pr.status.Pushed += int64(cnt)
+	pr.status.LastPushAt = time.Now().Format(time.RFC3339)
+	pr.mu.Unlock()
+	pr.log.Debug("blobs pushed", "blobs", cnt)
+	return len(hashes), nil
+}
+
+// upload streams the blobs to the peer in a single multipart request, and returns the number of blobs sent (the blobs
+// removed since they were queued are skipped)
+func (pr *peer) upload(hashes []string) (int, error) {
+	body, pw := io.Pipe()
+	defer body.Close()
+	mw := multipart.NewWriter(pw)
+	var cnt int64
+	go func() {
+		for _, hash := range hashes {
+			data, err := pr.blobstore.Get(context.TODO(), hash)
+			if err != nil {
+				if err == blobstore.ErrBlobNotFound {
+					continue
+				}
+				pw.CloseWithError(err)
+				return
+			}
+			part, err := mw.CreateFormFile(hash, hash)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := part.Write(data); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			atomic.AddInt64(&cnt, 1)
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	resp, err := pr.client.Do("POST", "/api/blobstore/upload", body,
+		clientutil.WithHeader("Content-Type", mw.FormDataContentType()))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return 0, fmt.Errorf("upload failed: %w", err)
+	}
+	return int(atomic.LoadInt64(&cnt)), nil
+}
+
+// reconcile uploads the blobs missing on the peer (the blobs only present on the peer are left there)
+func (pr *peer) reconcile() error {
+	stats, err := pr.synctable.Push(pr.conf.URL, pr.conf.APIKey)
+	if err != nil {
+		return err
+	}
+	pr.log.Info("reconciliation done", "stats", stats)
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.status.LastReconcileAt = time.Now().Format(time.RFC3339)
+	pr.status.LastReconcile = stats
+	return nil
+}
@@ -0,0 +1,185 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/queue"
+)
+
+func TestPeerPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_push_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	bs, err := blobstore.New(logger, true, dir, &config.Config{DataDir: dir, StorageEngine: blobstore.DirEngine},
+		hub.New(logger, true))
+	if err != nil {
+		panic(err)
+	}
+	defer bs.Close()
+
+	// The fake peer records the uploaded blobs
+	var mu sync.Mutex
+	received := map[string]bool{}
+	var requests int
+	var onUpload func()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/blobstore/upload" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mr, err := r.MultipartReader()
+		if err != nil {
+			panic(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if onUpload != nil {
+			onUpload()
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				panic(err)
+			}
+			data, err := ioutil.ReadAll(part)
+			if err != nil {
+				panic(err)
+			}
+			if hashutil.Compute(data) != part.FormName() {
+				t.Errorf("corrupted blob %s", part.FormName())
+			}
+			received[part.FormName()] = true
+		}
+	}))
+	defer srv.Close()
+
+	q, err := queue.New(filepath.Join(dir, "queue"))
+	if err != nil {
+		panic(err)
+	}
+	defer q.Close()
+	pr := &peer{
+		conf:      &config.ReplicateTo{Name: "test", URL: srv.URL},
+		queue:     q,
+		client:    clientutil.NewClientUtil(srv.URL),
+		blobstore: bs,
+		batchSize: 3,
+		backoff:   &Backoff{},
+		log:       logger,
+		notify:    make(chan struct{}, 1),
+		status:    &PeerStatus{Name: "test"},
+	}
+
+	hashes := []string{}
+	for i := 0; i < 5; i++ {
+		data := []byte(fmt.Sprintf("hello%d", i))
+		b := &blob.Blob{Hash: hashutil.Compute(data), Data: data}
+		if _, err := bs.Put(context.Background(), b); err != nil {
+			panic(err)
+		}
+		if err := pr.newBlobCallback(context.Background(), b, nil); err != nil {
+			panic(err)
+		}
+		hashes = append(hashes, b.Hash)
+	}
+	// A blob removed since it was queued is skipped
+	if err := pr.newBlobCallback(context.Background(), &blob.Blob{Hash: hashutil.Compute([]byte("gone"))}, nil); err != nil {
+		panic(err)
+	}
+
+	status, err := pr.getStatus()
+	if err != nil {
+		panic(err)
+	}
+	if status.Queued != 6 || status.Lag <= 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	for _, expected := range []int{3, 3, 0} {
+		n, err := pr.push()
+		if err != nil {
+			panic(err)
+		}
+		if n != expected {
+			t.Errorf("expected %d blobs dequeued, got %d", expected, n)
+		}
+	}
+	if requests != 2 || len(received) != 5 {
+		t.Errorf("unexpected uploads (%d requests, %d blobs)", requests, len(received))
+	}
+	for _, h := range hashes {
+		if !received[h] {
+			t.Errorf("blob %s not pushed", h)
+		}
+	}
+
+	status, err = pr.getStatus()
+	if err != nil {
+		panic(err)
+	}
+	if status.Queued != 0 || status.Lag != 0 || status.Pushed != 5 || status.LastPushAt == "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// A blob enqueued during an upload is not removed from the queue
+	blobs := []*blob.Blob{}
+	for _, data := range []string{"hello5", "late"} {
+		b := &blob.Blob{Hash: hashutil.Compute([]byte(data)), Data: []byte(data)}
+		if _, err := bs.Put(context.Background(), b); err != nil {
+			panic(err)
+		}
+		blobs = append(blobs, b)
+	}
+	if err := pr.newBlobCallback(context.Background(), blobs[0], nil); err != nil {
+		panic(err)
+	}
+	mu.Lock()
+	onUpload = func() {
+		if err := pr.newBlobCallback(context.Background(), blobs[1], nil); err != nil {
+			panic(err)
+		}
+	}
+	mu.Unlock()
+	if n, err := pr.push(); err != nil || n != 1 {
+		t.Errorf("expected 1 blob dequeued, got %d (%v)", n, err)
+	}
+	mu.Lock()
+	onUpload = nil
+	mu.Unlock()
+	if status, err = pr.getStatus(); err != nil || status.Queued != 1 {
+		t.Errorf("the blob enqueued during the upload should still be queued: %+v", status)
+	}
+	if n, err := pr.push(); err != nil || n != 1 {
+		t.Errorf("expected 1 blob dequeued, got %d (%v)", n, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !received[blobs[1].Hash] {
+		t.Errorf("the blob enqueued during the upload was not pushed")
+	}
+}
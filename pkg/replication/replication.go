@@ -2,32 +2,68 @@ package replication // import "a4.io/blobstash/pkg/replication"
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
 	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/client/kvstore"
 	"a4.io/blobstash/pkg/client/oplog"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/metrics"
 	"a4.io/blobstash/pkg/stash/store"
 	bsync "a4.io/blobstash/pkg/sync"
 
 	log "github.com/inconshreveable/log15"
 )
 
+// maxApplyAttempts is the number of times a failed event is applied (with a backoff) before catching up with a sync
+const maxApplyAttempts = 5
+
+var (
+	connectedMetric = metrics.NewGaugeVec("blobstash_replication_connected", "1 if the remote oplog is connected.")
+	lagMetric       = metrics.NewGaugeVec("blobstash_replication_lag_seconds",
+		"Time since the replica was last known to be up to date with the remote instance.")
+	appliedMetric = metrics.NewCounterVec("blobstash_replication_blobs_applied", "Blobs replicated from the remote instance.")
+	errorsMetric  = metrics.NewCounterVec("blobstash_replication_errors", "Replication errors.", "stage")
+)
+
 type Backoff struct {
 	delay    time.Duration
 	factor   float64
 	maxDelay time.Duration
-	attempt  int
+
+	mu      sync.Mutex
+	attempt int
 }
 
 func (b *Backoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.attempt = 1
 }
 
+// Attempt returns the number of delays since the last reset
+func (b *Backoff) Attempt() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.attempt < 1 {
+		return 0
+	}
+	return b.attempt - 1
+}
+
 func (b *Backoff) Delay() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	d := float64(b.delay) * math.Pow(b.factor, float64(b.attempt))
 	maxD := float64(b.maxDelay)
 	b.attempt++
@@ -37,34 +73,96 @@ func (b *Backoff) Delay() time.Duration {
 	return time.Duration(d)
 }
 
+// Status holds the state of the replication from the `replicate_from` instance
+type Status struct {
+	URL            string  `json:"url"`
+	Selective      bool    `json:"selective"`
+	Connected      bool    `json:"connected"`
+	ConnectedSince string  `json:"connected_since,omitempty"`
+	Lag            float64 `json:"lag_seconds"`
+	BackoffAttempt int     `json:"backoff_attempt"`
+
+	LastEventID string `json:"last_event_id,omitempty"`
+	LastEventAt string `json:"last_event_at,omitempty"`
+
+	BlobsApplied     int64 `json:"blobs_applied"`
+	KvEntriesApplied int64 `json:"kv_entries_applied"`
+
+	Errors         int64  `json:"errors"`
+	LastError      string `json:"last_error,omitempty"`
+	LastErrorStage string `json:"last_error_stage,omitempty"`
+	LastErrorAt    string `json:"last_error_at,omitempty"`
+
+	LastSyncAt        string           `json:"last_sync_at,omitempty"`
+	LastSync          *bsync.SyncStats `json:"last_sync,omitempty"`
+	LastSelectiveSync *SelectiveStats  `json:"last_selective_sync,omitempty"`
+}
+
 type Replication struct {
 	log       log.Logger
 	synctable *bsync.Sync
 	blobstore store.BlobStore
+	kvstore   store.KvStore
 	backoff   *Backoff
 
-	remoteOplog *oplog.Oplog
+	// Delays the retries of a failed event
+	applyBackoff *Backoff
+
+	remoteOplog   *oplog.Oplog
+	remoteKvStore *kvstore.KvStore
 
 	conf *config.ReplicateFrom
 
 	wg *sync.WaitGroup
+
+	// Used to compute the replication lag
+	mu         sync.Mutex
+	connected  bool
+	upToDateAt time.Time // last time the replica was known to be up to date
+	applyingAt time.Time // time the op currently being applied was received
+
+	// Exposed by the status API
+	status *Status
+
+	// ID of the last remote oplog event applied (persisted so the replication can resume after a restart)
+	lastEventID     string
+	lastEventIDPath string
 }
 
-func New(logger log.Logger, conf *config.Config, bs store.BlobStore, s *bsync.Sync, wg *sync.WaitGroup) (*Replication, error) {
-	logger.Debug("init")
+func New(logger log.Logger, conf *config.Config, bs store.BlobStore, kvs store.KvStore, s *bsync.Sync, wg *sync.WaitGroup) (*Replication, error) {
+	logger.Debug("init", "selective", conf.ReplicateFrom.Selective())
+	client := clientutil.NewClientUtil(conf.ReplicateFrom.URL, clientutil.WithAPIKey(conf.ReplicateFrom.APIKey))
 	rep := &Replication{
-		conf:        conf.ReplicateFrom,
-		blobstore:   bs,
-		log:         logger,
-		remoteOplog: oplog.New(clientutil.NewClientUtil(conf.ReplicateFrom.URL, clientutil.WithAPIKey(conf.ReplicateFrom.APIKey))),
-		synctable:   s,
+		conf:          conf.ReplicateFrom,
+		blobstore:     bs,
+		kvstore:       kvs,
+		log:           logger,
+		remoteOplog:   oplog.New(client),
+		remoteKvStore: kvstore.New(client),
+		synctable:     s,
 		backoff: &Backoff{
 			delay:    1 * time.Second,
 			maxDelay: 120 * time.Second,
 			factor:   1.6,
 		},
-		wg: wg,
+		applyBackoff: &Backoff{
+			delay:    1 * time.Second,
+			maxDelay: 30 * time.Second,
+			factor:   1.6,
+		},
+		wg:              wg,
+		status:          &Status{URL: conf.ReplicateFrom.URL, Selective: conf.ReplicateFrom.Selective()},
+		lastEventIDPath: filepath.Join(conf.VarDir(), "replication.last_event_id"),
+	}
+	data, err := ioutil.ReadFile(rep.lastEventIDPath)
+	switch {
+	case err == nil:
+		rep.lastEventID = strings.TrimSpace(string(data))
+	case os.IsNotExist(err):
+	default:
+		return nil, err
 	}
+	metrics.OnCollect(rep.collect)
 	if err := rep.init(); err != nil {
 		return nil, err
 	}
@@ -72,24 +170,241 @@ func New(logger log.Logger, conf *config.Config, bs store.BlobStore, s *bsync.Sy
 	return rep, nil
 }
 
+// lag returns the replication lag (must be called with the lock held)
+func (r *Replication) lag() time.Duration {
+	switch {
+	case !r.connected && !r.upToDateAt.IsZero():
+		return time.Since(r.upToDateAt)
+	case !r.applyingAt.IsZero():
+		return time.Since(r.applyingAt)
+	}
+	return 0
+}
+
+// collect updates the lag metric
+func (r *Replication) collect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lagMetric.With().Set(r.lag().Seconds())
+}
+
+// Status returns the current state of the replication
+func (r *Replication) Status() *Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := *r.status
+	status.Connected = r.connected
+	status.Lag = r.lag().Seconds()
+	status.BackoffAttempt = r.backoff.Attempt()
+	status.LastEventID = r.lastEventID
+	return &status
+}
+
+// recordError records a replication error, `stage` is one of "sync", "oplog" or "apply"
+func (r *Replication) recordError(stage string, err error) {
+	errorsMetric.With(stage).Inc()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.Errors++
+	r.status.LastError = err.Error()
+	r.status.LastErrorStage = stage
+	r.status.LastErrorAt = time.Now().Format(time.RFC3339)
+}
+
+// setConnected updates the connection state (the replica is up to date at the time the connection is lost)
+func (r *Replication) setConnected(connected bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.connected && !connected {
+		r.upToDateAt = time.Now()
+	}
+	r.connected = connected
+	if connected {
+		r.status.ConnectedSince = time.Now().Format(time.RFC3339)
+		connectedMetric.With().Set(1)
+	} else {
+		r.status.ConnectedSince = ""
+		connectedMetric.With().Set(0)
+	}
+}
+
+// applying records the time the op being applied was received (zero once applied)
+func (r *Replication) applying(t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.applyingAt = t
+}
+
+// getLastEventID returns the ID of the last applied event (empty if the remote oplog does not support IDs)
+func (r *Replication) getLastEventID() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastEventID
+}
+
+// setLastEventID persists the ID of the last applied event
+func (r *Replication) setLastEventID(id string) error {
+	if id == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tmpPath := r.lastEventIDPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(id), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, r.lastEventIDPath); err != nil {
+		return err
+	}
+	r.lastEventID = id
+	return nil
+}
+
 func (r *Replication) sync() error {
+	if r.conf.Selective() {
+		// Only replicate the selected kv entries and the blobs reachable from them
+		stats, err := r.selectiveSync(context.TODO())
+		if err != nil {
+			r.recordError("sync", err)
+			return err
+		}
+		r.log.Info("selective sync done", "stats", stats)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.upToDateAt = time.Now()
+		r.status.LastSyncAt = r.upToDateAt.Format(time.RFC3339)
+		r.status.LastSelectiveSync = stats
+		r.status.BlobsApplied += int64(stats.Blobs)
+		r.status.KvEntriesApplied += int64(stats.KvEntries)
+		return nil
+	}
+
 	// Initiate a one-way synchronization
 	stats, err := r.synctable.Sync(r.conf.URL, r.conf.APIKey, true)
 	if err != nil {
+		r.recordError("sync", err)
 		return err
 	}
 	r.log.Info("sync done", "stats", stats)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.upToDateAt = time.Now()
+	r.status.LastSyncAt = r.upToDateAt.Format(time.RFC3339)
+	r.status.LastSync = stats
+	r.status.BlobsApplied += int64(stats.Downloaded)
+	return nil
+}
+
+// resync syncs with the remote instance until it succeeds
+func (r *Replication) resync() {
+	for {
+		if err := r.sync(); err != nil {
+			r.log.Error("failed to sync", "err", err, "attempt", r.backoff.Attempt())
+			time.Sleep(r.backoff.Delay())
+			continue
+		}
+		r.backoff.Reset()
+		return
+	}
+}
+
+// applyBlob fetches the blob from the remote instance and saves it locally
+func (r *Replication) applyBlob(ctx context.Context, hash string) error {
+	data, err := r.remoteOplog.GetBlob(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("failed to fetch blob %s: %w", hash, err)
+	}
+
+	// Ensure the blob is not corrupted (it may have been hashed with another algorithm than the current one)
+	computed, err := hashutil.ComputeLike(hash, data)
+	if err != nil {
+		return fmt.Errorf("invalid blob ref %s: %w", hash, err)
+	}
+	if computed != hash {
+		return fmt.Errorf("corrupted blob %s", hash)
+	}
+	blob := &blob.Blob{Hash: hash, Data: data}
+	r.log.Debug("fetched blob", "blob", blob)
+
+	// Save it locally
+	if _, err := r.blobstore.Put(ctx, blob); err != nil {
+		return err
+	}
+	appliedMetric.With().Inc()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.BlobsApplied++
 	return nil
 }
 
+// apply applies a remote oplog event
+func (r *Replication) apply(op *oplog.Op) error {
+	r.applying(time.Now())
+	defer r.applying(time.Time{})
+	switch op.Event {
+	case "blob":
+		r.log.Info("new blob from replication", "hash", op.Data)
+		return r.applyBlob(context.TODO(), op.Data)
+	case "kv":
+		return r.applyKvEvent(context.TODO(), op.Data)
+	}
+	return nil
+}
+
+// applyWithRetry applies a remote oplog event, a failed event is retried with a backoff, false is returned if it still
+// fails after `maxApplyAttempts` attempts
+func (r *Replication) applyWithRetry(op *oplog.Op) bool {
+	r.applyBackoff.Reset()
+	for attempt := 1; ; attempt++ {
+		err := r.apply(op)
+		if err == nil {
+			return true
+		}
+		r.log.Error("failed to apply event", "event", op.Event, "data", op.Data, "err", err, "attempt", attempt)
+		r.recordError("apply", err)
+		if attempt >= maxApplyAttempts {
+			return false
+		}
+		time.Sleep(r.applyBackoff.Delay())
+	}
+}
+
+// listen streams the remote oplog events until the connection is lost, and returns the delay before reconnecting (the
+// backoff is only reset once connected, so the delay grows with each consecutive failure)
+func (r *Replication) listen(filters url.Values, ops chan<- *oplog.Op) (time.Duration, error) {
+	r.log.Debug("listen to remote oplog", "last_event_id", r.getLastEventID())
+	err := r.remoteOplog.Notify(context.TODO(), r.getLastEventID(), filters, ops, func() {
+		r.backoff.Reset()
+		r.setConnected(true)
+	})
+	r.setConnected(false)
+	if err != nil {
+		r.recordError("oplog", err)
+		r.log.Error("remote oplog SSE error", "err", err, "attempt", r.backoff.Attempt())
+		return r.backoff.Delay(), err
+	}
+	return 0, nil
+}
+
 func (r *Replication) init() error {
-	r.log.Debug("initial sync")
 	r.backoff.Reset()
-	if err := r.sync(); err != nil {
-		return err
+	// Only sync everything if the replication cannot resume from the last applied event
+	if r.getLastEventID() == "" {
+		r.log.Debug("initial sync")
+		if err := r.sync(); err != nil {
+			return err
+		}
+	} else {
+		r.log.Info("resuming replication", "last_event_id", r.getLastEventID())
 	}
 	var resync bool
 
+	// The selective replication only needs the kv updates (the blobs are pulled from the kv entries)
+	var filters url.Values
+	if r.conf.Selective() {
+		filters = url.Values{"types": []string{"kv"}}
+	}
+
 	ops := make(chan *oplog.Op)
 
 	// This should run forever (can't disable replication while BlobStash is already running)
@@ -98,45 +413,40 @@ func (r *Replication) init() error {
 			if resync {
 				r.log.Debug("trying to resync")
 				if err := r.sync(); err != nil {
-					r.log.Error("failed to sync", "err", err, "attempt", r.backoff.attempt)
+					r.log.Error("failed to sync", "err", err, "attempt", r.backoff.Attempt())
 					time.Sleep(r.backoff.Delay())
 					continue
 				}
-				r.backoff.Reset()
 				r.log.Debug("sync successful")
 				resync = false
 			}
 
-			r.log.Debug("listen to remote oplog")
-			if err := r.remoteOplog.Notify(context.TODO(), ops, nil); err != nil {
-				r.log.Error("remote oplog SSE error", "err", err, "attempt", r.backoff.attempt)
-				resync = true
-				time.Sleep(r.backoff.Delay())
+			if delay, err := r.listen(filters, ops); err != nil {
+				// The events missed in the meantime are replayed, unless the remote oplog does not support IDs
+				resync = r.getLastEventID() == ""
+				time.Sleep(delay)
 			}
-			r.backoff.Reset()
 		}
 	}()
 
 	go func() {
 		for op := range ops {
-			if op.Event == "blob" {
-				hash := op.Data
-				r.log.Info("new blob from replication", "hash", hash)
-
-				// Fetch the blob from the remote BlobStash instance
-				data, err := r.remoteOplog.GetBlob(context.TODO(), hash)
-				if err != nil {
-					panic(err)
-				}
-
-				// Ensure the blob is not corrupted
-				blob := &blob.Blob{Hash: hash, Data: data}
-				r.log.Debug("fetched blob", "blob", blob)
+			if op.Event == "resync" {
+				// The remote cannot replay the events since the last applied one
+				r.log.Info("resync requested by the remote oplog")
+				r.resync()
+			} else if !r.applyWithRetry(op) {
+				// Catch up with a sync instead of skipping the event (the event ID is only saved once the sync
+				// completes)
+				r.resync()
+			}
 
-				// Save it locally
-				if r.blobstore.Put(context.Background(), blob); err != nil {
-					panic(err)
-				}
+			r.mu.Lock()
+			r.status.LastEventAt = time.Now().Format(time.RFC3339)
+			r.mu.Unlock()
+			if err := r.setLastEventID(op.ID); err != nil {
+				r.log.Error("failed to save the last event ID", "id", op.ID, "err", err)
+				r.recordError("apply", err)
 			}
 		}
 		r.log.Debug("done listening the remote oplog")
@@ -0,0 +1,173 @@
+package replication
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/client/oplog"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestApplyStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_replication_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	bs, err := blobstore.New(logger, true, dir, &config.Config{DataDir: dir, StorageEngine: blobstore.DirEngine},
+		hub.New(logger, true))
+	if err != nil {
+		panic(err)
+	}
+	defer bs.Close()
+
+	data := []byte("hello")
+	hash := hashutil.Compute(data)
+	corrupted := hashutil.Compute([]byte("corrupted"))
+	// Hashed with another algorithm than the current one
+	sha256Data := []byte("hello sha256")
+	sha256Hash := hashutil.ComputeWith(hashutil.SHA256, sha256Data)
+	// Only available after a few attempts
+	flakyData := []byte("flaky")
+	flakyHash := hashutil.Compute(flakyData)
+	var flakyRequests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/api/blobstore/blob/") {
+		case hash:
+			w.Write(data)
+		case sha256Hash:
+			w.Write(sha256Data)
+		case flakyHash:
+			if atomic.AddInt32(&flakyRequests, 1) < 3 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write(flakyData)
+		case corrupted:
+			w.Write([]byte("nope"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	conf := &config.ReplicateFrom{URL: srv.URL}
+	rep := &Replication{
+		conf:        conf,
+		blobstore:   bs,
+		log:         logger,
+		remoteOplog: oplog.New(clientutil.NewClientUtil(srv.URL)),
+		backoff:     &Backoff{delay: time.Millisecond, maxDelay: time.Millisecond, factor: 1},
+		status:      &Status{URL: conf.URL},
+	}
+	rep.backoff.Reset()
+
+	for _, h := range []string{hash, sha256Hash} {
+		if err := rep.apply(&oplog.Op{Event: "blob", Data: h}); err != nil {
+			panic(err)
+		}
+		if ok, err := bs.Stat(context.Background(), h); err != nil || !ok {
+			t.Errorf("blob %s should have been replicated (%v)", h, err)
+		}
+	}
+	for _, h := range []string{corrupted, hashutil.Compute([]byte("missing"))} {
+		err := rep.apply(&oplog.Op{Event: "blob", Data: h})
+		if err == nil {
+			t.Errorf("applying %s should fail", h)
+			continue
+		}
+		rep.recordError("apply", err)
+	}
+	if ok, _ := bs.Stat(context.Background(), corrupted); ok {
+		t.Errorf("corrupted blob should not be saved")
+	}
+
+	status := rep.Status()
+	if status.BlobsApplied != 2 || status.Errors != 2 || status.LastErrorStage != "apply" || status.LastError == "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if status.Connected || status.Lag != 0 || status.BackoffAttempt != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	rep.setConnected(true)
+	rep.backoff.Delay()
+	if status := rep.Status(); !status.Connected || status.ConnectedSince == "" || status.BackoffAttempt != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// A failed event is retried before falling back to a sync
+	rep.applyBackoff = &Backoff{delay: time.Millisecond, maxDelay: time.Millisecond, factor: 1}
+	if !rep.applyWithRetry(&oplog.Op{Event: "blob", Data: flakyHash}) {
+		t.Errorf("the flaky blob should have been applied after a few attempts")
+	}
+	if n := atomic.LoadInt32(&flakyRequests); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+	if rep.applyWithRetry(&oplog.Op{Event: "blob", Data: corrupted}) {
+		t.Errorf("the corrupted blob should not be applied")
+	}
+	if status := rep.Status(); status.BlobsApplied != 3 || status.Errors != 4+maxApplyAttempts {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestListenBackoff(t *testing.T) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	// The remote oplog is unavailable twice, then the stream is closed right after connecting
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	conf := &config.ReplicateFrom{URL: srv.URL}
+	rep := &Replication{
+		conf:        conf,
+		log:         logger,
+		remoteOplog: oplog.New(clientutil.NewClientUtil(srv.URL)),
+		backoff:     &Backoff{delay: time.Millisecond, maxDelay: time.Second, factor: 2},
+		status:      &Status{URL: conf.URL},
+	}
+	rep.backoff.Reset()
+	ops := make(chan *oplog.Op)
+
+	first, err := rep.listen(nil, ops)
+	if err == nil {
+		t.Fatalf("listen should fail")
+	}
+	second, err := rep.listen(nil, ops)
+	if err == nil {
+		t.Fatalf("listen should fail")
+	}
+	if second <= first {
+		t.Errorf("the delay should grow after two failures in a row (%s then %s)", first, second)
+	}
+	if status := rep.Status(); status.BackoffAttempt != 2 {
+		t.Errorf("expected backoff attempt 2, got %+v", status)
+	}
+
+	// The backoff is reset once connected
+	if delay, _ := rep.listen(nil, ops); delay != first {
+		t.Errorf("the delay should be reset once connected, got %s", delay)
+	}
+}
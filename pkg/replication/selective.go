@@ -0,0 +1,282 @@
+package replication // import "a4.io/blobstash/pkg/replication"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/response"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/docstore"
+	"a4.io/blobstash/pkg/filetree"
+	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/gitserver"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Kind of data stored in a kv entry
+const (
+	kindKv         = "kv"
+	kindFS         = "fs"
+	kindCollection = "collection"
+	kindGit        = "git"
+)
+
+var fsKeyPrefix = strings.TrimSuffix(filetree.FSKeyFmt, "%s")
+
+// classify returns the kind of data stored in the kv entry, and the name of the FS, collection or git namespace (the
+// key itself for the other entries)
+func classify(key string) (string, string) {
+	switch {
+	case strings.HasPrefix(key, fsKeyPrefix):
+		return kindFS, strings.TrimPrefix(key, fsKeyPrefix)
+	case strings.HasPrefix(key, "docstore:"):
+		if parts := strings.SplitN(key, ":", 3); len(parts) == 3 {
+			return kindCollection, parts[1]
+		}
+	case strings.HasPrefix(key, "_git:"):
+		if parts := strings.SplitN(key, ":", 3); len(parts) == 3 {
+			return kindGit, parts[1]
+		}
+	}
+	return kindKv, key
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// rulesMatch returns true if the kv entry matches one of the rules
+func rulesMatch(rules *config.ReplicationRules, key string) bool {
+	kind, name := classify(key)
+	switch kind {
+	case kindFS:
+		return contains(rules.FS, name)
+	case kindCollection:
+		return contains(rules.Collections, name)
+	case kindGit:
+		return contains(rules.GitNamespaces, name)
+	}
+	for _, prefix := range rules.KvPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// selected returns true if the kv entry must be replicated
+func selected(conf *config.ReplicateFrom, key string) bool {
+	if conf.Exclude != nil && rulesMatch(conf.Exclude, key) {
+		return false
+	}
+	return conf.Include == nil || rulesMatch(conf.Include, key)
+}
+
+// scanPrefixes returns the prefixes of the remote keys to scan during a selective sync
+func scanPrefixes(conf *config.ReplicateFrom) []string {
+	if conf.Include == nil {
+		return []string{""}
+	}
+	out := []string{}
+	for _, name := range conf.Include.FS {
+		out = append(out, fsKeyPrefix+name)
+	}
+	for _, name := range conf.Include.Collections {
+		out = append(out, "docstore:"+name+":")
+	}
+	for _, name := range conf.Include.GitNamespaces {
+		out = append(out, "_git:"+name+":")
+	}
+	return append(out, conf.Include.KvPrefixes...)
+}
+
+// SelectiveStats holds the stats of a selective sync
+type SelectiveStats struct {
+	KvEntries int `json:"kv_entries"`
+	Blobs     int `json:"blobs"`
+}
+
+// selectiveSync replicates the selected kv entries (their latest version) and the blobs reachable from them
+func (r *Replication) selectiveSync(ctx context.Context) (*SelectiveStats, error) {
+	stats := &SelectiveStats{}
+	for _, prefix := range scanPrefixes(r.conf) {
+		cursor := prefix
+		for {
+			kvs, next, err := r.remoteKvStore.KeysFrom(ctx, cursor, 100)
+			if err != nil {
+				return stats, err
+			}
+			for _, rkv := range kvs {
+				if !strings.HasPrefix(rkv.Key, prefix) {
+					next = ""
+					break
+				}
+				if !selected(r.conf, rkv.Key) {
+					continue
+				}
+				if err := r.pullKv(ctx, toVkv(rkv), stats); err != nil {
+					return stats, err
+				}
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+	return stats, nil
+}
+
+func toVkv(rkv *response.KeyValue) *vkv.KeyValue {
+	kv := &vkv.KeyValue{
+		Key:       rkv.Key,
+		Version:   int64(rkv.Version),
+		Data:      rkv.Data,
+		TTL:       rkv.TTL,
+		ExpiresAt: rkv.ExpiresAt,
+	}
+	if rkv.Hash != "" {
+		kv.SetHexHash(rkv.Hash)
+	}
+	return kv
+}
+
+// applyKvEvent replicates the kv entry of a remote oplog "kv" event if it's selected
+func (r *Replication) applyKvEvent(ctx context.Context, data string) error {
+	evt := &struct {
+		Key     string `json:"key"`
+		Version int64  `json:"version"`
+	}{}
+	if err := json.Unmarshal([]byte(data), evt); err != nil {
+		return err
+	}
+	if !selected(r.conf, evt.Key) {
+		return nil
+	}
+	rkv, err := r.remoteKvStore.Get(ctx, evt.Key, int(evt.Version))
+	if err != nil {
+		return fmt.Errorf("failed to fetch key %q: %w", evt.Key, err)
+	}
+	stats := &SelectiveStats{}
+	if err := r.pullKv(ctx, toVkv(rkv), stats); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.status.KvEntriesApplied += int64(stats.KvEntries)
+	r.status.BlobsApplied += int64(stats.Blobs)
+	r.mu.Unlock()
+	r.log.Info("kv entry replicated", "key", evt.Key, "version", evt.Version, "blobs", stats.Blobs)
+	return nil
+}
+
+// pullKv fetches the blobs referenced by the kv entry (the same ones the GC marks) and then saves the entry in the
+// local kvstore
+func (r *Replication) pullKv(ctx context.Context, kv *vkv.KeyValue, stats *SelectiveStats) error {
+	// Skip the versions already applied
+	metaBlob, err := r.kvstore.GetMetaBlob(ctx, kv.Key, kv.Version)
+	if err != nil {
+		return err
+	}
+	if metaBlob != "" {
+		return nil
+	}
+
+	refs := []string{}
+	if ref := kv.HexHash(); ref != "" {
+		refs = append(refs, ref)
+	}
+	blobs, nodes, err := docstore.Pointers(kv)
+	if err != nil {
+		return err
+	}
+	refs = append(refs, blobs...)
+	refs = append(refs, nodes...)
+	gitBlobs, err := gitserver.ObjectBlobs(kv)
+	if err != nil {
+		return err
+	}
+	refs = append(refs, gitBlobs...)
+	for _, ref := range refs {
+		if err := r.pull(ctx, ref, stats); err != nil {
+			return err
+		}
+	}
+
+	// The TTL is recomputed from the expiration date, so the replicated key expires at the same time
+	ttl := kv.TTL
+	if kv.ExpiresAt > 0 {
+		ttl = (kv.ExpiresAt - time.Now().UnixNano() + int64(time.Second) - 1) / int64(time.Second)
+		if ttl < 1 {
+			// Already expired
+			return nil
+		}
+	}
+
+	if _, err := r.kvstore.PutWithTTL(ctx, kv.Key, kv.HexHash(), kv.Data, kv.Version, ttl, nil); err != nil {
+		return err
+	}
+	stats.KvEntries++
+	return nil
+}
+
+// pull fetches the blob, and the whole tree if it's a filetree node, the blobs are saved after their children so a
+// node stored locally implies its tree is complete
+func (r *Replication) pull(ctx context.Context, hash string, stats *SelectiveStats) error {
+	exists, err := r.blobstore.Stat(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	data, err := r.remoteOplog.GetBlob(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("failed to fetch blob %s: %w", hash, err)
+	}
+	// The blob may have been hashed with another algorithm than the current one
+	computed, err := hashutil.ComputeLike(hash, data)
+	if err != nil {
+		return fmt.Errorf("invalid blob ref %s: %w", hash, err)
+	}
+	if computed != hash {
+		return fmt.Errorf("corrupted blob %s", hash)
+	}
+
+	if _, isNode := node.IsNodeBlob(data); isNode {
+		n, err := node.NewNodeFromBlob(hash, data)
+		if err != nil {
+			return err
+		}
+		if n.IsFile() {
+			for _, iv := range n.FileRefs() {
+				if err := r.pull(ctx, iv.Value, stats); err != nil {
+					return err
+				}
+			}
+		} else {
+			for _, ref := range n.Refs {
+				if err := r.pull(ctx, ref.(string), stats); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if _, err := r.blobstore.Put(ctx, &blob.Blob{Hash: hash, Data: data}); err != nil {
+		return err
+	}
+	stats.Blobs++
+	appliedMetric.With().Inc()
+	return nil
+}
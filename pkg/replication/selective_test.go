@@ -0,0 +1,48 @@
+package replication
+
+import (
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestSelected(t *testing.T) {
+	conf := &config.ReplicateFrom{
+		Include: &config.ReplicationRules{
+			FS:            []string{"docs"},
+			Collections:   []string{"notes"},
+			KvPrefixes:    []string{"app:"},
+			GitNamespaces: []string{"tsileo"},
+		},
+		Exclude: &config.ReplicationRules{
+			KvPrefixes: []string{"app:cache"},
+		},
+	}
+	for key, expected := range map[string]bool{
+		"_filetree:fs:docs":                         true,
+		"_filetree:fs:media":                        false,
+		"docstore:notes:5d3b4a6c1f0000000000":       true,
+		"docstore:todos:5d3b4a6c1f0000000000":       false,
+		"_git:tsileo:blobstash!r!refs~heads~master": true,
+		"_git:other:repo!r!refs~heads~master":       false,
+		"app:conf":                                  true,
+		"app:cache:1":                               false,
+		"other":                                     false,
+	} {
+		if selected(conf, key) != expected {
+			t.Errorf("%q selected should be %v", key, expected)
+		}
+	}
+	if prefixes := scanPrefixes(conf); len(prefixes) != 4 || prefixes[0] != "_filetree:fs:docs" {
+		t.Errorf("unexpected scan prefixes %q", prefixes)
+	}
+
+	// Exclude only
+	conf = &config.ReplicateFrom{Exclude: &config.ReplicationRules{FS: []string{"media"}}}
+	if !conf.Selective() || selected(conf, "_filetree:fs:media") || !selected(conf, "docstore:notes:1") {
+		t.Errorf("only the media FS should be excluded")
+	}
+	if prefixes := scanPrefixes(conf); len(prefixes) != 1 || prefixes[0] != "" {
+		t.Errorf("all the keys should be scanned, got %q", prefixes)
+	}
+}
@@ -18,6 +18,9 @@ import (
 	"a4.io/blobstash/pkg/auth"
 	"a4.io/blobstash/pkg/blobstore"
 	blobStoreAPI "a4.io/blobstash/pkg/blobstore/api"
+	"a4.io/blobstash/pkg/blobstore/audit"
+	blobStoreGC "a4.io/blobstash/pkg/blobstore/gc"
+	"a4.io/blobstash/pkg/blobstore/scrub"
 	"a4.io/blobstash/pkg/capabilities"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/docstore"
@@ -25,18 +28,22 @@ import (
 	"a4.io/blobstash/pkg/expvarserver"
 	"a4.io/blobstash/pkg/filetree"
 	"a4.io/blobstash/pkg/gitserver"
+	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/kvstore"
 	kvStoreAPI "a4.io/blobstash/pkg/kvstore/api"
 	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/metrics"
 	"a4.io/blobstash/pkg/middleware"
 	"a4.io/blobstash/pkg/oplog"
+	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/replication"
 	"a4.io/blobstash/pkg/session"
 	"a4.io/blobstash/pkg/stash"
 	stashAPI "a4.io/blobstash/pkg/stash/api"
 	synctable "a4.io/blobstash/pkg/sync"
+	"a4.io/blobstash/pkg/usage"
 	"a4.io/blobstash/pkg/webauthn"
 	gcontext "github.com/gorilla/context"
 
@@ -67,7 +74,10 @@ type Server struct {
 	log       log.Logger
 	closeFunc func() error
 
-	blobstore *blobstore.BlobStore
+	blobstore   *blobstore.BlobStore
+	auditor     *audit.Auditor
+	replication *replication.Replication
+	push        *replication.Push
 
 	hostWhitelist map[string]bool
 	shutdown      chan struct{}
@@ -84,6 +94,11 @@ func New(conf *config.Config) (*Server, error) {
 	logger.SetHandler(log.LvlFilterHandler(conf.LogLvl(), log.StreamHandler(os.Stdout, log.LogfmtFormat())))
 	var wg sync.WaitGroup
 
+	// Select the hash algorithm for the new blobs
+	if err := hashutil.SetAlgorithm(conf.HashAlgorithm); err != nil {
+		return nil, err
+	}
+
 	sess := session.New(conf)
 
 	s := &Server{
@@ -96,8 +111,14 @@ func New(conf *config.Config) (*Server, error) {
 	}
 	authFunc, basicAuth := middleware.NewBasicAuth(conf)
 	s.router.Handle("/api/ping", basicAuth(http.HandlerFunc(pingHandler)))
+	s.router.Handle("/metrics", basicAuth(metrics.Handler()))
+	s.router.Use(httputil.MetricsMiddleware)
 
 	hub := hub.New(logger.New("app", "hub"), true)
+	if err := hub.EnableAsync(filepath.Join(conf.VarDir(), "hub")); err != nil {
+		return nil, fmt.Errorf("failed to initialize the hub queues: %v", err)
+	}
+	hub.Register(s.router.PathPrefix("/api/hub").Subrouter(), basicAuth)
 	// Load the blobstore
 	rootBlobstore, err := blobstore.New(logger.New("app", "blobstore"), true, conf.VarDir(), conf, hub)
 	if err != nil {
@@ -111,6 +132,24 @@ func New(conf *config.Config) (*Server, error) {
 	}
 	s.blobstore = rootBlobstore
 
+	// Setup the usage accounting (and the quotas)
+	usg, err := usage.New(logger.New("app", "usage"), conf, filepath.Join(conf.VarDir(), "usage"), hub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize the usage accounting: %v", err)
+	}
+	rootBlobstore.SetUsage(usg)
+	usg.Register(s.router.PathPrefix("/api/usage").Subrouter(), basicAuth)
+
+	// Refresh the gauges that are only computed on demand
+	metrics.OnCollect(func() {
+		if _, err := rootBlobstore.S3Stats(); err != nil && err != blobstore.ErrRemoteNotAvailable {
+			logger.Error("failed to collect the S3 stats", "err", err)
+		}
+		if _, err := hub.Status(); err != nil {
+			logger.Error("failed to collect the hub status", "err", err)
+		}
+	})
+
 	s.router.Handle("/api/status", basicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		stats, err := s.blobstore.S3Stats()
 		if err != nil {
@@ -128,12 +167,24 @@ func New(conf *config.Config) (*Server, error) {
 		bs["blobs_size_human"] = humanize.Bytes(uint64(bstats.BlobsSize))
 		bs["blobs_blobsfile_volumes"] = bstats.BlobsFilesCount
 
-		// return newRev.Version, nil
-		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+		out := map[string]interface{}{
 			"s3":         stats,
 			"started_at": start.Format(time.RFC3339),
 			"blobstore":  bs,
-		})
+		}
+		if report := s.auditor.Report(); report != nil {
+			out["s3_audit"] = map[string]interface{}{
+				"last_audit_at":   report.FinishedAt,
+				"last_success_at": report.LastSuccessAt,
+				"consistent":      report.Consistent,
+			}
+		}
+		if s.push != nil {
+			out["replicate_to"] = s.push.Status()
+		}
+
+		// return newRev.Version, nil
+		httputil.MarshalAndWrite(r, w, out)
 
 	})))
 
@@ -143,15 +194,16 @@ func New(conf *config.Config) (*Server, error) {
 		return nil, fmt.Errorf("failed to initialize blobstore meta: %v", err)
 	}
 
+	var oplg *oplog.Oplog
 	if conf.Replication != nil && conf.Replication.EnableOplog {
-		oplg, err := oplog.New(logger.New("app", "oplog"), conf, hub)
+		oplg, err = oplog.New(logger.New("app", "oplog"), conf, hub)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize oplog: %v", err)
 		}
 		oplg.Register(s.router.PathPrefix("/_oplog").Subrouter(), basicAuth)
 	}
 	// Load the kvstore
-	rootKvstore, err := kvstore.New(logger.New("app", "kvstore"), conf.VarDir(), rootBlobstore, metaHandler)
+	rootKvstore, err := kvstore.New(logger.New("app", "kvstore"), conf.VarDir(), rootBlobstore, metaHandler, hub)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize kvstore app: %v", err)
 	}
@@ -171,27 +223,67 @@ func New(conf *config.Config) (*Server, error) {
 
 	kvStoreAPI.New(kvstore).Register(s.router.PathPrefix("/api/kvstore").Subrouter(), basicAuth)
 	// FIXME(tsileo): handle middleware in the `Register` interface
-	blobStoreAPI.New(blobstore).Register(s.router.PathPrefix("/api/blobstore").Subrouter(), basicAuth)
+	blobStoreRouter := s.router.PathPrefix("/api/blobstore").Subrouter()
+	blobStoreAPI.New(blobstore).Register(blobStoreRouter, basicAuth)
 
 	// Load the synctable
 	// XXX(tsileo): sync should always get the root data context
-	synctable := synctable.New(logger.New("app", "sync"), conf, rootBlobstore)
+	synctable, err := synctable.New(logger.New("app", "sync"), conf, rootBlobstore, hub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize sync app: %v", err)
+	}
 	synctable.Register(s.router.PathPrefix("/api/sync").Subrouter(), basicAuth)
 
 	// Enable replication if set in the config
 	if conf.ReplicateFrom != nil {
-		if _, err := replication.New(logger.New("app", "replication"), conf, rootBlobstore, synctable, &wg); err != nil {
+		if s.replication, err = replication.New(logger.New("app", "replication"), conf, rootBlobstore, rootKvstore, synctable, &wg); err != nil {
 			return nil, fmt.Errorf("failed to initialize replication app: %v", err)
 		}
 	}
+	if len(conf.ReplicateTo) > 0 {
+		if s.push, err = replication.NewPush(logger.New("app", "replicate_to"), conf, hub, rootBlobstore, synctable); err != nil {
+			return nil, fmt.Errorf("failed to initialize push replication: %v", err)
+		}
+	}
+	s.router.Handle("/api/replication", basicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		out := map[string]interface{}{
+			"replicate_from": nil,
+			"replicate_to":   []*replication.PeerStatus{},
+		}
+		if s.replication != nil {
+			out["replicate_from"] = s.replication.Status()
+		}
+		if s.push != nil {
+			out["replicate_to"] = s.push.Status()
+		}
+		httputil.MarshalAndWrite(r, w, out)
+	})))
 
-	filetree, err := filetree.New(logger.New("app", "filetree"), conf, authFunc, kvstore, blobstore, hub)
+	filetree, err := filetree.New(logger.New("app", "filetree"), conf, authFunc, kvstore, blobstore, hub, usg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize filetree app: %v", err)
 	}
 	filetree.Register(s.router.PathPrefix("/api/filetree").Subrouter(), s.router, basicAuth)
 
-	docstore, err := docstore.New(logger.New("app", "docstore"), conf, kvstore, blobstore, filetree)
+	// Setup the GC for the root blobstore
+	blobStoreGC.New(logger.New("app", "gc"), rootBlobstore, cstash, filetree).Register(blobStoreRouter, basicAuth)
+
+	// Setup the background scrubber for the root blobstore
+	scrubber, err := scrub.New(logger.New("app", "scrub"), conf, rootBlobstore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize scrubber: %v", err)
+	}
+	scrubber.Register(blobStoreRouter, basicAuth)
+
+	// Setup the S3 consistency audit
+	s.auditor, err = audit.New(logger.New("app", "s3_audit"), conf, rootBlobstore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize S3 audit: %v", err)
+	}
+	s.auditor.Register(blobStoreRouter, basicAuth)
+	blobStoreRouter.Handle("/_s3_flush", basicAuth(http.HandlerFunc(s.s3FlushHandler())))
+
+	docstore, err := docstore.New(logger.New("app", "docstore"), conf, kvstore, blobstore, filetree, hub, usg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize docstore app: %v", err)
 	}
@@ -208,7 +300,7 @@ func New(conf *config.Config) (*Server, error) {
 		if err := func() error {
 			L := lua.NewState()
 			defer L.Close()
-			docstoreLua.Setup(L, docstore)
+			docstoreLua.Setup(context.Background(), L, docstore)
 			dat, err := ioutil.ReadFile("blobstash.lua")
 			if err != nil {
 				return err
@@ -244,6 +336,20 @@ func New(conf *config.Config) (*Server, error) {
 		logger.Debug("waiting for the waitgroup...")
 		wg.Wait()
 		logger.Debug("waitgroup done")
+		if err := scrubber.Close(); err != nil {
+			return err
+		}
+		logger.Debug("scrubber closed")
+		if err := s.auditor.Close(); err != nil {
+			return err
+		}
+		logger.Debug("auditor closed")
+		if s.push != nil {
+			if err := s.push.Close(); err != nil {
+				return err
+			}
+			logger.Debug("push replication closed")
+		}
 		if err := filetree.Close(); err != nil {
 			return err
 		}
@@ -264,6 +370,24 @@ func New(conf *config.Config) (*Server, error) {
 			return err
 		}
 		logger.Debug("root kv closed")
+		if err := synctable.Close(); err != nil {
+			return err
+		}
+		logger.Debug("sync closed")
+		if err := hub.Close(); err != nil {
+			return err
+		}
+		logger.Debug("hub closed")
+		if oplg != nil {
+			if err := oplg.Close(); err != nil {
+				return err
+			}
+			logger.Debug("oplog closed")
+		}
+		if err := usg.Close(); err != nil {
+			return err
+		}
+		logger.Debug("usage closed")
 		if err := rootBlobstore.Close(); err != nil {
 			return err
 		}
@@ -273,6 +397,33 @@ func New(conf *config.Config) (*Server, error) {
 	return s, nil
 }
 
+// s3FlushHandler uploads the S3 upload queues now, even outside of the upload windows
+func (s *Server) s3FlushHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Blob),
+			perms.Resource(perms.BlobStore, perms.Blob),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		if !s.blobstore.ReplicationEnabled() {
+			httputil.WriteJSONError(w, http.StatusNotFound, blobstore.ErrRemoteNotAvailable.Error())
+			return
+		}
+		for _, s3back := range s.blobstore.S3Backends() {
+			s3back.Flush()
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
 func (s *Server) Shutdown() {
 	s.shutdown <- struct{}{}
 	// TODO(tsileo) shotdown sync repl too
@@ -290,9 +441,20 @@ func (s *Server) Bootstrap() error {
 		s.log.Info("Scan done")
 	}
 	if s.conf.S3ScanMode || s.conf.S3RestoreMode {
-		if err := s.blobstore.S3Backend().Reindex(s.conf.S3RestoreMode); err != nil {
-			return err
+		// The blobs restored from the first target are skipped by the next ones
+		for _, s3back := range s.blobstore.S3Backends() {
+			if err := s3back.Reindex(s.conf.S3RestoreMode); err != nil {
+				return fmt.Errorf("failed to reindex target %q: %w", s3back.Name(), err)
+			}
+		}
+	}
+	if s.conf.S3AuditMode {
+		s.log.Info("Starting S3 audit")
+		report, err := s.auditor.Audit(s.conf.S3AuditRequeueMode, audit.DefaultSampleSize)
+		if err != nil {
+			return fmt.Errorf("failed to audit: %w", err)
 		}
+		s.log.Info("S3 audit done", "consistent", report.Consistent)
 	}
 
 	return nil
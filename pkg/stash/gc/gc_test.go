@@ -48,7 +48,7 @@ func TestDataContextMerge(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	kvsRoot, err := kstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	kvsRoot, err := kstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler, nil)
 	if err != nil {
 		panic(err)
 	}
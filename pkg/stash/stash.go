@@ -3,23 +3,30 @@ package stash // import "a4.io/blobstash/pkg/stash"
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	log "github.com/inconshreveable/log15"
 
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/kvstore"
 	"a4.io/blobstash/pkg/meta"
 	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/usage"
 	"a4.io/blobstash/pkg/vkv"
 )
 
+// docKeyPrefix is the prefix of the docstore keys (`docstore:<collection>:<id>`)
+const docKeyPrefix = "docstore:"
+
 type dataContext struct {
 	bs       store.BlobStore
 	kvs      store.KvStore
@@ -28,6 +35,7 @@ type dataContext struct {
 	kvsProxy store.KvStore
 	hub      *hub.Hub
 	meta     *meta.Meta
+	usage    *usage.Usage
 	log      log.Logger
 	dir      string
 	root     bool
@@ -107,20 +115,68 @@ func (dc *dataContext) Destroy() error {
 	return os.RemoveAll(dc.dir)
 }
 
+// releaseUsage credits back the usage of the blobs and the documents that were not moved to the root data context
+func (dc *dataContext) releaseUsage(ctx context.Context, name string) error {
+	if dc.usage == nil {
+		return nil
+	}
+	rootBs := dc.bsProxy.(*store.BlobStoreProxy).ReadSrc
+	rootKvs := dc.kvsProxy.(*store.KvStoreProxy).ReadSrc
+
+	blobs, _, err := dc.bs.Enumerate(ctx, "", "\xff", 0)
+	if err != nil {
+		return err
+	}
+	hashes := []string{}
+	for _, blobRef := range blobs {
+		exists, err := rootBs.Stat(ctx, blobRef.Hash)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			hashes = append(hashes, blobRef.Hash)
+		}
+	}
+
+	kvs, _, err := dc.kvs.Keys(ctx, docKeyPrefix, docKeyPrefix+"\xff", 0)
+	if err != nil {
+		return err
+	}
+	docs := []string{}
+	for _, kv := range kvs {
+		_, err := rootKvs.Get(ctx, kv.Key, -1)
+		switch err {
+		case nil:
+		case vkv.ErrNotFound:
+			docs = append(docs, strings.TrimPrefix(kv.Key, docKeyPrefix))
+		default:
+			return err
+		}
+	}
+
+	return dc.usage.ReleaseNamespace(name, hashes, docs)
+}
+
 type Stash struct {
 	rootDataContext *dataContext
 	contexes        map[string]*dataContext
 	path            string
+	// The data contexts use the same storage engine as the root blobstore
+	engine string
 	sync.Mutex
 }
 
-func (s *Stash) destroy(dataContext *dataContext, name string) error {
+func (s *Stash) destroy(ctx context.Context, dataContext *dataContext, name string) error {
 	if dataContext.root {
 		return fmt.Errorf("cannot destroy the root data context")
 	}
 
 	delete(s.contexes, name)
 
+	if err := dataContext.releaseUsage(ctx, name); err != nil {
+		return err
+	}
+
 	if err := dataContext.Destroy(); err != nil {
 		return err
 	}
@@ -132,6 +188,7 @@ func New(dir string, m *meta.Meta, bs *blobstore.BlobStore, kvs *kvstore.KvStore
 	s := &Stash{
 		contexes: map[string]*dataContext{},
 		path:     dir,
+		engine:   bs.StorageEngine(),
 		rootDataContext: &dataContext{
 			bs:       bs,
 			kvs:      kvs,
@@ -179,15 +236,21 @@ func (s *Stash) NewDataContext(name string) (*dataContext, error) {
 		return nil, err
 	}
 	// XXX(tsileo): use a dumb single file cache instead of the blobstore?
-	bsDst, err := blobstore.New(l.New("app", "blobstore"), false, path, nil, h)
+	bsDst, err := blobstore.New(l.New("app", "blobstore"), false, path, &config.Config{StorageEngine: s.engine}, h)
 	if err != nil {
 		return nil, err
 	}
+	var usg *usage.Usage
+	if rootBs, ok := s.rootDataContext.bs.(*blobstore.BlobStore); ok {
+		usg = rootBs.Usage()
+		bsDst.SetUsage(usg)
+	}
 	bs := &store.BlobStoreProxy{
 		BlobStore: bsDst,
 		ReadSrc:   s.rootDataContext.bs,
 	}
-	kvsDst, err := kvstore.New(l.New("app", "kvstore"), path, bs, m)
+	// The kv updates are notified to the root hub (along with the namespace) so they reach the oplog
+	kvsDst, err := kvstore.New(l.New("app", "kvstore"), path, bs, m, s.rootDataContext.hub)
 	if err != nil {
 		return nil, err
 	}
@@ -200,6 +263,7 @@ func (s *Stash) NewDataContext(name string) (*dataContext, error) {
 		log:      l,
 		meta:     m,
 		hub:      h,
+		usage:    usg,
 		bs:       bsDst,
 		kvs:      kvsDst,
 		kvsProxy: kvs,
@@ -239,7 +303,7 @@ func (s *Stash) DoAndDestroy(ctx context.Context, name string, do func(context.C
 
 	s.Lock()
 	defer s.Unlock()
-	if err := s.destroy(dc, name); err != nil {
+	if err := s.destroy(ctx, dc, name); err != nil {
 		return err
 	}
 
@@ -258,7 +322,7 @@ func (s *Stash) MergeAndDestroy(ctx context.Context, name string) error {
 		return err
 	}
 
-	if err := s.destroy(dc, name); err != nil {
+	if err := s.destroy(ctx, dc, name); err != nil {
 		return err
 	}
 
@@ -273,7 +337,7 @@ func (s *Stash) Destroy(ctx context.Context, name string) error {
 		return fmt.Errorf("data context not found")
 	}
 
-	if err := s.destroy(dc, name); err != nil {
+	if err := s.destroy(ctx, dc, name); err != nil {
 		return err
 	}
 
@@ -347,6 +411,22 @@ func (bs *BlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
 
 }
 
+func (bs *BlobStore) PutReader(ctx context.Context, hash string, r io.Reader) (bool, error) {
+	dataContext, err := bs.s.dataContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	return dataContext.BlobStoreProxy().PutReader(ctx, hash, r)
+}
+
+func (bs *BlobStore) GetReader(ctx context.Context, hash string) (io.ReadCloser, int, error) {
+	dataContext, err := bs.s.dataContext(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return dataContext.BlobStoreProxy().GetReader(ctx, hash)
+}
+
 func (bs *BlobStore) Stat(ctx context.Context, hash string) (bool, error) {
 	dataContext, err := bs.s.dataContext(ctx)
 	if err != nil {
@@ -364,6 +444,14 @@ func (bs *BlobStore) Enumerate(ctx context.Context, start, end string, limit int
 	return dataContext.BlobStoreProxy().Enumerate(ctx, start, end, limit)
 }
 
+func (bs *BlobStore) EnumerateKind(ctx context.Context, kind, start, end string, limit int) ([]*blob.SizedBlobRef, string, error) {
+	dataContext, err := bs.s.dataContext(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return dataContext.BlobStoreProxy().EnumerateKind(ctx, kind, start, end, limit)
+}
+
 type KvStore struct {
 	s *Stash
 }
@@ -378,6 +466,30 @@ func (kv *KvStore) Put(ctx context.Context, key, ref string, data []byte, versio
 	return dataContext.KvStoreProxy().Put(ctx, key, ref, data, version)
 }
 
+func (kv *KvStore) PutIf(ctx context.Context, key, ref string, data []byte, version int64, cond *vkv.Condition) (*vkv.KeyValue, error) {
+	dataContext, err := kv.s.dataContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dataContext.KvStoreProxy().PutIf(ctx, key, ref, data, version, cond)
+}
+
+func (kv *KvStore) PutWithTTL(ctx context.Context, key, ref string, data []byte, version, ttl int64, cond *vkv.Condition) (*vkv.KeyValue, error) {
+	dataContext, err := kv.s.dataContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dataContext.KvStoreProxy().PutWithTTL(ctx, key, ref, data, version, ttl, cond)
+}
+
+func (kv *KvStore) Batch(ctx context.Context, entries []*vkv.BatchEntry) ([]*vkv.KeyValue, error) {
+	dataContext, err := kv.s.dataContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dataContext.KvStoreProxy().Batch(ctx, entries)
+}
+
 func (kv *KvStore) Get(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
 	dataContext, err := kv.s.dataContext(ctx)
 	if err != nil {
@@ -3,17 +3,22 @@ package stash
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	log "github.com/inconshreveable/log15"
 
 	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/ctxutil"
 	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/kvstore"
 	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/usage"
 )
 
 func makeBlob(data []byte) *blob.Blob {
@@ -46,7 +51,7 @@ func TestDataContextMerge(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	kvsRoot, err := kvstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	kvsRoot, err := kvstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -105,3 +110,79 @@ func TestDataContextMerge(t *testing.T) {
 	}
 
 }
+
+func TestDestroyReleasesUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_stash_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := hub.New(logger.New("app", "hub"), true)
+	metaHandler, err := meta.New(logger.New("app", "meta"), h)
+	if err != nil {
+		panic(err)
+	}
+	bsRoot, err := blobstore.New(logger.New("app", "blobstore"), true, filepath.Join(dir, "root"), nil, h)
+	if err != nil {
+		panic(err)
+	}
+	defer bsRoot.Close()
+	usg, err := usage.New(logger.New("app", "usage"), nil, filepath.Join(dir, "usage"), h)
+	if err != nil {
+		panic(err)
+	}
+	defer usg.Close()
+	bsRoot.SetUsage(usg)
+	kvsRoot, err := kvstore.New(logger.New("app", "kvstore"), filepath.Join(dir, "root"), bsRoot, metaHandler, nil)
+	if err != nil {
+		panic(err)
+	}
+	defer kvsRoot.Close()
+
+	s, err := New(filepath.Join(dir, "stash"), metaHandler, bsRoot, kvsRoot, h, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	tmpDataContext, err := s.NewDataContext("tmp")
+	if err != nil {
+		panic(err)
+	}
+	ctx := ctxutil.WithNamespace(context.Background(), "tmp")
+	for i := 0; i < 3; i++ {
+		if _, err := tmpDataContext.bsProxy.Put(ctx, makeBlob([]byte(fmt.Sprintf("hello%d", i)))); err != nil {
+			panic(err)
+		}
+	}
+	// The namespaced kv updates are notified to the root hub
+	var events []string
+	h.Subscribe(hub.KvUpdate, "test", func(_ context.Context, _ *blob.Blob, data interface{}) error {
+		events = append(events, data.(string))
+		return nil
+	})
+	if _, err := tmpDataContext.kvsProxy.Put(ctx, docKeyPrefix+"col:doc1", "", []byte("doc"), -1); err != nil {
+		panic(err)
+	}
+	if len(events) != 1 || !strings.Contains(events[0], `"ns":"tmp"`) {
+		t.Errorf("expected a kv update event with the namespace, got %v", events)
+	}
+	if err := usg.ReserveDoc(ctx, "col", "doc1"); err != nil {
+		panic(err)
+	}
+
+	if err := s.Destroy(ctx, "tmp"); err != nil {
+		panic(err)
+	}
+
+	report, err := usg.Report()
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range report.Namespaces {
+		if entry.Name == "tmp" && (entry.Blobs != 0 || entry.Bytes != 0 || len(entry.Docs) != 0) {
+			t.Errorf("the usage of the destroyed stash should be credited back, got %+v", entry.Counters)
+		}
+	}
+}
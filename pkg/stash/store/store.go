@@ -3,6 +3,7 @@ package store // import "a4.io/blobstash/pkg/stash/store"
 import (
 	"context"
 	"fmt"
+	"io"
 	"sort"
 	"strconv"
 	"strings"
@@ -80,6 +81,9 @@ type DataContext interface {
 
 type KvStore interface {
 	Put(ctx context.Context, key, ref string, data []byte, version int64) (*vkv.KeyValue, error)
+	PutIf(ctx context.Context, key, ref string, data []byte, version int64, cond *vkv.Condition) (*vkv.KeyValue, error)
+	PutWithTTL(ctx context.Context, key, ref string, data []byte, version, ttl int64, cond *vkv.Condition) (*vkv.KeyValue, error)
+	Batch(ctx context.Context, entries []*vkv.BatchEntry) ([]*vkv.KeyValue, error)
 	Get(ctx context.Context, key string, version int64) (*vkv.KeyValue, error)
 	GetMetaBlob(ctx context.Context, key string, version int64) (string, error)
 	Versions(ctx context.Context, key, start string, limit int) (*vkv.KeyValueVersions, string, error)
@@ -108,6 +112,78 @@ func (p *KvStoreProxy) Put(ctx context.Context, key, ref string, data []byte, ve
 	return p.KvStore.Put(ctx, key, ref, data, version)
 }
 
+// PutIf checks the condition against the latest version from both kv stores
+func (p *KvStoreProxy) PutIf(ctx context.Context, key, ref string, data []byte, version int64, cond *vkv.Condition) (*vkv.KeyValue, error) {
+	return p.PutWithTTL(ctx, key, ref, data, version, 0, cond)
+}
+
+// PutWithTTL checks the condition (if any) against the latest version from both kv stores
+func (p *KvStoreProxy) PutWithTTL(ctx context.Context, key, ref string, data []byte, version, ttl int64, cond *vkv.Condition) (*vkv.KeyValue, error) {
+	if cond == nil {
+		if ttl == 0 {
+			return p.Put(ctx, key, ref, data, version)
+		}
+		return p.KvStore.PutWithTTL(ctx, key, ref, data, version, ttl, nil)
+	}
+	current, err := p.Get(ctx, key, -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		current = nil
+	default:
+		return nil, err
+	}
+	if err := cond.Check(current); err != nil {
+		return nil, err
+	}
+
+	localCond, err := p.localCondition(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return p.KvStore.PutWithTTL(ctx, key, ref, data, version, ttl, localCond)
+}
+
+// localCondition returns a condition ensuring the key did not change in the data context kv store (where the writes
+// go) since it was checked
+func (p *KvStoreProxy) localCondition(ctx context.Context, key string) (*vkv.Condition, error) {
+	lkv, err := p.KvStore.Get(ctx, key, -1)
+	switch err {
+	case nil:
+		return &vkv.Condition{Version: lkv.Version}, nil
+	case vkv.ErrNotFound:
+		return &vkv.Condition{Absent: true}, nil
+	default:
+		return nil, err
+	}
+}
+
+// Batch checks the conditions against the latest versions from both kv stores
+func (p *KvStoreProxy) Batch(ctx context.Context, entries []*vkv.BatchEntry) ([]*vkv.KeyValue, error) {
+	localEntries := []*vkv.BatchEntry{}
+	for _, e := range entries {
+		le := *e
+		if e.Cond != nil {
+			current, err := p.Get(ctx, e.Key, -1)
+			switch err {
+			case nil:
+			case vkv.ErrNotFound:
+				current = nil
+			default:
+				return nil, err
+			}
+			if err := e.Cond.Check(current); err != nil {
+				return nil, fmt.Errorf("key %q: %w", e.Key, err)
+			}
+			if le.Cond, err = p.localCondition(ctx, e.Key); err != nil {
+				return nil, err
+			}
+		}
+		localEntries = append(localEntries, &le)
+	}
+	return p.KvStore.Batch(ctx, localEntries)
+}
+
 func (p *KvStoreProxy) Get(ctx context.Context, key string, version int64) (*vkv.KeyValue, error) {
 	kv, err := p.KvStore.Get(ctx, key, version)
 	switch err {
@@ -301,9 +377,13 @@ func (p *KvStoreProxy) Keys(ctx context.Context, start, end string, limit int) (
 
 type BlobStore interface {
 	Put(ctx context.Context, blob *blob.Blob) (bool, error)
+	PutReader(ctx context.Context, hash string, r io.Reader) (bool, error)
 	Get(ctx context.Context, hash string) ([]byte, error)
+	GetReader(ctx context.Context, hash string) (io.ReadCloser, int, error)
 	Stat(ctx context.Context, hash string) (bool, error)
 	Enumerate(ctx context.Context, start, end string, limit int) ([]*blob.SizedBlobRef, string, error)
+	// EnumerateKind only returns the blobs of the given kind (see `blobstore.Kinds`)
+	EnumerateKind(ctx context.Context, kind, start, end string, limit int) ([]*blob.SizedBlobRef, string, error)
 	Close() error
 }
 
@@ -324,6 +404,18 @@ func (p *BlobStoreProxy) Get(ctx context.Context, hash string) ([]byte, error) {
 	return data, nil
 }
 
+func (p *BlobStoreProxy) GetReader(ctx context.Context, hash string) (io.ReadCloser, int, error) {
+	r, size, err := p.BlobStore.GetReader(ctx, hash)
+	switch err {
+	case nil:
+	case blobsfile.ErrBlobNotFound:
+		return p.ReadSrc.GetReader(ctx, hash)
+	default:
+		return nil, 0, err
+	}
+	return r, size, nil
+}
+
 func (p *BlobStoreProxy) Stat(ctx context.Context, hash string) (bool, error) {
 	exists, err := p.BlobStore.Stat(ctx, hash)
 	if err != nil {
@@ -346,7 +438,22 @@ func (p *BlobStoreProxy) Put(ctx context.Context, blob *blob.Blob) (bool, error)
 	return p.BlobStore.Put(ctx, blob)
 }
 
+func (p *BlobStoreProxy) PutReader(ctx context.Context, hash string, r io.Reader) (bool, error) {
+	existsSrc, err := p.ReadSrc.Stat(ctx, hash)
+	if err != nil {
+		return false, err
+	}
+	if existsSrc {
+		return true, nil
+	}
+	return p.BlobStore.PutReader(ctx, hash, r)
+}
+
 func (p *BlobStoreProxy) Enumerate(ctx context.Context, start, end string, limit int) ([]*blob.SizedBlobRef, string, error) {
+	return p.EnumerateKind(ctx, "", start, end, limit)
+}
+
+func (p *BlobStoreProxy) EnumerateKind(ctx context.Context, kind, start, end string, limit int) ([]*blob.SizedBlobRef, string, error) {
 	// Here, we will need to merge two differents "enumerate results" into one
 	var tmp []*sortHelper
 	var out []*blob.SizedBlobRef
@@ -354,7 +461,7 @@ func (p *BlobStoreProxy) Enumerate(ctx context.Context, start, end string, limit
 	mcursor := parseCursor(start)
 
 	// Fetch the data from the "root" blobstore
-	rootBlobs, _, err := p.ReadSrc.Enumerate(ctx, mcursor.rstart, end, limit)
+	rootBlobs, _, err := p.ReadSrc.EnumerateKind(ctx, kind, mcursor.rstart, end, limit)
 	if err != nil {
 		return nil, "", err
 	}
@@ -364,7 +471,7 @@ func (p *BlobStoreProxy) Enumerate(ctx context.Context, start, end string, limit
 	}
 
 	// Fetch the data from the stash
-	localBlobs, _, err := p.BlobStore.Enumerate(ctx, mcursor.sstart, end, 0)
+	localBlobs, _, err := p.BlobStore.EnumerateKind(ctx, kind, mcursor.sstart, end, 0)
 	if err != nil {
 		return nil, "", err
 	}
@@ -1,12 +1,13 @@
 package sync
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
-	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/client/clientutil"
 	"a4.io/blobstash/pkg/stash/store"
 
@@ -19,6 +20,9 @@ type SyncClient struct {
 	blobstore store.BlobStore
 	oneWay    bool
 
+	// Only upload the blobs missing on the remote instance (the blobs only present on the remote are left there)
+	push bool
+
 	st    *Sync
 	state *StateTree
 
@@ -69,6 +73,24 @@ func (stc *SyncClient) RemoteLeaf(prefix string) (*LeafState, error) {
 	return ls, nil
 }
 
+func (stc *SyncClient) RemoteNode(prefix string) (*NodeState, error) {
+	ns := &NodeState{}
+	resp, err := stc.client.Get(fmt.Sprintf("/api/sync/state/node/%s", prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	if err := clientutil.Unmarshal(resp, ns); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
 type SyncStats struct {
 	Downloaded     int    `json:"blobs_downloaded"`
 	DownloadedSize int    `json:"downloaded_size"`
@@ -79,9 +101,9 @@ type SyncStats struct {
 	OneWay         bool   `json:"one_way_sync"`
 }
 
-// Get fetch the given blob from the remote BlobStash instance.
-func (stc *SyncClient) remotePutBlob(hash string, blob []byte) error {
-	resp, err := stc.client.Post(fmt.Sprintf("/api/blobstore/blob/%s", hash), blob)
+// remotePutBlob streams the given blob to the remote BlobStash instance.
+func (stc *SyncClient) remotePutBlob(hash string, blob io.Reader) error {
+	resp, err := stc.client.Do("POST", fmt.Sprintf("/api/blobstore/blob/%s", hash), blob)
 	if err != nil {
 		return err
 	}
@@ -93,58 +115,71 @@ func (stc *SyncClient) remotePutBlob(hash string, blob []byte) error {
 	return nil
 }
 
-// Get fetch the given blob from the remote BlobStash instance.
-func (stc *SyncClient) remoteGetBlob(hash string) ([]byte, error) {
+// remoteGetBlob fetch the given blob from the remote BlobStash instance, and stream it to the local blobstore.
+func (stc *SyncClient) remoteGetBlob(hash string) (int, error) {
 	resp, err := stc.client.Get(fmt.Sprintf("/api/blobstore/blob/%s", hash))
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	defer resp.Body.Close()
 
 	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
 		if err.IsNotFound() {
-			return nil, clientutil.ErrBlobNotFound
+			return 0, clientutil.ErrBlobNotFound
 		}
-		return nil, err
+		return 0, err
 	}
 
-	return clientutil.Decode(resp)
-}
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "snappy" {
+		data, err := clientutil.Decode(resp)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
 
-func (stc *SyncClient) putBlob(hash string, data []byte) (bool, error) {
-	blob := &blob.Blob{Hash: hash, Data: data}
-	if err := blob.Check(); err != nil {
-		return false, err
+	// Count the bytes as they are streamed (the blob is verified by `PutReader`)
+	cr := &countingReader{r: body}
+	if _, err := stc.blobstore.PutReader(context.Background(), hash, cr); err != nil {
+		return 0, err
 	}
-	return stc.blobstore.Put(context.Background(), blob)
+	return cr.n, nil
 }
 
-func (stc *SyncClient) getBlob(hash string) ([]byte, error) {
-	return stc.blobstore.Get(context.Background(), hash)
+type countingReader struct {
+	r io.Reader
+	n int
 }
 
-func (stc *SyncClient) Send(h string) error {
-	blob, err := stc.getBlob(h)
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
+
+func (stc *SyncClient) sendBlob(hash string) (int, error) {
+	blob, size, err := stc.blobstore.GetReader(context.Background(), hash)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer blob.Close()
 
-	if err := stc.remotePutBlob(h, blob); err != nil {
-		return err
+	if err := stc.remotePutBlob(hash, blob); err != nil {
+		return 0, err
 	}
-	return nil
+	return size, nil
 }
-func (stc *SyncClient) Receive(h string) error {
-	blob, err := stc.remoteGetBlob(h)
-	if err != nil {
-		return err
-	}
 
-	if _, err := stc.putBlob(h, blob); err != nil {
-		return err
-	}
-	return nil
+func (stc *SyncClient) Send(h string) error {
+	_, err := stc.sendBlob(h)
+	return err
+}
+
+func (stc *SyncClient) Receive(h string) error {
+	_, err := stc.remoteGetBlob(h)
+	return err
 }
 
 func (stc *SyncClient) Sync() (*SyncStats, error) {
@@ -153,46 +188,36 @@ func (stc *SyncClient) Sync() (*SyncStats, error) {
 		OneWay: stc.oneWay,
 	}
 
-	local_state := stc.state.State()
-	stc.state.Close()
+	localState := stc.state.State()
 
-	remote_state, err := stc.RemoteState()
+	remoteState, err := stc.RemoteState()
 	if err != nil {
 		return nil, err
 	}
 
-	if local_state.Root == remote_state.Root {
+	if localState.Root == remoteState.Root {
 		stats.Duration = time.Since(start).String()
 		stats.AlreadySynced = true
 		return stats, nil
 	}
 
-	// The root differs, found out the leaves we need to inspect
-	leavesNeeded := []string{}
-	leavesToSend := []string{}
-	leavesConflict := []string{}
-
-	for lleaf, lh := range local_state.Leaves {
-		if rh, ok := remote_state.Leaves[lleaf]; ok {
-			if lh != rh {
-				leavesConflict = append(leavesConflict, lleaf)
-			}
-		} else {
-			// This leaf is only present locally, we can send blindly all the blobs belonging to this leaf
-			leavesToSend = append(leavesToSend, lleaf)
-			// If an entire leaf is missing, this means we can send/receive the entire hashes for the missing leaf
-		}
+	// The trees are compared down to the shallowest leaves (the instances without a configurable depth only have
+	// 2 levels, and their digests differ so their leaves are always inspected)
+	leafLevel := stc.state.Depth()
+	if remoteState.Depth < leafLevel {
+		leafLevel = remoteState.Depth
 	}
-	// Find out the leaves present only on the remote-side
-	for rleaf, _ := range remote_state.Leaves {
-		if _, ok := local_state.Leaves[rleaf]; !ok {
-			leavesNeeded = append(leavesNeeded, rleaf)
-		}
+	if leafLevel < 2 {
+		leafLevel = 2
+	}
+	d := &treeDiff{}
+	if err := stc.diff(localState.Leaves, remoteState.Leaves, leafLevel, d); err != nil {
+		return nil, err
 	}
 
 	var upHashes, dlHashes []string
 
-	for _, leaf := range leavesNeeded {
+	for _, leaf := range d.needed {
 		// Only present on remote-side, fetch the list of hashes
 		ls, err := stc.RemoteLeaf(leaf)
 		if err != nil {
@@ -203,7 +228,7 @@ func (stc *SyncClient) Sync() (*SyncStats, error) {
 		}
 	}
 
-	for _, leaf := range leavesToSend {
+	for _, leaf := range d.toSend {
 		ls, err := stc.st.LeafState(leaf)
 		if err != nil {
 			return nil, err
@@ -213,7 +238,7 @@ func (stc *SyncClient) Sync() (*SyncStats, error) {
 		}
 
 	}
-	for _, leaf := range leavesConflict {
+	for _, leaf := range d.conflicts {
 		// Fetch the local leaf state
 		localLeaf, err := stc.st.LeafState(leaf)
 		if err != nil {
@@ -247,41 +272,75 @@ func (stc *SyncClient) Sync() (*SyncStats, error) {
 	if stc.oneWay && len(upHashes) > 0 {
 		return nil, fmt.Errorf("one way sync error: found %d blobs only present locally", len(upHashes))
 	}
+	if stc.push {
+		dlHashes = nil
+	}
 
 	// Upload blobs to the remote BlobStash instances
 	for _, h := range upHashes {
-		blob, err := stc.getBlob(h)
+		size, err := stc.sendBlob(h)
 		if err != nil {
 			return nil, err
 		}
 
-		stats.Downloaded++
-		stats.DownloadedSize += len(blob)
-
-		if err := stc.remotePutBlob(h, blob); err != nil {
-			return nil, err
-		}
+		stats.Uploaded++
+		stats.UploadedSize += size
 	}
 
 	// Pull missing blobs from remote BlobStash instances
 	for _, h := range dlHashes {
-		blob, err := stc.remoteGetBlob(h)
+		size, err := stc.remoteGetBlob(h)
 		if err != nil {
 			return nil, err
 		}
 
-		stats.Uploaded++
-		stats.UploadedSize += len(blob)
-
-		if _, err := stc.putBlob(h, blob); err != nil {
-			return nil, err
-		}
+		stats.Downloaded++
+		stats.DownloadedSize += size
 	}
 
 	stats.Duration = time.Since(start).String()
 	return stats, nil
 }
 
+// treeDiff holds the prefixes of the subtrees that differ
+type treeDiff struct {
+	needed    []string // only present on the remote-side
+	toSend    []string // only present locally
+	conflicts []string // leaves present on both sides with different digests
+}
+
+// diff compares the nodes of the same level, and descends into the differing nodes until `leafLevel`
+func (stc *SyncClient) diff(local, remote map[string]string, leafLevel int, d *treeDiff) error {
+	for prefix, lh := range local {
+		rh, ok := remote[prefix]
+		switch {
+		case !ok:
+			// This subtree is only present locally, we can send blindly all the blobs belonging to it
+			d.toSend = append(d.toSend, prefix)
+		case lh == rh:
+		case len(prefix) >= leafLevel:
+			d.conflicts = append(d.conflicts, prefix)
+		default:
+			// `leafLevel` is never deeper than the local tree
+			localChildren, _ := stc.state.Children(prefix)
+			remoteNode, err := stc.RemoteNode(prefix)
+			if err != nil {
+				return err
+			}
+			if err := stc.diff(localChildren, remoteNode.Children, leafLevel, d); err != nil {
+				return err
+			}
+		}
+	}
+	// Find out the subtrees present only on the remote-side
+	for prefix := range remote {
+		if _, ok := local[prefix]; !ok {
+			d.needed = append(d.needed, prefix)
+		}
+	}
+	return nil
+}
+
 func slice2map(items []string) map[string]struct{} {
 	res := map[string]struct{}{}
 	for _, item := range items {
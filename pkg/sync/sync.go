@@ -4,11 +4,11 @@ Package sync implements a sync mechanism using Merkle trees (tree of hahes) for
 
 The algorithm is inspired by Dynamo or Cassandra uses of Merkle trees (as an anti-entropy mechanism).
 
-Each node maintains its own Merkle tree, when doing a sync, the hashes of the tree are checked against each other starting from the root hash to the leaves.
+Each node maintains its own Merkle tree, when doing a sync, the hashes of the tree are checked against each other starting from the root hash to the leaves, only descending into the subtrees that differ.
 
-This first implementation only keep 256 (16**2) buckets (the first 2 hex of the hashes).
+The depth of the tree is configurable (`sync_tree_depth`), each level splits the blobs on one more hex char of their digest (the algorithm prefix of the ref is ignored). The tree is updated on every new blob (and garbage collected blob), and persisted across restarts.
 
-Blake2B (the same hashing algorithm used by the Blob Store) is used to compute the tree.
+The digest of a node is the XOR of the Blake2B digests of the blobs below it, so it does not depend on the order the blobs were added.
 
 */
 package sync // import "a4.io/blobstash/pkg/sync"
@@ -16,72 +16,109 @@ package sync // import "a4.io/blobstash/pkg/sync"
 import (
 	"context"
 	"fmt"
-	"hash"
 	"net/http"
-	"sync"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"a4.io/blobstash/pkg/blob"
 	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
 	"a4.io/blobstash/pkg/stash/store"
 
 	"github.com/gorilla/mux"
 	log2 "github.com/inconshreveable/log15"
 	logext "github.com/inconshreveable/log15/ext"
-	"golang.org/x/crypto/blake2b"
 )
 
-// FIXME(tsileo): ensure the keys/maps are sorted/iterated in lexicographical order
-
-var hashPool sync.Pool
-
-func NewHash() (h hash.Hash) {
-	var err error
-	if ih := hashPool.Get(); ih != nil {
-		h = ih.(hash.Hash)
-		h.Reset()
-	} else {
-		// Creates a new one if the pool is empty
-		h, err = blake2b.New256(nil)
-		if err != nil {
-			panic(err)
-		}
-	}
-	return
-}
-
 type Sync struct {
 	blobstore store.BlobStore
 	conf      *config.Config
+	hub       *hub.Hub
+
+	tree     *StateTree
+	treePath string
 
 	log log2.Logger
 }
 
-func New(logger log2.Logger, conf *config.Config, blobstore store.BlobStore) *Sync {
+func New(logger log2.Logger, conf *config.Config, blobstore store.BlobStore, chub *hub.Hub) (*Sync, error) {
 	logger.Debug("init")
-	return &Sync{
+	st := &Sync{
 		blobstore: blobstore,
 		conf:      conf,
+		hub:       chub,
+		treePath:  filepath.Join(conf.VarDir(), "sync_tree.json"),
 		log:       logger,
 	}
+	tree, err := loadStateTree(st.treePath, conf.SyncTreeDepth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the tree: %w", err)
+	}
+	if tree == nil {
+		logger.Info("building the tree", "depth", conf.SyncTreeDepth)
+		if tree, err = st.buildTree(); err != nil {
+			return nil, err
+		}
+	}
+	st.tree = tree
+
+	// The saved tree is only valid until the next blob, it will be saved again on shutdown (and rebuilt after a crash)
+	if err := os.Remove(st.treePath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	chub.Subscribe(hub.NewBlob, "sync", st.newBlobCallback)
+	chub.Subscribe(hub.GarbageCollection, "sync", st.gcCallback)
+	return st, nil
+}
+
+// Close saves the tree
+func (st *Sync) Close() error {
+	if err := st.hub.Unsubscribe(hub.NewBlob, "sync"); err != nil {
+		return err
+	}
+	if err := st.hub.Unsubscribe(hub.GarbageCollection, "sync"); err != nil {
+		return err
+	}
+	return st.tree.save(st.treePath)
+}
+
+func (st *Sync) newBlobCallback(ctx context.Context, b *blob.Blob, _ interface{}) error {
+	st.tree.Add(b.Hash)
+	return nil
+}
+
+func (st *Sync) gcCallback(ctx context.Context, b *blob.Blob, _ interface{}) error {
+	st.tree.Remove(b.Hash)
+	return nil
 }
 
 func (st *Sync) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
 	r.Handle("/state", basicAuth(http.HandlerFunc(st.stateHandler())))
+	r.Handle("/state/node/{prefix}", basicAuth(http.HandlerFunc(st.stateNodeHandler())))
 	r.Handle("/state/leaf/{prefix}", basicAuth(http.HandlerFunc(st.stateLeafHandler())))
 	r.Handle("/_trigger", basicAuth(http.HandlerFunc(st.triggerHandler())))
 }
 
 func (st *Sync) Client(url, apiKey string, oneWay bool) *SyncClient {
-	rawState := st.generateTree()
-	return NewSyncClient(st.log.New("submodule", "synctable-client"), st, rawState, st.blobstore, url, apiKey, oneWay)
+	return NewSyncClient(st.log.New("submodule", "synctable-client"), st, st.tree, st.blobstore, url, apiKey, oneWay)
 }
 
 func (st *Sync) Sync(url, apiKey string, oneWay bool) (*SyncStats, error) {
 	log := st.log.New("trigger_id", logext.RandId(6))
 	log.Info("Starting sync...", "url", url)
-	rawState := st.generateTree()
-	defer rawState.Close()
-	client := NewSyncClient(st.log.New("submodule", "synctable-client"), st, rawState, st.blobstore, url, apiKey, oneWay)
+	client := NewSyncClient(st.log.New("submodule", "synctable-client"), st, st.tree, st.blobstore, url, apiKey, oneWay)
+	return client.Sync()
+}
+
+// Push uploads the blobs missing on the remote instance, without fetching the blobs only present on the remote
+func (st *Sync) Push(url, apiKey string) (*SyncStats, error) {
+	log := st.log.New("trigger_id", logext.RandId(6))
+	log.Info("Starting push...", "url", url)
+	client := NewSyncClient(st.log.New("submodule", "synctable-client"), st, st.tree, st.blobstore, url, apiKey, false)
+	client.push = true
 	return client.Sync()
 }
 
@@ -102,41 +139,109 @@ func (st *Sync) triggerHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func (st *Sync) generateTree() *StateTree {
-	state := NewStateTree()
-	blobs, _, err := st.blobstore.Enumerate(context.Background(), "", "\xff", 0)
+// allEnumerator is implemented by the blobstores supporting the tiered storage (`Enumerate` skips the evicted blobs)
+type allEnumerator interface {
+	EnumerateAll(ctx context.Context, start, end string) ([]*blob.SizedBlobRef, error)
+}
+
+// enumerate returns all the blobs in the range, including the ones evicted by the tiered storage (so the tree matches
+// the one updated by the new blob events)
+func (st *Sync) enumerate(start, end string) ([]*blob.SizedBlobRef, error) {
+	if e, ok := st.blobstore.(allEnumerator); ok {
+		return e.EnumerateAll(context.Background(), start, end)
+	}
+	blobs, _, err := st.blobstore.Enumerate(context.Background(), start, end, 0)
+	return blobs, err
+}
+
+// buildTree builds the tree from all the blobs
+func (st *Sync) buildTree() (*StateTree, error) {
+	state := NewStateTree(st.conf.SyncTreeDepth)
+	blobs, err := st.enumerate("", "\xff")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	for _, blob := range blobs {
-		// st.log.Debug("_state loop", "ns", ns, "hash", h)
 		state.Add(blob.Hash)
 	}
-	return state
+	return state, nil
 }
 
 func (st *Sync) stateHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		state := st.generateTree()
-		defer state.Close()
-		httputil.WriteJSON(w, state.State())
+		httputil.WriteJSON(w, st.tree.State())
 	}
 }
 
 type State struct {
 	Root   string            `json:"root"`
 	Count  int               `json:"count"`
+	Depth  int               `json:"depth,omitempty"`
 	Leaves map[string]string `json:"leaves"`
 }
 
 func (st *State) String() string {
-	return fmt.Sprintf("[State root=%s, hashes_cnt=%v, leaves_cnt=%v]", st.Root, st.Count, len(st.Leaves))
+	return fmt.Sprintf("[State root=%s, hashes_cnt=%v, leaves_cnt=%v, depth=%d]", st.Root, st.Count, len(st.Leaves), st.Depth)
+}
+
+// NodeState holds the digests of the children of a node
+type NodeState struct {
+	Prefix   string            `json:"prefix"`
+	Children map[string]string `json:"children"`
+}
+
+// NodeState returns the children of the given node, if the node is a leaf of the local tree, the children are computed
+// from the blobs
+func (st *Sync) NodeState(prefix string) (*NodeState, error) {
+	children, ok := st.tree.Children(prefix)
+	if !ok {
+		blobs, err := st.blobsWithPrefix(prefix)
+		if err != nil {
+			return nil, err
+		}
+		subtree := NewStateTree(len(prefix) + 1)
+		for _, blob := range blobs {
+			subtree.Add(blob.Hash)
+		}
+		children = subtree.Level(len(prefix) + 1)
+	}
+	return &NodeState{
+		Prefix:   prefix,
+		Children: children,
+	}, nil
+}
+
+func (st *Sync) stateNodeHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nodeState, err := st.NodeState(mux.Vars(r)["prefix"])
+		if err != nil {
+			panic(err)
+		}
+		httputil.WriteJSON(w, nodeState)
+	}
+}
+
+// blobsWithPrefix returns the blobs whose digest starts with the given prefix (the prefix of the nodes of the tree)
+func (st *Sync) blobsWithPrefix(prefix string) ([]*blob.SizedBlobRef, error) {
+	out := []*blob.SizedBlobRef{}
+	for _, refPrefix := range hashutil.RefPrefixes(prefix) {
+		blobs, err := st.enumerate(refPrefix, refPrefix+"\xff")
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range blobs {
+			if strings.HasPrefix(hashutil.HexDigest(blob.Hash), prefix) {
+				out = append(out, blob)
+			}
+		}
+	}
+	return out, nil
 }
 
 func (st *Sync) LeafState(prefix string) (*LeafState, error) {
-	blobs, _, err := st.blobstore.Enumerate(context.Background(), prefix, prefix+"\xff", 0)
+	blobs, err := st.blobsWithPrefix(prefix)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	var hashes []string
 	for _, blob := range blobs {
@@ -169,94 +274,4 @@ type LeafState struct {
 	Hashes []string `json:"hashes"`
 }
 
-type StateTree struct {
-	root   hash.Hash
-	level1 map[string]hash.Hash
-
-	count int
-
-	sync.Mutex
-}
-
-func NewStateTree() *StateTree {
-	h, err := blake2b.New256(nil)
-	if err != nil {
-		panic(err)
-	}
-	return &StateTree{
-		root:   h,
-		level1: map[string]hash.Hash{},
-	}
-}
-
-func (st *StateTree) String() string {
-	return fmt.Sprintf("[StateTree root=%s, hashes_cnt=%v, leaves_cnt=%v]", st.Root(), st.Count(), len(st.level1))
-}
-
-func (st *StateTree) Close() error {
-	hashPool.Put(st.root)
-	st.root = nil
-	for _, h := range st.level1 {
-		hashPool.Put(h)
-	}
-	st.level1 = nil
-	return nil
-}
-
-func (st *StateTree) Root() string {
-	st.Lock()
-	defer st.Unlock()
-	return fmt.Sprintf("%x", st.root.Sum(nil))
-}
-
-func (st *StateTree) Level1Prefix(prefix string) string {
-	st.Lock()
-	defer st.Unlock()
-	if h, ok := st.level1[prefix]; ok {
-		return fmt.Sprintf("%x", h.Sum(nil))
-	}
-	return ""
-}
-
-func (st *StateTree) Level1() map[string]string {
-	st.Lock()
-	defer st.Unlock()
-	res := map[string]string{}
-	for k, h := range st.level1 {
-		res[k] = fmt.Sprintf("%x", h.Sum(nil))
-	}
-	return res
-}
-
-func (st *StateTree) Add(h string) {
-	var err error
-	st.Lock()
-	defer st.Unlock()
-	var chash hash.Hash
-	if exhash, ok := st.level1[h[0:2]]; ok {
-		chash = exhash
-	} else {
-		chash, err = blake2b.New256(nil)
-		if err != nil {
-			panic(err)
-		}
-		st.level1[h[0:2]] = chash
-	}
-	chash.Write([]byte(h))
-	st.root.Write([]byte(h))
-	st.count++
-}
-
-func (st *StateTree) Count() int {
-	return st.count
-}
-
-func (st *StateTree) State() *State {
-	return &State{
-		Root:   st.Root(),
-		Count:  st.Count(),
-		Leaves: st.Level1(),
-	}
-}
-
 // TODO(tsileo): import the scheduler from blobsnap to run sync periodically
@@ -0,0 +1,317 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hashutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestStateTree(t *testing.T) {
+	var hashes []string
+	for i := 0; i < 500; i++ {
+		hashes = append(hashes, hashutil.Compute([]byte(fmt.Sprintf("blob%d", i))))
+	}
+	st1 := NewStateTree(3)
+	for _, h := range hashes {
+		st1.Add(h)
+	}
+	st2 := NewStateTree(4)
+	for i := len(hashes) - 1; i >= 0; i-- {
+		st2.Add(hashes[i])
+	}
+	st2.Add(hashes[0] + "extra")
+	st2.Remove(hashes[0] + "extra")
+	if st1.Root() != st2.Root() || st1.Count() != 500 || st2.Count() != 500 {
+		t.Errorf("trees should match, got %s and %s", st1, st2)
+	}
+	for prefix, d := range st1.Level(3) {
+		if st2.Level(3)[prefix] != d {
+			t.Errorf("node %s should match", prefix)
+		}
+	}
+	if _, ok := st1.Children(hashes[0][:3]); ok {
+		t.Errorf("%s should be a leaf", hashes[0][:3])
+	}
+
+	st2.Remove(hashes[0])
+	if st1.Root() == st2.Root() || st2.Count() != 499 {
+		t.Errorf("trees should differ")
+	}
+	if st1.Level(2)[hashes[0][:2]] == st2.Level(2)[hashes[0][:2]] {
+		t.Errorf("node %s should differ", hashes[0][:2])
+	}
+	if st1.Level(2)[hashes[1][:2]] != st2.Level(2)[hashes[1][:2]] && hashes[0][:2] != hashes[1][:2] {
+		t.Errorf("node %s should match", hashes[1][:2])
+	}
+
+	dir, err := ioutil.TempDir("", "blobstash_sync_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tree.json")
+	if err := st1.save(path); err != nil {
+		panic(err)
+	}
+	loaded, err := loadStateTree(path, 3)
+	if err != nil {
+		panic(err)
+	}
+	if loaded.Root() != st1.Root() || loaded.Count() != st1.Count() || len(loaded.Level(1)) != len(st1.Level(1)) {
+		t.Errorf("loaded tree %s should match %s", loaded, st1)
+	}
+	if loaded, err := loadStateTree(path, 4); err != nil || loaded != nil {
+		t.Errorf("a tree with a different depth should not be loaded (%v)", err)
+	}
+
+	// The SHA-256 refs are bucketed by their digest (and not all in the subtree of their "1220" prefix)
+	st3 := NewStateTree(3)
+	for i := 0; i < 500; i++ {
+		st3.Add(hashutil.ComputeWith(hashutil.SHA256, []byte(fmt.Sprintf("blob%d", i))))
+	}
+	if len(st3.Level(1)) != 16 || st3.Count() != 500 {
+		t.Errorf("the SHA-256 refs should be spread across the tree, got %d nodes at level 1", len(st3.Level(1)))
+	}
+}
+
+type testInstance struct {
+	bs   *blobstore.BlobStore
+	sync *Sync
+	srv  *httptest.Server
+	reqs []string
+}
+
+func newTestInstance(logger log.Logger, dir string, depth int) *testInstance {
+	conf := &config.Config{DataDir: dir, StorageEngine: blobstore.DirEngine, SyncTreeDepth: depth}
+	h := hub.New(logger, true)
+	bs, err := blobstore.New(logger, true, dir, conf, h)
+	if err != nil {
+		panic(err)
+	}
+	st, err := New(logger, conf, bs, h)
+	if err != nil {
+		panic(err)
+	}
+	ti := &testInstance{bs: bs, sync: st}
+	r := mux.NewRouter()
+	st.Register(r.PathPrefix("/api/sync").Subrouter(), func(h http.Handler) http.Handler { return h })
+	r.HandleFunc("/api/blobstore/blob/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		hash := mux.Vars(r)["hash"]
+		switch r.Method {
+		case "GET":
+			data, err := bs.Get(context.Background(), hash)
+			if err != nil {
+				panic(err)
+			}
+			w.Write(data)
+		case "POST":
+			if _, err := bs.PutReader(context.Background(), hash, r.Body); err != nil {
+				panic(err)
+			}
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+	ti.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/api/sync/") {
+			ti.reqs = append(ti.reqs, req.URL.Path)
+		}
+		r.ServeHTTP(w, req)
+	}))
+	return ti
+}
+
+func (ti *testInstance) close() {
+	ti.srv.Close()
+	if err := ti.sync.Close(); err != nil {
+		panic(err)
+	}
+	if err := ti.bs.Close(); err != nil {
+		panic(err)
+	}
+}
+
+func (ti *testInstance) put(data string) string {
+	b := &blob.Blob{Hash: hashutil.Compute([]byte(data)), Data: []byte(data)}
+	if _, err := ti.bs.Put(context.Background(), b); err != nil {
+		panic(err)
+	}
+	return b.Hash
+}
+
+func TestSync(t *testing.T) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	dir, err := ioutil.TempDir("", "blobstash_sync_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := newTestInstance(logger, filepath.Join(dir, "local"), 3)
+	remote := newTestInstance(logger, filepath.Join(dir, "remote"), 4)
+	for i := 0; i < 300; i++ {
+		local.put(fmt.Sprintf("blob%d", i))
+		remote.put(fmt.Sprintf("blob%d", i))
+	}
+	if local.sync.tree.Root() != remote.sync.tree.Root() {
+		t.Errorf("trees with different depths should match")
+	}
+	// A SHA-256 blob put concurrently must only be added once to the tree
+	onlyLocal := hashutil.ComputeWith(hashutil.SHA256, []byte("local"))
+	var wg gosync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := local.bs.Put(context.Background(), &blob.Blob{Hash: onlyLocal, Data: []byte("local")}); err != nil {
+				panic(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if local.sync.tree.Count() != 301 {
+		t.Errorf("the blob should only be counted once, got %d blobs", local.sync.tree.Count())
+	}
+	onlyRemote := remote.put("remote")
+
+	stats, err := local.sync.Sync(remote.srv.URL, "", false)
+	if err != nil {
+		panic(err)
+	}
+	if stats.Uploaded != 1 || stats.Downloaded != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	for _, ti := range []*testInstance{local, remote} {
+		for _, h := range []string{onlyLocal, onlyRemote} {
+			if ok, err := ti.bs.Stat(context.Background(), h); err != nil || !ok {
+				t.Errorf("blob %s should have been synced", h)
+			}
+		}
+	}
+	if local.sync.tree.Root() != remote.sync.tree.Root() {
+		t.Errorf("trees should match after the sync")
+	}
+	// Only the 2 differing subtrees should have been inspected
+	for _, req := range remote.reqs {
+		if strings.HasPrefix(req, "/api/sync/state/leaf/") && !strings.HasPrefix(hashutil.HexDigest(onlyLocal), req[21:]) &&
+			!strings.HasPrefix(onlyRemote, req[21:]) {
+			t.Errorf("unexpected request %s", req)
+		}
+	}
+
+	stats, err = local.sync.Sync(remote.srv.URL, "", false)
+	if err != nil {
+		panic(err)
+	}
+	if !stats.AlreadySynced {
+		t.Errorf("should already be in sync")
+	}
+
+	// The tree is saved on shutdown
+	root := local.sync.tree.Root()
+	local.close()
+	remote.close()
+	local = newTestInstance(logger, filepath.Join(dir, "local"), 3)
+	defer local.close()
+	if local.sync.tree.Root() != root || local.sync.tree.Count() != 302 {
+		t.Errorf("the tree should have been restored")
+	}
+}
+
+func TestTreeWithTiering(t *testing.T) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	dir, err := ioutil.TempDir("", "blobstash_sync_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	remoteDir := filepath.Join(dir, "remote")
+	if err := os.MkdirAll(remoteDir, 0700); err != nil {
+		panic(err)
+	}
+	conf := &config.Config{
+		DataDir:       filepath.Join(dir, "data"),
+		StorageEngine: blobstore.DirEngine,
+		SyncTreeDepth: 2,
+		S3Repls: config.S3Repls{&config.S3Repl{
+			Dir:     remoteDir,
+			Tiering: &config.Tiering{MaxAge: "1ms", Interval: "100ms"},
+		}},
+	}
+	h := hub.New(logger, true)
+	bs, err := blobstore.New(logger, true, conf.DataDir, conf, h)
+	if err != nil {
+		panic(err)
+	}
+	defer bs.Close()
+	st, err := New(logger, conf, bs, h)
+	if err != nil {
+		panic(err)
+	}
+	defer st.Close()
+
+	hashes := []string{}
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf("blob%d", i))
+		b := &blob.Blob{Hash: hashutil.Compute(data), Data: data}
+		if _, err := bs.Put(context.Background(), b); err != nil {
+			panic(err)
+		}
+		hashes = append(hashes, b.Hash)
+	}
+
+	// Wait for the blobs to be uploaded and evicted
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		local, _, err := bs.Enumerate(context.Background(), "", "\xff", 0)
+		if err != nil {
+			panic(err)
+		}
+		if len(local) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the blobs were not evicted (%d blobs stored locally)", len(local))
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The evicted blobs are still part of the tree
+	tree, err := st.buildTree()
+	if err != nil {
+		panic(err)
+	}
+	if tree.Count() != 20 || tree.Root() != st.tree.Root() {
+		t.Errorf("the rebuilt tree %s should match the tree %s", tree, st.tree)
+	}
+	prefix := hashutil.HexDigest(hashes[0])[:2]
+	leaf, err := st.LeafState(prefix)
+	if err != nil {
+		panic(err)
+	}
+	var found bool
+	for _, h := range leaf.Hashes {
+		found = found || h == hashes[0]
+	}
+	if !found {
+		t.Errorf("the evicted blob %s should be in the leaf %s", hashes[0], prefix)
+	}
+}
@@ -0,0 +1,245 @@
+package sync // import "a4.io/blobstash/pkg/sync"
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/hashutil"
+)
+
+// DefaultTreeDepth is the depth of the Merkle tree if not set in the config
+const DefaultTreeDepth = 3
+
+// treeVersion is the version of the persisted tree, a tree saved with another version is rebuilt (version 2 keys the
+// nodes by the digest instead of the ref)
+const treeVersion = 2
+
+type digest [blake2b.Size256]byte
+
+func (d digest) String() string {
+	return hex.EncodeToString(d[:])
+}
+
+// blobDigest returns the digest of a single blob
+func blobDigest(h string) digest {
+	return digest(blake2b.Sum256([]byte(h)))
+}
+
+// node of the Merkle tree, its digest is the XOR of the digests of the blobs below it, so it can be updated
+// incrementally (the blobs can be added and removed in any order), and a node only depends on its blobs (the trees of
+// two instances with different depths can be compared)
+type node struct {
+	digest digest
+	count  int
+}
+
+// StateTree is a Merkle tree of the blobs, the nodes at level `n` are keyed by the first `n` hex chars of the digests
+// (the root being the empty prefix), the leaves are at level `depth`.
+//
+// The digest is used instead of the ref as the refs of some algorithms start with a constant prefix (all the SHA-256
+// refs would end up in the same subtree).
+type StateTree struct {
+	depth  int
+	levels []map[string]*node
+
+	sync.Mutex
+}
+
+func NewStateTree(depth int) *StateTree {
+	if depth < 2 {
+		depth = DefaultTreeDepth
+	}
+	levels := make([]map[string]*node, depth+1)
+	for i := range levels {
+		levels[i] = map[string]*node{}
+	}
+	return &StateTree{
+		depth:  depth,
+		levels: levels,
+	}
+}
+
+func (st *StateTree) String() string {
+	return fmt.Sprintf("[StateTree root=%s, hashes_cnt=%v, depth=%d]", st.Root(), st.Count(), st.depth)
+}
+
+// Depth returns the level of the leaves
+func (st *StateTree) Depth() int {
+	return st.depth
+}
+
+// update XORs the blob digest in the nodes on the path to its leaf
+func (st *StateTree) update(h string, delta int) {
+	d := blobDigest(h)
+	key := hashutil.HexDigest(h)
+	for i, level := range st.levels {
+		prefix := key[:i]
+		n, ok := level[prefix]
+		if !ok {
+			n = &node{}
+			level[prefix] = n
+		}
+		for j := range n.digest {
+			n.digest[j] ^= d[j]
+		}
+		n.count += delta
+		if n.count <= 0 {
+			delete(level, prefix)
+		}
+	}
+}
+
+// Add adds the blob to the tree, it must not already be in it
+func (st *StateTree) Add(h string) {
+	st.Lock()
+	defer st.Unlock()
+	st.update(h, 1)
+}
+
+// Remove removes the blob from the tree
+func (st *StateTree) Remove(h string) {
+	st.Lock()
+	defer st.Unlock()
+	st.update(h, -1)
+}
+
+func (st *StateTree) Root() string {
+	st.Lock()
+	defer st.Unlock()
+	if n, ok := st.levels[0][""]; ok {
+		return n.digest.String()
+	}
+	return digest{}.String()
+}
+
+func (st *StateTree) Count() int {
+	st.Lock()
+	defer st.Unlock()
+	if n, ok := st.levels[0][""]; ok {
+		return n.count
+	}
+	return 0
+}
+
+// Level returns the digests of the non-empty nodes of the given level
+func (st *StateTree) Level(n int) map[string]string {
+	st.Lock()
+	defer st.Unlock()
+	res := map[string]string{}
+	for prefix, nd := range st.levels[n] {
+		res[prefix] = nd.digest.String()
+	}
+	return res
+}
+
+// Children returns the digests of the non-empty children of the given node (`ok` is false if the node is a leaf)
+func (st *StateTree) Children(prefix string) (map[string]string, bool) {
+	st.Lock()
+	defer st.Unlock()
+	if len(prefix) >= st.depth {
+		return nil, false
+	}
+	res := map[string]string{}
+	if _, ok := st.levels[len(prefix)][prefix]; !ok {
+		return res, true
+	}
+	for _, c := range "0123456789abcdef" {
+		child := prefix + string(c)
+		if nd, ok := st.levels[len(child)][child]; ok {
+			res[child] = nd.digest.String()
+		}
+	}
+	return res, true
+}
+
+// State returns the root and the nodes of the second level (the leaves of the trees of the older instances)
+func (st *StateTree) State() *State {
+	return &State{
+		Root:   st.Root(),
+		Count:  st.Count(),
+		Depth:  st.depth,
+		Leaves: st.Level(2),
+	}
+}
+
+// persistedTree is the on-disk format of the tree (the inner nodes are computed from the leaves when loading it)
+type persistedTree struct {
+	Version int               `json:"version"`
+	Depth   int               `json:"depth"`
+	Leaves  map[string]string `json:"leaves"`
+	Counts  map[string]int    `json:"counts"`
+}
+
+// save writes the tree to the given path
+func (st *StateTree) save(path string) error {
+	st.Lock()
+	defer st.Unlock()
+	pt := &persistedTree{
+		Version: treeVersion,
+		Depth:   st.depth,
+		Leaves:  map[string]string{},
+		Counts:  map[string]int{},
+	}
+	for prefix, nd := range st.levels[st.depth] {
+		pt.Leaves[prefix] = nd.digest.String()
+		pt.Counts[prefix] = nd.count
+	}
+	js, err := json.Marshal(pt)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, js, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadStateTree loads the tree saved at the given path, it returns nil if there's no tree or if it was saved with a
+// different depth (or version)
+func loadStateTree(path string, depth int) (*StateTree, error) {
+	js, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	pt := &persistedTree{}
+	if err := json.Unmarshal(js, pt); err != nil {
+		return nil, err
+	}
+	st := NewStateTree(depth)
+	if pt.Version != treeVersion || pt.Depth != st.depth {
+		return nil, nil
+	}
+	for prefix, rawDigest := range pt.Leaves {
+		raw, err := hex.DecodeString(rawDigest)
+		if err != nil {
+			return nil, err
+		}
+		if len(prefix) != st.depth || len(raw) != len(digest{}) {
+			return nil, fmt.Errorf("invalid leaf %q", prefix)
+		}
+		var d digest
+		copy(d[:], raw)
+		for i, level := range st.levels {
+			n, ok := level[prefix[:i]]
+			if !ok {
+				n = &node{}
+				level[prefix[:i]] = n
+			}
+			for j := range n.digest {
+				n.digest[j] ^= d[j]
+			}
+			n.count += pt.Counts[prefix]
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,525 @@
+package usage // import "a4.io/blobstash/pkg/usage"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// RootNamespace is the name of the namespace used when the `BlobStash-Namespace` header is not set
+const RootNamespace = "_root"
+
+// ErrQuotaExceeded is returned when a write would exceed a hard quota
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Keys prefixes
+const (
+	nsCountersPrefix   = "c:ns:"
+	authCountersPrefix = "c:auth:"
+	blobPrefix         = "b:"
+	docPrefix          = "d:"
+)
+
+// Counters holds the usage of a namespace or an auth ID
+type Counters struct {
+	Blobs int64            `json:"blobs"`
+	Bytes int64            `json:"bytes"`
+	Docs  map[string]int64 `json:"docs"` // Number of documents by collection
+}
+
+func (c *Counters) docs() int64 {
+	var total int64
+	for _, cnt := range c.Docs {
+		total += cnt
+	}
+	return total
+}
+
+// owner is who stored a blob or a document (a blob is only accounted once, for its first owner)
+type owner struct {
+	Namespace string `json:"ns"`
+	AuthID    string `json:"auth,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+}
+
+// quota is a parsed `config.Quota` (a zero value means no limit)
+type quota struct {
+	softSize, hardSize int64
+	softDocs, hardDocs int64
+}
+
+func parseQuota(q *config.Quota) (*quota, error) {
+	out := &quota{softDocs: q.SoftDocs, hardDocs: q.HardDocs}
+	for _, s := range []struct {
+		raw string
+		dst *int64
+	}{{q.SoftSize, &out.softSize}, {q.HardSize, &out.hardSize}} {
+		if s.raw == "" {
+			continue
+		}
+		size, err := humanize.ParseBytes(s.raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota size %q: %w", s.raw, err)
+		}
+		*s.dst = int64(size)
+	}
+	return out, nil
+}
+
+func parseQuotas(quotas map[string]*config.Quota) (map[string]*quota, error) {
+	out := map[string]*quota{}
+	for name, q := range quotas {
+		pq, err := parseQuota(q)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = pq
+	}
+	return out, nil
+}
+
+// Usage keeps track of the blobs and documents stored by each namespace and auth ID, and enforces the quotas
+type Usage struct {
+	db  *rangedb.RangeDB
+	log log.Logger
+
+	quotas     *config.Quotas
+	nsQuotas   map[string]*quota
+	authQuotas map[string]*quota
+
+	mu     sync.Mutex
+	warned map[string]bool // Soft limits already reported
+}
+
+// New initializes the usage accounting, the counters are persisted in `dir`
+func New(logger log.Logger, conf *config.Config, dir string, h *hub.Hub) (*Usage, error) {
+	logger.Debug("init")
+	db, err := rangedb.New(dir)
+	if err != nil {
+		return nil, err
+	}
+	u := &Usage{
+		db:         db,
+		log:        logger,
+		quotas:     &config.Quotas{},
+		nsQuotas:   map[string]*quota{},
+		authQuotas: map[string]*quota{},
+		warned:     map[string]bool{},
+	}
+	if conf != nil && conf.Quotas != nil {
+		u.quotas = conf.Quotas
+		if u.nsQuotas, err = parseQuotas(conf.Quotas.Namespaces); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if u.authQuotas, err = parseQuotas(conf.Quotas.Auths); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	// Credit back the blobs removed by the GC
+	h.Subscribe(hub.GarbageCollection, "usage", u.gcCallback)
+
+	return u, nil
+}
+
+// Close closes the underlying DB
+func (u *Usage) Close() error {
+	return u.db.Close()
+}
+
+// ownerFromContext returns the namespace and the auth ID of the request
+func ownerFromContext(ctx context.Context) *owner {
+	o := &owner{Namespace: RootNamespace}
+	if ns, ok := ctxutil.Namespace(ctx); ok && ns != "" {
+		o.Namespace = ns
+	}
+	if a, ok := ctxutil.Auth(ctx); ok && a != nil {
+		o.AuthID = a.ID
+	}
+	return o
+}
+
+// target is a set of counters with its (optional) quota
+type target struct {
+	kind, name, key string
+	quota           *quota
+}
+
+func (u *Usage) targets(o *owner) []*target {
+	targets := []*target{{"namespace", o.Namespace, nsCountersPrefix + o.Namespace, u.nsQuotas[o.Namespace]}}
+	if o.AuthID != "" {
+		targets = append(targets, &target{"auth", o.AuthID, authCountersPrefix + o.AuthID, u.authQuotas[o.AuthID]})
+	}
+	return targets
+}
+
+func (u *Usage) counters(key string) (*Counters, error) {
+	c := &Counters{Docs: map[string]int64{}}
+	data, err := u.db.Get([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return c, nil
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	if c.Docs == nil {
+		c.Docs = map[string]int64{}
+	}
+	return c, nil
+}
+
+// update applies `f` to the counters of every target of the owner, and logs a warning when a soft limit is crossed.
+// The counters are written along with the other writes of the batch (so the owner records and the counters can't
+// diverge).
+func (u *Usage) update(b *rangedb.Batch, o *owner, f func(*Counters)) error {
+	for _, t := range u.targets(o) {
+		c, err := u.counters(t.key)
+		if err != nil {
+			return err
+		}
+		f(c)
+		js, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		b.Set([]byte(t.key), js)
+		if t.quota == nil {
+			continue
+		}
+		softExceeded := (t.quota.softSize > 0 && c.Bytes >= t.quota.softSize) ||
+			(t.quota.softDocs > 0 && c.docs() >= t.quota.softDocs)
+		if softExceeded && !u.warned[t.key] {
+			u.log.Warn("soft quota reached", t.kind, t.name, "bytes", c.Bytes, "docs", c.docs())
+		}
+		u.warned[t.key] = softExceeded
+	}
+	return nil
+}
+
+// check returns an `ErrQuotaExceeded` error if adding the given size/docs would exceed a hard quota
+func (u *Usage) check(o *owner, size, docs int64) error {
+	for _, t := range u.targets(o) {
+		if t.quota == nil {
+			continue
+		}
+		c, err := u.counters(t.key)
+		if err != nil {
+			return err
+		}
+		if size > 0 && t.quota.hardSize > 0 && c.Bytes+size > t.quota.hardSize {
+			return fmt.Errorf("%w: %s %q uses %s, the hard limit is %s", ErrQuotaExceeded, t.kind, t.name,
+				humanize.Bytes(uint64(c.Bytes)), humanize.Bytes(uint64(t.quota.hardSize)))
+		}
+		if docs > 0 && t.quota.hardDocs > 0 && c.docs()+docs > t.quota.hardDocs {
+			return fmt.Errorf("%w: %s %q stores %d documents, the hard limit is %d", ErrQuotaExceeded, t.kind, t.name,
+				c.docs(), t.quota.hardDocs)
+		}
+	}
+	return nil
+}
+
+// CheckBlob returns an `ErrQuotaExceeded` error if storing a blob of the given size would exceed a hard quota for
+// the namespace/auth of the context
+func (u *Usage) CheckBlob(ctx context.Context, size int) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.check(ownerFromContext(ctx), int64(size), 0)
+}
+
+// ReserveBlob accounts a blob about to be stored, or returns an `ErrQuotaExceeded` error if it would exceed a hard
+// quota for the namespace/auth of the context (a blob already accounted is ignored).
+// The check and the accounting are done under the same lock so concurrent writes can't exceed the quota.
+func (u *Usage) ReserveBlob(ctx context.Context, hash string, size int) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	key := []byte(blobPrefix + hash)
+	exists, err := u.db.Has(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	o := ownerFromContext(ctx)
+	o.Size = int64(size)
+	if err := u.check(o, o.Size, 0); err != nil {
+		return err
+	}
+	js, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	b := u.db.NewBatch()
+	b.Set(key, js)
+	if err := u.update(b, o, func(c *Counters) {
+		c.Blobs++
+		c.Bytes += o.Size
+	}); err != nil {
+		return err
+	}
+	return u.db.Write(b)
+}
+
+// ReleaseBlob credits back a blob reserved with `ReserveBlob` that could not be stored
+func (u *Usage) ReleaseBlob(hash string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.removeBlob(hash)
+}
+
+func (u *Usage) gcCallback(ctx context.Context, b *blob.Blob, _ interface{}) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.removeBlob(b.Hash)
+}
+
+func (u *Usage) removeBlob(hash string) error {
+	key := []byte(blobPrefix + hash)
+	o, err := u.owner(key)
+	if err != nil || o == nil {
+		return err
+	}
+	b := u.db.NewBatch()
+	b.Delete(key)
+	if err := u.update(b, o, func(c *Counters) {
+		c.Blobs--
+		c.Bytes -= o.Size
+	}); err != nil {
+		return err
+	}
+	return u.db.Write(b)
+}
+
+func (u *Usage) owner(key []byte) (*owner, error) {
+	data, err := u.db.Get(key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	o := &owner{}
+	if err := json.Unmarshal(data, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// CheckDoc returns an `ErrQuotaExceeded` error if inserting a new document would exceed a hard quota for the
+// namespace/auth of the context
+func (u *Usage) CheckDoc(ctx context.Context) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.check(ownerFromContext(ctx), 0, 1)
+}
+
+// ReserveDoc accounts a document about to be inserted, or returns an `ErrQuotaExceeded` error if it would exceed a
+// hard quota for the namespace/auth of the context (a document already accounted is ignored).
+// The check and the accounting are done under the same lock so concurrent inserts can't exceed the quota.
+func (u *Usage) ReserveDoc(ctx context.Context, collection, id string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	key := []byte(docPrefix + collection + ":" + id)
+	exists, err := u.db.Has(key)
+	if err != nil || exists {
+		return err
+	}
+	o := ownerFromContext(ctx)
+	if err := u.check(o, 0, 1); err != nil {
+		return err
+	}
+	js, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	b := u.db.NewBatch()
+	b.Set(key, js)
+	if err := u.update(b, o, func(c *Counters) {
+		c.Docs[collection]++
+	}); err != nil {
+		return err
+	}
+	return u.db.Write(b)
+}
+
+// ReleaseDoc credits back a document reserved with `ReserveDoc` that could not be inserted
+func (u *Usage) ReleaseDoc(collection, id string) error {
+	return u.RemoveDoc(collection, id)
+}
+
+// RemoveDoc credits back the owner of a removed document
+func (u *Usage) RemoveDoc(collection, id string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.removeDoc(collection, id)
+}
+
+// ReleaseNamespace credits back the blobs and the documents (as `collection:id`) of a destroyed namespace, the ones
+// owned by another namespace are ignored
+func (u *Usage) ReleaseNamespace(ns string, hashes, docs []string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, hash := range hashes {
+		o, err := u.owner([]byte(blobPrefix + hash))
+		if err != nil {
+			return err
+		}
+		if o == nil || o.Namespace != ns {
+			continue
+		}
+		if err := u.removeBlob(hash); err != nil {
+			return err
+		}
+	}
+	for _, doc := range docs {
+		i := strings.LastIndex(doc, ":")
+		if i < 0 {
+			return fmt.Errorf("invalid doc %q", doc)
+		}
+		o, err := u.owner([]byte(docPrefix + doc))
+		if err != nil {
+			return err
+		}
+		if o == nil || o.Namespace != ns {
+			continue
+		}
+		if err := u.removeDoc(doc[:i], doc[i+1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *Usage) removeDoc(collection, id string) error {
+	key := []byte(docPrefix + collection + ":" + id)
+	o, err := u.owner(key)
+	if err != nil || o == nil {
+		return err
+	}
+	b := u.db.NewBatch()
+	b.Delete(key)
+	if err := u.update(b, o, func(c *Counters) {
+		c.Docs[collection]--
+		if c.Docs[collection] <= 0 {
+			delete(c.Docs, collection)
+		}
+	}); err != nil {
+		return err
+	}
+	return u.db.Write(b)
+}
+
+// Entry is the usage of a namespace or an auth ID
+type Entry struct {
+	Name string `json:"name"`
+	*Counters
+	Quota        *config.Quota `json:"quota,omitempty"`
+	SoftExceeded bool          `json:"soft_exceeded"`
+	HardExceeded bool          `json:"hard_exceeded"`
+}
+
+// Report holds the usage of every namespace and auth ID
+type Report struct {
+	Namespaces []*Entry `json:"namespaces"`
+	Auths      []*Entry `json:"auths"`
+}
+
+// Report returns the current usage of every namespace and auth ID (including the ones with a quota but no usage)
+func (u *Usage) Report() (*Report, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	report := &Report{Namespaces: []*Entry{}, Auths: []*Entry{}}
+	for _, p := range []struct {
+		prefix     string
+		entries    *[]*Entry
+		quotas     map[string]*quota
+		confQuotas map[string]*config.Quota
+	}{
+		{nsCountersPrefix, &report.Namespaces, u.nsQuotas, u.quotas.Namespaces},
+		{authCountersPrefix, &report.Auths, u.authQuotas, u.quotas.Auths},
+	} {
+		keys := []string{}
+		for name := range p.quotas {
+			keys = append(keys, p.prefix+name)
+		}
+		it := u.db.PrefixRange([]byte(p.prefix), false)
+		k, _, err := it.Next()
+		for ; err == nil; k, _, err = it.Next() {
+			keys = append(keys, string(k))
+		}
+		it.Close()
+		if err != io.EOF {
+			return nil, err
+		}
+
+		sort.Strings(keys)
+		for i, key := range keys {
+			if i > 0 && keys[i-1] == key {
+				continue
+			}
+			c, err := u.counters(key)
+			if err != nil {
+				return nil, err
+			}
+			name := strings.TrimPrefix(key, p.prefix)
+			entry := &Entry{Name: name, Counters: c, Quota: p.confQuotas[name]}
+			if q, ok := p.quotas[name]; ok {
+				entry.SoftExceeded = (q.softSize > 0 && c.Bytes >= q.softSize) || (q.softDocs > 0 && c.docs() >= q.softDocs)
+				entry.HardExceeded = (q.hardSize > 0 && c.Bytes >= q.hardSize) || (q.hardDocs > 0 && c.docs() >= q.hardDocs)
+			}
+			*p.entries = append(*p.entries, entry)
+		}
+	}
+	return report, nil
+}
+
+// Register registers the `/api/usage` endpoint
+func (u *Usage) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
+	r.Handle("/", basicAuth(http.HandlerFunc(u.usageHandler())))
+}
+
+func (u *Usage) usageHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Admin, perms.Namespace),
+			perms.Resource(perms.Stash, perms.Namespace),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		report, err := u.Report()
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": report,
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package usage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/hub"
+)
+
+func TestUsageQuotas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_usage_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+
+	h := hub.New(logger, true)
+	conf := &config.Config{Quotas: &config.Quotas{
+		Namespaces: map[string]*config.Quota{
+			"tenant": &config.Quota{SoftSize: "10B", HardSize: "20B", HardDocs: 1},
+		},
+	}}
+	u, err := New(logger, conf, dir, h)
+	if err != nil {
+		panic(err)
+	}
+	defer u.Close()
+
+	ctx := ctxutil.WithNamespace(context.Background(), "tenant")
+	if err := u.CheckBlob(ctx, 8); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A blob is only accounted once
+	for _, hash := range []string{"a", "b", "a"} {
+		if err := u.ReserveBlob(ctx, hash, 8); err != nil {
+			panic(err)
+		}
+	}
+	if err := u.ReserveBlob(ctx, "c", 8); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	// A released blob is credited back
+	if err := u.ReleaseBlob("a"); err != nil {
+		panic(err)
+	}
+	if err := u.ReserveBlob(ctx, "c", 8); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := u.CheckBlob(ctx, 8); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	// The root namespace has no quota
+	if err := u.CheckBlob(context.Background(), 8); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := u.CheckDoc(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := u.ReserveDoc(ctx, "col", "doc1"); err != nil {
+		panic(err)
+	}
+	if err := u.CheckDoc(ctx); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := u.ReserveDoc(ctx, "col", "doc2"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := u.RemoveDoc("col", "doc1"); err != nil {
+		panic(err)
+	}
+	if err := u.CheckDoc(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// A removed blob is credited back
+	if err := h.GarbageCollectionEvent(context.Background(), &blob.Blob{Hash: "b"}, nil); err != nil {
+		panic(err)
+	}
+
+	report, err := u.Report()
+	if err != nil {
+		panic(err)
+	}
+	if len(report.Namespaces) != 1 {
+		t.Fatalf("unexpected report %+v", report.Namespaces)
+	}
+	entry := report.Namespaces[0]
+	if entry.Name != "tenant" || entry.Blobs != 1 || entry.Bytes != 8 || len(entry.Docs) != 0 {
+		t.Errorf("unexpected usage %+v", entry)
+	}
+	if entry.SoftExceeded || entry.HardExceeded {
+		t.Errorf("the quota should not be exceeded anymore: %+v", entry)
+	}
+}
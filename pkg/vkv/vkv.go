@@ -11,6 +11,7 @@ import (
 
 	"github.com/vmihailenco/msgpack"
 
+	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/rangedb"
 )
 
@@ -22,6 +23,7 @@ const (
 	FlagMetaBlob
 	FlagVersion
 	FlagKey
+	FlagExpiry
 )
 
 // KvType for meta serialization
@@ -29,6 +31,49 @@ const KvType = "kv"
 
 var ErrNotFound = errors.New("vkv: key not found")
 
+// ErrConditionFailed is returned when the condition of a conditional put is not met
+var ErrConditionFailed = errors.New("vkv: condition failed")
+
+// Condition is checked against the latest version of a key before writing a new version
+type Condition struct {
+	// Version must be the latest version of the key
+	Version int64
+
+	// Absent requires the key to not exist (or its latest version to be empty, i.e. deleted)
+	Absent bool
+
+	// Hash must be the ref of the latest version, or the hash of its value if there's no ref
+	Hash string
+}
+
+// Check returns `ErrConditionFailed` if the condition is not met by `kv` (the latest version of the key, nil if it
+// does not exist)
+func (c *Condition) Check(kv *KeyValue) error {
+	exists := kv != nil && (len(kv.Hash) > 0 || len(kv.Data) > 0)
+	if c.Absent && exists {
+		return ErrConditionFailed
+	}
+	if c.Version > 0 && (kv == nil || kv.Version != c.Version) {
+		return ErrConditionFailed
+	}
+	if c.Hash != "" {
+		if !exists {
+			return ErrConditionFailed
+		}
+		if ref := kv.HexHash(); ref != "" {
+			if ref != c.Hash {
+				return ErrConditionFailed
+			}
+			return nil
+		}
+		h, err := hashutil.ComputeLike(c.Hash, kv.Data)
+		if err != nil || h != c.Hash {
+			return ErrConditionFailed
+		}
+	}
+	return nil
+}
+
 type KeyValue struct {
 	SchemaVersion int `msgpack:"_v"`
 
@@ -36,6 +81,28 @@ type KeyValue struct {
 	Version int64  `msgpack:"v"`
 	Hash    []byte `msgpack:"h,omitempty"`
 	Data    []byte `msgpack:"d,omitempty"`
+
+	// TTL is the number of seconds (starting from the write) after which the key expires (0 if it never expires)
+	TTL int64 `msgpack:"ttl,omitempty"`
+
+	// ExpiresAt is the expiration date as a Unix timestamp in nanoseconds (0 if the key never expires), it's computed
+	// from the TTL when the key is written (and not from the version, that can be set explicitly)
+	ExpiresAt int64 `msgpack:"e,omitempty"`
+}
+
+// SetTTL sets the TTL (in seconds) and the matching expiration date, starting from `now` (a Unix timestamp in
+// nanoseconds)
+func (kv *KeyValue) SetTTL(ttl, now int64) {
+	kv.TTL = ttl
+	kv.ExpiresAt = 0
+	if ttl > 0 {
+		kv.ExpiresAt = now + ttl*int64(time.Second)
+	}
+}
+
+// Expired returns true if the key value is expired at `now` (a Unix timestamp in nanoseconds)
+func (kv *KeyValue) Expired(now int64) bool {
+	return kv.ExpiresAt > 0 && kv.ExpiresAt <= now
 }
 
 // Implements the `MetaData` interface
@@ -65,6 +132,44 @@ func (kv *KeyValue) HexHash() string {
 	return ""
 }
 
+// BatchKvType for the meta serialization of batches
+const BatchKvType = "kv-batch"
+
+// KeyValueBatch holds the key values written by a batch (saved in a single meta blob)
+type KeyValueBatch struct {
+	SchemaVersion int `msgpack:"_v"`
+
+	KeyValues []*KeyValue `msgpack:"kvs"`
+}
+
+// Implements the `MetaData` interface
+func (b *KeyValueBatch) Type() string {
+	return BatchKvType
+}
+
+// Implements the `MetaData` interface
+func (b *KeyValueBatch) Dump() ([]byte, error) {
+	b.SchemaVersion = schemaVersion
+	return msgpack.Marshal(b)
+}
+
+// BatchEntry is a key value to write in a batch, with an optional condition
+type BatchEntry struct {
+	Key     string
+	Ref     string
+	Data    []byte
+	Version int64
+	TTL     int64
+	Cond    *Condition
+}
+
+// ExpiredKey is an entry of the expiry index, the version of the key expired at `ExpiresAt`
+type ExpiredKey struct {
+	Key       string
+	Version   int64
+	ExpiresAt int64
+}
+
 // KeyValueVersions holds the full history for a key value pair
 type KeyValueVersions struct {
 	Key string `json:"key"`
@@ -126,13 +231,27 @@ func (db *DB) Close() error { return db.rdb.Close() }
 
 func (db *DB) Destroy() error { return db.rdb.Destroy() }
 
+// Get returns the given version of the key, or its latest version if `version` is not set (`ErrNotFound` is returned
+// if the latest version is expired, the older versions are still available)
 func (db *DB) Get(key string, version int64) (*KeyValue, error) {
 	if version <= 0 {
-		return db.get(key)
+		res, err := db.get(key)
+		if err != nil {
+			return nil, err
+		}
+		if res.Expired(time.Now().UTC().UnixNano()) {
+			return nil, ErrNotFound
+		}
+		return res, nil
 	}
 	return db.getAt(key, version)
 }
 
+// Latest returns the latest version of the key, even if it's expired
+func (db *DB) Latest(key string) (*KeyValue, error) {
+	return db.get(key)
+}
+
 func (db *DB) get(key string) (*KeyValue, error) {
 	kvkey := append([]byte{FlagKey}, []byte(key)...)
 	data, err := db.rdb.Get(kvkey)
@@ -152,6 +271,36 @@ func (db *DB) get(key string) (*KeyValue, error) {
 }
 
 func (db *DB) Put(kv *KeyValue) error {
+	b := db.rdb.NewBatch()
+	if err := db.put(b, kv); err != nil {
+		return err
+	}
+	return db.rdb.Write(b)
+}
+
+// PutBatch saves all the key values (or none of them if it fails), along with the hash of the meta blob holding them
+func (db *DB) PutBatch(kvs []*KeyValue, metaBlobHash string) error {
+	h, err := hex.DecodeString(metaBlobHash)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	b := db.rdb.NewBatch()
+	for _, kv := range kvs {
+		if seen[kv.Key] {
+			return fmt.Errorf("duplicate key %q in batch", kv.Key)
+		}
+		seen[kv.Key] = true
+		if err := db.put(b, kv); err != nil {
+			return err
+		}
+		b.Set(buildMetaBlobKey([]byte(kv.Key), kv.Version), h)
+	}
+	return db.rdb.Write(b)
+}
+
+// put adds the writes for saving the key value to the batch
+func (db *DB) put(b *rangedb.Batch, kv *KeyValue) error {
 	kv.SchemaVersion = schemaVersion
 
 	if kv.Version < 1 {
@@ -173,20 +322,73 @@ func (db *DB) Put(kv *KeyValue) error {
 	}
 
 	if ckv == nil || kv.Version > ckv.Version {
-		if err := db.rdb.Set(kvkey, encoded); err != nil {
-			return err
-		}
+		b.Set(kvkey, encoded)
 	}
 
 	// Set the version key (for keeping track of all the versions)
 	vkey := buildVkey(kvkey, kv.Version)
-	if err := db.rdb.Set(vkey, encoded); err != nil {
-		return err
+	b.Set(vkey, encoded)
+
+	// Index the expiration date for the sweeper
+	if kv.ExpiresAt > 0 {
+		version := make([]byte, 8)
+		binary.BigEndian.PutUint64(version, uint64(kv.Version))
+		b.Set(buildExpiryKey([]byte(kv.Key), kv.ExpiresAt), version)
 	}
 
 	return nil
 }
 
+func buildExpiryKey(key []byte, expiresAt int64) []byte {
+	ekey := make([]byte, len(key)+9)
+
+	// Set the expiry flag
+	ekey[0] = FlagExpiry
+
+	// Add the binary encoded expiration date first so the keys are sorted by date
+	binary.BigEndian.PutUint64(ekey[1:], uint64(expiresAt))
+
+	// Copy the key
+	copy(ekey[9:], key)
+
+	return ekey
+}
+
+// Expired returns (up to `limit`) the entries of the expiry index that are expired at `now`, sorted by expiration
+// date (the key may have been updated since)
+func (db *DB) Expired(now int64, limit int) ([]*ExpiredKey, error) {
+	out := []*ExpiredKey{}
+
+	c := db.rdb.PrefixRange([]byte{FlagExpiry}, false)
+	defer c.Close()
+
+	k, v, err := c.Next()
+	for ; err == nil && (limit <= 0 || len(out) < limit); k, v, err = c.Next() {
+		if len(k) < 9 || len(v) != 8 {
+			return nil, fmt.Errorf("invalid expiry entry %q", k)
+		}
+		expiresAt := int64(binary.BigEndian.Uint64(k[1:9]))
+		if expiresAt > now {
+			break
+		}
+		out = append(out, &ExpiredKey{
+			Key:       string(k[9:]),
+			Version:   int64(binary.BigEndian.Uint64(v)),
+			ExpiresAt: expiresAt,
+		})
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// RemoveExpiry removes the entry from the expiry index
+func (db *DB) RemoveExpiry(e *ExpiredKey) error {
+	return db.rdb.Delete(buildExpiryKey([]byte(e.Key), e.ExpiresAt))
+}
+
 func buildVkey(kvkey []byte, version int64) []byte {
 	klen := len(kvkey) - 1
 	vkey := make([]byte, klen+10)
@@ -281,6 +483,7 @@ func (db *DB) getAt(key string, version int64) (*KeyValue, error) {
 func (db *DB) keys(start, end string, limit int, reverse bool) ([]*KeyValue, string, error) {
 	var cursor string
 	out := []*KeyValue{}
+	now := time.Now().UTC().UnixNano()
 
 	c := db.rdb.Range(append([]byte{FlagKey}, []byte(start)...), append([]byte{FlagKey}, []byte(end)...), reverse)
 	defer c.Close()
@@ -293,6 +496,11 @@ func (db *DB) keys(start, end string, limit int, reverse bool) ([]*KeyValue, str
 			return nil, cursor, err
 		}
 
+		// Hide the expired keys (the sweeper will write a tombstone)
+		if res.Expired(now) {
+			continue
+		}
+
 		out = append(out, res)
 	}
 
@@ -365,3 +573,11 @@ func UnserializeBlob(blob []byte) (*KeyValue, error) {
 	}
 	return kv, nil
 }
+
+func UnserializeBatchBlob(blob []byte) (*KeyValueBatch, error) {
+	b := &KeyValueBatch{}
+	if err := msgpack.Unmarshal(blob, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
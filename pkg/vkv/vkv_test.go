@@ -6,6 +6,8 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+
+	"a4.io/blobstash/pkg/hashutil"
 )
 
 func check(e error) {
@@ -206,3 +208,71 @@ func TestDBIter(t *testing.T) {
 		t.Errorf("bad reverse sort order")
 	}
 }
+
+func TestCondition(t *testing.T) {
+	kv := &KeyValue{Key: "k1", Version: 10, Data: []byte("hello")}
+	withRef := &KeyValue{Key: "k1", Version: 11}
+	withRef.SetHexHash("deadbeef")
+	deleted := &KeyValue{Key: "k1", Version: 12}
+	for i, tc := range []struct {
+		cond *Condition
+		kv   *KeyValue
+		ok   bool
+	}{
+		{&Condition{Absent: true}, nil, true},
+		{&Condition{Absent: true}, deleted, true},
+		{&Condition{Absent: true}, kv, false},
+		{&Condition{Version: 10}, kv, true},
+		{&Condition{Version: 9}, kv, false},
+		{&Condition{Version: 10}, nil, false},
+		{&Condition{Hash: hashutil.Compute([]byte("hello"))}, kv, true},
+		{&Condition{Hash: hashutil.ComputeWith(hashutil.SHA256, []byte("hello"))}, kv, true},
+		{&Condition{Hash: hashutil.Compute([]byte("nope"))}, kv, false},
+		{&Condition{Hash: "deadbeef"}, withRef, true},
+		{&Condition{Hash: "deadbeef"}, nil, false},
+		{&Condition{Hash: "deadbeef", Version: 10}, withRef, false},
+	} {
+		err := tc.cond.Check(tc.kv)
+		if tc.ok && err != nil || !tc.ok && err != ErrConditionFailed {
+			t.Errorf("case %d: unexpected result %v", i, err)
+		}
+	}
+}
+
+func TestDBPutBatch(t *testing.T) {
+	db, err := New("db_batch")
+	defer db.Destroy()
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+	metaBlobHash := hashutil.Compute([]byte("meta"))
+
+	check(db.Put(&KeyValue{Key: "k1", Data: []byte("old"), Version: 5}))
+	kvs := []*KeyValue{
+		&KeyValue{Key: "k1", Data: []byte("hello"), Version: 10},
+		&KeyValue{Key: "k2", Data: []byte("world"), Version: 10},
+	}
+	check(db.PutBatch(kvs, metaBlobHash))
+	for _, kv := range kvs {
+		gkv, err := db.Get(kv.Key, -1)
+		check(err)
+		checkKv(t, kv, gkv)
+		h, err := db.GetMetaBlob(kv.Key, kv.Version)
+		check(err)
+		if h != metaBlobHash {
+			t.Errorf("unexpected meta blob %q for %s", h, kv.Key)
+		}
+	}
+
+	// Nothing is written if the batch fails
+	err = db.PutBatch([]*KeyValue{
+		&KeyValue{Key: "k3", Data: []byte("a"), Version: 11},
+		&KeyValue{Key: "k3", Data: []byte("b"), Version: 11},
+	}, metaBlobHash)
+	if err == nil {
+		t.Errorf("duplicate keys should fail")
+	}
+	if _, err := db.Get("k3", -1); err != ErrNotFound {
+		t.Errorf("k3 should not exist, got %v", err)
+	}
+}